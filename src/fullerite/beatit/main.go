@@ -53,6 +53,21 @@ func sendMetrics(handler handler.Handler, metrics []metric.Metric) {
 	}
 }
 
+func publishMetrics(bus *handler.Bus, metrics []metric.Metric) {
+	start := time.Now()
+	bus.Publish(name, metrics...)
+	log.Debug("Published ", len(metrics), " metrics in ", time.Since(start))
+}
+
+// reportBus logs how many metrics the bus delivered to and dropped for each handler
+func reportBus(bus *handler.Bus) {
+	for handlerName, stats := range bus.InternalMetrics() {
+		log.Info(handlerName, ": delivered ", stats.Counters["busDelivered"],
+			", dropped ", stats.Counters["busDropped"],
+			", buffered ", stats.Gauges["busDepth"])
+	}
+}
+
 func newHandler(name string, c config.Config, dps int) handler.Handler {
 	h := handler.New(name)
 	h.SetInterval(1)
@@ -126,6 +141,15 @@ func main() {
 			Name:  "randomize",
 			Usage: "Randomize metric names",
 		},
+		cli.BoolFlag{
+			Name:  "bus",
+			Usage: "Publish the metrics on the bus, the way the collectors do, instead of writing to the handlers",
+		},
+		cli.IntFlag{
+			Name:  "bus-buffer-size",
+			Value: handler.DefaultBusBufferSize,
+			Usage: "Number of metrics the bus buffers for each handler",
+		},
 		cli.StringFlag{
 			Name:  "config, c",
 			Value: "/etc/fullerite.conf",
@@ -152,40 +176,56 @@ func start(ctx *cli.Context) {
 		return
 	}
 
+	var bus *handler.Bus
+	if ctx.Bool("bus") {
+		// the handlers listen to beatit as if it was a collector
+		c.Collectors = []string{name}
+		c.DiamondCollectors = nil
+		bus = handler.NewBus(ctx.Int("bus-buffer-size"))
+	}
+
 	var handlers []handler.Handler
 	for i := 0; i < ctx.Int("num-tasks"); i++ {
 		if ctx.Bool("graphite") {
-			h := newHandler("Graphite", c, ctx.Int("num-datapoints"))
-			go h.Run()
-			handlers = append(handlers, h)
+			handlers = append(handlers, newHandler("Graphite", c, ctx.Int("num-datapoints")))
 		}
 		if ctx.Bool("signalfx") {
-			h := newHandler("SignalFx", c, ctx.Int("num-datapoints"))
-			go h.Run()
-			handlers = append(handlers, h)
+			handlers = append(handlers, newHandler("SignalFx", c, ctx.Int("num-datapoints")))
 		}
 		if ctx.Bool("datadog") {
-			h := newHandler("Datadog", c, ctx.Int("num-datapoints"))
-			go h.Run()
-			handlers = append(handlers, h)
+			handlers = append(handlers, newHandler("Datadog", c, ctx.Int("num-datapoints")))
 		}
 		if ctx.Bool("wavefront") {
-			h := newHandler("Wavefront", c, ctx.Int("num-datapoints"))
-			go h.Run()
-			handlers = append(handlers, h)
+			handlers = append(handlers, newHandler("Wavefront", c, ctx.Int("num-datapoints")))
 		}
 	}
+	for _, h := range handlers {
+		if bus != nil {
+			h.InitListeners(c)
+		}
+		go h.Run()
+	}
+	if bus != nil {
+		bus.SetHandlers(handlers)
+	}
 
 	t := time.Tick(1 * time.Second)
 	count := 0
 	for _ = range t {
 		if count++; count > ctx.Int("time") {
+			if bus != nil {
+				reportBus(bus)
+			}
 			os.Exit(0)
 		}
 		metrics := generateMetrics(ctx.String("prefix"),
 			ctx.Int("num-metrics"),
 			ctx.Int("num-datapoints"),
 			ctx.Bool("randomize"))
+		if bus != nil {
+			go publishMetrics(bus, metrics)
+			continue
+		}
 		for _, h := range handlers {
 			go sendMetrics(h, metrics)
 		}
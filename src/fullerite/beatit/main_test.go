@@ -1,7 +1,11 @@
 package beatit
 
 import (
+	"fullerite/handler"
+	"fullerite/metric"
+
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -19,3 +23,28 @@ func TestGenerateMetricsMoreMetricsThanDPS(t *testing.T) {
 	metrics := generateMetrics("test", numMetrics, dps, false)
 	assert.Equal(t, len(metrics), dps)
 }
+
+func BenchmarkPublishMetrics(b *testing.B) {
+	// 10M metrics per minute, i.e. about 170k per second, broadcast to 3
+	// handlers. An op has to take less than a second to keep up.
+	metrics := generateMetrics("test", 1000, 170000, false)
+	var handlers []handler.Handler
+	for i := 0; i < 3; i++ {
+		end := handler.CollectorEnd{Channel: make(chan metric.Metric, 1000), BufferSize: 1000}
+		go func() {
+			for range end.Channel {
+			}
+		}()
+		h := handler.New("Log")
+		h.SetCollectorEndpoints(map[string]handler.CollectorEnd{name: end})
+		handlers = append(handlers, h)
+	}
+	bus := handler.NewBus(len(metrics))
+	bus.SetHandlers(handlers)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		publishMetrics(bus, metrics)
+		bus.Flush(time.Second)
+	}
+}
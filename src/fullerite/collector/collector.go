@@ -4,8 +4,11 @@ import (
 	"fullerite/config"
 	"fullerite/metric"
 
+	"context"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	l "github.com/Sirupsen/logrus"
 )
@@ -13,10 +16,29 @@ import (
 const (
 	// DefaultCollectionInterval the interval to collect on unless overridden by a collectors config
 	DefaultCollectionInterval = 10
+
+	// how long the listeners wait after a socket error, doubled while
+	// the errors go on
+	listenerMinErrorBackoff = 5 * time.Millisecond
+	listenerMaxErrorBackoff = time.Second
 )
 
 var defaultLog = l.WithFields(l.Fields{"app": "fullerite", "pkg": "collector"})
 
+// guards the lifecycle of the collectors
+var lifecycleMu sync.Mutex
+
+// the running collectors which report internal metrics, for the
+// internal server
+var (
+	internalStatsMu sync.Mutex
+	internalStats   = map[string]internalStatsReporter{}
+)
+
+type internalStatsReporter interface {
+	InternalMetrics() metric.InternalMetrics
+}
+
 // Collector defines the interface of a generic collector.
 type Collector interface {
 	Collect()
@@ -38,6 +60,13 @@ type Collector interface {
 	DimensionsBlacklist() map[string]string
 	SetDimensionsBlacklist(map[string]string)
 	ContainsBlacklistedDimension(map[string]string) bool
+
+	// Start ties the collector to ctx, it is stopped when either ctx
+	// is cancelled or Stop() is called. Collectors which run anything
+	// in the background (e.g. a listening socket) stop it on Done().
+	Start(context.Context)
+	Stop()
+	Done() <-chan struct{}
 }
 
 var collectorConstructs map[string]func(chan metric.Metric, int, *l.Entry) Collector
@@ -72,6 +101,8 @@ func New(name string) Collector {
 		collector.SetCollectorType("collector")
 	}
 	collector.SetCanonicalName(name)
+	// set up the lifecycle before the collector is shared between goroutines
+	collector.Done()
 	return collector
 }
 
@@ -86,10 +117,102 @@ type baseCollector struct {
 	blacklist           []string
 	dimensionsBlacklist map[string]string
 
+	life *lifecycle
+
 	// intentionally exported
 	log *l.Entry
 }
 
+// lifecycle of a collector, guarded by lifecycleMu. It's only referenced
+// by baseCollector so that copies of a collector share it.
+type lifecycle struct {
+	done    chan struct{}
+	stopped bool
+}
+
+// InternalStats returns the internal metrics of the running collectors
+func InternalStats() map[string]metric.InternalMetrics {
+	internalStatsMu.Lock()
+	defer internalStatsMu.Unlock()
+	stats := make(map[string]metric.InternalMetrics, len(internalStats))
+	for name, reporter := range internalStats {
+		stats[name] = reporter.InternalMetrics()
+	}
+	return stats
+}
+
+// reportInternalStats adds the internal metrics of the collector named
+// name to InternalStats until the returned func is called
+func reportInternalStats(name string, reporter internalStatsReporter) func() {
+	internalStatsMu.Lock()
+	defer internalStatsMu.Unlock()
+	internalStats[name] = reporter
+	return func() {
+		internalStatsMu.Lock()
+		defer internalStatsMu.Unlock()
+		// a reloaded collector may have taken the name already
+		if internalStats[name] == reporter {
+			delete(internalStats, name)
+		}
+	}
+}
+
+// Start : the collector runs until ctx is cancelled or Stop() is called
+func (col *baseCollector) Start(ctx context.Context) {
+	done := col.Done()
+	go func() {
+		select {
+		case <-ctx.Done():
+			col.Stop()
+		case <-done:
+		}
+	}()
+}
+
+// Stop : stop the collector
+func (col *baseCollector) Stop() {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+	life := col.lifecycle()
+	if !life.stopped {
+		life.stopped = true
+		close(life.done)
+	}
+}
+
+// Done : closed once the collector has been stopped
+func (col *baseCollector) Done() <-chan struct{} {
+	lifecycleMu.Lock()
+	defer lifecycleMu.Unlock()
+	return col.lifecycle().done
+}
+
+// waitAfterError waits before a listener reads from its socket again, so
+// that an error which goes on doesn't keep a CPU busy, unless the collector
+// is stopped. It returns how long it waited.
+func (col *baseCollector) waitAfterError(previous time.Duration) time.Duration {
+	backoff := previous * 2
+	if backoff < listenerMinErrorBackoff {
+		backoff = listenerMinErrorBackoff
+	} else if backoff > listenerMaxErrorBackoff {
+		backoff = listenerMaxErrorBackoff
+	}
+	select {
+	case <-col.Done():
+	case <-time.After(backoff):
+	}
+	return backoff
+}
+
+// lifecycle is created lazily so that collectors don't have to set it up
+// themselves. Must be called holding lifecycleMu.
+func (col *baseCollector) lifecycle() *lifecycle {
+	if col.life == nil {
+		col.life = &lifecycle{done: make(chan struct{})}
+	}
+	return col.life
+}
+
 func (col *baseCollector) configureCommonParams(configMap map[string]interface{}) {
 	if interval, exists := configMap["interval"]; exists {
 		col.interval = config.GetAsInt(interval, DefaultCollectionInterval)
@@ -1,9 +1,11 @@
 package collector
 
 import (
+	"context"
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 
 	"fullerite/metric"
 
@@ -69,3 +71,33 @@ func TestDimensionsBlacklistNotSet(t *testing.T) {
 	result := col.ContainsBlacklistedDimension(m.Dimensions)
 	assert.False(t, result)
 }
+
+func TestCollectorLifecycle(t *testing.T) {
+	c := New("Test")
+	ctx, cancel := context.WithCancel(context.Background())
+	c.Start(ctx)
+
+	select {
+	case <-c.Done():
+		t.Fatal("should not be stopped before ctx is cancelled")
+	default:
+	}
+
+	cancel()
+	select {
+	case <-c.Done():
+	case <-time.After(time.Second):
+		t.Fatal("should be stopped once ctx is cancelled")
+	}
+}
+
+func TestCollectorStopWithoutStart(t *testing.T) {
+	c := New("Test")
+	c.Stop()
+
+	select {
+	case <-c.Done():
+	default:
+		t.Fatal("should be stopped")
+	}
+}
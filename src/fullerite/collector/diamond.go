@@ -23,6 +23,7 @@ type Diamond struct {
 	baseCollector
 	port          string
 	serverStarted bool
+	serverStopped chan struct{}
 	incoming      chan []byte
 }
 
@@ -42,6 +43,7 @@ func newDiamond(channel chan metric.Metric, initialInterval int, log *l.Entry) C
 	d.incoming = make(chan []byte)
 	d.port = DefaultDiamondCollectorPort
 	d.serverStarted = false
+	d.serverStopped = make(chan struct{})
 	d.SetCollectorType("listener")
 	return d
 }
@@ -66,6 +68,7 @@ func (d *Diamond) Port() string {
 // When Collect() is called it reads from the local channel converts
 // strings to metrics and publishes metrics to handlers.
 func (d *Diamond) collectDiamond() {
+	defer close(d.serverStopped)
 	addr, err := net.ResolveTCPAddr("tcp", ":"+d.port)
 
 	if err != nil {
@@ -80,10 +83,22 @@ func (d *Diamond) collectDiamond() {
 	// figure out the port bind for Port()
 	d.port = strings.Split(l.Addr().String(), ":")[1]
 
+	// closing the socket unblocks AcceptTCP() once we're stopped
+	go func() {
+		<-d.Done()
+		l.Close()
+	}()
+
 	for {
 		conn, err := l.AcceptTCP()
 		if err != nil {
-			d.log.Fatal(err)
+			select {
+			case <-d.Done():
+				d.log.Info("Diamond socket closed")
+				return
+			default:
+				d.log.Fatal(err)
+			}
 		}
 		go d.readDiamondMetrics(conn)
 	}
@@ -92,6 +107,16 @@ func (d *Diamond) collectDiamond() {
 // readDiamondMetrics reads from the connection
 func (d *Diamond) readDiamondMetrics(conn *net.TCPConn) {
 	defer conn.Close()
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-d.Done():
+			conn.Close()
+		case <-closed:
+		}
+	}()
+
 	conn.SetKeepAlive(true)
 	conn.SetKeepAlivePeriod(time.Second)
 	reader := bufio.NewReader(conn)
@@ -103,23 +128,40 @@ func (d *Diamond) readDiamondMetrics(conn *net.TCPConn) {
 			break
 		}
 		d.log.Debug("Read: ", string(line))
-		d.incoming <- line
+		select {
+		case d.incoming <- line:
+		case <-d.Done():
+			return
+		}
 	}
 	d.log.Info("Connection closed: ", conn.RemoteAddr())
 }
 
 // Collect reads metrics collected from Diamond collectors, converts
 // them to fullerite's Metric type and publishes them to handlers.
+// It returns once the collector is stopped, closing the socket.
 func (d *Diamond) Collect() {
 	if !d.serverStarted {
 		d.serverStarted = true
 		go d.collectDiamond()
 	}
 
-	for line := range d.incoming {
-		if metrics, ok := d.parseMetrics(line); ok {
-			for _, metric := range metrics {
-				d.Channel() <- metric
+	for {
+		select {
+		case <-d.Done():
+			// the socket is closed by the time we return
+			<-d.serverStopped
+			return
+		case line := <-d.incoming:
+			if metrics, ok := d.parseMetrics(line); ok {
+				for _, metric := range metrics {
+					select {
+					case d.Channel() <- metric:
+					case <-d.Done():
+						<-d.serverStopped
+						return
+					}
+				}
 			}
 		}
 	}
@@ -132,7 +174,8 @@ func (d *Diamond) parseMetrics(line []byte) ([]metric.Metric, bool) {
 		return metrics, false
 	}
 	// All diamond metric_types are reported in uppercase, lets make them
-	// fullerite compatible
+	// fullerite compatible. An optional "timestamp" is honoured by the
+	// Metric JSON decoder.
 	for i := range metrics {
 		metrics[i].MetricType = strings.ToLower(metrics[i].MetricType)
 		metrics[i].AddDimension("diamond", "yes")
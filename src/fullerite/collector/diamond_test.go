@@ -6,6 +6,7 @@ import (
 	"fullerite/metric"
 	"fullerite/test_utils"
 
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -71,6 +72,42 @@ func TestDiamondCollect(t *testing.T) {
 	}
 }
 
+func TestDiamondStop(t *testing.T) {
+	config := make(map[string]interface{})
+	config["port"] = "0"
+
+	testChannel := make(chan metric.Metric)
+	testLog := test_utils.BuildLogger()
+
+	d := newDiamond(testChannel, 123, testLog).(*Diamond)
+	d.Configure(config)
+	d.Start(context.Background())
+
+	stopped := make(chan struct{})
+	go func() {
+		d.Collect()
+		close(stopped)
+	}()
+
+	conn, err := connectToDiamondCollector(d)
+	require.Nil(t, err, "should connect")
+	require.NotNil(t, conn, "should connect")
+
+	d.Stop()
+	select {
+	case <-stopped:
+	case <-time.After(1 * time.Second):
+		t.Fatal("Collect should return once the collector is stopped")
+	}
+
+	// both the client connection and the socket are closed
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	_, err = net.Dial("tcp", "localhost:"+d.Port())
+	assert.NotNil(t, err)
+}
+
 func TestParseJsonToMetric(t *testing.T) {
 	rawData := []byte(`
 [{
@@ -90,6 +127,30 @@ func TestParseJsonToMetric(t *testing.T) {
 	}
 }
 
+func TestParseJsonToMetricWithTimestamp(t *testing.T) {
+	rawData := []byte(`
+[{
+   "name": "foobar",
+   "type":  "GAUGE",
+   "value": 100.0,
+   "timestamp": 1500000000,
+   "dimensions": {
+      "host": "windrunner"
+   }
+},
+{
+   "name": "foobaz",
+   "type":  "GAUGE",
+   "value": 100.0
+}]
+        `)
+	d := newDiamond(nil, 12, nil).(*Diamond)
+	metrics, ok := d.parseMetrics(rawData)
+	assert.True(t, ok)
+	assert.Equal(t, time.Unix(1500000000, 0), metrics[0].Timestamp)
+	assert.True(t, metrics[1].Timestamp.IsZero())
+}
+
 func TestInvalidJsonToMetric(t *testing.T) {
 	rawData := []byte(`
 [{
@@ -0,0 +1,420 @@
+package collector
+
+import (
+	"fullerite/forward"
+	"fullerite/metric"
+
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+// The metrics the ForwardReceiver collector reports about its sources
+const (
+	forwardReceiverConnections  = "fullerite.forward_receiver.connections"
+	forwardReceiverBatches      = "fullerite.forward_receiver.batches"
+	forwardReceiverMetrics      = "fullerite.forward_receiver.metrics"
+	forwardReceiverAuthFailures = "fullerite.forward_receiver.auth_failures"
+)
+
+// ErrForwardUnauthorized is sent to the sources which don't know the secret
+var ErrForwardUnauthorized = errors.New("unauthorized")
+
+// defaultForwardHelloTimeout is how long a new connection has to say hello
+const defaultForwardHelloTimeout = 10 * time.Second
+
+// ForwardReceiver collector receives the metrics of the Forward handlers
+// of other fullerites and emits them as they were sent, with their
+// dimensions and timestamps. It listens over TCP on port and, if httpPort
+// is set, over HTTP. Every interval it reports the connections, batches
+// and metrics of every source.
+type ForwardReceiver struct {
+	baseCollector
+	port          string
+	httpPort      string
+	secret        string
+	certFile      string
+	keyFile       string
+	clientCAFile  string
+	tlsConfig     *tls.Config
+	helloTimeout  time.Duration
+	serverStarted bool
+	serverStopped chan struct{}
+	incoming      chan metric.Metric
+
+	mu      sync.Mutex
+	sources map[string]*forwardSource
+}
+
+// forwardSource holds what a source did since the last report
+type forwardSource struct {
+	connections  int
+	batches      int
+	metrics      int
+	authFailures int
+}
+
+func init() {
+	RegisterCollector("ForwardReceiver", newForwardReceiver)
+}
+
+// newForwardReceiver creates a new ForwardReceiver collector.
+func newForwardReceiver(channel chan metric.Metric, initialInterval int, log *l.Entry) Collector {
+	f := new(ForwardReceiver)
+
+	f.log = log
+	f.channel = channel
+	f.interval = initialInterval
+
+	f.name = "ForwardReceiver"
+	f.port = forward.DefaultPort
+	f.helloTimeout = defaultForwardHelloTimeout
+	f.serverStopped = make(chan struct{})
+	f.incoming = make(chan metric.Metric)
+	f.sources = make(map[string]*forwardSource)
+	f.SetCollectorType("listener")
+	return f
+}
+
+// Configure the collector
+func (f *ForwardReceiver) Configure(configMap map[string]interface{}) {
+	if port, exists := configMap["port"]; exists {
+		f.port = fmt.Sprint(port)
+	}
+	if httpPort, exists := configMap["httpPort"]; exists {
+		f.httpPort = fmt.Sprint(httpPort)
+	}
+	if secret, exists := configMap["secret"]; exists {
+		f.secret = secret.(string)
+	}
+	if certFile, exists := configMap["certFile"]; exists {
+		f.certFile = certFile.(string)
+	}
+	if keyFile, exists := configMap["keyFile"]; exists {
+		f.keyFile = keyFile.(string)
+	}
+	if clientCAFile, exists := configMap["clientCAFile"]; exists {
+		f.clientCAFile = clientCAFile.(string)
+	}
+	f.configureCommonParams(configMap)
+}
+
+// Port returns the port the batches are received on over TCP
+func (f *ForwardReceiver) Port() string {
+	return f.port
+}
+
+// HTTPPort returns the port the batches are received on over HTTP, empty
+// when disabled
+func (f *ForwardReceiver) HTTPPort() string {
+	return f.httpPort
+}
+
+// Collect publishes the metrics forwarded to the collector and reports the
+// sources every interval. It returns once the collector is stopped,
+// closing the sockets.
+func (f *ForwardReceiver) Collect() {
+	if !f.serverStarted {
+		if err := f.listen(); err != nil {
+			f.log.Error("Cannot listen on the ForwardReceiver sockets: ", err)
+			close(f.serverStopped)
+		}
+	}
+
+	ticker := time.NewTicker(time.Duration(f.interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		var metrics []metric.Metric
+		select {
+		case <-f.Done():
+			// the sockets are closed by the time we return
+			<-f.serverStopped
+			return
+		case m := <-f.incoming:
+			metrics = []metric.Metric{m}
+		case <-ticker.C:
+			metrics = f.report()
+		}
+		for _, m := range metrics {
+			select {
+			case f.Channel() <- m:
+			case <-f.Done():
+				<-f.serverStopped
+				return
+			}
+		}
+	}
+}
+
+// listen opens the sockets, the ports they are bound to are known once it
+// returns
+func (f *ForwardReceiver) listen() error {
+	f.serverStarted = true
+	if f.certFile != "" || f.keyFile != "" {
+		tlsConfig, err := forward.ServerTLSConfig(f.certFile, f.keyFile, f.clientCAFile)
+		if err != nil {
+			return err
+		}
+		f.tlsConfig = tlsConfig
+	}
+
+	ln, err := f.listenTCP(f.port)
+	if err != nil {
+		return err
+	}
+	f.port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	servers := []func(){func() { f.serveTCP(ln) }}
+
+	if f.httpPort != "" {
+		httpLn, err := f.listenTCP(f.httpPort)
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		f.httpPort = strconv.Itoa(httpLn.Addr().(*net.TCPAddr).Port)
+		servers = append(servers, func() { f.serveHTTP(httpLn) })
+	}
+
+	var running sync.WaitGroup
+	for _, serve := range servers {
+		running.Add(1)
+		go func(serve func()) {
+			defer running.Done()
+			serve()
+		}(serve)
+	}
+	go func() {
+		running.Wait()
+		close(f.serverStopped)
+	}()
+	return nil
+}
+
+func (f *ForwardReceiver) listenTCP(port string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil || f.tlsConfig == nil {
+		return ln, err
+	}
+	return tls.NewListener(ln, f.tlsConfig), nil
+}
+
+func (f *ForwardReceiver) serveTCP(ln net.Listener) {
+	var connections sync.WaitGroup
+	// the connections are closed before the collector says it stopped
+	defer connections.Wait()
+	go func() {
+		<-f.Done()
+		ln.Close()
+	}()
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-f.Done():
+				f.log.Info("ForwardReceiver TCP socket closed")
+				return
+			default:
+				f.log.Warn("Error while accepting forwarded connections ", err)
+				continue
+			}
+		}
+		connections.Add(1)
+		go func() {
+			defer connections.Done()
+			defer conn.Close()
+			closed := make(chan struct{})
+			defer close(closed)
+			go func() {
+				select {
+				case <-f.Done():
+					conn.Close()
+				case <-closed:
+				}
+			}()
+			f.readConnection(conn)
+		}()
+	}
+}
+
+// readConnection authenticates the source of conn then acks its batches.
+// Until then it only waits helloTimeout for a hello of MaxHelloSize.
+func (f *ForwardReceiver) readConnection(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(f.helloTimeout))
+	hello, err := forward.ReadHello(conn)
+	if err != nil {
+		f.log.Warn("Invalid hello from ", conn.RemoteAddr(), ": ", err)
+		return
+	}
+	source := hello.Source
+	if !forward.Authenticate(f.secret, hello) {
+		f.log.Warn("Wrong secret from ", source, " at ", conn.RemoteAddr())
+		f.count(source, func(s *forwardSource) { s.authFailures++ })
+		forward.WriteMessage(conn, forward.NewAck(0, 0, ErrForwardUnauthorized))
+		return
+	}
+	if err := forward.WriteMessage(conn, forward.NewAck(0, 0, nil)); err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	f.count(source, func(s *forwardSource) { s.connections++ })
+	defer f.count(source, func(s *forwardSource) { s.connections-- })
+	for {
+		batch, err := forward.ReadMessage(conn)
+		if err != nil {
+			if err != io.EOF {
+				f.log.Debug("Closing the connection of ", source, ": ", err)
+			}
+			return
+		}
+		if batch.Type != forward.TypeBatch {
+			f.log.Warn("Unexpected ", batch.Type, " from ", source)
+			return
+		}
+		accepted, ok := f.publishBatch(source, batch)
+		if !ok {
+			// stopped, the source sends the batch again elsewhere
+			return
+		}
+		if err := forward.WriteMessage(conn, forward.NewAck(batch.Seq, accepted, nil)); err != nil {
+			return
+		}
+	}
+}
+
+func (f *ForwardReceiver) serveHTTP(ln net.Listener) {
+	server := &http.Server{Handler: http.HandlerFunc(f.handleHTTP)}
+	go func() {
+		<-f.Done()
+		server.Close()
+	}()
+	if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+		f.log.Warn("ForwardReceiver HTTP server failed ", err)
+	}
+	f.log.Info("ForwardReceiver HTTP socket closed")
+}
+
+// handleHTTP publishes a batch posted by a source
+func (f *ForwardReceiver) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != forward.HTTPPath {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	payload, err := ioutil.ReadAll(io.LimitReader(r.Body, forward.MaxMessageSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(payload) > forward.MaxMessageSize {
+		http.Error(w, forward.ErrMessageTooLarge.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	batch, err := forward.Decode(payload)
+	if err != nil || batch.Type != forward.TypeBatch {
+		http.Error(w, fmt.Sprint("invalid batch ", err), http.StatusBadRequest)
+		return
+	}
+	if !forward.Authenticate(f.secret, batch) {
+		f.log.Warn("Wrong secret from ", batch.Source, " at ", r.RemoteAddr)
+		f.count(batch.Source, func(s *forwardSource) { s.authFailures++ })
+		http.Error(w, ErrForwardUnauthorized.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	accepted, ok := f.publishBatch(batch.Source, batch)
+	if !ok {
+		http.Error(w, "stopping", http.StatusServiceUnavailable)
+		return
+	}
+	ack, err := forward.Encode(forward.NewAck(batch.Seq, accepted, nil))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", forward.ContentType)
+	io.Copy(w, bytes.NewReader(ack))
+}
+
+// publishBatch publishes the metrics of batch, it returns false once the
+// collector is stopped
+func (f *ForwardReceiver) publishBatch(source string, batch *forward.Message) (int, bool) {
+	metrics := batch.ToMetrics()
+	for _, m := range metrics {
+		select {
+		case f.incoming <- m:
+		case <-f.Done():
+			return 0, false
+		}
+	}
+	f.count(source, func(s *forwardSource) {
+		s.batches++
+		s.metrics += len(metrics)
+	})
+	return len(metrics), true
+}
+
+// count updates the stats of source
+func (f *ForwardReceiver) count(source string, update func(*forwardSource)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s, exists := f.sources[source]
+	if !exists {
+		s = new(forwardSource)
+		f.sources[source] = s
+	}
+	update(s)
+}
+
+// report returns the metrics of every source and resets the counters. The
+// sources without connections are forgotten once reported.
+func (f *ForwardReceiver) report() []metric.Metric {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	names := make([]string, 0, len(f.sources))
+	for name := range f.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var metrics []metric.Metric
+	for _, name := range names {
+		s := f.sources[name]
+		dimensions := map[string]string{"source": name}
+		metrics = append(metrics,
+			forwardReceiverMetric(forwardReceiverConnections, metric.Gauge, s.connections, dimensions),
+			forwardReceiverMetric(forwardReceiverBatches, metric.Counter, s.batches, dimensions),
+			forwardReceiverMetric(forwardReceiverMetrics, metric.Counter, s.metrics, dimensions),
+			forwardReceiverMetric(forwardReceiverAuthFailures, metric.Counter, s.authFailures, dimensions),
+		)
+		if s.connections == 0 {
+			delete(f.sources, name)
+			continue
+		}
+		s.batches, s.metrics, s.authFailures = 0, 0, 0
+	}
+	return metrics
+}
+
+func forwardReceiverMetric(name string, metricType string, value int, dimensions map[string]string) metric.Metric {
+	m := metric.WithValue(name, float64(value))
+	m.MetricType = metricType
+	m.AddDimensions(dimensions)
+	return m
+}
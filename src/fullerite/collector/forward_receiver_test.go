@@ -0,0 +1,253 @@
+package collector
+
+import (
+	"fullerite/forward"
+	"fullerite/metric"
+	"fullerite/test_utils"
+
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestForwardReceiver(config map[string]interface{}) *ForwardReceiver {
+	f := newForwardReceiver(make(chan metric.Metric), 10, test_utils.BuildLogger()).(*ForwardReceiver)
+	f.Configure(config)
+	// set up the lifecycle like New does
+	f.Done()
+	return f
+}
+
+// startTestForwardReceiver returns a receiver listening on random ports,
+// the caller stops it
+func startTestForwardReceiver(t *testing.T, config map[string]interface{}) *ForwardReceiver {
+	config["port"] = "0"
+	f := newTestForwardReceiver(config)
+	require.Nil(t, f.listen())
+	go f.Collect()
+	return f
+}
+
+func stopTestForwardReceiver(t *testing.T, f *ForwardReceiver) {
+	f.Stop()
+	select {
+	case <-f.serverStopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ForwardReceiver didn't close its sockets")
+	}
+}
+
+// receiveForwarded waits for the next metric of the collector
+func receiveForwarded(t *testing.T, f *ForwardReceiver) metric.Metric {
+	select {
+	case m := <-f.Channel():
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("ForwardReceiver didn't emit anything")
+		return metric.Metric{}
+	}
+}
+
+// helloForwardReceiver connects to the receiver and returns the ack of the
+// hello
+func helloForwardReceiver(t *testing.T, conn net.Conn, secret string) *forward.Message {
+	require.Nil(t, forward.WriteMessage(conn, forward.NewHello("web1", secret)))
+	ack, err := forward.ReadAck(conn, 0)
+	require.Nil(t, err)
+	return ack
+}
+
+func testForwardedMetric() metric.Metric {
+	m := metric.WithValue("load", 0.5)
+	m.AddDimensions(map[string]string{"host": "web1", "collector": "CPUInfo"})
+	m.Timestamp = time.Unix(1500000000, 123456789)
+	return m
+}
+
+func TestForwardReceiverConfigureEmptyConfig(t *testing.T) {
+	f := newTestForwardReceiver(map[string]interface{}{})
+
+	assert.Equal(t, forward.DefaultPort, f.Port())
+	assert.Equal(t, "", f.HTTPPort())
+	assert.Equal(t, "", f.secret)
+	assert.Equal(t, "listener", f.CollectorType())
+}
+
+func TestForwardReceiverConfigure(t *testing.T) {
+	f := newTestForwardReceiver(map[string]interface{}{
+		"port":         3015,
+		"httpPort":     "3016",
+		"secret":       "shared",
+		"certFile":     "/etc/fullerite/cert.pem",
+		"keyFile":      "/etc/fullerite/key.pem",
+		"clientCAFile": "/etc/fullerite/ca.pem",
+	})
+
+	assert.Equal(t, "3015", f.Port())
+	assert.Equal(t, "3016", f.HTTPPort())
+	assert.Equal(t, "shared", f.secret)
+	assert.Equal(t, "/etc/fullerite/cert.pem", f.certFile)
+	assert.Equal(t, "/etc/fullerite/key.pem", f.keyFile)
+	assert.Equal(t, "/etc/fullerite/ca.pem", f.clientCAFile)
+}
+
+func TestForwardReceiverTCP(t *testing.T) {
+	f := startTestForwardReceiver(t, map[string]interface{}{"secret": "shared"})
+	defer stopTestForwardReceiver(t, f)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+f.Port())
+	require.Nil(t, err)
+	defer conn.Close()
+	assert.Equal(t, "", helloForwardReceiver(t, conn, "shared").Error)
+
+	sent := testForwardedMetric()
+	require.Nil(t, forward.WriteMessage(conn, forward.NewBatch(1, []metric.Metric{sent})))
+	m := receiveForwarded(t, f)
+	assert.Equal(t, "load", m.Name)
+	assert.Equal(t, 0.5, m.Value)
+	assert.Equal(t, sent.Dimensions, m.Dimensions, "the original dimensions are kept")
+	assert.True(t, m.Forwarded, "the defaults of the handlers don't override them")
+	assert.True(t, sent.Timestamp.Equal(m.Timestamp), "the original timestamp is kept")
+
+	ack, err := forward.ReadAck(conn, 1)
+	require.Nil(t, err)
+	assert.Equal(t, 1, ack.Accepted)
+
+	report := f.report()
+	require.Len(t, report, 4)
+	assert.Equal(t, forwardReceiverConnections, report[0].Name)
+	assert.Equal(t, 1.0, report[0].Value)
+	assert.Equal(t, "web1", report[0].Dimensions["source"])
+	assert.Equal(t, 1.0, report[1].Value, "batches")
+	assert.Equal(t, 1.0, report[2].Value, "metrics")
+	assert.Equal(t, 0.0, report[3].Value, "auth failures")
+}
+
+func TestForwardReceiverWrongSecret(t *testing.T) {
+	f := startTestForwardReceiver(t, map[string]interface{}{"secret": "shared"})
+	defer stopTestForwardReceiver(t, f)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+f.Port())
+	require.Nil(t, err)
+	defer conn.Close()
+	assert.Equal(t, ErrForwardUnauthorized.Error(), helloForwardReceiver(t, conn, "guess").Error)
+
+	_, err = forward.ReadMessage(conn)
+	assert.NotNil(t, err, "the connection is closed")
+
+	report := f.report()
+	require.Len(t, report, 4)
+	assert.Equal(t, forwardReceiverAuthFailures, report[3].Name)
+	assert.Equal(t, 1.0, report[3].Value)
+	assert.Empty(t, f.report(), "the sources without connections are forgotten")
+}
+
+func TestForwardReceiverHello(t *testing.T) {
+	f := newTestForwardReceiver(map[string]interface{}{"port": "0"})
+	f.helloTimeout = 50 * time.Millisecond
+	require.Nil(t, f.listen())
+	go f.Collect()
+	defer stopTestForwardReceiver(t, f)
+
+	silent, err := net.Dial("tcp", "127.0.0.1:"+f.Port())
+	require.Nil(t, err)
+	defer silent.Close()
+	silent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = silent.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "the connections which don't say hello are closed")
+
+	large, err := net.Dial("tcp", "127.0.0.1:"+f.Port())
+	require.Nil(t, err)
+	defer large.Close()
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, forward.MaxHelloSize+1)
+	_, err = large.Write(header)
+	require.Nil(t, err)
+	large.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = large.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err, "nothing large is read before the source is authenticated")
+}
+
+func TestForwardReceiverHTTP(t *testing.T) {
+	f := startTestForwardReceiver(t, map[string]interface{}{"httpPort": "0", "secret": "shared"})
+	defer stopTestForwardReceiver(t, f)
+
+	post := func(secret string) *http.Response {
+		batch := forward.NewBatch(1, []metric.Metric{testForwardedMetric()})
+		batch.Source = "web2"
+		batch.Secret = secret
+		payload, err := forward.Encode(batch)
+		require.Nil(t, err)
+		rsp, err := http.Post("http://127.0.0.1:"+f.HTTPPort()+forward.HTTPPath, forward.ContentType, bytes.NewReader(payload))
+		require.Nil(t, err)
+		return rsp
+	}
+
+	rsp := post("guess")
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, rsp.StatusCode)
+
+	received := make(chan metric.Metric, 1)
+	go func() { received <- receiveForwarded(t, f) }()
+	rsp = post("shared")
+	defer rsp.Body.Close()
+	require.Equal(t, http.StatusOK, rsp.StatusCode)
+	body, err := ioutil.ReadAll(rsp.Body)
+	require.Nil(t, err)
+	ack, err := forward.Decode(body)
+	require.Nil(t, err)
+	assert.Equal(t, 1, ack.Accepted)
+	assert.Equal(t, "web1", (<-received).Dimensions["host"])
+
+	rsp, err = http.Post("http://127.0.0.1:"+f.HTTPPort()+forward.HTTPPath, forward.ContentType, bytes.NewReader([]byte("junk")))
+	require.Nil(t, err)
+	rsp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, rsp.StatusCode)
+}
+
+func TestForwardReceiverTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fullerite-forward")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, err := test_utils.WriteSelfSignedCertificate(dir)
+	require.Nil(t, err)
+
+	f := startTestForwardReceiver(t, map[string]interface{}{
+		"certFile":     certFile,
+		"keyFile":      keyFile,
+		"clientCAFile": certFile,
+	})
+	defer stopTestForwardReceiver(t, f)
+
+	withoutCert, err := forward.ClientTLSConfig(certFile, "", "", false)
+	require.Nil(t, err)
+	conn, err := tls.Dial("tcp", "127.0.0.1:"+f.Port(), withoutCert)
+	if err == nil {
+		// the handshake fails on the first read with TLS 1.3
+		_, err = forward.ReadMessage(conn)
+		conn.Close()
+	}
+	assert.NotNil(t, err, "the senders must present a certificate")
+
+	withCert, err := forward.ClientTLSConfig(certFile, certFile, keyFile, false)
+	require.Nil(t, err)
+	conn, err = tls.Dial("tcp", "127.0.0.1:"+f.Port(), withCert)
+	require.Nil(t, err)
+	defer conn.Close()
+	assert.Equal(t, "", helloForwardReceiver(t, conn, "").Error)
+}
+
+func TestForwardReceiverInvalidTLS(t *testing.T) {
+	f := newTestForwardReceiver(map[string]interface{}{"port": "0", "certFile": "/nonexistent.pem"})
+	assert.NotNil(t, f.listen())
+}
@@ -0,0 +1,487 @@
+package collector
+
+import (
+	"fullerite/config"
+	"fullerite/metric"
+
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+const (
+	// DefaultGraphiteListenerPort is the port carbon plaintext is sent to
+	DefaultGraphiteListenerPort = "2003"
+	// DefaultGraphiteListenerFallback names the metrics after their whole
+	// path when no template matches it
+	DefaultGraphiteListenerFallback = "{name}..."
+
+	// the largest pickle carbon accepts
+	graphitePickleMaxSize = 1 << 20
+	// the largest datagram carbon clients send
+	graphiteMaxDatagramSize = 65535
+)
+
+// DefaultGraphiteListenerProtocols are the protocols plaintext is read with
+var DefaultGraphiteListenerProtocols = []string{"tcp", "udp"}
+
+// GraphiteListener collector accepts what is sent to carbon, plaintext
+// lines over TCP and UDP and optionally pickles over TCP. The paths are
+// turned into a name and dimensions by the first matching template, e.g.
+// servers.{host}.{service}.{name}... The timestamps sent are kept.
+type GraphiteListener struct {
+	baseCollector
+	port          string
+	protocols     []string
+	picklePort    string
+	templates     []*graphiteTemplate
+	fallback      *graphiteTemplate
+	serverStarted bool
+	serverStopped chan struct{}
+	incoming      chan metric.Metric
+}
+
+// graphiteTemplate is a parsed template, its nodes are matched against the
+// nodes of the paths: {name} is a part of the name, {dimension} the value
+// of a dimension, * any node and anything else a node which must be equal.
+// With a trailing ... the last node takes the rest of the path.
+type graphiteTemplate struct {
+	nodes  []string
+	greedy bool
+}
+
+func init() {
+	RegisterCollector("GraphiteListener", newGraphiteListener)
+}
+
+// newGraphiteListener creates a new GraphiteListener collector.
+func newGraphiteListener(channel chan metric.Metric, initialInterval int, log *l.Entry) Collector {
+	g := new(GraphiteListener)
+
+	g.log = log
+	g.channel = channel
+	g.interval = initialInterval
+
+	g.name = "GraphiteListener"
+	g.port = DefaultGraphiteListenerPort
+	g.protocols = DefaultGraphiteListenerProtocols
+	g.fallback, _ = parseGraphiteTemplate(DefaultGraphiteListenerFallback)
+	g.serverStopped = make(chan struct{})
+	g.incoming = make(chan metric.Metric)
+	g.SetCollectorType("listener")
+	return g
+}
+
+// Configure the collector
+func (g *GraphiteListener) Configure(configMap map[string]interface{}) {
+	if port, exists := configMap["port"]; exists {
+		g.port = fmt.Sprint(port)
+	}
+	if protocols, exists := configMap["protocols"]; exists {
+		g.protocols = nil
+		for _, protocol := range config.GetAsSlice(protocols) {
+			if protocol != "tcp" && protocol != "udp" {
+				g.log.Error("Unknown protocol ", protocol)
+				continue
+			}
+			g.protocols = append(g.protocols, protocol)
+		}
+	}
+	if picklePort, exists := configMap["picklePort"]; exists {
+		g.picklePort = fmt.Sprint(picklePort)
+	}
+	if templates, exists := configMap["templates"]; exists {
+		g.templates = nil
+		for _, raw := range config.GetAsSlice(templates) {
+			template, err := parseGraphiteTemplate(raw)
+			if err != nil {
+				g.log.Error("Invalid template ", raw, ": ", err)
+				continue
+			}
+			g.templates = append(g.templates, template)
+		}
+	}
+	if fallback, exists := configMap["fallback"]; exists {
+		// an empty fallback drops the paths no template matches
+		g.fallback = nil
+		if raw := fmt.Sprint(fallback); raw != "" {
+			template, err := parseGraphiteTemplate(raw)
+			if err != nil {
+				g.log.Error("Invalid fallback ", raw, ": ", err, ", dropping the unmatched paths")
+			}
+			g.fallback = template
+		}
+	}
+	g.configureCommonParams(configMap)
+}
+
+// Port returns the port plaintext is read on
+func (g *GraphiteListener) Port() string {
+	return g.port
+}
+
+// PicklePort returns the port pickles are read on, empty when disabled
+func (g *GraphiteListener) PicklePort() string {
+	return g.picklePort
+}
+
+// Collect publishes the metrics sent to the collector. It returns once the
+// collector is stopped, closing the sockets.
+func (g *GraphiteListener) Collect() {
+	if !g.serverStarted {
+		if err := g.listen(); err != nil {
+			g.log.Error("Cannot listen on the Graphite sockets: ", err)
+			close(g.serverStopped)
+		}
+	}
+
+	for {
+		select {
+		case <-g.Done():
+			// the sockets are closed by the time we return
+			<-g.serverStopped
+			return
+		case m := <-g.incoming:
+			select {
+			case g.Channel() <- m:
+			case <-g.Done():
+				<-g.serverStopped
+				return
+			}
+		}
+	}
+}
+
+// listen opens the sockets, the ports they are bound to are known once
+// it returns. When port is 0, UDP is bound to the port TCP was given.
+func (g *GraphiteListener) listen() error {
+	g.serverStarted = true
+	var servers []func()
+	var sockets []io.Closer
+
+	for _, protocol := range g.protocols {
+		if protocol == "tcp" {
+			ln, err := net.Listen("tcp", ":"+g.port)
+			if err != nil {
+				return err
+			}
+			g.port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+			sockets = append(sockets, ln)
+			servers = append(servers, func() { g.serveTCP(ln, g.readPlaintext) })
+		}
+	}
+	for _, protocol := range g.protocols {
+		if protocol == "udp" {
+			conn, err := net.ListenPacket("udp", ":"+g.port)
+			if err != nil {
+				closeGraphiteSockets(sockets)
+				return err
+			}
+			g.port = strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port)
+			sockets = append(sockets, conn)
+			servers = append(servers, func() { g.serveUDP(conn) })
+		}
+	}
+	if g.picklePort != "" {
+		ln, err := net.Listen("tcp", ":"+g.picklePort)
+		if err != nil {
+			closeGraphiteSockets(sockets)
+			return err
+		}
+		g.picklePort = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+		servers = append(servers, func() { g.serveTCP(ln, g.readPickles) })
+	}
+
+	var running sync.WaitGroup
+	for _, serve := range servers {
+		running.Add(1)
+		go func(serve func()) {
+			defer running.Done()
+			serve()
+		}(serve)
+	}
+	go func() {
+		running.Wait()
+		close(g.serverStopped)
+	}()
+	return nil
+}
+
+// closeGraphiteSockets closes the sockets opened before one failed
+func closeGraphiteSockets(sockets []io.Closer) {
+	for _, socket := range sockets {
+		socket.Close()
+	}
+}
+
+func (g *GraphiteListener) serveUDP(conn net.PacketConn) {
+	// closing the socket unblocks ReadFrom() once we're stopped
+	go func() {
+		<-g.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, graphiteMaxDatagramSize)
+	var backoff time.Duration
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-g.Done():
+				g.log.Info("Graphite UDP socket closed")
+				return
+			default:
+				g.log.Warn("Error while reading Graphite metrics ", err)
+				backoff = g.waitAfterError(backoff)
+				continue
+			}
+		}
+		backoff = 0
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			if !g.handleLine(line) {
+				return
+			}
+		}
+	}
+}
+
+func (g *GraphiteListener) serveTCP(ln net.Listener, read func(net.Conn)) {
+	var connections sync.WaitGroup
+	// the connections are closed before the collector says it stopped
+	defer connections.Wait()
+	go func() {
+		<-g.Done()
+		ln.Close()
+	}()
+
+	var backoff time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-g.Done():
+				g.log.Info("Graphite TCP socket closed")
+				return
+			default:
+				g.log.Warn("Error while accepting Graphite connections ", err)
+				backoff = g.waitAfterError(backoff)
+				continue
+			}
+		}
+		backoff = 0
+		connections.Add(1)
+		go func() {
+			defer connections.Done()
+			defer conn.Close()
+			closed := make(chan struct{})
+			defer close(closed)
+			go func() {
+				select {
+				case <-g.Done():
+					conn.Close()
+				case <-closed:
+				}
+			}()
+			read(conn)
+		}()
+	}
+}
+
+// readPlaintext reads <path> <value> [<timestamp>] lines
+func (g *GraphiteListener) readPlaintext(conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		if !g.handleLine(scanner.Text()) {
+			return
+		}
+	}
+}
+
+// readPickles reads pickles, each is preceded by its length
+func (g *GraphiteListener) readPickles(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size > graphitePickleMaxSize {
+			g.log.Warn("Pickle of ", size, " bytes from ", conn.RemoteAddr(), " is too large, closing the connection")
+			return
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return
+		}
+
+		datapoints, err := unpickleGraphite(payload)
+		if err != nil {
+			g.log.Warn("Invalid pickle from ", conn.RemoteAddr(), ": ", err)
+			continue
+		}
+		for _, datapoint := range datapoints {
+			m, ok := g.convert(datapoint)
+			if ok && !g.publish(m) {
+				return
+			}
+		}
+	}
+}
+
+// handleLine parses line and publishes its metric, it returns false once
+// the collector is stopped
+func (g *GraphiteListener) handleLine(line string) bool {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return true
+	}
+	datapoint, err := parseGraphiteLine(line)
+	if err != nil {
+		g.log.Debug("Cannot parse Graphite line ", line, ": ", err)
+		return true
+	}
+	if m, ok := g.convert(datapoint); ok {
+		return g.publish(m)
+	}
+	return true
+}
+
+func (g *GraphiteListener) publish(m metric.Metric) bool {
+	select {
+	case g.incoming <- m:
+		return true
+	case <-g.Done():
+		return false
+	}
+}
+
+// parseGraphiteLine parses <path> <value> [<timestamp>]
+func parseGraphiteLine(line string) (graphiteDatapoint, error) {
+	datapoint := graphiteDatapoint{timestamp: -1}
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return datapoint, errors.New("expected <path> <value> [<timestamp>]")
+	}
+	datapoint.path = fields[0]
+
+	var err error
+	if datapoint.value, err = strconv.ParseFloat(fields[1], 64); err != nil {
+		return datapoint, err
+	}
+	if len(fields) == 3 {
+		datapoint.timestamp, err = strconv.ParseFloat(fields[2], 64)
+	}
+	return datapoint, err
+}
+
+// convert names the datapoint after its path, it returns false if the
+// datapoint is dropped
+func (g *GraphiteListener) convert(datapoint graphiteDatapoint) (metric.Metric, bool) {
+	if math.IsNaN(datapoint.value) || math.IsInf(datapoint.value, 0) {
+		return metric.Metric{}, false
+	}
+
+	// tagged series, <path>;<tag>=<value>;...
+	parts := strings.Split(datapoint.path, ";")
+	name, dimensions, ok := g.applyTemplates(parts[0])
+	if !ok {
+		g.log.Debug("No template matches ", parts[0])
+		return metric.Metric{}, false
+	}
+	for _, tag := range parts[1:] {
+		if eq := strings.Index(tag, "="); eq > 0 {
+			dimensions[tag[:eq]] = tag[eq+1:]
+		}
+	}
+
+	m := metric.WithValue(name, datapoint.value)
+	m.AddDimensions(dimensions)
+	// -1 means now, like a missing timestamp
+	if datapoint.timestamp > 0 {
+		sec, frac := math.Modf(datapoint.timestamp)
+		m.Timestamp = time.Unix(int64(sec), int64(frac*1e9))
+	}
+	return m, true
+}
+
+// applyTemplates returns the name and dimensions given by the first
+// template matching path, or the fallback
+func (g *GraphiteListener) applyTemplates(path string) (string, map[string]string, bool) {
+	nodes := strings.Split(path, ".")
+	for _, template := range g.templates {
+		if name, dimensions, ok := template.apply(nodes); ok {
+			return name, dimensions, true
+		}
+	}
+	if g.fallback != nil {
+		return g.fallback.apply(nodes)
+	}
+	return "", nil, false
+}
+
+// parseGraphiteTemplate parses e.g. servers.{host}.{service}.{name}...
+func parseGraphiteTemplate(raw string) (*graphiteTemplate, error) {
+	template := new(graphiteTemplate)
+	if strings.HasSuffix(raw, "...") {
+		template.greedy = true
+		raw = strings.TrimSuffix(raw, "...")
+	}
+	template.nodes = strings.Split(raw, ".")
+
+	hasName := false
+	for _, node := range template.nodes {
+		switch {
+		case node == "":
+			return nil, errors.New("empty node")
+		case node == "{name}":
+			hasName = true
+		case node == "{}":
+			return nil, errors.New("empty dimension node")
+		case strings.HasPrefix(node, "{") != strings.HasSuffix(node, "}"):
+			return nil, errors.New("unbalanced braces in node " + node)
+		}
+	}
+	if !hasName {
+		return nil, errors.New("no {name} node")
+	}
+	return template, nil
+}
+
+// apply matches the nodes of a path, the nodes of the name are joined
+// with dots
+func (template *graphiteTemplate) apply(nodes []string) (string, map[string]string, bool) {
+	if len(nodes) < len(template.nodes) || (!template.greedy && len(nodes) > len(template.nodes)) {
+		return "", nil, false
+	}
+
+	var name []string
+	dimensions := make(map[string]string)
+	for i, node := range template.nodes {
+		value := nodes[i]
+		if template.greedy && i == len(template.nodes)-1 {
+			value = strings.Join(nodes[i:], ".")
+		}
+
+		switch {
+		case node == "*":
+		case node == "{name}":
+			name = append(name, value)
+		case strings.HasPrefix(node, "{") && strings.HasSuffix(node, "}"):
+			dimensions[node[1:len(node)-1]] = value
+		case node != value:
+			return "", nil, false
+		}
+	}
+	return strings.Join(name, "."), dimensions, true
+}
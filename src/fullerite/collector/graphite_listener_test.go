@@ -0,0 +1,185 @@
+package collector
+
+import (
+	"fullerite/metric"
+	"fullerite/test_utils"
+
+	"encoding/binary"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestGraphiteListener(config map[string]interface{}) *GraphiteListener {
+	g := newGraphiteListener(make(chan metric.Metric), 10, test_utils.BuildLogger()).(*GraphiteListener)
+	g.Configure(config)
+	// set up the lifecycle like New does
+	g.Done()
+	return g
+}
+
+// receiveGraphite waits for the next metric of the collector
+func receiveGraphite(t *testing.T, g *GraphiteListener) metric.Metric {
+	select {
+	case m := <-g.Channel():
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("GraphiteListener didn't emit anything")
+		return metric.Metric{}
+	}
+}
+
+func TestGraphiteListenerConfigureEmptyConfig(t *testing.T) {
+	g := newTestGraphiteListener(map[string]interface{}{})
+
+	assert.Equal(t, DefaultGraphiteListenerPort, g.Port())
+	assert.Equal(t, DefaultGraphiteListenerProtocols, g.protocols)
+	assert.Equal(t, "", g.PicklePort())
+	assert.Empty(t, g.templates)
+	assert.NotNil(t, g.fallback)
+	assert.Equal(t, "listener", g.CollectorType())
+}
+
+func TestGraphiteListenerConfigure(t *testing.T) {
+	g := newTestGraphiteListener(map[string]interface{}{
+		"port":       2103,
+		"protocols":  []interface{}{"tcp", "sctp"},
+		"picklePort": "2104",
+		"templates":  []interface{}{"servers.{host}.{name}...", "no.name", "a..{name}"},
+		"fallback":   "",
+	})
+
+	assert.Equal(t, "2103", g.Port())
+	assert.Equal(t, []string{"tcp"}, g.protocols)
+	assert.Equal(t, "2104", g.PicklePort())
+	assert.Len(t, g.templates, 1)
+	assert.Nil(t, g.fallback)
+}
+
+func TestParseGraphiteLine(t *testing.T) {
+	datapoint, err := parseGraphiteLine("servers.web1.load 0.5 1500000000")
+	require.Nil(t, err)
+	assert.Equal(t, graphiteDatapoint{path: "servers.web1.load", value: 0.5, timestamp: 1500000000}, datapoint)
+
+	datapoint, err = parseGraphiteLine("servers.web1.load 0.5")
+	require.Nil(t, err)
+	assert.Equal(t, -1.0, datapoint.timestamp)
+
+	for _, invalid := range []string{"path", "path one", "path 1 now", "path 1 2 3"} {
+		_, err := parseGraphiteLine(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestGraphiteListenerTemplates(t *testing.T) {
+	g := newTestGraphiteListener(map[string]interface{}{
+		"templates": []interface{}{
+			"servers.{host}.{service}.{name}...",
+			"*.{name}.{cluster}",
+		},
+	})
+
+	m, ok := g.convert(graphiteDatapoint{path: "servers.web1.nginx.requests.2xx", value: 3, timestamp: 1500000000.5})
+	require.True(t, ok)
+	assert.Equal(t, "requests.2xx", m.Name)
+	assert.Equal(t, map[string]string{"host": "web1", "service": "nginx"}, m.Dimensions)
+	assert.Equal(t, time.Unix(1500000000, 5e8), m.Timestamp)
+	assert.Equal(t, metric.Gauge, m.MetricType)
+
+	m, ok = g.convert(graphiteDatapoint{path: "db.connections.main", value: 1, timestamp: -1})
+	require.True(t, ok)
+	assert.Equal(t, "connections", m.Name)
+	assert.Equal(t, map[string]string{"cluster": "main"}, m.Dimensions)
+	assert.True(t, m.Timestamp.IsZero(), "no timestamp means now")
+
+	// too short for both templates
+	m, ok = g.convert(graphiteDatapoint{path: "cron.uptime", value: 1})
+	require.True(t, ok)
+	assert.Equal(t, "cron.uptime", m.Name)
+	assert.Empty(t, m.Dimensions)
+}
+
+func TestParseGraphiteTemplate(t *testing.T) {
+	template, err := parseGraphiteTemplate("servers.{host}.{name}...")
+	require.Nil(t, err)
+	assert.Equal(t, []string{"servers", "{host}", "{name}"}, template.nodes)
+	assert.True(t, template.greedy)
+
+	for _, invalid := range []string{"servers.{host}", "a.{name}..b", "{name}.", "{name}.{}", "{name}.{host", "{name}.host}"} {
+		_, err := parseGraphiteTemplate(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestGraphiteListenerTaggedPaths(t *testing.T) {
+	g := newTestGraphiteListener(map[string]interface{}{
+		"templates": []interface{}{"servers.{host}.{name}"},
+	})
+
+	m, ok := g.convert(graphiteDatapoint{path: "servers.web1.load;host=web2;dc=east", value: 1})
+	require.True(t, ok)
+	assert.Equal(t, "load", m.Name)
+	assert.Equal(t, map[string]string{"host": "web2", "dc": "east"}, m.Dimensions)
+}
+
+func TestGraphiteListenerDropsUnmatched(t *testing.T) {
+	g := newTestGraphiteListener(map[string]interface{}{
+		"templates": []interface{}{"servers.{host}.{name}"},
+		"fallback":  "",
+	})
+
+	_, ok := g.convert(graphiteDatapoint{path: "servers.web1.load", value: 1})
+	assert.True(t, ok)
+	_, ok = g.convert(graphiteDatapoint{path: "cron.backup.duration", value: 1})
+	assert.False(t, ok)
+}
+
+func TestGraphiteListenerCollect(t *testing.T) {
+	g := newTestGraphiteListener(map[string]interface{}{
+		"port":       "0",
+		"picklePort": "0",
+		"templates":  []interface{}{"servers.{host}.{service}.{name}..."},
+	})
+	require.Nil(t, g.listen())
+	go g.Collect()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+g.Port())
+	require.Nil(t, err)
+	defer conn.Close()
+	fmt.Fprint(conn, "servers.web1.cron.duration 12 1500000000\n")
+	m := receiveGraphite(t, g)
+	assert.Equal(t, "duration", m.Name)
+	assert.Equal(t, 12.0, m.Value)
+	assert.Equal(t, int64(1500000000), m.Timestamp.Unix())
+
+	udp, err := net.Dial("udp", "127.0.0.1:"+g.Port())
+	require.Nil(t, err)
+	defer udp.Close()
+	fmt.Fprint(udp, "servers.web2.cron.duration 13 1500000000\n")
+	m = receiveGraphite(t, g)
+	assert.Equal(t, "web2", m.Dimensions["host"])
+
+	pickles, err := net.Dial("tcp", "127.0.0.1:"+g.PicklePort())
+	require.Nil(t, err)
+	defer pickles.Close()
+	pickle := graphitePickles["protocol 2"]
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(pickle)))
+	pickles.Write(append(header, pickle...))
+	m = receiveGraphite(t, g)
+	assert.Equal(t, "requests", m.Name)
+	assert.Equal(t, "nginx", m.Dimensions["service"])
+	m = receiveGraphite(t, g)
+	assert.Equal(t, "errors", m.Name)
+
+	g.Stop()
+	select {
+	case <-g.serverStopped:
+	case <-time.After(time.Second):
+		t.Fatal("GraphiteListener didn't close its sockets")
+	}
+}
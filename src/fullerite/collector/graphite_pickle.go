@@ -0,0 +1,461 @@
+package collector
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// The carbon pickle protocol sends a list of (path, (timestamp, value))
+// tuples pickled by python. unpickleGraphite only implements the opcodes
+// needed to build lists, tuples, strings and numbers, anything else (and
+// in particular the opcodes which import and call python objects) is an
+// error, so that a sender can't make us do more than decode datapoints.
+
+// pickleMark is pushed on the stack by the MARK opcode
+type pickleMark struct{}
+
+// pickleList is a python list, lists are changed in place by APPEND(S)
+// and may be referenced by the memo
+type pickleList struct {
+	items []interface{}
+}
+
+// pickleTuple is a python tuple
+type pickleTuple []interface{}
+
+// graphiteDatapoint is a datapoint sent with the pickle protocol
+type graphiteDatapoint struct {
+	path      string
+	timestamp float64
+	value     float64
+}
+
+// unpickler runs the opcodes of a pickle
+type unpickler struct {
+	r     *bytes.Reader
+	stack []interface{}
+	memo  map[int]interface{}
+}
+
+// unpickleGraphite decodes a pickled list of (path, (timestamp, value))
+func unpickleGraphite(data []byte) ([]graphiteDatapoint, error) {
+	u := &unpickler{r: bytes.NewReader(data), memo: make(map[int]interface{})}
+	value, err := u.load()
+	if err != nil {
+		return nil, err
+	}
+
+	list, ok := value.(*pickleList)
+	if !ok {
+		return nil, errors.New("not a list of datapoints")
+	}
+	datapoints := make([]graphiteDatapoint, 0, len(list.items))
+	for _, item := range list.items {
+		datapoint, err := pickledDatapoint(item)
+		if err != nil {
+			return nil, err
+		}
+		datapoints = append(datapoints, datapoint)
+	}
+	return datapoints, nil
+}
+
+// pickledDatapoint converts (path, (timestamp, value))
+func pickledDatapoint(item interface{}) (graphiteDatapoint, error) {
+	var datapoint graphiteDatapoint
+	outer, ok := item.(pickleTuple)
+	if !ok || len(outer) != 2 {
+		return datapoint, fmt.Errorf("invalid datapoint %v", item)
+	}
+	inner, ok := outer[1].(pickleTuple)
+	if !ok || len(inner) != 2 {
+		return datapoint, fmt.Errorf("invalid datapoint %v", item)
+	}
+	if datapoint.path, ok = outer[0].(string); !ok {
+		return datapoint, fmt.Errorf("invalid path %v", outer[0])
+	}
+
+	var err error
+	if datapoint.timestamp, err = pickledNumber(inner[0]); err != nil {
+		return datapoint, err
+	}
+	datapoint.value, err = pickledNumber(inner[1])
+	return datapoint, err
+}
+
+// pickledNumber converts a python number, carbon also accepts strings
+func pickledNumber(value interface{}) (float64, error) {
+	switch number := value.(type) {
+	case int64:
+		return float64(number), nil
+	case float64:
+		return number, nil
+	case *big.Int:
+		f, _ := new(big.Float).SetInt(number).Float64()
+		return f, nil
+	case string:
+		return strconv.ParseFloat(number, 64)
+	}
+	return 0, fmt.Errorf("invalid number %v", value)
+}
+
+// load runs the opcodes until STOP and returns the top of the stack
+func (u *unpickler) load() (interface{}, error) {
+	for {
+		op, err := u.r.ReadByte()
+		if err != nil {
+			return nil, errors.New("truncated pickle")
+		}
+
+		switch op {
+		case '\x80': // PROTO
+			_, err = u.r.ReadByte()
+		case '\x95': // FRAME
+			_, err = u.readN(8)
+		case '.': // STOP
+			return u.pop()
+		case '(': // MARK
+			u.push(pickleMark{})
+		case '0': // POP
+			_, err = u.pop()
+		case '1': // POP_MARK
+			_, err = u.popMark()
+		case '2': // DUP
+			var top interface{}
+			if top, err = u.top(); err == nil {
+				u.push(top)
+			}
+
+		case 'N': // NONE
+			u.push(nil)
+		case '\x88': // NEWTRUE
+			u.push(true)
+		case '\x89': // NEWFALSE
+			u.push(false)
+		case 'I': // INT
+			err = u.loadInt()
+		case 'J': // BININT
+			err = u.loadBinInt(4, true)
+		case 'K': // BININT1
+			err = u.loadBinInt(1, false)
+		case 'M': // BININT2
+			err = u.loadBinInt(2, false)
+		case 'L': // LONG
+			err = u.loadLong()
+		case '\x8a': // LONG1
+			err = u.loadBinLong(1)
+		case '\x8b': // LONG4
+			err = u.loadBinLong(4)
+		case 'F': // FLOAT
+			var line string
+			if line, err = u.readLine(); err == nil {
+				var f float64
+				if f, err = strconv.ParseFloat(line, 64); err == nil {
+					u.push(f)
+				}
+			}
+		case 'G': // BINFLOAT
+			var b []byte
+			if b, err = u.readN(8); err == nil {
+				u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+			}
+
+		case 'S': // STRING
+			err = u.loadQuotedString()
+		case 'V': // UNICODE
+			var line string
+			if line, err = u.readLine(); err == nil {
+				u.push(line)
+			}
+		case 'T', 'X', 'B': // BINSTRING, BINUNICODE, BINBYTES
+			err = u.loadString(4)
+		case 'U', '\x8c', 'C': // SHORT_BINSTRING, SHORT_BINUNICODE, SHORT_BINBYTES
+			err = u.loadString(1)
+		case '\x8d', '\x8e': // BINUNICODE8, BINBYTES8
+			err = u.loadString(8)
+
+		case ']': // EMPTY_LIST
+			u.push(&pickleList{})
+		case 'l': // LIST
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				u.push(&pickleList{items: items})
+			}
+		case 'a': // APPEND
+			var item interface{}
+			if item, err = u.pop(); err == nil {
+				err = u.appendTo(item)
+			}
+		case 'e': // APPENDS
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				err = u.appendTo(items...)
+			}
+		case ')': // EMPTY_TUPLE
+			u.push(pickleTuple{})
+		case 't': // TUPLE
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				u.push(pickleTuple(items))
+			}
+		case '\x85', '\x86', '\x87': // TUPLE1, TUPLE2, TUPLE3
+			err = u.loadTuple(int(op-'\x85') + 1)
+
+		case 'p': // PUT
+			err = u.loadTextIndex(u.put)
+		case 'q': // BINPUT
+			err = u.loadBinIndex(1, u.put)
+		case 'r': // LONG_BINPUT
+			err = u.loadBinIndex(4, u.put)
+		case '\x94': // MEMOIZE
+			err = u.put(len(u.memo))
+		case 'g': // GET
+			err = u.loadTextIndex(u.get)
+		case 'h': // BINGET
+			err = u.loadBinIndex(1, u.get)
+		case 'j': // LONG_BINGET
+			err = u.loadBinIndex(4, u.get)
+
+		default:
+			return nil, fmt.Errorf("unsupported pickle opcode %q", op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (u *unpickler) push(value interface{}) {
+	u.stack = append(u.stack, value)
+}
+
+func (u *unpickler) top() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, errors.New("pickle stack underflow")
+	}
+	return u.stack[len(u.stack)-1], nil
+}
+
+func (u *unpickler) pop() (interface{}, error) {
+	value, err := u.top()
+	if err == nil {
+		u.stack = u.stack[:len(u.stack)-1]
+	}
+	return value, err
+}
+
+// popMark pops the values pushed since the last MARK
+func (u *unpickler) popMark() ([]interface{}, error) {
+	for i := len(u.stack) - 1; i >= 0; i-- {
+		if _, ok := u.stack[i].(pickleMark); ok {
+			items := append([]interface{}{}, u.stack[i+1:]...)
+			u.stack = u.stack[:i]
+			return items, nil
+		}
+	}
+	return nil, errors.New("pickle mark not found")
+}
+
+func (u *unpickler) appendTo(items ...interface{}) error {
+	top, err := u.top()
+	if err != nil {
+		return err
+	}
+	list, ok := top.(*pickleList)
+	if !ok {
+		return errors.New("append to something else than a list")
+	}
+	list.items = append(list.items, items...)
+	return nil
+}
+
+func (u *unpickler) loadTuple(size int) error {
+	if len(u.stack) < size {
+		return errors.New("pickle stack underflow")
+	}
+	tuple := append(pickleTuple{}, u.stack[len(u.stack)-size:]...)
+	u.stack = u.stack[:len(u.stack)-size]
+	u.push(tuple)
+	return nil
+}
+
+func (u *unpickler) put(index int) error {
+	top, err := u.top()
+	if err == nil {
+		u.memo[index] = top
+	}
+	return err
+}
+
+func (u *unpickler) get(index int) error {
+	value, exists := u.memo[index]
+	if !exists {
+		return fmt.Errorf("pickle memo %d not found", index)
+	}
+	u.push(value)
+	return nil
+}
+
+func (u *unpickler) loadTextIndex(f func(int) error) error {
+	line, err := u.readLine()
+	if err != nil {
+		return err
+	}
+	index, err := strconv.Atoi(line)
+	if err != nil {
+		return err
+	}
+	return f(index)
+}
+
+func (u *unpickler) loadBinIndex(size int, f func(int) error) error {
+	index, err := u.readUint(size)
+	if err != nil {
+		return err
+	}
+	return f(int(index))
+}
+
+// loadInt handles INT, which also encodes booleans as 00 and 01
+func (u *unpickler) loadInt() error {
+	line, err := u.readLine()
+	if err != nil {
+		return err
+	}
+	switch line {
+	case "00":
+		u.push(false)
+		return nil
+	case "01":
+		u.push(true)
+		return nil
+	}
+	i, err := strconv.ParseInt(line, 10, 64)
+	if err == nil {
+		u.push(i)
+	}
+	return err
+}
+
+func (u *unpickler) loadBinInt(size int, signed bool) error {
+	i, err := u.readUint(size)
+	if err != nil {
+		return err
+	}
+	if signed {
+		u.push(int64(int32(i)))
+	} else {
+		u.push(int64(i))
+	}
+	return nil
+}
+
+func (u *unpickler) loadLong() error {
+	line, err := u.readLine()
+	if err != nil {
+		return err
+	}
+	i, ok := new(big.Int).SetString(strings.TrimSuffix(line, "L"), 10)
+	if !ok {
+		return fmt.Errorf("invalid long %q", line)
+	}
+	u.push(i)
+	return nil
+}
+
+// loadBinLong handles the little endian two's complement longs
+func (u *unpickler) loadBinLong(size int) error {
+	n, err := u.readUint(size)
+	if err != nil {
+		return err
+	}
+	b, err := u.readN(int(n))
+	if err != nil {
+		return err
+	}
+
+	bigEndian := make([]byte, len(b))
+	for i := range b {
+		bigEndian[len(b)-1-i] = b[i]
+	}
+	i := new(big.Int).SetBytes(bigEndian)
+	if len(b) > 0 && b[len(b)-1]&0x80 != 0 {
+		i.Sub(i, new(big.Int).Lsh(big.NewInt(1), uint(8*len(b))))
+	}
+	u.push(i)
+	return nil
+}
+
+// loadQuotedString handles STRING, a python string literal
+func (u *unpickler) loadQuotedString() error {
+	line, err := u.readLine()
+	if err != nil {
+		return err
+	}
+	if len(line) < 2 || line[0] != line[len(line)-1] || (line[0] != '\'' && line[0] != '"') {
+		return fmt.Errorf("invalid string %q", line)
+	}
+	quoted := line[1 : len(line)-1]
+	if line[0] == '\'' {
+		quoted = strings.Replace(strings.Replace(quoted, `\'`, `'`, -1), `"`, `\"`, -1)
+	}
+	s, err := strconv.Unquote(`"` + quoted + `"`)
+	if err == nil {
+		u.push(s)
+	}
+	return err
+}
+
+func (u *unpickler) loadString(lengthSize int) error {
+	length, err := u.readUint(lengthSize)
+	if err != nil {
+		return err
+	}
+	b, err := u.readN(int(length))
+	if err == nil {
+		u.push(string(b))
+	}
+	return err
+}
+
+// readUint reads a little endian unsigned integer of size bytes
+func (u *unpickler) readUint(size int) (uint64, error) {
+	b, err := u.readN(size)
+	if err != nil {
+		return 0, err
+	}
+	var i uint64
+	for n := size - 1; n >= 0; n-- {
+		i = i<<8 | uint64(b[n])
+	}
+	return i, nil
+}
+
+func (u *unpickler) readN(n int) ([]byte, error) {
+	if n < 0 || n > u.r.Len() {
+		return nil, errors.New("truncated pickle")
+	}
+	b := make([]byte, n)
+	u.r.Read(b)
+	return b, nil
+}
+
+func (u *unpickler) readLine() (string, error) {
+	var line []byte
+	for {
+		c, err := u.r.ReadByte()
+		if err != nil {
+			return "", errors.New("truncated pickle")
+		}
+		if c == '\n' {
+			return string(line), nil
+		}
+		line = append(line, c)
+	}
+}
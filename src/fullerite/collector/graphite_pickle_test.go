@@ -0,0 +1,61 @@
+package collector
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// the datapoints servers.web1.nginx.requests (1500000000, 1.5) and
+// servers.web1.nginx.errors (1500000010.5, 2) pickled by python
+var graphitePickles = map[string]string{
+	"protocol 0": "(lp0\n(Vservers.web1.nginx.requests\np1\n(I1500000000\nF1.5\ntp2\ntp3\na(Vservers.web1.nginx.errors\np4\n(F1500000010.5\nI2\ntp5\ntp6\na.",
+	"protocol 2": "\x80\x02]q\x00(X\x1b\x00\x00\x00servers.web1.nginx.requestsq\x01J\x00/hYG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x19\x00\x00\x00servers.web1.nginx.errorsq\x04GA\xd6Z\x0b\xc2\xa0\x00\x00K\x02\x86q\x05\x86q\x06e.",
+	"protocol 4": "\x80\x04\x95`\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x1bservers.web1.nginx.requests\x94J\x00/hYG?\xf8\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x19servers.web1.nginx.errors\x94GA\xd6Z\x0b\xc2\xa0\x00\x00K\x02\x86\x94\x86\x94e.",
+	// python 2 pickles paths as byte strings
+	"python 2": "(lp0\n(S'servers.web1.nginx.requests'\np1\n(I1500000000\nF1.5\ntp2\ntp3\na(S'servers.web1.nginx.errors'\np4\n(F1500000010.5\nI2\ntp5\ntp6\na.",
+}
+
+func TestUnpickleGraphite(t *testing.T) {
+	expected := []graphiteDatapoint{
+		{path: "servers.web1.nginx.requests", timestamp: 1500000000, value: 1.5},
+		{path: "servers.web1.nginx.errors", timestamp: 1500000010.5, value: 2},
+	}
+	for protocol, pickle := range graphitePickles {
+		datapoints, err := unpickleGraphite([]byte(pickle))
+		require.Nil(t, err, protocol)
+		assert.Equal(t, expected, datapoints, protocol)
+	}
+}
+
+func TestUnpickleGraphiteLongsAndMemo(t *testing.T) {
+	// a value of 2**40 and a tuple sent twice through the memo
+	datapoints, err := unpickleGraphite([]byte("\x80\x02]q\x00X\x03\x00\x00\x00bigq\x01J\x00/hY\x8a\x06\x00\x00\x00\x00\x00\x01\x86q\x02\x86q\x03a."))
+	require.Nil(t, err)
+	assert.Equal(t, float64(1<<40), datapoints[0].value)
+
+	datapoints, err = unpickleGraphite([]byte("(lp0\n(Vbig\np1\n(I1500000000\nL1099511627776L\ntp2\ntp3\na."))
+	require.Nil(t, err)
+	assert.Equal(t, float64(1<<40), datapoints[0].value)
+
+	datapoints, err = unpickleGraphite([]byte("\x80\x02]q\x00(X\x01\x00\x00\x00mq\x01K\x01K\x01\x86q\x02\x86q\x03h\x03e."))
+	require.Nil(t, err)
+	assert.Len(t, datapoints, 2)
+}
+
+func TestUnpickleGraphiteRejectsObjects(t *testing.T) {
+	// pickle.dumps(os.system, 2)
+	_, err := unpickleGraphite([]byte("\x80\x02cposix\nsystem\nq\x00."))
+	assert.NotNil(t, err)
+
+	for _, invalid := range []string{
+		"",
+		"\x80\x02]q\x00(X\xff\x00\x00\x00short",
+		"(I1\n.",
+		"(lp0\n(Vpath\ntp1\na.",
+	} {
+		_, err := unpickleGraphite([]byte(invalid))
+		assert.NotNil(t, err, invalid)
+	}
+}
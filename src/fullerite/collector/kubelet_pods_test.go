@@ -125,8 +125,8 @@ func TestKubeletPodsGetPodInfo(t *testing.T) {
 	}
 
 	expectedMetrics := []metric.Metric{
-		metric.Metric{"KubernetesContainerEphemeralStorageLimit", "gauge", 53687091200, container1Dims},
-		metric.Metric{"KubernetesContainerEphemeralStorageLimit", "gauge", 35433480192, container2Dims},
+		metric.Metric{Name: "KubernetesContainerEphemeralStorageLimit", MetricType: "gauge", Value: 53687091200, Dimensions: container1Dims},
+		metric.Metric{Name: "KubernetesContainerEphemeralStorageLimit", MetricType: "gauge", Value: 35433480192, Dimensions: container2Dims},
 	}
 
 	d := getSUT2()
@@ -0,0 +1,517 @@
+package collector
+
+import (
+	"fullerite/config"
+	"fullerite/metric"
+
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+const (
+	// DefaultStatsDPort is the port StatsD clients send to
+	DefaultStatsDPort = "8125"
+	// DefaultStatsDProtocol is the protocol StatsD clients send with
+	DefaultStatsDProtocol = "udp"
+	// DefaultStatsDGaugeExpiryIntervals is how many intervals the gauges
+	// are sent for once they're not updated anymore
+	DefaultStatsDGaugeExpiryIntervals = 5
+
+	// the largest datagram StatsD clients send
+	statsDMaxDatagramSize = 65535
+	// the name of the counter reporting the lines which couldn't be parsed
+	statsDParseErrorsMetric = "fullerite.statsd.parse_errors"
+)
+
+// DefaultStatsDPercentiles are the percentiles of the timers
+var DefaultStatsDPercentiles = []float64{50, 90, 99}
+
+// StatsD collector listens to StatsD clients and emits the aggregates of
+// what they sent every interval: the sum of the counters, the latest value
+// of the gauges, the count, min, max, mean and percentiles of the timers
+// and the number of unique values of the sets. DogStatsD tags become
+// dimensions.
+type StatsD struct {
+	baseCollector
+	port          string
+	protocol      string
+	percentiles   []float64
+	gaugeExpiry   int
+	serverStarted bool
+	serverStopped chan struct{}
+
+	mu          sync.Mutex
+	counters    map[string]*statsDCounter
+	gauges      map[string]*statsDGauge
+	timers      map[string]*statsDTimer
+	sets        map[string]*statsDSet
+	parseErrors int
+}
+
+type statsDSeries struct {
+	name       string
+	dimensions map[string]string
+}
+
+type statsDCounter struct {
+	statsDSeries
+	value float64
+}
+
+type statsDGauge struct {
+	statsDSeries
+	value float64
+	// the intervals since the gauge was updated
+	idle int
+}
+
+type statsDTimer struct {
+	statsDSeries
+	values []float64
+	// the number of values sent, given the sample rates
+	count float64
+}
+
+type statsDSet struct {
+	statsDSeries
+	values map[string]bool
+}
+
+// statsDLine is a parsed line, <name>:<value>|<type>[|@<rate>][|#<tags>]
+type statsDLine struct {
+	statsDSeries
+	value      string
+	metricType string
+	sampleRate float64
+}
+
+func init() {
+	RegisterCollector("StatsD", newStatsD)
+}
+
+// newStatsD creates a new StatsD collector.
+func newStatsD(channel chan metric.Metric, initialInterval int, log *l.Entry) Collector {
+	s := new(StatsD)
+
+	s.log = log
+	s.channel = channel
+	s.interval = initialInterval
+
+	s.name = "StatsD"
+	s.port = DefaultStatsDPort
+	s.protocol = DefaultStatsDProtocol
+	s.percentiles = DefaultStatsDPercentiles
+	s.gaugeExpiry = DefaultStatsDGaugeExpiryIntervals
+	s.serverStopped = make(chan struct{})
+	s.counters = make(map[string]*statsDCounter)
+	s.gauges = make(map[string]*statsDGauge)
+	s.timers = make(map[string]*statsDTimer)
+	s.sets = make(map[string]*statsDSet)
+	s.SetCollectorType("listener")
+	return s
+}
+
+// Configure the collector
+func (s *StatsD) Configure(configMap map[string]interface{}) {
+	if port, exists := configMap["port"]; exists {
+		s.port = fmt.Sprint(port)
+	}
+	if protocol, exists := configMap["protocol"]; exists {
+		switch p, _ := protocol.(string); p {
+		case "udp", "tcp":
+			s.protocol = p
+		default:
+			s.log.Error("Unknown protocol ", protocol, ", using ", DefaultStatsDProtocol)
+		}
+	}
+	if percentiles, exists := configMap["percentiles"]; exists {
+		// percentiles are numbers, GetAsSlice only handles strings
+		list, ok := percentiles.([]interface{})
+		if !ok {
+			s.log.Error("Invalid percentiles ", percentiles)
+		}
+		s.percentiles = nil
+		for _, percentile := range list {
+			value := config.GetAsFloat(percentile, -1)
+			if value <= 0 || value > 100 {
+				s.log.Error("Invalid percentile ", percentile)
+				continue
+			}
+			s.percentiles = append(s.percentiles, value)
+		}
+	}
+	if gaugeExpiry, exists := configMap["gaugeExpiryIntervals"]; exists {
+		s.gaugeExpiry = config.GetAsInt(gaugeExpiry, DefaultStatsDGaugeExpiryIntervals)
+	}
+	s.configureCommonParams(configMap)
+}
+
+// Port returns the port the collector listens on
+func (s *StatsD) Port() string {
+	return s.port
+}
+
+// Protocol returns the protocol the collector listens with, udp or tcp
+func (s *StatsD) Protocol() string {
+	return s.protocol
+}
+
+// Collect listens to the StatsD clients and emits the aggregates every
+// interval. It returns once the collector is stopped, closing the socket.
+func (s *StatsD) Collect() {
+	if !s.serverStarted {
+		if err := s.listen(); err != nil {
+			s.log.Error("Cannot listen on the StatsD socket: ", err)
+			close(s.serverStopped)
+		}
+	}
+
+	defer reportInternalStats(s.Name(), s)()
+
+	ticker := time.NewTicker(time.Duration(s.interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.Done():
+			// the socket is closed by the time we return
+			<-s.serverStopped
+			return
+		case <-ticker.C:
+			for _, m := range s.flush() {
+				select {
+				case s.Channel() <- m:
+				case <-s.Done():
+					<-s.serverStopped
+					return
+				}
+			}
+		}
+	}
+}
+
+// listen opens the socket, the port it is bound to is known once it returns
+func (s *StatsD) listen() error {
+	s.serverStarted = true
+	if s.protocol == "tcp" {
+		ln, err := net.Listen("tcp", ":"+s.port)
+		if err != nil {
+			return err
+		}
+		s.port = strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+		go s.serveTCP(ln)
+		return nil
+	}
+
+	conn, err := net.ListenPacket("udp", ":"+s.port)
+	if err != nil {
+		return err
+	}
+	s.port = strconv.Itoa(conn.LocalAddr().(*net.UDPAddr).Port)
+	go s.serveUDP(conn)
+	return nil
+}
+
+func (s *StatsD) serveUDP(conn net.PacketConn) {
+	defer close(s.serverStopped)
+	// closing the socket unblocks ReadFrom() once we're stopped
+	go func() {
+		<-s.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, statsDMaxDatagramSize)
+	var backoff time.Duration
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.Done():
+				s.log.Info("StatsD socket closed")
+				return
+			default:
+				s.log.Warn("Error while reading StatsD metrics ", err)
+				backoff = s.waitAfterError(backoff)
+				continue
+			}
+		}
+		backoff = 0
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			s.handleLine(line)
+		}
+	}
+}
+
+func (s *StatsD) serveTCP(ln net.Listener) {
+	defer close(s.serverStopped)
+	var connections sync.WaitGroup
+	// the connections are closed before the collector says it stopped
+	defer connections.Wait()
+	go func() {
+		<-s.Done()
+		ln.Close()
+	}()
+
+	var backoff time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			select {
+			case <-s.Done():
+				s.log.Info("StatsD socket closed")
+				return
+			default:
+				s.log.Warn("Error while accepting StatsD connections ", err)
+				backoff = s.waitAfterError(backoff)
+				continue
+			}
+		}
+		backoff = 0
+		connections.Add(1)
+		go func() {
+			defer connections.Done()
+			s.readTCP(conn)
+		}()
+	}
+}
+
+func (s *StatsD) readTCP(conn net.Conn) {
+	defer conn.Close()
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-s.Done():
+			conn.Close()
+		case <-closed:
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		s.handleLine(scanner.Text())
+	}
+}
+
+// handleLine parses line and aggregates it
+func (s *StatsD) handleLine(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	parsed, err := parseStatsDLine(line)
+	if err == nil {
+		err = s.aggregate(parsed)
+	}
+	if err != nil {
+		s.log.Debug("Cannot parse StatsD line ", line, ": ", err)
+		s.mu.Lock()
+		s.parseErrors++
+		s.mu.Unlock()
+	}
+}
+
+// parseStatsDLine parses <name>:<value>|<type>[|@<rate>][|#<tags>]
+func parseStatsDLine(line string) (*statsDLine, error) {
+	colon := strings.Index(line, ":")
+	if colon <= 0 {
+		return nil, errors.New("missing name")
+	}
+	parsed := &statsDLine{sampleRate: 1}
+	parsed.name = line[:colon]
+
+	fields := strings.Split(line[colon+1:], "|")
+	if len(fields) < 2 || fields[0] == "" {
+		return nil, errors.New("missing value or type")
+	}
+	parsed.value = fields[0]
+	parsed.metricType = fields[1]
+
+	for _, field := range fields[2:] {
+		switch {
+		case strings.HasPrefix(field, "@"):
+			rate, err := strconv.ParseFloat(field[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return nil, errors.New("invalid sample rate " + field)
+			}
+			parsed.sampleRate = rate
+		case strings.HasPrefix(field, "#"):
+			parsed.dimensions = parseStatsDTags(field[1:])
+		default:
+			return nil, errors.New("unknown field " + field)
+		}
+	}
+	return parsed, nil
+}
+
+// parseStatsDTags parses DogStatsD tags, tag1:value1,tag2. The tags
+// without a value are dimensions whose value is "true".
+func parseStatsDTags(tags string) map[string]string {
+	dimensions := make(map[string]string)
+	for _, tag := range strings.Split(tags, ",") {
+		if tag == "" {
+			continue
+		}
+		if colon := strings.Index(tag, ":"); colon >= 0 {
+			dimensions[tag[:colon]] = tag[colon+1:]
+		} else {
+			dimensions[tag] = "true"
+		}
+	}
+	return dimensions
+}
+
+// aggregate adds the parsed line to the aggregates of its series
+func (s *StatsD) aggregate(parsed *statsDLine) error {
+	key := statsDSeriesKey(parsed.name, parsed.dimensions)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch parsed.metricType {
+	case "c":
+		value, err := strconv.ParseFloat(parsed.value, 64)
+		if err != nil {
+			return err
+		}
+		c, exists := s.counters[key]
+		if !exists {
+			c = &statsDCounter{statsDSeries: parsed.statsDSeries}
+			s.counters[key] = c
+		}
+		c.value += value / parsed.sampleRate
+	case "g":
+		value, err := strconv.ParseFloat(parsed.value, 64)
+		if err != nil {
+			return err
+		}
+		g, exists := s.gauges[key]
+		if !exists {
+			g = &statsDGauge{statsDSeries: parsed.statsDSeries}
+			s.gauges[key] = g
+		}
+		// a sign changes the gauge by the value rather than setting it
+		if strings.HasPrefix(parsed.value, "+") || strings.HasPrefix(parsed.value, "-") {
+			g.value += value
+		} else {
+			g.value = value
+		}
+		g.idle = 0
+	case "ms", "h", "d":
+		value, err := strconv.ParseFloat(parsed.value, 64)
+		if err != nil {
+			return err
+		}
+		t, exists := s.timers[key]
+		if !exists {
+			t = &statsDTimer{statsDSeries: parsed.statsDSeries}
+			s.timers[key] = t
+		}
+		t.values = append(t.values, value)
+		t.count += 1 / parsed.sampleRate
+	case "s":
+		set, exists := s.sets[key]
+		if !exists {
+			set = &statsDSet{statsDSeries: parsed.statsDSeries, values: make(map[string]bool)}
+			s.sets[key] = set
+		}
+		set.values[parsed.value] = true
+	default:
+		return errors.New("unknown type " + parsed.metricType)
+	}
+	return nil
+}
+
+// flush returns the aggregates of the interval and starts the next one,
+// the gauges keep their value until they're sent a new one or aren't
+// updated for gaugeExpiry intervals
+func (s *StatsD) flush() []metric.Metric {
+	s.mu.Lock()
+	counters, timers, sets := s.counters, s.timers, s.sets
+	s.counters = make(map[string]*statsDCounter)
+	s.timers = make(map[string]*statsDTimer)
+	s.sets = make(map[string]*statsDSet)
+
+	var metrics []metric.Metric
+	for key, g := range s.gauges {
+		if s.gaugeExpiry > 0 && g.idle >= s.gaugeExpiry {
+			delete(s.gauges, key)
+			continue
+		}
+		metrics = append(metrics, g.newMetric("", g.value, metric.Gauge))
+		g.idle++
+	}
+	s.mu.Unlock()
+
+	for _, c := range counters {
+		metrics = append(metrics, c.newMetric("", c.value, metric.Counter))
+	}
+	for _, set := range sets {
+		metrics = append(metrics, set.newMetric("", float64(len(set.values)), metric.Gauge))
+	}
+	for _, t := range timers {
+		metrics = append(metrics, s.timerMetrics(t)...)
+	}
+	return metrics
+}
+
+// InternalMetrics reports the lines which couldn't be parsed since the
+// collector started
+func (s *StatsD) InternalMetrics() metric.InternalMetrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m := metric.NewInternalMetrics()
+	m.Counters[statsDParseErrorsMetric] = float64(s.parseErrors)
+	return *m
+}
+
+// timerMetrics returns <name>.count, .min, .max, .mean and .p<percentile>
+func (s *StatsD) timerMetrics(t *statsDTimer) []metric.Metric {
+	values := t.values
+	sort.Float64s(values)
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+	}
+
+	metrics := []metric.Metric{
+		t.newMetric(".count", t.count, metric.Counter),
+		t.newMetric(".min", values[0], metric.Gauge),
+		t.newMetric(".max", values[len(values)-1], metric.Gauge),
+		t.newMetric(".mean", sum/float64(len(values)), metric.Gauge),
+	}
+	for _, percentile := range s.percentiles {
+		stat := ".p" + strings.Replace(strconv.FormatFloat(percentile, 'f', -1, 64), ".", "_", -1)
+		metrics = append(metrics, t.newMetric(stat, metric.NearestRank(values, percentile), metric.Gauge))
+	}
+	return metrics
+}
+
+func (series statsDSeries) newMetric(suffix string, value float64, metricType string) metric.Metric {
+	m := metric.WithValue(series.name+suffix, value)
+	m.MetricType = metricType
+	m.AddDimensions(series.dimensions)
+	return m
+}
+
+// statsDSeriesKey identifies a metric name and its tags
+func statsDSeriesKey(name string, dimensions map[string]string) string {
+	keys := make([]string, 0, len(dimensions))
+	for k := range dimensions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	key := name
+	for _, k := range keys {
+		key += "|" + k + ":" + dimensions[k]
+	}
+	return key
+}
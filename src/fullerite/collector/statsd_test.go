@@ -0,0 +1,238 @@
+package collector
+
+import (
+	"fullerite/metric"
+	"fullerite/test_utils"
+
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestStatsD(config map[string]interface{}) *StatsD {
+	s := newStatsD(make(chan metric.Metric), 10, test_utils.BuildLogger()).(*StatsD)
+	s.Configure(config)
+	// set up the lifecycle like New does
+	s.Done()
+	return s
+}
+
+// flushedStatsD returns the metrics of the interval by name
+func flushedStatsD(s *StatsD) map[string]metric.Metric {
+	metrics := make(map[string]metric.Metric)
+	for _, m := range s.flush() {
+		metrics[m.Name] = m
+	}
+	return metrics
+}
+
+// receiveStatsD waits for the metric named name
+func receiveStatsD(t *testing.T, s *StatsD, name string) metric.Metric {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case m := <-s.Channel():
+			if m.Name == name {
+				return m
+			}
+		case <-timeout:
+			t.Fatal("StatsD didn't emit ", name)
+			return metric.Metric{}
+		}
+	}
+}
+
+func TestStatsDConfigureEmptyConfig(t *testing.T) {
+	s := newTestStatsD(map[string]interface{}{})
+
+	assert.Equal(t, 10, s.Interval())
+	assert.Equal(t, DefaultStatsDPort, s.Port())
+	assert.Equal(t, DefaultStatsDProtocol, s.Protocol())
+	assert.Equal(t, DefaultStatsDPercentiles, s.percentiles)
+	assert.Equal(t, DefaultStatsDGaugeExpiryIntervals, s.gaugeExpiry)
+	assert.Equal(t, "listener", s.CollectorType())
+}
+
+func TestStatsDConfigure(t *testing.T) {
+	s := newTestStatsD(map[string]interface{}{
+		"interval":             5,
+		"port":                 9125,
+		"protocol":             "tcp",
+		"percentiles":          []interface{}{95.0, "99.9", 200.0},
+		"gaugeExpiryIntervals": 3,
+	})
+
+	assert.Equal(t, 5, s.Interval())
+	assert.Equal(t, "9125", s.Port())
+	assert.Equal(t, "tcp", s.Protocol())
+	assert.Equal(t, []float64{95, 99.9}, s.percentiles)
+	assert.Equal(t, 3, s.gaugeExpiry)
+}
+
+func TestParseStatsDLine(t *testing.T) {
+	parsed, err := parseStatsDLine("api.requests:2|c|@0.5|#service:api,canary")
+	require.Nil(t, err)
+	assert.Equal(t, "api.requests", parsed.name)
+	assert.Equal(t, "2", parsed.value)
+	assert.Equal(t, "c", parsed.metricType)
+	assert.Equal(t, 0.5, parsed.sampleRate)
+	assert.Equal(t, map[string]string{"service": "api", "canary": "true"}, parsed.dimensions)
+
+	for _, invalid := range []string{
+		"no_value",
+		":1|c",
+		"name:1",
+		"name:|c",
+		"name:1|c|@2",
+		"name:1|c|unknown",
+	} {
+		_, err := parseStatsDLine(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestStatsDAggregates(t *testing.T) {
+	s := newTestStatsD(map[string]interface{}{"percentiles": []interface{}{50.0, 90.0}})
+	for _, line := range []string{
+		"requests:1|c",
+		"requests:2|c|@0.5",
+		"temperature:20|g",
+		"temperature:+5|g",
+		"latency:10|ms",
+		"latency:30|ms",
+		"latency:20|h|@0.5",
+		"users:alice|s",
+		"users:bob|s",
+		"users:alice|s",
+	} {
+		s.handleLine(line)
+	}
+
+	metrics := flushedStatsD(s)
+	assert.Equal(t, 5.0, metrics["requests"].Value)
+	assert.Equal(t, metric.Counter, metrics["requests"].MetricType)
+	assert.Equal(t, 25.0, metrics["temperature"].Value)
+	assert.Equal(t, metric.Gauge, metrics["temperature"].MetricType)
+	assert.Equal(t, 2.0, metrics["users"].Value)
+
+	assert.Equal(t, 4.0, metrics["latency.count"].Value)
+	assert.Equal(t, metric.Counter, metrics["latency.count"].MetricType)
+	assert.Equal(t, 10.0, metrics["latency.min"].Value)
+	assert.Equal(t, 30.0, metrics["latency.max"].Value)
+	assert.Equal(t, 20.0, metrics["latency.mean"].Value)
+	assert.Equal(t, 20.0, metrics["latency.p50"].Value)
+	assert.Equal(t, 30.0, metrics["latency.p90"].Value)
+	assert.NotContains(t, metrics, statsDParseErrorsMetric)
+
+	// only the gauges are sent again
+	metrics = flushedStatsD(s)
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, 25.0, metrics["temperature"].Value)
+}
+
+func TestStatsDGaugesExpire(t *testing.T) {
+	s := newTestStatsD(map[string]interface{}{"gaugeExpiryIntervals": 2})
+	s.handleLine("temperature:20|g")
+
+	assert.Contains(t, flushedStatsD(s), "temperature")
+	s.handleLine("temperature:+1|g")
+	assert.Equal(t, 21.0, flushedStatsD(s)["temperature"].Value, "updating a gauge keeps it")
+	assert.Contains(t, flushedStatsD(s), "temperature")
+	assert.NotContains(t, flushedStatsD(s), "temperature", "not updated for 2 intervals")
+	assert.Empty(t, s.gauges)
+}
+
+func TestStatsDWaitsAfterErrors(t *testing.T) {
+	s := newTestStatsD(map[string]interface{}{})
+	assert.Equal(t, listenerMinErrorBackoff, s.waitAfterError(0))
+	assert.Equal(t, 2*listenerMinErrorBackoff, s.waitAfterError(listenerMinErrorBackoff))
+
+	s.Stop()
+	start := time.Now()
+	assert.Equal(t, listenerMaxErrorBackoff, s.waitAfterError(listenerMaxErrorBackoff))
+	assert.True(t, time.Since(start) < listenerMaxErrorBackoff, "a stopped collector doesn't wait")
+}
+
+func TestStatsDTagsAreDimensions(t *testing.T) {
+	s := newTestStatsD(map[string]interface{}{})
+	s.handleLine("requests:1|c|#service:api,zone:a")
+	s.handleLine("requests:1|c|#zone:a,service:api")
+	s.handleLine("requests:1|c|#service:web")
+
+	var api, web metric.Metric
+	for _, m := range s.flush() {
+		if m.Name != "requests" {
+			continue
+		}
+		if m.Dimensions["service"] == "api" {
+			api = m
+		} else {
+			web = m
+		}
+	}
+	assert.Equal(t, 2.0, api.Value)
+	assert.Equal(t, "a", api.Dimensions["zone"])
+	assert.Equal(t, 1.0, web.Value)
+}
+
+func TestStatsDCountsParseErrors(t *testing.T) {
+	s := newTestStatsD(map[string]interface{}{})
+	s.handleLine("garbage")
+	s.handleLine("requests:one|c")
+	s.handleLine("requests:1|x")
+	s.handleLine("")
+
+	assert.Empty(t, flushedStatsD(s), "parse errors aren't emitted")
+	assert.Equal(t, 3.0, s.InternalMetrics().Counters[statsDParseErrorsMetric])
+
+	s.handleLine("garbage")
+	assert.Equal(t, 4.0, s.InternalMetrics().Counters[statsDParseErrorsMetric], "the counter isn't reset")
+}
+
+func TestStatsDCollectUDP(t *testing.T) {
+	s := newTestStatsD(map[string]interface{}{
+		"interval": 1,
+		"port":     "0",
+	})
+	require.Nil(t, s.listen())
+	go s.Collect()
+	defer s.Stop()
+
+	conn, err := net.Dial("udp", "127.0.0.1:"+s.Port())
+	require.Nil(t, err)
+	defer conn.Close()
+	fmt.Fprint(conn, "requests:1|c\nrequests:2|c|#service:api")
+
+	m := receiveStatsD(t, s, "requests")
+	assert.Equal(t, metric.Counter, m.MetricType)
+	assert.Contains(t, InternalStats(), "StatsD", "a running collector reports its internal metrics")
+}
+
+func TestStatsDCollectTCP(t *testing.T) {
+	s := newTestStatsD(map[string]interface{}{
+		"interval": 1,
+		"port":     "0",
+		"protocol": "tcp",
+	})
+	require.Nil(t, s.listen())
+	go s.Collect()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:"+s.Port())
+	require.Nil(t, err)
+	defer conn.Close()
+	fmt.Fprint(conn, "latency:12|ms\n")
+
+	m := receiveStatsD(t, s, "latency.max")
+	assert.Equal(t, 12.0, m.Value)
+
+	s.Stop()
+	select {
+	case <-s.serverStopped:
+	case <-time.After(time.Second):
+		t.Fatal("StatsD didn't close its socket")
+	}
+}
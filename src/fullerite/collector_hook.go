@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"sync"
 
 	"fullerite/handler"
 	"fullerite/metric"
@@ -12,7 +13,8 @@ import (
 
 // LogErrorHook to send errors via handlers.
 type LogErrorHook struct {
-	handlers []handler.Handler
+	handlersMu sync.RWMutex
+	handlers   []handler.Handler
 
 	// intentionally exported
 	log *logrus.Entry
@@ -22,7 +24,14 @@ type LogErrorHook struct {
 // so that errors are forwarded as a metric to the handlers.
 func NewLogErrorHook(handlers []handler.Handler) *LogErrorHook {
 	hookLog := log.WithFields(logrus.Fields{"hook": "LogErrorHook"})
-	return &LogErrorHook{handlers, hookLog}
+	return &LogErrorHook{handlers: handlers, log: hookLog}
+}
+
+// SetHandlers replaces the handlers errors are sent to, e.g. after a reload.
+func (hook *LogErrorHook) SetHandlers(handlers []handler.Handler) {
+	hook.handlersMu.Lock()
+	defer hook.handlersMu.Unlock()
+	hook.handlers = handlers
 }
 
 // Fire action to take when log is fired.
@@ -54,6 +63,10 @@ func (hook *LogErrorHook) reportErrors(entry *logrus.Entry) {
 		newMetric.AddDimension("collector", val.(string))
 	}
 
-	writeToHandlers(hook.handlers, newMetric)
+	hook.handlersMu.RLock()
+	handlers := hook.handlers
+	hook.handlersMu.RUnlock()
+
+	writeToHandlers(handlers, newMetric)
 	return
 }
@@ -5,13 +5,23 @@ import (
 	"fullerite/config"
 	"fullerite/handler"
 	"fullerite/metric"
+	"fullerite/processor"
 
+	"context"
 	"fmt"
 	"regexp"
+	"sync"
 	"time"
 )
 
-func startCollectors(c config.Config) (collectors []collector.Collector) {
+// runningCollectors tracks the collector run loops so that we can wait
+// for in-progress collections on shutdown.
+var runningCollectors sync.WaitGroup
+
+// runningReaders tracks the goroutines reading from collector channels
+var runningReaders sync.WaitGroup
+
+func startCollectors(ctx context.Context, c config.Config) (collectors []collector.Collector) {
 	log.Info("Starting collectors...")
 
 	for _, name := range c.Collectors {
@@ -21,7 +31,7 @@ func startCollectors(c config.Config) (collectors []collector.Collector) {
 			continue
 		}
 
-		collectorInst := startCollector(name, c, conf)
+		collectorInst := startCollector(ctx, name, c, conf)
 		if collectorInst != nil {
 			collectors = append(collectors, collectorInst)
 		}
@@ -29,8 +39,17 @@ func startCollectors(c config.Config) (collectors []collector.Collector) {
 	return collectors
 }
 
-func startCollector(name string, globalConfig config.Config, instanceConfig map[string]interface{}) collector.Collector {
+func startCollector(ctx context.Context, name string, globalConfig config.Config, instanceConfig map[string]interface{}) collector.Collector {
 	log.Debug("Starting collector ", name)
+	collectorInst := newCollector(name, globalConfig, instanceConfig)
+	if collectorInst == nil {
+		return nil
+	}
+	goRunCollector(ctx, collectorInst)
+	return collectorInst
+}
+
+func newCollector(name string, globalConfig config.Config, instanceConfig map[string]interface{}) collector.Collector {
 	collectorInst := collector.New(name)
 	if collectorInst == nil {
 		return nil
@@ -41,15 +60,30 @@ func startCollector(name string, globalConfig config.Config, instanceConfig map[
 
 	// apply the instance configs
 	collectorInst.Configure(instanceConfig)
-
-	go runCollector(collectorInst)
 	return collectorInst
 }
 
-func runCollector(collector collector.Collector) {
+// goRunCollector runs the collector in the background, the returned
+// channel is closed once it stopped
+func goRunCollector(ctx context.Context, collectorInst collector.Collector) <-chan struct{} {
+	runningCollectors.Add(1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runCollector(ctx, collectorInst)
+	}()
+	return done
+}
+
+// runCollector calls Collect() every interval until the collector
+// is stopped, either by cancelling ctx or by calling its Stop()
+func runCollector(ctx context.Context, collector collector.Collector) {
 	log.Info("Running ", collector)
+	defer runningCollectors.Done()
+	collector.Start(ctx)
 
 	ticker := time.NewTicker(time.Duration(collector.Interval()) * time.Second)
+	defer ticker.Stop()
 	collect := ticker.C
 
 	staggerValue := 1
@@ -57,6 +91,9 @@ func runCollector(collector collector.Collector) {
 
 	for {
 		select {
+		case <-collector.Done():
+			log.Info("Stopping ", collector)
+			return
 		case <-collect:
 			if collector.CollectorType() == "listener" {
 				collector.Collect()
@@ -69,19 +106,41 @@ func runCollector(collector collector.Collector) {
 			}
 		}
 	}
-	ticker.Stop()
 }
 
-func readFromCollectors(collectors []collector.Collector,
-	handlers []handler.Handler,
-	collectorStatChans ...chan<- metric.CollectorEmission) {
-	for i := range collectors {
-		go readFromCollector(collectors[i], handlers, collectorStatChans...)
-	}
+// goReadFromCollector reads from the collector in the background until
+// ctx is cancelled, the returned channel is closed once it stopped
+func goReadFromCollector(ctx context.Context,
+	collector collector.Collector,
+	bus *handler.Bus,
+	processors processor.Chain,
+	collectorStatChans ...chan<- metric.CollectorEmission) <-chan struct{} {
+	runningReaders.Add(1)
+	done := make(chan struct{})
+	go func() {
+		defer runningReaders.Done()
+		defer close(done)
+		readFromCollector(ctx, collector, bus, processors, collectorStatChans...)
+	}()
+	return done
 }
 
-func readFromCollector(collector collector.Collector,
-	handlers []handler.Handler,
+// newProcessorChain returns the processors of a collector: its own
+// ones followed by the global ones. Processors holding metrics back
+// release them on the handler interval unless configured otherwise.
+func newProcessorChain(globalConfig config.Config, instanceConfig map[string]interface{}) processor.Chain {
+	interval := config.GetAsInt(globalConfig.Interval, handler.DefaultInterval)
+	chain := processor.NewChain(instanceConfig["processors"], interval)
+	return append(chain, processor.NewChain(globalConfig.Processors, interval)...)
+}
+
+// readFromCollector publishes the metrics of a collector, once they went
+// through its processors, to the handlers until either the collector
+// channel is closed or ctx is cancelled.
+func readFromCollector(ctx context.Context,
+	collector collector.Collector,
+	bus *handler.Bus,
+	processors processor.Chain,
 	collectorStatChans ...chan<- metric.CollectorEmission) {
 	// In case of Diamond collectors, metric from multiple collectors are read
 	// from Single channel (owned by Go Diamond Collector) and hence we use a map
@@ -89,9 +148,40 @@ func readFromCollector(collector collector.Collector,
 	emissionCounter := map[string]uint64{}
 	lastEmission := time.Now()
 	statDuration := time.Duration(collector.Interval()) * time.Second
-	for m := range collector.Channel() {
+
+	// processors aggregating metrics are flushed every second, they
+	// know themselves whether their interval is over
+	var flush <-chan time.Time
+	if processors.HasFlushers() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		flush = ticker.C
+	}
+	for {
+		var m metric.Metric
+		var ok bool
+		select {
+		case <-ctx.Done():
+			// Whatever the processors still hold is sent out before
+			// stopping. The stat channels may be shared with other
+			// readers which are stopping as well, leave them open.
+			bus.Publish(collector.CanonicalName(), processors.Flush(true)...)
+			return
+		case <-flush:
+			bus.Publish(collector.CanonicalName(), processors.Flush(false)...)
+			continue
+		case m, ok = <-collector.Channel():
+		}
+		if !ok {
+			break
+		}
+
 		var exists bool
 		c := collector.CanonicalName()
+		// Collector channels are unbuffered, so the time we read a metric
+		// is the time it was collected. Metrics that already carry a
+		// timestamp (e.g. from Diamond or AdHoc) keep their own.
+		m.SetTimestampIfMissing(time.Now())
 		if _, exists = m.GetDimensionValue("collector"); !exists {
 			log.Debugf("readFromCollector: m = %+v", m)
 			m.AddDimension("collector", collector.Name())
@@ -125,11 +215,11 @@ func readFromCollector(collector collector.Collector,
 			m.Name = collector.Prefix() + m.Name
 		}
 
-		for i := range handlers {
-			if _, exists := handlers[i].CollectorEndpoints()[c]; exists {
-				handlers[i].CollectorEndpoints()[c].Channel <- m
-			}
+		if m, ok = processors.Process(m); !ok {
+			continue
 		}
+
+		bus.Publish(c, m)
 	}
 	// Closing the stat channel after collector loop finishes
 	for _, statChannel := range collectorStatChans {
@@ -7,8 +7,13 @@ import (
 	"fullerite/metric"
 	"sync"
 
+	"context"
 	"io/ioutil"
+	"net"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
 	"time"
 
@@ -60,9 +65,15 @@ func TestMain(m *testing.M) {
 	os.Exit(m.Run())
 }
 
+func newTestBus(handlers ...handler.Handler) *handler.Bus {
+	bus := handler.NewBus(100)
+	bus.SetHandlers(handlers)
+	return bus
+}
+
 func TestStartCollectorsEmptyConfig(t *testing.T) {
 	logrus.SetLevel(logrus.ErrorLevel)
-	collectors := startCollectors(config.Config{})
+	collectors := startCollectors(context.Background(), config.Config{})
 
 	assert.NotEqual(t, len(collectors), 1, "should create a Collector")
 }
@@ -70,7 +81,7 @@ func TestStartCollectorsEmptyConfig(t *testing.T) {
 func TestStartCollectorUnknownCollector(t *testing.T) {
 	logrus.SetLevel(logrus.ErrorLevel)
 	c := make(map[string]interface{})
-	collector := startCollector("unknown collector", config.Config{}, c)
+	collector := startCollector(context.Background(), "unknown collector", config.Config{}, c)
 
 	assert.Nil(t, collector, "should NOT create a Collector")
 }
@@ -78,7 +89,7 @@ func TestStartCollectorUnknownCollector(t *testing.T) {
 func TestStartCollectorsMixedConfig(t *testing.T) {
 	logrus.SetLevel(logrus.ErrorLevel)
 	conf, _ := config.ReadConfig(tmpTestFakeFile)
-	collectors := startCollectors(conf)
+	collectors := startCollectors(context.Background(), conf)
 
 	for _, c := range collectors {
 		assert.Equal(t, c.Name(), "Test", "Only create valid collectors")
@@ -89,7 +100,7 @@ func TestStartCollectorTooLong(t *testing.T) {
 	logrus.SetLevel(logrus.ErrorLevel)
 	c := make(map[string]interface{})
 	c["interval"] = 1
-	collector := startCollector("Test", config.Config{}, c)
+	collector := startCollector(context.Background(), "Test", config.Config{}, c)
 
 	select {
 	case m := <-collector.Channel():
@@ -134,7 +145,7 @@ func TestReadFromCollector(t *testing.T) {
 			collectorMetrics[collectorMetric.Name] = collectorMetric.EmissionCount
 		}
 	}()
-	readFromCollector(collector, []handler.Handler{}, collectorStatChannel)
+	readFromCollector(context.Background(), collector, newTestBus(), nil, collectorStatChannel)
 	wg.Wait()
 	assert.Equal(t, uint64(1), collectorMetrics["Test"])
 	assert.Equal(t, uint64(2), collectorMetrics["Foobar"])
@@ -168,10 +179,88 @@ func TestCollectorPrefix(t *testing.T) {
 		testMetric := <-collectorChannel["Test"].Channel
 		assert.Equal(t, "px.hello", testMetric.Name)
 	}()
-	readFromCollector(collector, []handler.Handler{testHandler})
+	readFromCollector(context.Background(), collector, newTestBus(testHandler), nil)
+	wg.Wait()
+}
+
+func TestCollectorProcessors(t *testing.T) {
+	logrus.SetLevel(logrus.ErrorLevel)
+	c := map[string]interface{}{
+		"interval": 1,
+		"processors": []interface{}{
+			map[string]interface{}{"processor": "DropMetrics", "metric_pattern": "^drop"},
+		},
+	}
+	globalConfig := config.Config{
+		Processors: []map[string]interface{}{
+			{"processor": "RenameMetric", "pattern": "^hello$", "replacement": "world"},
+		},
+	}
+	collector := collector.New("Test")
+	collector.SetInterval(1)
+	collector.Configure(c)
+
+	collectorChannel := map[string]handler.CollectorEnd{
+		"Test": handler.CollectorEnd{make(chan metric.Metric), 1},
+	}
+	testHandler := handler.New("Log")
+	testHandler.SetCollectorEndpoints(collectorChannel)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		collector.Channel() <- metric.New("drop.me")
+		collector.Channel() <- metric.New("hello")
+		close(collector.Channel())
+	}()
+	go func() {
+		defer wg.Done()
+		testMetric := <-collectorChannel["Test"].Channel
+		assert.Equal(t, "world", testMetric.Name)
+	}()
+	readFromCollector(context.Background(), collector, newTestBus(testHandler), newProcessorChain(globalConfig, c))
 	wg.Wait()
 }
 
+func TestCollectorAggregatesFlushedOnStop(t *testing.T) {
+	logrus.SetLevel(logrus.ErrorLevel)
+
+	c := map[string]interface{}{
+		"interval": 1,
+		"processors": []interface{}{
+			map[string]interface{}{"processor": "Aggregate", "stats": []interface{}{"sum"}, "drop_raw": true},
+		},
+	}
+	collector := collector.New("Test")
+	collector.SetInterval(1)
+	collector.Configure(c)
+
+	collectorChannel := map[string]handler.CollectorEnd{
+		"Test": handler.CollectorEnd{make(chan metric.Metric, 10), 1},
+	}
+	testHandler := handler.New("Log")
+	testHandler.SetCollectorEndpoints(collectorChannel)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		m := metric.WithValue("requests", 1)
+		m.MetricType = metric.Counter
+		collector.Channel() <- m
+		collector.Channel() <- m
+		cancel()
+	}()
+	globalConfig := config.Config{Interval: 60}
+	bus := newTestBus(testHandler)
+	readFromCollector(ctx, collector, bus, newProcessorChain(globalConfig, c))
+	bus.Flush(time.Second)
+
+	assert.Len(t, collectorChannel["Test"].Channel, 1)
+	testMetric := <-collectorChannel["Test"].Channel
+	assert.Equal(t, "requests.sum", testMetric.Name)
+	assert.Equal(t, 2.0, testMetric.Value)
+}
+
 func TestCollectorBlacklist(t *testing.T) {
 	logrus.SetLevel(logrus.ErrorLevel)
 
@@ -202,8 +291,68 @@ func TestCollectorBlacklist(t *testing.T) {
 			collectorMetrics[collectorMetric.Name] = collectorMetric.EmissionCount
 		}
 	}()
-	readFromCollector(col, []handler.Handler{}, collectorStatChannel)
+	readFromCollector(context.Background(), col, newTestBus(), nil, collectorStatChannel)
 	wg.Wait()
 
 	assert.Equal(t, uint64(1), collectorMetrics["Test"])
 }
+
+func TestForwardedMetricsKeepTheirDimensions(t *testing.T) {
+	logrus.SetLevel(logrus.ErrorLevel)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	dir, err := ioutil.TempDir("", "fullerite-forward")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "metrics.influx")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	aggregator := config.Config{
+		Interval:          1,
+		Collectors:        []string{"ForwardReceiver"},
+		DefaultDimensions: map[string]string{"host": "aggregator", "region": "east"},
+	}
+	receiver := startCollector(ctx, "ForwardReceiver", aggregator, map[string]interface{}{"port": port})
+	file := createHandler("File", aggregator, map[string]interface{}{
+		"path":            path,
+		"encoding":        "influx",
+		"max_buffer_size": 1,
+	})
+	startHandlers(ctx, []handler.Handler{file})
+	go readFromCollector(ctx, receiver, newTestBus(file), nil)
+	// listeners start listening on their first collection
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if conn, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+			conn.Close()
+			break
+		}
+	}
+
+	for _, host := range []string{"web1", "web2"} {
+		sender := createHandler("Forward", config.Config{DefaultDimensions: map[string]string{"host": host}},
+			map[string]interface{}{"server": "127.0.0.1", "port": port, "max_buffer_size": 1})
+		startHandlers(ctx, []handler.Handler{sender})
+		sender.Channel() <- metric.WithValue("load", 1)
+	}
+
+	var forwarded []string
+	for deadline := time.Now().Add(5 * time.Second); len(forwarded) < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		contents, _ := ioutil.ReadFile(path)
+		forwarded = forwarded[:0]
+		for _, line := range strings.Split(string(contents), "\n") {
+			if strings.HasPrefix(line, "load,") {
+				forwarded = append(forwarded, line)
+			}
+		}
+	}
+	if assert.Len(t, forwarded, 2) {
+		sort.Strings(forwarded)
+		assert.Contains(t, forwarded[0], "host=web1", "the dimensions of the sender win")
+		assert.Contains(t, forwarded[1], "host=web2")
+		assert.Contains(t, forwarded[0], "region=east", "the missing defaults are added")
+	}
+}
@@ -23,6 +23,9 @@ type Config struct {
 	Collectors            []string                          `json:"collectors"`
 	DefaultDimensions     map[string]string                 `json:"defaultDimensions"`
 	InternalServerConfig  map[string]interface{}            `json:"internalServer"`
+	ShutdownTimeout       interface{}                       `json:"shutdownTimeout"`
+	Processors            []map[string]interface{}          `json:"processors"`
+	BusBufferSize         interface{}                       `json:"busBufferSize"`
 }
 
 // ReadConfig reads a fullerite configuration file
@@ -0,0 +1,246 @@
+/*
+Package forward is the protocol fullerite instances forward metrics to one
+another with, from the Forward handler to the ForwardReceiver collector.
+
+Every message is JSON compressed with gzip. Over TCP a message is
+preceded by its length, a 4 bytes big endian unsigned integer. The sender
+opens the connection with a hello, telling its source and the shared
+secret, in at most MaxHelloSize, then sends batches, each numbered. The
+receiver answers every message with an ack carrying the number of the
+batch and how many metrics it accepted. An ack carrying an error, e.g. for
+a wrong secret, is the last message of the connection.
+
+Over HTTP every batch is a POST of a message, which carries the source and
+the secret as well, to HTTPPath. The receiver answers with an ack.
+*/
+package forward
+
+import (
+	"fullerite/metric"
+
+	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	// Version of the protocol
+	Version = 1
+	// DefaultPort is the port the receivers listen on
+	DefaultPort = "2015"
+	// HTTPPath is where the batches are posted over HTTP
+	HTTPPath = "/forward"
+	// ContentType of the messages over HTTP
+	ContentType = "application/x-fullerite-forward"
+	// MaxMessageSize is the largest message, compressed or not
+	MaxMessageSize = 64 << 20
+	// MaxHelloSize is the largest hello, compressed or not. The receivers
+	// read it before they know the source is allowed to send anything.
+	MaxHelloSize = 4 << 10
+)
+
+// The types of messages
+const (
+	TypeHello = "hello"
+	TypeBatch = "batch"
+	TypeAck   = "ack"
+)
+
+// ErrMessageTooLarge is returned for a message larger than allowed
+var ErrMessageTooLarge = errors.New("message too large")
+
+// maxMessageSize is MaxMessageSize, tests lower it
+var maxMessageSize = MaxMessageSize
+
+// Message is what the senders and receivers exchange
+type Message struct {
+	Type    string `json:"type"`
+	Version int    `json:"version,omitempty"`
+	Source  string `json:"source,omitempty"`
+	Secret  string `json:"secret,omitempty"`
+	// Seq numbers the batches of a connection, the acks repeat it
+	Seq      uint64   `json:"seq,omitempty"`
+	Metrics  []Metric `json:"metrics,omitempty"`
+	Accepted int      `json:"accepted,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// Metric is the compact form metrics are forwarded in, the timestamp is
+// in nanoseconds since the epoch, 0 when the metric doesn't have one
+type Metric struct {
+	Name       string            `json:"n"`
+	Type       string            `json:"t,omitempty"`
+	Value      float64           `json:"v"`
+	Dimensions map[string]string `json:"d,omitempty"`
+	Timestamp  int64             `json:"ts,omitempty"`
+}
+
+// NewHello returns the hello of source
+func NewHello(source string, secret string) *Message {
+	return &Message{Type: TypeHello, Version: Version, Source: source, Secret: secret}
+}
+
+// NewBatch returns batch seq of metrics
+func NewBatch(seq uint64, metrics []metric.Metric) *Message {
+	batch := &Message{Type: TypeBatch, Version: Version, Seq: seq, Metrics: make([]Metric, 0, len(metrics))}
+	for _, m := range metrics {
+		forwarded := Metric{
+			Name:       m.Name,
+			Type:       m.MetricType,
+			Value:      m.Value,
+			Dimensions: m.Dimensions,
+		}
+		if !m.Timestamp.IsZero() {
+			forwarded.Timestamp = m.Timestamp.UnixNano()
+		}
+		batch.Metrics = append(batch.Metrics, forwarded)
+	}
+	return batch
+}
+
+// NewAck returns the ack of batch seq, an error rejects the whole batch
+func NewAck(seq uint64, accepted int, err error) *Message {
+	ack := &Message{Type: TypeAck, Seq: seq, Accepted: accepted}
+	if err != nil {
+		ack.Error = err.Error()
+	}
+	return ack
+}
+
+// ToMetrics returns the metrics of a batch as they were sent, marked as
+// forwarded so that they keep their dimensions
+func (msg *Message) ToMetrics() []metric.Metric {
+	metrics := make([]metric.Metric, 0, len(msg.Metrics))
+	for _, forwarded := range msg.Metrics {
+		m := metric.WithValue(forwarded.Name, forwarded.Value)
+		m.Forwarded = true
+		if forwarded.Type != "" {
+			m.MetricType = forwarded.Type
+		}
+		m.AddDimensions(forwarded.Dimensions)
+		if forwarded.Timestamp != 0 {
+			m.Timestamp = time.Unix(0, forwarded.Timestamp)
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// Authenticate tells if msg carries the secret, any message does when the
+// secret is empty
+func Authenticate(secret string, msg *Message) bool {
+	if secret == "" {
+		return true
+	}
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(msg.Secret)) == 1
+}
+
+// Encode returns msg compressed
+func Encode(msg *Message) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(writer).Encode(msg); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() > maxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode returns the message of payload
+func Decode(payload []byte) (*Message, error) {
+	return decode(payload, maxMessageSize)
+}
+
+func decode(payload []byte, maxSize int) (*Message, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// a small payload can expand to anything
+	decompressed, err := ioutil.ReadAll(io.LimitReader(reader, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > maxSize {
+		return nil, ErrMessageTooLarge
+	}
+	msg := new(Message)
+	if err := json.Unmarshal(decompressed, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// WriteMessage writes msg preceded by its length
+func WriteMessage(w io.Writer, msg *Message) error {
+	payload, err := Encode(msg)
+	if err != nil {
+		return err
+	}
+	frame := make([]byte, 4+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	copy(frame[4:], payload)
+	_, err = w.Write(frame)
+	return err
+}
+
+// ReadMessage reads a message preceded by its length
+func ReadMessage(r io.Reader) (*Message, error) {
+	return readMessage(r, maxMessageSize)
+}
+
+// ReadHello reads the hello opening a connection, which can't be larger
+// than MaxHelloSize
+func ReadHello(r io.Reader) (*Message, error) {
+	hello, err := readMessage(r, MaxHelloSize)
+	if err != nil {
+		return nil, err
+	}
+	if hello.Type != TypeHello {
+		return nil, fmt.Errorf("expected a hello, got a %s", hello.Type)
+	}
+	return hello, nil
+}
+
+func readMessage(r io.Reader, maxSize int) (*Message, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if int64(size) > int64(maxSize) {
+		return nil, ErrMessageTooLarge
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return decode(payload, maxSize)
+}
+
+// ReadAck reads the ack of batch seq, or of the hello when seq is 0. The
+// error the receiver sent, if any, is in the ack.
+func ReadAck(r io.Reader, seq uint64) (*Message, error) {
+	ack, err := ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+	if ack.Type != TypeAck || ack.Seq != seq {
+		return nil, fmt.Errorf("expected the ack of %d, got a %s of %d", seq, ack.Type, ack.Seq)
+	}
+	return ack, nil
+}
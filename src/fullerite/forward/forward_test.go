@@ -0,0 +1,140 @@
+package forward
+
+import (
+	"fullerite/metric"
+	"fullerite/test_utils"
+
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchRoundTrip(t *testing.T) {
+	withTimestamp := metric.WithValue("load", 0.5)
+	withTimestamp.MetricType = metric.Counter
+	withTimestamp.AddDimension("host", "dev")
+	withTimestamp.Timestamp = time.Unix(1500000000, 123456789)
+	withoutTimestamp := metric.WithValue("cpu", 2)
+
+	var buf bytes.Buffer
+	require.Nil(t, WriteMessage(&buf, NewBatch(7, []metric.Metric{withTimestamp, withoutTimestamp})))
+
+	msg, err := ReadMessage(&buf)
+	require.Nil(t, err)
+	assert.Equal(t, TypeBatch, msg.Type)
+	assert.Equal(t, uint64(7), msg.Seq)
+
+	metrics := msg.ToMetrics()
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "load", metrics[0].Name)
+	assert.Equal(t, metric.Counter, metrics[0].MetricType)
+	assert.Equal(t, 0.5, metrics[0].Value)
+	assert.Equal(t, map[string]string{"host": "dev"}, metrics[0].Dimensions)
+	assert.True(t, withTimestamp.Timestamp.Equal(metrics[0].Timestamp), "the timestamps are kept to the nanosecond")
+	assert.Equal(t, metric.Gauge, metrics[1].MetricType)
+	assert.True(t, metrics[1].Timestamp.IsZero())
+}
+
+func TestReadAck(t *testing.T) {
+	var buf bytes.Buffer
+	require.Nil(t, WriteMessage(&buf, NewAck(3, 10, nil)))
+	ack, err := ReadAck(&buf, 3)
+	require.Nil(t, err)
+	assert.Equal(t, 10, ack.Accepted)
+	assert.Equal(t, "", ack.Error)
+
+	require.Nil(t, WriteMessage(&buf, NewAck(4, 10, nil)))
+	_, err = ReadAck(&buf, 3)
+	assert.NotNil(t, err, "the ack of another batch")
+
+	require.Nil(t, WriteMessage(&buf, NewBatch(3, nil)))
+	_, err = ReadAck(&buf, 3)
+	assert.NotNil(t, err, "not an ack")
+}
+
+func TestAuthenticate(t *testing.T) {
+	assert.True(t, Authenticate("", NewHello("web1", "")))
+	assert.True(t, Authenticate("", NewHello("web1", "anything")))
+	assert.True(t, Authenticate("secret", NewHello("web1", "secret")))
+	assert.False(t, Authenticate("secret", NewHello("web1", "")))
+	assert.False(t, Authenticate("secret", NewHello("web1", "secreT")))
+}
+
+func TestReadMessageTooLarge(t *testing.T) {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(maxMessageSize+1))
+	_, err := ReadMessage(bytes.NewReader(header))
+	assert.Equal(t, ErrMessageTooLarge, err)
+}
+
+func TestReadHello(t *testing.T) {
+	var buf bytes.Buffer
+	require.Nil(t, WriteMessage(&buf, NewHello("web1", "secret")))
+	hello, err := ReadHello(&buf)
+	require.Nil(t, err)
+	assert.Equal(t, "web1", hello.Source)
+
+	require.Nil(t, WriteMessage(&buf, NewBatch(1, nil)))
+	_, err = ReadHello(&buf)
+	assert.NotNil(t, err, "not a hello")
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(MaxHelloSize+1))
+	_, err = ReadHello(bytes.NewReader(header))
+	assert.Equal(t, ErrMessageTooLarge, err, "nothing larger is read before the source is authenticated")
+}
+
+func TestDecodeTooLarge(t *testing.T) {
+	defer func(size int) { maxMessageSize = size }(maxMessageSize)
+	maxMessageSize = 1024
+
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err := writer.Write(make([]byte, maxMessageSize+1))
+	require.Nil(t, err)
+	require.Nil(t, writer.Close())
+
+	_, err = Decode(buf.Bytes())
+	assert.Equal(t, ErrMessageTooLarge, err, "messages expanding past the limit are rejected")
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	_, err := Decode([]byte("not gzip"))
+	assert.NotNil(t, err)
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fullerite-forward")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, err := test_utils.WriteSelfSignedCertificate(dir)
+	require.Nil(t, err)
+
+	server, err := ServerTLSConfig(certFile, keyFile, "")
+	require.Nil(t, err)
+	assert.Len(t, server.Certificates, 1)
+	assert.Equal(t, tls.NoClientCert, server.ClientAuth)
+
+	server, err = ServerTLSConfig(certFile, keyFile, certFile)
+	require.Nil(t, err)
+	assert.Equal(t, tls.RequireAndVerifyClientCert, server.ClientAuth)
+
+	client, err := ClientTLSConfig(certFile, certFile, keyFile, false)
+	require.Nil(t, err)
+	assert.NotNil(t, client.RootCAs)
+	assert.Len(t, client.Certificates, 1)
+
+	_, err = ServerTLSConfig(filepath.Join(dir, "missing.pem"), keyFile, "")
+	assert.NotNil(t, err)
+	_, err = ClientTLSConfig(keyFile, "", "", false)
+	assert.NotNil(t, err, "no certificate in the CA file")
+}
@@ -0,0 +1,298 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"sync"
+	"time"
+)
+
+// DefaultBusBufferSize is how many metrics the bus buffers for each handler
+const DefaultBusBufferSize = 10000
+
+// Bus broadcasts the metrics of the collectors to the handlers. Publishing
+// never blocks: every handler has its own subscription, a bounded ring
+// buffer drained into the endpoint of the collector by a goroutine of its
+// own. When a handler can't keep up its ring fills up and its oldest
+// metrics are dropped, while the other handlers keep receiving theirs.
+type Bus struct {
+	bufferSize int
+
+	mu            sync.RWMutex
+	subscriptions map[Handler]*subscription
+
+	// held by Pause, the publishers wait for Resume
+	paused sync.RWMutex
+}
+
+type busEntry struct {
+	collector string
+	metric    metric.Metric
+}
+
+// subscription is the ring buffer of a handler
+type subscription struct {
+	handler Handler
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	ring []busEntry
+	head int
+	size int
+	// the collector endpoints of the handler, refreshed by SetHandlers
+	endpoints map[string]CollectorEnd
+	// the entries being delivered, taken out of the ring
+	delivering int
+	closed     bool
+	stopped    bool
+
+	delivered uint64
+	dropped   uint64
+}
+
+// NewBus creates a bus buffering bufferSize metrics per handler
+func NewBus(bufferSize int) *Bus {
+	if bufferSize <= 0 {
+		bufferSize = DefaultBusBufferSize
+	}
+	return &Bus{
+		bufferSize:    bufferSize,
+		subscriptions: make(map[Handler]*subscription),
+	}
+}
+
+// SetHandlers subscribes the handlers which aren't yet and unsubscribes
+// the ones missing from handlers, after their buffer was delivered. The
+// collector endpoints of the handlers are read again, it must be called
+// once they changed.
+func (b *Bus) SetHandlers(handlers []Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	wanted := make(map[Handler]bool, len(handlers))
+	for _, h := range handlers {
+		wanted[h] = true
+		if s, exists := b.subscriptions[h]; exists {
+			s.setEndpoints(h.CollectorEndpoints())
+			continue
+		}
+		s := &subscription{
+			handler:   h,
+			endpoints: h.CollectorEndpoints(),
+			ring:      make([]busEntry, b.bufferSize),
+		}
+		s.cond = sync.NewCond(&s.mu)
+		b.subscriptions[h] = s
+		go s.deliver()
+	}
+	for h, s := range b.subscriptions {
+		if !wanted[h] {
+			s.close()
+			delete(b.subscriptions, h)
+		}
+	}
+}
+
+// Publish broadcasts the metrics of collector c to the handlers
+// listening to it, the same as writing to their collector endpoint
+// but without waiting for them
+func (b *Bus) Publish(c string, metrics ...metric.Metric) {
+	b.paused.RLock()
+	defer b.paused.RUnlock()
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, s := range b.subscriptions {
+		s.push(c, metrics)
+	}
+}
+
+// Pause blocks the publishers until Resume is called, e.g. while the
+// handlers are replaced
+func (b *Bus) Pause() {
+	b.paused.Lock()
+}
+
+// Resume lets the publishers blocked by Pause go on
+func (b *Bus) Resume() {
+	b.paused.Unlock()
+}
+
+// Flush waits for the metrics published so far to be delivered
+// to the handlers, or dropped by the handlers which stopped. The metrics
+// still buffered once timeout expired are dropped, Flush returns how many.
+func (b *Bus) Flush(timeout time.Duration) (dropped uint64) {
+	b.mu.RLock()
+	subscriptions := make([]*subscription, 0, len(b.subscriptions))
+	for _, s := range b.subscriptions {
+		subscriptions = append(subscriptions, s)
+	}
+	b.mu.RUnlock()
+
+	deadline := time.Now().Add(timeout)
+	for _, s := range subscriptions {
+		dropped += s.flush(deadline)
+	}
+	return dropped
+}
+
+// Close delivers what's buffered within timeout and stops the bus
+func (b *Bus) Close(timeout time.Duration) {
+	b.Flush(timeout)
+	b.SetHandlers(nil)
+}
+
+// InternalMetrics returns, by handler name, the metrics delivered and
+// dropped by the bus and the depth of the buffer of each handler
+func (b *Bus) InternalMetrics() map[string]metric.InternalMetrics {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	stats := make(map[string]metric.InternalMetrics, len(b.subscriptions))
+	for h, s := range b.subscriptions {
+		s.mu.Lock()
+		stats[h.Name()] = metric.InternalMetrics{
+			Counters: map[string]float64{
+				"busDelivered": float64(s.delivered),
+				"busDropped":   float64(s.dropped),
+			},
+			Gauges: map[string]float64{
+				"busDepth": float64(s.size),
+			},
+		}
+		s.mu.Unlock()
+	}
+	return stats
+}
+
+func (s *subscription) setEndpoints(endpoints map[string]CollectorEnd) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.endpoints = endpoints
+}
+
+// push appends the metrics of collector c to the ring if the handler
+// listens to it, overwriting the oldest entries if it is full
+func (s *subscription) push(c string, metrics []metric.Metric) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.endpoints[c]; !exists {
+		return
+	}
+	if s.stopped {
+		s.dropped += uint64(len(metrics))
+		return
+	}
+	for _, m := range metrics {
+		if s.size == len(s.ring) {
+			s.head = (s.head + 1) % len(s.ring)
+			s.size--
+			s.dropped++
+		}
+		s.ring[(s.head+s.size)%len(s.ring)] = busEntry{c, m}
+		s.size++
+		if s.size == 1 {
+			s.cond.Broadcast()
+		}
+	}
+}
+
+// take waits for entries and moves them out of the ring, along with the
+// endpoints to deliver them to. Returns false once the subscription is
+// closed and empty.
+func (s *subscription) take(entries []busEntry) ([]busEntry, map[string]CollectorEnd, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delivering = 0
+	s.cond.Broadcast()
+	for s.size == 0 {
+		if s.closed {
+			return nil, nil, false
+		}
+		s.cond.Wait()
+	}
+	entries = entries[:0]
+	for ; s.size > 0 && len(entries) < cap(entries); s.size-- {
+		entries = append(entries, s.ring[s.head])
+		s.ring[s.head] = busEntry{}
+		s.head = (s.head + 1) % len(s.ring)
+	}
+	s.delivering = len(entries)
+	return entries, s.endpoints, true
+}
+
+// deliver writes the buffered metrics to the collector endpoints of
+// the handler until the subscription is closed or the handler stopped
+func (s *subscription) deliver() {
+	defer s.stop()
+	entries := make([]busEntry, 0, 256)
+	for {
+		var endpoints map[string]CollectorEnd
+		var ok bool
+		if entries, endpoints, ok = s.take(entries); !ok {
+			return
+		}
+		for i, e := range entries {
+			end, exists := endpoints[e.collector]
+			if !exists {
+				// the endpoint was removed on reload
+				continue
+			}
+			select {
+			case end.Channel <- e.metric:
+			case <-s.handler.Done():
+				s.mu.Lock()
+				s.dropped += uint64(len(entries) - i)
+				s.mu.Unlock()
+				return
+			}
+		}
+		s.mu.Lock()
+		s.delivered += uint64(len(entries))
+		s.mu.Unlock()
+	}
+}
+
+// stop drops whatever is left once nothing delivers anymore
+func (s *subscription) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropped += uint64(s.size)
+	s.size = 0
+	s.delivering = 0
+	s.stopped = true
+	s.cond.Broadcast()
+}
+
+func (s *subscription) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+// flush waits for the ring to be delivered until deadline, then drops
+// what's left in it and returns how many entries
+func (s *subscription) flush(deadline time.Time) uint64 {
+	// the cond can't time out, wake the wait up at the deadline
+	timer := time.AfterFunc(time.Until(deadline), func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.cond.Broadcast()
+	})
+	defer timer.Stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.stopped && (s.size > 0 || s.delivering > 0) {
+		if !time.Now().Before(deadline) {
+			dropped := uint64(s.size)
+			for ; s.size > 0; s.size-- {
+				s.ring[s.head] = busEntry{}
+				s.head = (s.head + 1) % len(s.ring)
+			}
+			s.dropped += dropped
+			return dropped
+		}
+		s.cond.Wait()
+	}
+	return 0
+}
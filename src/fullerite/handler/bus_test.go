@@ -0,0 +1,173 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestBusHandler(name string, endpoints map[string]CollectorEnd) Handler {
+	h := NewTest(make(chan metric.Metric), 1, 10, time.Second, l.WithField("testing", "bus"))
+	h.(*Test).name = name
+	h.SetCollectorEndpoints(endpoints)
+	return h
+}
+
+func TestBusPublishesToListeningHandlers(t *testing.T) {
+	first := CollectorEnd{make(chan metric.Metric, 10), 10}
+	second := CollectorEnd{make(chan metric.Metric, 10), 10}
+	bus := NewBus(10)
+	bus.SetHandlers([]Handler{
+		getTestBusHandler("first", map[string]CollectorEnd{"Test": first}),
+		getTestBusHandler("second", map[string]CollectorEnd{"Other": second}),
+	})
+
+	bus.Publish("Test", metric.New("hello"), metric.New("world"))
+	bus.Publish("Other", metric.New("other"))
+	bus.Close(time.Second)
+
+	assert.Equal(t, 2, len(first.Channel))
+	assert.Equal(t, "hello", (<-first.Channel).Name)
+	assert.Equal(t, "world", (<-first.Channel).Name)
+	assert.Equal(t, 1, len(second.Channel))
+	assert.Equal(t, "other", (<-second.Channel).Name)
+}
+
+func TestBusSlowHandlerDoesNotBlockOthers(t *testing.T) {
+	// nobody reads from the endpoint of the stuck handler
+	stuck := CollectorEnd{make(chan metric.Metric), 10}
+	healthy := CollectorEnd{make(chan metric.Metric, 100), 10}
+	stuckHandler := getTestBusHandler("stuck", map[string]CollectorEnd{"Test": stuck})
+	bus := NewBus(5)
+	bus.SetHandlers([]Handler{
+		stuckHandler,
+		getTestBusHandler("healthy", map[string]CollectorEnd{"Test": healthy}),
+	})
+
+	for i := 1; i <= 50; i++ {
+		bus.Publish("Test", metric.New("test"))
+		assert.Nil(t, waitFor(time.Second, func() bool {
+			return len(healthy.Channel) == i
+		}))
+	}
+
+	assert.Nil(t, waitFor(time.Second, func() bool {
+		return bus.InternalMetrics()["healthy"].Counters["busDelivered"] == 50
+	}))
+	stats := bus.InternalMetrics()
+	assert.Equal(t, 0.0, stats["healthy"].Counters["busDropped"])
+	assert.Equal(t, 5.0, stats["stuck"].Gauges["busDepth"])
+	// the ring holds 5, a few more are waiting to be delivered
+	assert.True(t, stats["stuck"].Counters["busDropped"] >= 40)
+
+	// the buffer of a stopped handler is dropped
+	stuckHandler.Stop()
+	bus.Flush(time.Second)
+	stats = bus.InternalMetrics()
+	assert.Equal(t, 50.0, stats["stuck"].Counters["busDropped"])
+	assert.Equal(t, 0.0, stats["stuck"].Gauges["busDepth"])
+}
+
+func TestBusFlushTimeout(t *testing.T) {
+	// nobody reads from the endpoint of the stuck handler
+	stuck := CollectorEnd{make(chan metric.Metric), 10}
+	stuckHandler := getTestBusHandler("stuck", map[string]CollectorEnd{"Test": stuck})
+	defer stuckHandler.Stop()
+	bus := NewBus(5)
+	bus.SetHandlers([]Handler{stuckHandler})
+
+	bus.Publish("Test", metric.New("delivering"))
+	assert.Nil(t, waitFor(time.Second, func() bool {
+		return bus.InternalMetrics()["stuck"].Gauges["busDepth"] == 0
+	}))
+	bus.Publish("Test", metric.New("buffered"), metric.New("buffered"))
+
+	assert.Equal(t, uint64(2), bus.Flush(10*time.Millisecond), "what the handler didn't take is dropped")
+	stats := bus.InternalMetrics()
+	assert.Equal(t, 2.0, stats["stuck"].Counters["busDropped"])
+	assert.Equal(t, 0.0, stats["stuck"].Gauges["busDepth"])
+}
+
+func TestBusPause(t *testing.T) {
+	end := CollectorEnd{make(chan metric.Metric, 10), 10}
+	bus := NewBus(10)
+	bus.SetHandlers([]Handler{getTestBusHandler("test", map[string]CollectorEnd{"Test": end})})
+
+	bus.Pause()
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		bus.Publish("Test", metric.New("paused"))
+	}()
+	select {
+	case <-published:
+		t.Fatal("published while paused")
+	case <-time.After(10 * time.Millisecond):
+	}
+	bus.Resume()
+	<-published
+	bus.Flush(time.Second)
+	assert.Equal(t, "paused", (<-end.Channel).Name)
+}
+
+func TestBusSetHandlers(t *testing.T) {
+	end := CollectorEnd{make(chan metric.Metric, 10), 10}
+	h := getTestBusHandler("test", map[string]CollectorEnd{"Test": end})
+	bus := NewBus(10)
+
+	bus.Publish("Test", metric.New("before"))
+	bus.SetHandlers([]Handler{h})
+	bus.Publish("Test", metric.New("subscribed"))
+	bus.SetHandlers(nil)
+	bus.Publish("Test", metric.New("after"))
+	bus.Flush(time.Second)
+
+	assert.Nil(t, waitFor(time.Second, func() bool { return len(end.Channel) == 1 }))
+	assert.Equal(t, "subscribed", (<-end.Channel).Name)
+	assert.Empty(t, bus.InternalMetrics())
+}
+
+func TestBusRefreshesEndpoints(t *testing.T) {
+	old := CollectorEnd{make(chan metric.Metric, 10), 10}
+	added := CollectorEnd{make(chan metric.Metric, 10), 10}
+	h := getTestBusHandler("test", map[string]CollectorEnd{"Old": old})
+	bus := NewBus(10)
+	bus.SetHandlers([]Handler{h})
+
+	h.SetCollectorEndpoints(map[string]CollectorEnd{"Added": added})
+	bus.Publish("Added", metric.New("cached"))
+	bus.Flush(time.Second)
+	assert.Equal(t, 0, len(added.Channel), "the endpoints are read by SetHandlers")
+
+	bus.SetHandlers([]Handler{h})
+	bus.Publish("Old", metric.New("removed"))
+	bus.Publish("Added", metric.New("refreshed"))
+	bus.Close(time.Second)
+	assert.Equal(t, 0, len(old.Channel))
+	assert.Equal(t, "refreshed", (<-added.Channel).Name)
+}
+
+func BenchmarkBusPublish(b *testing.B) {
+	bus := NewBus(DefaultBusBufferSize)
+	var handlers []Handler
+	for i := 0; i < 3; i++ {
+		end := CollectorEnd{make(chan metric.Metric, 100), 100}
+		go func() {
+			for range end.Channel {
+			}
+		}()
+		handlers = append(handlers, getTestBusHandler("test", map[string]CollectorEnd{"Test": end}))
+	}
+	bus.SetHandlers(handlers)
+	m := metric.New("test")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bus.Publish("Test", m)
+	}
+	bus.Flush(time.Second)
+}
@@ -0,0 +1,112 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"sync"
+	"time"
+)
+
+// Modes converting cumulative counters for the backends without native support
+const (
+	CumulativeCounterDelta = "delta"
+	CumulativeCounterRate  = "rate"
+)
+
+// DefaultCumulativeCounterExpiry is how long (in seconds) we remember a
+// cumulative counter series that stopped reporting
+const DefaultCumulativeCounterExpiry = 600
+
+// how many times per expiry period the expired series are purged, they're
+// forgotten at most a tenth of the period after they expired
+const cumulativeCounterPurgesPerExpiry = 10
+
+// cumulativeCounterConverter turns the monotonically increasing values of
+// cumulative counters into the delta between two consecutive points of
+// a series, emitted as a counter, or into a per second rate, emitted as
+// a gauge. The first point of a series only sets the baseline and is
+// dropped. A value lower than the previous one means the counter was
+// reset, the new value is then the delta. The series collapsed by a
+// cardinality limit merge several counters, they are dropped.
+type cumulativeCounterConverter struct {
+	mode   string
+	expiry time.Duration
+
+	mu        sync.Mutex
+	series    map[string]cumulativeCounterPoint
+	lastPurge time.Time
+}
+
+type cumulativeCounterPoint struct {
+	value     float64
+	timestamp time.Time
+	seen      time.Time
+}
+
+func newCumulativeCounterConverter(mode string, expiry time.Duration) *cumulativeCounterConverter {
+	return &cumulativeCounterConverter{
+		mode:      mode,
+		expiry:    expiry,
+		series:    make(map[string]cumulativeCounterPoint),
+		lastPurge: time.Now(),
+	}
+}
+
+// convert returns the converted metric, or false if it has to be dropped.
+// Metrics which aren't cumulative counters are returned as they are.
+func (c *cumulativeCounterConverter) convert(m metric.Metric) (metric.Metric, bool) {
+	if m.MetricType != metric.CumulativeCounter {
+		return m, true
+	}
+	if m.Collapsed {
+		return m, false
+	}
+
+	now := time.Now()
+	timestamp := m.GetTimestamp()
+	key := m.SeriesKey()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.purge(now)
+
+	previous, exists := c.series[key]
+	c.series[key] = cumulativeCounterPoint{value: m.Value, timestamp: timestamp, seen: now}
+	if !exists {
+		return m, false
+	}
+
+	delta := m.Value - previous.value
+	if delta < 0 {
+		delta = m.Value
+	}
+
+	switch c.mode {
+	case CumulativeCounterRate:
+		elapsed := timestamp.Sub(previous.timestamp).Seconds()
+		if elapsed <= 0 {
+			return m, false
+		}
+		m.Value = delta / elapsed
+		m.MetricType = metric.Gauge
+	default:
+		m.Value = delta
+		m.MetricType = metric.Counter
+	}
+	return m, true
+}
+
+// purge forgets the series we haven't seen for longer than
+// the expiry, it runs at most cumulativeCounterPurgesPerExpiry times per
+// expiry period
+func (c *cumulativeCounterConverter) purge(now time.Time) {
+	if now.Sub(c.lastPurge) < c.expiry/cumulativeCounterPurgesPerExpiry {
+		return
+	}
+	for key, point := range c.series {
+		if now.Sub(point.seen) >= c.expiry {
+			delete(c.series, key)
+		}
+	}
+	c.lastPurge = now
+}
@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func cumulativeCounter(value float64, timestamp time.Time, dimensions map[string]string) metric.Metric {
+	m := metric.WithValue("requests", value)
+	m.MetricType = metric.CumulativeCounter
+	m.Timestamp = timestamp
+	m.AddDimensions(dimensions)
+	return m
+}
+
+func TestCumulativeCounterDelta(t *testing.T) {
+	c := newCumulativeCounterConverter(CumulativeCounterDelta, time.Minute)
+	start := time.Now()
+	dimensions := map[string]string{"a": "1", "b": "2"}
+
+	_, ok := c.convert(cumulativeCounter(100, start, dimensions))
+	assert.False(t, ok, "the first point is the baseline")
+
+	m, ok := c.convert(cumulativeCounter(130, start.Add(10*time.Second), map[string]string{"b": "2", "a": "1"}))
+	assert.True(t, ok)
+	assert.Equal(t, 30.0, m.Value)
+	assert.Equal(t, metric.Counter, m.MetricType)
+
+	// the counter was reset
+	m, ok = c.convert(cumulativeCounter(5, start.Add(20*time.Second), dimensions))
+	assert.True(t, ok)
+	assert.Equal(t, 5.0, m.Value)
+
+	_, ok = c.convert(cumulativeCounter(5, start, map[string]string{"a": "2"}))
+	assert.False(t, ok, "other dimensions are another series")
+
+	gauge := metric.WithValue("requests", 3)
+	m, ok = c.convert(gauge)
+	assert.True(t, ok)
+	assert.Equal(t, gauge, m)
+}
+
+func TestCumulativeCounterCollapsedSeries(t *testing.T) {
+	c := newCumulativeCounterConverter(CumulativeCounterDelta, time.Minute)
+	start := time.Now()
+	overflow := map[string]string{"request_id": metric.OverflowValue}
+	collapsed := func(value float64, timestamp time.Time) metric.Metric {
+		m := cumulativeCounter(value, timestamp, overflow)
+		m.Collapsed = true
+		return m
+	}
+
+	c.convert(collapsed(100, start))
+	_, ok := c.convert(collapsed(30, start.Add(10*time.Second)))
+	assert.False(t, ok, "no delta across the merged series")
+
+	c.convert(cumulativeCounter(100, start, overflow))
+	_, ok = c.convert(cumulativeCounter(130, start.Add(10*time.Second), overflow))
+	assert.True(t, ok, "only the collapsed series are dropped")
+}
+
+func TestCumulativeCounterRate(t *testing.T) {
+	c := newCumulativeCounterConverter(CumulativeCounterRate, time.Minute)
+	start := time.Now()
+
+	c.convert(cumulativeCounter(100, start, nil))
+	m, ok := c.convert(cumulativeCounter(150, start.Add(10*time.Second), nil))
+	assert.True(t, ok)
+	assert.Equal(t, 5.0, m.Value)
+	assert.Equal(t, metric.Gauge, m.MetricType)
+
+	_, ok = c.convert(cumulativeCounter(160, start.Add(10*time.Second), nil))
+	assert.False(t, ok, "no rate without elapsed time")
+}
+
+func TestCumulativeCounterExpiry(t *testing.T) {
+	c := newCumulativeCounterConverter(CumulativeCounterDelta, time.Minute)
+	c.convert(cumulativeCounter(100, time.Now(), nil))
+	assert.Len(t, c.series, 1)
+
+	// pretend the series and the last purge are older than the expiry
+	for key, point := range c.series {
+		point.seen = point.seen.Add(-2 * time.Minute)
+		c.series[key] = point
+	}
+	c.lastPurge = c.lastPurge.Add(-2 * time.Minute)
+
+	_, ok := c.convert(cumulativeCounter(200, time.Now(), nil))
+	assert.False(t, ok, "an expired series starts over")
+	assert.Len(t, c.series, 1)
+
+	// the series just expired, the last purge was a few seconds ago
+	for key, point := range c.series {
+		point.seen = point.seen.Add(-61 * time.Second)
+		c.series[key] = point
+	}
+	c.lastPurge = c.lastPurge.Add(-7 * time.Second)
+	c.convert(cumulativeCounter(300, time.Now(), map[string]string{"a": "1"}))
+	assert.Len(t, c.series, 1, "the expired series is forgotten before the next period")
+}
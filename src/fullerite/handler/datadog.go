@@ -5,6 +5,7 @@ import (
 
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -80,7 +81,7 @@ func (d Datadog) Endpoint() string {
 
 // Run runs the handler main loop
 func (d *Datadog) Run() {
-	d.run(d.emitMetrics)
+	d.runEmitter(d.emit)
 }
 
 func (d *Datadog) convertToDatadog(incomingMetric metric.Metric) (datapoint datadogMetric) {
@@ -89,10 +90,8 @@ func (d *Datadog) convertToDatadog(incomingMetric metric.Metric) (datapoint data
 	dog.Points = makeDatadogPoints(incomingMetric)
 	dog.MetricType = incomingMetric.MetricType
 
-	// first check the defaults
-	if host, ok := d.DefaultDimensions()["host"]; ok {
-		dog.Host = host
-	} else if host, ok := incomingMetric.GetDimensionValue("host"); ok {
+	// first check the defaults, forwarded metrics keep their host
+	if host, ok := incomingMetric.GetDimensions(d.DefaultDimensions())["host"]; ok {
 		dog.Host = host
 	} else {
 		dog.Host = "unknown"
@@ -103,11 +102,16 @@ func (d *Datadog) convertToDatadog(incomingMetric metric.Metric) (datapoint data
 }
 
 func (d *Datadog) emitMetrics(metrics []metric.Metric) bool {
+	return d.emit(metrics) == nil
+}
+
+// emit posts metrics to Datadog, the payloads it rejects aren't retried
+func (d *Datadog) emit(metrics []metric.Metric) error {
 	d.log.Info("Starting to emit ", len(metrics), " metrics")
 
 	if len(metrics) == 0 {
 		d.log.Warn("Skipping send because of an empty payload")
-		return false
+		return fatal(errors.New("empty payload"))
 	}
 
 	series := make([]datadogMetric, 0, len(metrics))
@@ -120,14 +124,14 @@ func (d *Datadog) emitMetrics(metrics []metric.Metric) bool {
 	if err != nil {
 		d.log.Error("Failed marshaling datapoints to Datadog format")
 		d.log.Error("Dropping Datadog datapoints ", series)
-		return false
+		return fatal(err)
 	}
 
 	apiURL := fmt.Sprintf("%s/series?api_key=%s", d.endpoint, d.apiKey)
 	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(payload))
 	if err != nil {
 		d.log.Error("Failed to create a request to endpoint ", d.endpoint)
-		return false
+		return fatal(err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
@@ -137,16 +141,18 @@ func (d *Datadog) emitMetrics(metrics []metric.Metric) bool {
 	client := &http.Client{
 		Transport: &transport,
 	}
+	// the transport only serves this request, don't leave its connection idle
+	defer transport.CloseIdleConnections()
 	rsp, err := client.Do(req)
 	if err != nil {
 		d.log.Error("Failed to complete POST ", err)
-		return false
+		return err
 	}
 
 	defer rsp.Body.Close()
 	if (rsp.StatusCode == http.StatusOK) || (rsp.StatusCode == http.StatusAccepted) {
 		d.log.Info("Successfully sent ", len(series), " datapoints to Datadog")
-		return true
+		return nil
 	}
 
 	body, _ := ioutil.ReadAll(rsp.Body)
@@ -154,7 +160,10 @@ func (d *Datadog) emitMetrics(metrics []metric.Metric) bool {
 		" status was ", rsp.Status,
 		" rsp body was ", string(body),
 		" payload was ", string(payload))
-	return false
+	if retryableStatus(rsp.StatusCode) {
+		return errors.New(rsp.Status)
+	}
+	return fatal(errors.New(rsp.Status))
 }
 
 func (d Datadog) dialTimeout(network, addr string) (net.Conn, error) {
@@ -169,6 +178,6 @@ func (d Datadog) serializedDimensions(m metric.Metric) (dimensions []string) {
 }
 
 func makeDatadogPoints(m metric.Metric) []datadogPoint {
-	point := datadogPoint{float64(time.Now().Unix()), m.Value}
+	point := datadogPoint{float64(m.GetTimestamp().Unix()), m.Value}
 	return []datadogPoint{point}
 }
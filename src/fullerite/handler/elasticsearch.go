@@ -0,0 +1,277 @@
+package handler
+
+import (
+	"fullerite/metric"
+	"fullerite/util"
+
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+func init() {
+	RegisterHandler("Elasticsearch", newElasticsearch)
+}
+
+// The defaults of the Elasticsearch handler
+const (
+	DefaultElasticsearchIndex    = "fullerite-%Y.%m.%d"
+	DefaultElasticsearchAttempts = 3
+	elasticsearchContentType     = "application/x-ndjson"
+	elasticsearchUserAgent       = "fullerite"
+	elasticsearchTimestampFormat = "2006-01-02T15:04:05.000Z07:00"
+)
+
+// Elasticsearch handler indexes the metrics in Elasticsearch, or
+// OpenSearch, with the bulk API. Every metric is a document of the index
+// named after its date.
+type Elasticsearch struct {
+	BaseHandler
+	endpoint   string
+	index      string
+	pipeline   string
+	username   string
+	password   string
+	apiKey     string
+	httpClient *util.HTTPAlive
+}
+
+// elasticsearchDocument is what a metric is indexed as
+type elasticsearchDocument struct {
+	Timestamp  string            `json:"@timestamp"`
+	Name       string            `json:"name"`
+	Value      float64           `json:"value"`
+	Type       string            `json:"type"`
+	Dimensions map[string]string `json:"dimensions,omitempty"`
+}
+
+// elasticsearchBulkResponse is the part of the response of the bulk API
+// telling which documents weren't indexed
+type elasticsearchBulkResponse struct {
+	Errors bool                               `json:"errors"`
+	Items  []map[string]elasticsearchBulkItem `json:"items"`
+}
+
+type elasticsearchBulkItem struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// newElasticsearch returns a new Elasticsearch handler
+func newElasticsearch(
+	channel chan metric.Metric,
+	initialInterval int,
+	initialBufferSize int,
+	initialTimeout time.Duration,
+	log *l.Entry) Handler {
+
+	inst := new(Elasticsearch)
+	inst.name = "Elasticsearch"
+
+	inst.interval = initialInterval
+	inst.maxBufferSize = initialBufferSize
+	inst.timeout = initialTimeout
+	inst.configureHTTPDefaults(DefaultElasticsearchAttempts)
+	inst.log = log
+	inst.channel = channel
+
+	inst.index = DefaultElasticsearchIndex
+	return inst
+}
+
+// Configure the Elasticsearch handler
+func (e *Elasticsearch) Configure(configMap map[string]interface{}) {
+	if endpoint, exists := configMap["endpoint"]; exists {
+		e.endpoint = strings.TrimSuffix(endpoint.(string), "/")
+	} else {
+		e.log.Error("There was no endpoint specified for the Elasticsearch handler, there won't be any emissions")
+	}
+	if index, exists := configMap["index"]; exists && index.(string) != "" {
+		e.index = index.(string)
+	}
+	if pipeline, exists := configMap["pipeline"]; exists {
+		e.pipeline = pipeline.(string)
+	}
+
+	if apiKey, exists := configMap["apiKey"]; exists {
+		e.apiKey = apiKey.(string)
+	}
+	if username, exists := configMap["username"]; exists {
+		e.username = username.(string)
+	}
+	if password, exists := configMap["password"]; exists {
+		e.password = password.(string)
+	}
+	if e.apiKey != "" && e.username != "" {
+		e.log.Warn("Both apiKey and username are set for the Elasticsearch handler, using the API key")
+	}
+
+	e.configureCommonParams(configMap)
+}
+
+// Endpoint returns the URL of the cluster
+func (e *Elasticsearch) Endpoint() string {
+	return e.endpoint
+}
+
+// Index returns the pattern of the index names
+func (e *Elasticsearch) Index() string {
+	return e.index
+}
+
+// Run runs the handler main loop
+func (e *Elasticsearch) Run() {
+	e.httpClient = e.newHTTPClient()
+	e.releaseOnStop(e.httpClient.Close)
+
+	e.runEmitter(e.emit)
+}
+
+// emit sends the metrics in a bulk request. The documents the cluster
+// failed to index are dropped, the requests rejected with a 4xx aren't
+// retried.
+func (e *Elasticsearch) emit(metrics []metric.Metric) error {
+	e.log.Info("Starting to emit ", len(metrics), " metrics")
+
+	if len(metrics) == 0 {
+		e.log.Warn("Skipping send because of an empty payload")
+		return fatal(errors.New("empty payload"))
+	}
+	if e.endpoint == "" {
+		e.log.Warn("Skipping emission because we're missing the endpoint")
+		return fatal(errors.New("missing endpoint"))
+	}
+
+	payload, sent := e.bulkRequest(metrics)
+	if sent == 0 {
+		return fatal(errors.New("no document to index"))
+	}
+
+	rsp, err := e.httpClient.MakeRequest("POST", e.bulkURL(), bytes.NewReader(payload), e.headers())
+	if err != nil {
+		e.log.Error("Failed to make request ", err, " to endpoint ", e.endpoint)
+		return err
+	}
+	if rsp.StatusCode/100 == 2 {
+		failed := e.handleBulkResponse(rsp.Body, sent)
+		return dropped(len(metrics)-sent+failed, nil)
+	}
+	return e.httpStatusError(e.endpoint, rsp)
+}
+
+// bulkURL returns the URL of the bulk API, with the ingest pipeline if
+// there's one
+func (e *Elasticsearch) bulkURL() string {
+	uri := e.endpoint + "/_bulk"
+	if e.pipeline != "" {
+		uri += "?pipeline=" + url.QueryEscape(e.pipeline)
+	}
+	return uri
+}
+
+// headers returns the bulk API headers and the ones authenticating the
+// request
+func (e *Elasticsearch) headers() map[string]string {
+	header := map[string]string{
+		"Content-Type": elasticsearchContentType,
+		"User-Agent":   elasticsearchUserAgent,
+	}
+	if e.apiKey != "" {
+		header["Authorization"] = "ApiKey " + e.apiKey
+	} else if e.username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(e.username + ":" + e.password))
+		header["Authorization"] = "Basic " + credentials
+	}
+	return header
+}
+
+// bulkRequest returns the NDJSON body of the bulk request and how many
+// documents it indexes. The values JSON can't represent are dropped.
+func (e *Elasticsearch) bulkRequest(metrics []metric.Metric) ([]byte, int) {
+	var buf bytes.Buffer
+	sent := 0
+	for _, m := range metrics {
+		if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			e.log.Debug("Dropping ", m.Name, " with value ", m.Value)
+			continue
+		}
+
+		timestamp := m.GetTimestamp().UTC()
+		action := map[string]map[string]string{
+			"index": {"_index": elasticsearchIndexName(e.index, timestamp)},
+		}
+		document := elasticsearchDocument{
+			Timestamp:  timestamp.Format(elasticsearchTimestampFormat),
+			Name:       e.Prefix() + m.Name,
+			Value:      m.Value,
+			Type:       m.MetricType,
+			Dimensions: m.GetDimensions(e.DefaultDimensions()),
+		}
+		encodedAction, err := json.Marshal(action)
+		if err != nil {
+			e.log.Error("Cannot encode ", m.Name, " ", err)
+			continue
+		}
+		encodedDocument, err := json.Marshal(document)
+		if err != nil {
+			e.log.Error("Cannot encode ", m.Name, " ", err)
+			continue
+		}
+		buf.Write(encodedAction)
+		buf.WriteByte('\n')
+		buf.Write(encodedDocument)
+		buf.WriteByte('\n')
+		sent++
+	}
+	return buf.Bytes(), sent
+}
+
+// handleBulkResponse returns how many documents the cluster failed to
+// index, they're dropped
+func (e *Elasticsearch) handleBulkResponse(body []byte, sent int) int {
+	response := new(elasticsearchBulkResponse)
+	if err := json.Unmarshal(body, response); err != nil {
+		e.log.Warn("Cannot parse the response of the bulk API ", err)
+	}
+	if !response.Errors {
+		e.log.Info("Successfully sent ", sent, " metrics to ", e.endpoint)
+		return 0
+	}
+
+	failed := 0
+	var firstError json.RawMessage
+	for _, item := range response.Items {
+		for _, result := range item {
+			if result.Status/100 == 2 {
+				continue
+			}
+			if failed == 0 {
+				firstError = result.Error
+			}
+			failed++
+		}
+	}
+	e.log.Error("Elasticsearch failed to index ", failed, " of ", sent, " documents, e.g. ", string(firstError))
+	return failed
+}
+
+// elasticsearchIndexName replaces the date fields of the pattern, %Y, %m,
+// %d and %H, with the ones of t
+func elasticsearchIndexName(pattern string, t time.Time) string {
+	if !strings.Contains(pattern, "%") {
+		return pattern
+	}
+	return strings.NewReplacer(
+		"%Y", t.Format("2006"),
+		"%m", t.Format("01"),
+		"%d", t.Format("02"),
+		"%H", t.Format("15"),
+	).Replace(pattern)
+}
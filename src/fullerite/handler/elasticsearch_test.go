@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"encoding/json"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getTestElasticsearchHandler(interval, buffsize, timeoutsec int) *Elasticsearch {
+	testChannel := make(chan metric.Metric)
+	testLog := l.WithField("testing", "elasticsearch_handler")
+	timeout := time.Duration(timeoutsec) * time.Second
+
+	return newElasticsearch(testChannel, interval, buffsize, timeout, testLog).(*Elasticsearch)
+}
+
+// getTestElasticsearchClient returns a handler posting to the cluster at
+// url
+func getTestElasticsearchClient(config map[string]interface{}, url string) *Elasticsearch {
+	config["endpoint"] = url + "/"
+	e := getTestElasticsearchHandler(12, 12, 12)
+	e.Configure(config)
+	e.httpClient = e.newHTTPClient()
+	return e
+}
+
+// parseBulkRequest returns the actions and the documents of the body
+func parseBulkRequest(t *testing.T, body string) ([]map[string]map[string]string, []map[string]interface{}) {
+	lines := strings.Split(body, "\n")
+	require.Equal(t, "", lines[len(lines)-1], "the body ends with a newline")
+	lines = lines[:len(lines)-1]
+	require.Equal(t, 0, len(lines)%2)
+
+	var actions []map[string]map[string]string
+	var documents []map[string]interface{}
+	for i := 0; i < len(lines); i += 2 {
+		var action map[string]map[string]string
+		require.Nil(t, json.Unmarshal([]byte(lines[i]), &action))
+		var document map[string]interface{}
+		require.Nil(t, json.Unmarshal([]byte(lines[i+1]), &document))
+		actions = append(actions, action)
+		documents = append(documents, document)
+	}
+	return actions, documents
+}
+
+func TestElasticsearchConfigureEmptyConfig(t *testing.T) {
+	e := getTestElasticsearchHandler(12, 13, 14)
+	e.Configure(map[string]interface{}{})
+
+	assert.Equal(t, 12, e.Interval())
+	assert.Equal(t, 13, e.MaxBufferSize())
+	assert.Equal(t, "", e.Endpoint())
+	assert.Equal(t, DefaultElasticsearchIndex, e.Index())
+	assert.Equal(t, "", e.pipeline)
+	assert.Equal(t, DefaultElasticsearchAttempts, e.maxEmissionAttempts)
+	assert.NotContains(t, e.headers(), "Authorization")
+}
+
+func TestElasticsearchConfigure(t *testing.T) {
+	e := getTestElasticsearchHandler(12, 13, 14)
+	e.Configure(map[string]interface{}{
+		"endpoint": "https://es.example.com:9200/",
+		"index":    "metrics-%Y.%m",
+		"pipeline": "fullerite",
+		"username": "fullerite",
+		"password": "secret",
+	})
+
+	assert.Equal(t, "https://es.example.com:9200", e.Endpoint())
+	assert.Equal(t, "metrics-%Y.%m", e.Index())
+	assert.Equal(t, "https://es.example.com:9200/_bulk?pipeline=fullerite", e.bulkURL())
+	assert.Equal(t, "Basic ZnVsbGVyaXRlOnNlY3JldA==", e.headers()["Authorization"])
+
+	e.Configure(map[string]interface{}{"endpoint": "http://localhost:9200", "apiKey": "a2V5"})
+	assert.Equal(t, "ApiKey a2V5", e.headers()["Authorization"], "the API key wins over the username")
+}
+
+func TestElasticsearchIndexName(t *testing.T) {
+	date := time.Date(2026, 10, 17, 8, 0, 0, 0, time.UTC)
+	assert.Equal(t, "fullerite-2026.10.17", elasticsearchIndexName(DefaultElasticsearchIndex, date))
+	assert.Equal(t, "metrics-2026-10-17-08", elasticsearchIndexName("metrics-%Y-%m-%d-%H", date))
+	assert.Equal(t, "metrics", elasticsearchIndexName("metrics", date))
+}
+
+func TestElasticsearchEmit(t *testing.T) {
+	ts, requests := newTestHTTPReceiver(t, []byte(`{"took": 3, "errors": false, "items": []}`), http.StatusOK)
+	defer ts.Close()
+	e := getTestElasticsearchClient(map[string]interface{}{
+		"pipeline": "enrich",
+		"apiKey":   "a2V5",
+	}, ts.URL)
+	e.SetPrefix("fullerite.")
+	e.SetDefaultDimensions(map[string]string{"region": "east"})
+
+	err := e.emit([]metric.Metric{
+		newTestMetric("load", metric.Gauge, 0.5, map[string]string{"host": "dev"}),
+		newTestMetric("load", metric.Gauge, math.NaN(), nil),
+	})
+	assert.Equal(t, 1, droppedCount(err), "NaN can't be indexed")
+
+	r := <-requests
+	assert.Equal(t, "POST", r.method)
+	assert.Equal(t, "/_bulk?pipeline=enrich", r.uri)
+	assert.Equal(t, elasticsearchContentType, r.header.Get("Content-Type"))
+	assert.Equal(t, "ApiKey a2V5", r.header.Get("Authorization"))
+
+	actions, documents := parseBulkRequest(t, string(r.body))
+	require.Len(t, actions, 1)
+	assert.Equal(t, map[string]map[string]string{"index": {"_index": "fullerite-2017.07.14"}}, actions[0])
+	assert.Equal(t, map[string]interface{}{
+		"@timestamp": "2017-07-14T02:40:00.000Z",
+		"name":       "fullerite.load",
+		"value":      0.5,
+		"type":       metric.Gauge,
+		"dimensions": map[string]interface{}{"host": "dev", "region": "east"},
+	}, documents[0])
+}
+
+func TestElasticsearchItemFailures(t *testing.T) {
+	ts, _ := newTestHTTPReceiver(t, []byte(`{
+		"took": 3,
+		"errors": true,
+		"items": [
+			{"index": {"_index": "fullerite-2017.07.14", "status": 201}},
+			{"index": {"_index": "fullerite-2017.07.14", "status": 400, "error": {"type": "mapper_parsing_exception"}}},
+			{"index": {"_index": "fullerite-2017.07.14", "status": 429, "error": {"type": "es_rejected_execution_exception"}}}
+		]
+	}`), http.StatusOK)
+	defer ts.Close()
+	e := getTestElasticsearchClient(map[string]interface{}{}, ts.URL)
+
+	err := e.emit([]metric.Metric{
+		newTestMetric("a", metric.Gauge, 1, nil),
+		newTestMetric("b", metric.Gauge, 2, nil),
+		newTestMetric("c", metric.Gauge, 3, nil),
+	})
+	assert.True(t, emitted(err), "the documents which were indexed aren't sent again")
+	assert.Equal(t, 2, droppedCount(err))
+}
+
+func TestElasticsearchErrors(t *testing.T) {
+	ts, _ := newTestHTTPReceiver(t, []byte(`{"error": "unauthorized"}`), http.StatusUnauthorized)
+	defer ts.Close()
+	e := getTestElasticsearchClient(map[string]interface{}{}, ts.URL)
+	err := e.emit([]metric.Metric{newTestMetric("a", metric.Gauge, 1, nil)})
+	assert.True(t, isFatal(err), "rejected requests aren't retried")
+
+	ts, _ = newTestHTTPReceiver(t, nil, http.StatusServiceUnavailable)
+	defer ts.Close()
+	e = getTestElasticsearchClient(map[string]interface{}{}, ts.URL)
+	err = e.emit([]metric.Metric{newTestMetric("a", metric.Gauge, 1, nil)})
+	assert.NotNil(t, err)
+	assert.False(t, isFatal(err))
+
+	e = getTestElasticsearchHandler(12, 13, 14)
+	e.Configure(map[string]interface{}{})
+	err = e.emit([]metric.Metric{newTestMetric("a", metric.Gauge, 1, nil)})
+	assert.True(t, isFatal(err), "nothing is sent without an endpoint")
+}
@@ -0,0 +1,131 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"sync"
+	"sync/atomic"
+)
+
+// What a handler does with a new batch when its emission queue is full
+const (
+	OverflowBlock      = "block"
+	OverflowDropNewest = "drop-newest"
+	OverflowDropOldest = "drop-oldest"
+)
+
+// Defaults bounding the emissions of the handlers
+const (
+	DefaultMaxConcurrentEmissions = 10
+	DefaultEmissionQueueSize      = 100
+	DefaultOverflowPolicy         = OverflowBlock
+)
+
+// the collector name reported for the metrics sent on the handler channel
+const defaultQueueCollector = "default"
+
+type emissionBatch struct {
+	collector string
+	metrics   []metric.Metric
+}
+
+// emissionQueue holds the batches flushed by the listeners of a handler
+// until one of its emission workers is free. When the queue is full the
+// listener either blocks, which in turn blocks the collectors feeding it,
+// or a batch is dropped so that a slow backend doesn't hold up the
+// collectors and through them the other handlers.
+type emissionQueue struct {
+	policy   string
+	batches  chan emissionBatch
+	inFlight int64
+
+	mu      sync.Mutex
+	dropped map[string]uint64
+}
+
+func newEmissionQueue(size int, policy string) *emissionQueue {
+	return &emissionQueue{
+		policy:  policy,
+		batches: make(chan emissionBatch, size),
+		dropped: make(map[string]uint64),
+	}
+}
+
+// push queues b following the overflow policy and returns
+// the batches dropped to do so
+func (q *emissionQueue) push(b emissionBatch) []emissionBatch {
+	switch q.policy {
+	case OverflowDropNewest:
+		select {
+		case q.batches <- b:
+			return nil
+		default:
+			return []emissionBatch{b}
+		}
+	case OverflowDropOldest:
+		var dropped []emissionBatch
+		for {
+			select {
+			case q.batches <- b:
+				return dropped
+			default:
+			}
+			// make room, other listeners may be pushing too
+			select {
+			case oldest := <-q.batches:
+				dropped = append(dropped, oldest)
+			default:
+			}
+		}
+	default:
+		q.batches <- b
+		return nil
+	}
+}
+
+// recordDrop accounts for the metrics of a collector we dropped
+func (q *emissionQueue) recordDrop(b emissionBatch) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.dropped[b.collector] += uint64(len(b.metrics))
+}
+
+// internalMetrics reports the depth of the queue, the emissions in flight
+// and the metrics dropped per collector, as "queueDropped.<collector>"
+func (q *emissionQueue) internalMetrics(counters map[string]float64, gauges map[string]float64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for collector, dropped := range q.dropped {
+		counters["queueDropped."+collector] = float64(dropped)
+	}
+	gauges["emissionQueueDepth"] = float64(len(q.batches))
+	gauges["emissionsInFlight"] = float64(atomic.LoadInt64(&q.inFlight))
+}
+
+// queueEmission hands the metrics flushed by the listener of a
+// collector over to the emission workers
+func (base *BaseHandler) queueEmission(tracker *emissionTracker, collector string, metrics []metric.Metric) {
+	if collector == "" {
+		collector = defaultQueueCollector
+	}
+	atomic.AddInt64(&tracker.pendingMetrics, int64(len(metrics)))
+	for _, b := range tracker.queue.push(emissionBatch{collector, metrics}) {
+		base.log.Warn("Emission queue full, dropping ", len(b.metrics), " metrics of ", b.collector)
+		tracker.queue.recordDrop(b)
+		atomic.AddUint64(&base.metricsDropped, uint64(len(b.metrics)))
+		atomic.AddInt64(&tracker.pendingMetrics, -int64(len(b.metrics)))
+	}
+}
+
+// emitQueued is an emission worker, it emits the queued
+// batches until the queue is closed
+func (base *BaseHandler) emitQueued(tracker *emissionTracker, emitFunc emitter) {
+	defer tracker.emissions.Done()
+	q := tracker.queue
+	for b := range q.batches {
+		atomic.AddInt64(&q.inFlight, 1)
+		base.timedEmit(b.metrics, emitFunc)
+		atomic.AddInt64(&q.inFlight, -1)
+		atomic.AddInt64(&tracker.pendingMetrics, -int64(len(b.metrics)))
+	}
+}
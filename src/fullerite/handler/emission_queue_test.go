@@ -0,0 +1,94 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"sync/atomic"
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func testBatch(collector string, name string) emissionBatch {
+	return emissionBatch{collector, []metric.Metric{metric.New(name)}}
+}
+
+func TestEmissionQueueDropNewest(t *testing.T) {
+	q := newEmissionQueue(1, OverflowDropNewest)
+
+	assert.Empty(t, q.push(testBatch("a", "first")))
+	dropped := q.push(testBatch("a", "second"))
+	assert.Equal(t, 1, len(dropped))
+	assert.Equal(t, "second", dropped[0].metrics[0].Name)
+	assert.Equal(t, "first", (<-q.batches).metrics[0].Name)
+}
+
+func TestEmissionQueueDropOldest(t *testing.T) {
+	q := newEmissionQueue(1, OverflowDropOldest)
+
+	assert.Empty(t, q.push(testBatch("a", "first")))
+	dropped := q.push(testBatch("a", "second"))
+	assert.Equal(t, 1, len(dropped))
+	assert.Equal(t, "first", dropped[0].metrics[0].Name)
+	assert.Equal(t, "second", (<-q.batches).metrics[0].Name)
+}
+
+func TestEmissionQueueInternalMetrics(t *testing.T) {
+	q := newEmissionQueue(2, OverflowBlock)
+	q.push(testBatch("a", "first"))
+	q.recordDrop(testBatch("a", "dropped"))
+	q.recordDrop(testBatch("b", "dropped"))
+	q.recordDrop(testBatch("b", "dropped"))
+
+	counters, gauges := map[string]float64{}, map[string]float64{}
+	q.internalMetrics(counters, gauges)
+	assert.Equal(t, 1.0, counters["queueDropped.a"])
+	assert.Equal(t, 2.0, counters["queueDropped.b"])
+	assert.Equal(t, 1.0, gauges["emissionQueueDepth"])
+	assert.Equal(t, 0.0, gauges["emissionsInFlight"])
+}
+
+func TestMaxConcurrentEmissions(t *testing.T) {
+	h := NewTest(make(chan metric.Metric), 1, 1, time.Second, l.WithField("testing", "queue")).(*Test)
+	h.Configure(map[string]interface{}{
+		"maxConcurrentEmissions": 1,
+		"emissionQueueSize":      1,
+		"overflowPolicy":         OverflowDropNewest,
+	})
+
+	var emissions, maxInFlight, inFlight int32
+	release := make(chan struct{})
+	emitFunc := func(metrics []metric.Metric) bool {
+		current := atomic.AddInt32(&inFlight, 1)
+		if current > atomic.LoadInt32(&maxInFlight) {
+			atomic.StoreInt32(&maxInFlight, current)
+		}
+		<-release
+		atomic.AddInt32(&inFlight, -1)
+		atomic.AddInt32(&emissions, 1)
+		return true
+	}
+	go h.run(emitFunc)
+
+	// one batch is emitted, one waits in the queue, the third is dropped
+	h.Channel() <- metric.New("first")
+	assert.Nil(t, waitFor(time.Second, func() bool {
+		return h.InternalMetrics().Gauges["emissionsInFlight"] == 1
+	}))
+	h.Channel() <- metric.New("second")
+	h.Channel() <- metric.New("third")
+	assert.Nil(t, waitFor(time.Second, func() bool {
+		return h.InternalMetrics().Counters["queueDropped.default"] == 1
+	}))
+	im := h.InternalMetrics()
+	assert.Equal(t, 1.0, im.Gauges["emissionQueueDepth"])
+	assert.Equal(t, 1.0, im.Counters["metricsDropped"])
+
+	close(release)
+	h.Stop()
+	assert.Equal(t, uint64(0), h.WaitForEmissions(time.Second))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&emissions))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&maxInFlight))
+}
@@ -0,0 +1,487 @@
+package handler
+
+import (
+	"fullerite/config"
+	"fullerite/metric"
+
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+func init() {
+	RegisterHandler("File", newFile)
+}
+
+// The encodings of the File handler
+const (
+	FileEncodingJSON     = "json"
+	FileEncodingGraphite = "graphite"
+	FileEncodingInflux   = "influx"
+)
+
+// When the File handler syncs its file to the disk
+const (
+	FileSyncNever  = "never"
+	FileSyncRotate = "rotate"
+	FileSyncBatch  = "batch"
+)
+
+// The defaults of the File handler
+const (
+	DefaultFileEncoding  = FileEncodingJSON
+	DefaultFileMaxSizeMB = 100
+	DefaultFileMaxFiles  = 10
+	DefaultFileSync      = FileSyncRotate
+
+	// rotated files are suffixed with the time of the rotation
+	fileRotationLayout = "20060102-150405"
+	fileGzipSuffix     = ".gz"
+)
+
+// File handler appends the metrics to a file, one per line, encoded as
+// JSON like the Log handler does, as Graphite plaintext or as Influx line
+// protocol. The file is rotated once it's too large or too old, the
+// rotated files are optionally compressed and the oldest ones removed.
+type File struct {
+	BaseHandler
+	path     string
+	encoding string
+
+	maxBytes       int64
+	rotateInterval time.Duration
+	compress       bool
+	maxFiles       int
+	maxAge         time.Duration
+	sync           string
+
+	// for the encodings shared with other handlers
+	graphite *Graphite
+	influx   *Influx
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+
+	// the rotated files are compressed, and the expired ones removed, in
+	// the background one rotation at a time
+	rotatedMu   sync.Mutex
+	compressing sync.WaitGroup
+}
+
+// newFile returns a new File handler
+func newFile(
+	channel chan metric.Metric,
+	initialInterval int,
+	initialBufferSize int,
+	initialTimeout time.Duration,
+	log *l.Entry) Handler {
+
+	inst := new(File)
+	inst.name = "File"
+
+	inst.interval = initialInterval
+	inst.maxBufferSize = initialBufferSize
+	inst.timeout = initialTimeout
+	inst.log = log
+	inst.channel = channel
+
+	inst.encoding = DefaultFileEncoding
+	inst.maxBytes = DefaultFileMaxSizeMB << 20
+	inst.maxFiles = DefaultFileMaxFiles
+	inst.sync = DefaultFileSync
+	inst.influx = newInflux(channel, initialInterval, initialBufferSize, initialTimeout, log).(*Influx)
+	inst.graphite = newGraphite(channel, initialInterval, initialBufferSize, initialTimeout, log).(*Graphite)
+	return inst
+}
+
+// Configure the File handler
+func (f *File) Configure(configMap map[string]interface{}) {
+	if path, exists := configMap["path"]; exists {
+		f.path = path.(string)
+	} else {
+		f.log.Error("There was no path specified for the File handler, there won't be any emissions")
+	}
+
+	if encoding, exists := configMap["encoding"]; exists {
+		switch e := fmt.Sprint(encoding); e {
+		case FileEncodingJSON, FileEncodingGraphite, FileEncodingInflux:
+			f.encoding = e
+		default:
+			f.log.Error("Unknown encoding ", e, ", using ", DefaultFileEncoding)
+		}
+	}
+	if precision, exists := configMap["precision"]; exists {
+		if _, ok := influxPrecisions[fmt.Sprint(precision)]; ok {
+			f.influx.precision = fmt.Sprint(precision)
+		} else {
+			f.log.Error("Unknown precision ", precision, ", using ", DefaultInfluxPrecision)
+		}
+	}
+
+	if maxSizeMB, exists := configMap["maxSizeMB"]; exists {
+		f.maxBytes = int64(config.GetAsInt(maxSizeMB, DefaultFileMaxSizeMB)) << 20
+	}
+	if rotateInterval, exists := configMap["rotateInterval"]; exists {
+		f.rotateInterval = time.Duration(config.GetAsInt(rotateInterval, 0)) * time.Second
+	}
+	if compress, exists := configMap["compress"]; exists {
+		f.compress = config.GetAsBool(compress, false)
+	}
+	if maxFiles, exists := configMap["maxFiles"]; exists {
+		f.maxFiles = config.GetAsInt(maxFiles, DefaultFileMaxFiles)
+	}
+	if maxAge, exists := configMap["maxAge"]; exists {
+		f.maxAge = time.Duration(config.GetAsInt(maxAge, 0)) * time.Second
+	}
+	if sync, exists := configMap["fsync"]; exists {
+		switch s := fmt.Sprint(sync); s {
+		case FileSyncNever, FileSyncRotate, FileSyncBatch:
+			f.sync = s
+		default:
+			f.log.Error("Unknown fsync ", s, ", using ", DefaultFileSync)
+		}
+	}
+
+	f.configureCommonParams(configMap)
+	f.SetDefaultDimensions(f.DefaultDimensions())
+}
+
+// SetPrefix : the prefix is also the one of the encodings shared with
+// other handlers
+func (f *File) SetPrefix(prefix string) {
+	f.BaseHandler.SetPrefix(prefix)
+	f.graphite.SetPrefix(prefix)
+	f.influx.SetPrefix(prefix)
+}
+
+// SetDefaultDimensions : the default dimensions are also the ones of the
+// encodings shared with other handlers
+func (f *File) SetDefaultDimensions(defaults map[string]string) {
+	f.BaseHandler.SetDefaultDimensions(defaults)
+	f.graphite.SetDefaultDimensions(defaults)
+	f.influx.SetDefaultDimensions(defaults)
+}
+
+// Path returns the path of the file the metrics are appended to
+func (f *File) Path() string {
+	return f.path
+}
+
+// Encoding returns how the metrics are written: json, graphite or influx
+func (f *File) Encoding() string {
+	return f.encoding
+}
+
+// Run runs the handler main loop
+func (f *File) Run() {
+	f.releaseOnStop(f.close)
+	f.runEmitter(f.emit)
+}
+
+// emit appends the metrics to the file, rotating it before if it's too
+// old and after if it's too large
+func (f *File) emit(metrics []metric.Metric) error {
+	f.log.Info("Starting to emit ", len(metrics), " metrics")
+
+	if len(metrics) == 0 {
+		f.log.Warn("Skipping send because of an empty payload")
+		return fatal(errors.New("empty payload"))
+	}
+	if f.path == "" {
+		f.log.Warn("Skipping emission because we're missing the path")
+		return fatal(errors.New("missing path"))
+	}
+
+	var payload bytes.Buffer
+	written := 0
+	for _, m := range metrics {
+		if f.encodeMetric(&payload, m) {
+			written++
+		}
+	}
+	if written == 0 {
+		f.log.Warn("Skipping send because of an empty payload")
+		return fatal(errors.New("empty payload"))
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.file != nil && f.rotateInterval > 0 && time.Since(f.openedAt) >= f.rotateInterval {
+		f.rotate()
+	}
+	if err := f.open(); err != nil {
+		f.log.Error("Cannot open ", f.path, ": ", err)
+		return err
+	}
+
+	// the lines of a batch which failed are removed, it's written again
+	// when it's retried
+	if _, err := f.file.Write(payload.Bytes()); err != nil {
+		f.log.Error("Cannot write to ", f.path, ": ", err)
+		f.truncate()
+		return err
+	}
+	if f.sync == FileSyncBatch {
+		if err := f.file.Sync(); err != nil {
+			f.log.Error("Cannot sync ", f.path, ": ", err)
+			f.truncate()
+			return err
+		}
+	}
+	f.size += int64(payload.Len())
+	f.log.Info("Successfully wrote ", written, " metrics to ", f.path)
+
+	if f.size >= f.maxBytes {
+		f.rotate()
+	}
+	return nil
+}
+
+// encodeMetric appends the line of m to buf, returns false if m can't be
+// written in the encoding
+func (f *File) encodeMetric(buf *bytes.Buffer, m metric.Metric) bool {
+	switch f.encoding {
+	case FileEncodingGraphite:
+		buf.WriteString(f.graphite.convertToGraphite(m))
+		return true
+	case FileEncodingInflux:
+		return f.influx.writeLine(buf, m)
+	}
+
+	line, err := Log{}.convertToLog(m)
+	if err != nil {
+		f.log.Error(fmt.Sprintf("Cannot convert metric %+v to JSON: %s", m, err))
+		return false
+	}
+	buf.WriteString(line)
+	buf.WriteByte('\n')
+	return true
+}
+
+// truncate removes what was written to the file since the last batch
+// written entirely, the file is closed if it can't. Must be called
+// holding mu.
+func (f *File) truncate() {
+	if err := f.file.Truncate(f.size); err != nil {
+		f.log.Error("Cannot remove the lines of the failed batch from ", f.path, ": ", err)
+		f.closeFile()
+	}
+}
+
+// open opens the file unless it's already open, the metrics are appended
+// to the file left by the previous run. Must be called holding mu.
+func (f *File) open() error {
+	if f.file != nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.openedAt = time.Now()
+	return nil
+}
+
+// rotate renames the file after the time of the rotation, compresses it
+// and removes the rotated files which aren't retained anymore, in the
+// background when compressing. The next emission opens a new file, or
+// appends to the same one if it couldn't be renamed. Must be called
+// holding mu.
+func (f *File) rotate() {
+	if err := f.closeFile(); err != nil {
+		f.log.Error("Cannot close ", f.path, ": ", err)
+	}
+
+	rotated := f.rotatedFileName(time.Now())
+	if err := os.Rename(f.path, rotated); err != nil {
+		f.log.Error("Cannot rotate ", f.path, ": ", err)
+		return
+	}
+	f.log.Info("Rotated ", f.path, " to ", rotated)
+
+	if !f.compress {
+		f.rotatedMu.Lock()
+		defer f.rotatedMu.Unlock()
+		f.removeExpired()
+		return
+	}
+	f.compressing.Add(1)
+	go func() {
+		defer f.compressing.Done()
+		f.rotatedMu.Lock()
+		defer f.rotatedMu.Unlock()
+		if err := f.gzipFile(rotated); err != nil {
+			f.log.Error("Cannot compress ", rotated, ": ", err)
+		}
+		f.removeExpired()
+	}()
+}
+
+// rotatedFileName returns <path>.<time of the rotation>, followed by a
+// sequence number higher than the one of the files rotated within the
+// same second, so that they stay in order
+func (f *File) rotatedFileName(now time.Time) string {
+	dir, base := filepath.Dir(f.path), filepath.Base(f.path)
+	rotatedAt := now.Format(fileRotationLayout)
+	entries, _ := ioutil.ReadDir(dir)
+
+	next := -1
+	for _, entry := range entries {
+		if at, seq, ok := parseRotatedFileName(base, entry.Name()); ok && at == rotatedAt && seq >= next {
+			next = seq + 1
+		}
+	}
+	if next < 0 {
+		return f.path + "." + rotatedAt
+	}
+	return fmt.Sprintf("%s.%s.%d", f.path, rotatedAt, next)
+}
+
+// gzipFile replaces path with path.gz
+func (f *File) gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// written aside and renamed so that a crash doesn't leave half a file
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+fileGzipSuffix)
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := gzip.NewWriter(out)
+	_, err = io.Copy(writer, bufio.NewReader(in))
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil && f.sync != FileSyncNever {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+fileGzipSuffix)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
+
+// removeExpired removes the oldest rotated files over maxFiles and the
+// ones older than maxAge. Must be called holding rotatedMu.
+func (f *File) removeExpired() {
+	dir, base := filepath.Dir(f.path), filepath.Base(f.path)
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		f.log.Error("Cannot list the rotated files of ", f.path, ": ", err)
+		return
+	}
+
+	var rotated []os.FileInfo
+	for _, entry := range entries {
+		if _, _, ok := parseRotatedFileName(base, entry.Name()); ok && !entry.IsDir() {
+			rotated = append(rotated, entry)
+		}
+	}
+	// newest first
+	sort.Slice(rotated, func(i, j int) bool {
+		iTime, iSeq, _ := parseRotatedFileName(base, rotated[i].Name())
+		jTime, jSeq, _ := parseRotatedFileName(base, rotated[j].Name())
+		if iTime != jTime {
+			return iTime > jTime
+		}
+		return iSeq > jSeq
+	})
+
+	for i, entry := range rotated {
+		tooMany := f.maxFiles > 0 && i >= f.maxFiles
+		tooOld := f.maxAge > 0 && time.Since(entry.ModTime()) > f.maxAge
+		if tooMany || tooOld {
+			path := filepath.Join(dir, entry.Name())
+			if err := os.Remove(path); err != nil {
+				f.log.Error("Cannot remove ", path, ": ", err)
+				continue
+			}
+			f.log.Info("Removed ", path)
+		}
+	}
+}
+
+// closeFile syncs the file, unless configured otherwise, and closes it.
+// Must be called holding mu.
+func (f *File) closeFile() error {
+	if f.file == nil {
+		return nil
+	}
+	file := f.file
+	f.file = nil
+	f.size = 0
+
+	var err error
+	if f.sync != FileSyncNever {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// close closes the file once the handler is stopped, and waits for the
+// rotated files to be compressed
+func (f *File) close() {
+	f.mu.Lock()
+	if err := f.closeFile(); err != nil {
+		f.log.Error("Cannot close ", f.path, ": ", err)
+	}
+	f.mu.Unlock()
+	f.compressing.Wait()
+}
+
+// parseRotatedFileName parses <base>.<time of the rotation>[.<seq>][.gz]
+func parseRotatedFileName(base string, name string) (rotatedAt string, seq int, ok bool) {
+	if !strings.HasPrefix(name, base+".") {
+		return "", 0, false
+	}
+	parts := strings.Split(strings.TrimSuffix(name[len(base)+1:], fileGzipSuffix), ".")
+	if _, err := time.Parse(fileRotationLayout, parts[0]); err != nil || len(parts) > 2 {
+		return "", 0, false
+	}
+	if len(parts) == 2 {
+		var err error
+		if seq, err = strconv.Atoi(parts[1]); err != nil {
+			return "", 0, false
+		}
+	}
+	return parts[0], seq, true
+}
@@ -0,0 +1,276 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getTestFileHandler(interval, buffsize, timeoutsec int) *File {
+	testChannel := make(chan metric.Metric)
+	testLog := l.WithField("testing", "file_handler")
+	timeout := time.Duration(timeoutsec) * time.Second
+
+	return newFile(testChannel, interval, buffsize, timeout, testLog).(*File)
+}
+
+// newTestFile returns a File handler writing to metrics.log in a new
+// directory, which the caller removes
+func newTestFile(t *testing.T, config map[string]interface{}) (*File, string) {
+	dir, err := ioutil.TempDir("", "fullerite-file")
+	require.Nil(t, err)
+	config["path"] = filepath.Join(dir, "metrics.log")
+
+	f := getTestFileHandler(12, 13, 14)
+	f.Configure(config)
+	return f, dir
+}
+
+func testFileMetric(name string, value float64) metric.Metric {
+	m := metric.WithValue(name, value)
+	m.Timestamp = time.Unix(1500000000, 0)
+	m.AddDimension("host", "dev")
+	return m
+}
+
+func readTestFile(t *testing.T, path string) []string {
+	contents, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	return strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+}
+
+// rotatedTestFiles returns the names of the rotated files, oldest first
+func rotatedTestFiles(t *testing.T, dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	var names []string
+	for _, entry := range entries {
+		if entry.Name() != "metrics.log" {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestFileConfigureEmptyConfig(t *testing.T) {
+	f := getTestFileHandler(12, 13, 14)
+	f.Configure(map[string]interface{}{})
+
+	assert.Equal(t, 12, f.Interval())
+	assert.Equal(t, 13, f.MaxBufferSize())
+	assert.Equal(t, "", f.Path())
+	assert.Equal(t, DefaultFileEncoding, f.Encoding())
+	assert.Equal(t, int64(DefaultFileMaxSizeMB<<20), f.maxBytes)
+	assert.Equal(t, time.Duration(0), f.rotateInterval)
+	assert.False(t, f.compress)
+	assert.Equal(t, DefaultFileMaxFiles, f.maxFiles)
+	assert.Equal(t, DefaultFileSync, f.sync)
+}
+
+func TestFileConfigure(t *testing.T) {
+	f := getTestFileHandler(12, 13, 14)
+	f.Configure(map[string]interface{}{
+		"path":           "/var/log/fullerite/metrics.log",
+		"encoding":       "influx",
+		"precision":      "ms",
+		"maxSizeMB":      "10",
+		"rotateInterval": 3600,
+		"compress":       true,
+		"maxFiles":       5,
+		"maxAge":         86400,
+		"fsync":          "batch",
+	})
+
+	assert.Equal(t, "/var/log/fullerite/metrics.log", f.Path())
+	assert.Equal(t, FileEncodingInflux, f.Encoding())
+	assert.Equal(t, InfluxPrecisionMilliseconds, f.influx.Precision())
+	assert.Equal(t, int64(10<<20), f.maxBytes)
+	assert.Equal(t, time.Hour, f.rotateInterval)
+	assert.True(t, f.compress)
+	assert.Equal(t, 5, f.maxFiles)
+	assert.Equal(t, 24*time.Hour, f.maxAge)
+	assert.Equal(t, FileSyncBatch, f.sync)
+}
+
+func TestFileConfigureUnknownValues(t *testing.T) {
+	f := getTestFileHandler(12, 13, 14)
+	f.Configure(map[string]interface{}{"encoding": "xml", "fsync": "always"})
+
+	assert.Equal(t, DefaultFileEncoding, f.Encoding())
+	assert.Equal(t, DefaultFileSync, f.sync)
+}
+
+func TestFileJSON(t *testing.T) {
+	f, dir := newTestFile(t, map[string]interface{}{})
+	defer os.RemoveAll(dir)
+	defer f.close()
+
+	m := testFileMetric("load", 0.5)
+	require.Nil(t, f.emit([]metric.Metric{m}))
+	require.Nil(t, f.emit([]metric.Metric{testFileMetric("load", 1)}))
+
+	lines := readTestFile(t, f.Path())
+	require.Len(t, lines, 2)
+	expected, _ := Log{}.convertToLog(m)
+	assert.Equal(t, expected, lines[0])
+
+	var parsed metric.Metric
+	require.Nil(t, json.Unmarshal([]byte(lines[1]), &parsed))
+	assert.Equal(t, 1.0, parsed.Value)
+}
+
+func TestFileGraphiteAndInflux(t *testing.T) {
+	f, dir := newTestFile(t, map[string]interface{}{"encoding": "graphite"})
+	defer os.RemoveAll(dir)
+	defer f.close()
+	f.SetPrefix("fullerite.")
+
+	require.Nil(t, f.emit([]metric.Metric{testFileMetric("load", 0.5)}))
+	assert.Equal(t, []string{"fullerite.load.host.dev 0.500000 1500000000"}, readTestFile(t, f.Path()))
+
+	g, dir := newTestFile(t, map[string]interface{}{"encoding": "influx"})
+	defer os.RemoveAll(dir)
+	defer g.close()
+	g.SetDefaultDimensions(map[string]string{"region": "east"})
+
+	require.Nil(t, g.emit([]metric.Metric{testFileMetric("load", 0.5)}))
+	assert.Equal(t, []string{"load,host=dev,region=east value=0.5 1500000000"}, readTestFile(t, g.Path()))
+}
+
+func TestFileAppendsToExistingFile(t *testing.T) {
+	f, dir := newTestFile(t, map[string]interface{}{"encoding": "graphite"})
+	defer os.RemoveAll(dir)
+	require.Nil(t, ioutil.WriteFile(f.Path(), []byte("before 1 1\n"), 0644))
+
+	require.Nil(t, f.emit([]metric.Metric{testFileMetric("after", 1)}))
+	f.close()
+	assert.Len(t, readTestFile(t, f.Path()), 2)
+}
+
+func TestFileRotatesOnSize(t *testing.T) {
+	f, dir := newTestFile(t, map[string]interface{}{"encoding": "graphite", "maxFiles": 2})
+	defer os.RemoveAll(dir)
+	defer f.close()
+	// every batch is larger than the limit
+	f.maxBytes = 10
+
+	for i := 0; i < 4; i++ {
+		require.Nil(t, f.emit([]metric.Metric{testFileMetric("load", float64(i))}))
+	}
+
+	rotated := rotatedTestFiles(t, dir)
+	require.Len(t, rotated, 2, "only maxFiles rotated files are kept")
+	assert.Equal(t, []string{"load.host.dev 3.000000 1500000000"}, readTestFile(t, filepath.Join(dir, rotated[1])))
+	_, err := os.Stat(f.Path())
+	assert.True(t, os.IsNotExist(err), "the next emission opens a new file")
+}
+
+func TestFileRotatesOnTime(t *testing.T) {
+	f, dir := newTestFile(t, map[string]interface{}{"rotateInterval": 3600})
+	defer os.RemoveAll(dir)
+	defer f.close()
+
+	require.Nil(t, f.emit([]metric.Metric{testFileMetric("first", 1)}))
+	require.Nil(t, f.emit([]metric.Metric{testFileMetric("second", 1)}))
+	assert.Empty(t, rotatedTestFiles(t, dir))
+
+	f.openedAt = time.Now().Add(-2 * time.Hour)
+	require.Nil(t, f.emit([]metric.Metric{testFileMetric("third", 1)}))
+	require.Len(t, rotatedTestFiles(t, dir), 1)
+	assert.Len(t, readTestFile(t, f.Path()), 1)
+}
+
+func TestFileCompressesRotatedFiles(t *testing.T) {
+	f, dir := newTestFile(t, map[string]interface{}{"encoding": "graphite", "compress": true})
+	defer os.RemoveAll(dir)
+	defer f.close()
+	f.maxBytes = 10
+
+	require.Nil(t, f.emit([]metric.Metric{testFileMetric("load", 1)}))
+	// compressed in the background
+	f.compressing.Wait()
+	rotated := rotatedTestFiles(t, dir)
+	require.Len(t, rotated, 1)
+	require.True(t, strings.HasSuffix(rotated[0], ".gz"))
+
+	compressed, err := os.Open(filepath.Join(dir, rotated[0]))
+	require.Nil(t, err)
+	defer compressed.Close()
+	reader, err := gzip.NewReader(compressed)
+	require.Nil(t, err)
+	contents, err := ioutil.ReadAll(reader)
+	require.Nil(t, err)
+	assert.Equal(t, "load.host.dev 1.000000 1500000000\n", string(contents))
+}
+
+func TestFileTruncatesFailedBatch(t *testing.T) {
+	f, dir := newTestFile(t, map[string]interface{}{"encoding": "graphite"})
+	defer os.RemoveAll(dir)
+	defer f.close()
+
+	require.Nil(t, f.emit([]metric.Metric{testFileMetric("first", 1)}))
+	// half of a batch which failed
+	_, err := f.file.Write([]byte("second.host.dev 2.0"))
+	require.Nil(t, err)
+	f.truncate()
+
+	require.Nil(t, f.emit([]metric.Metric{testFileMetric("second", 2)}))
+	assert.Equal(t, []string{
+		"first.host.dev 1.000000 1500000000",
+		"second.host.dev 2.000000 1500000000",
+	}, readTestFile(t, f.Path()))
+}
+
+func TestFileRemovesOldFiles(t *testing.T) {
+	f, dir := newTestFile(t, map[string]interface{}{"maxAge": 3600})
+	defer os.RemoveAll(dir)
+	defer f.close()
+
+	old := filepath.Join(dir, "metrics.log.20170101-000000")
+	require.Nil(t, ioutil.WriteFile(old, []byte("old\n"), 0644))
+	twoHoursAgo := time.Now().Add(-2 * time.Hour)
+	require.Nil(t, os.Chtimes(old, twoHoursAgo, twoHoursAgo))
+	unrelated := filepath.Join(dir, "metrics.log.lock")
+	require.Nil(t, ioutil.WriteFile(unrelated, nil, 0644))
+
+	f.maxBytes = 10
+	require.Nil(t, f.emit([]metric.Metric{testFileMetric("load", 1)}))
+
+	_, err := os.Stat(old)
+	assert.True(t, os.IsNotExist(err), "files older than maxAge are removed")
+	_, err = os.Stat(unrelated)
+	assert.Nil(t, err, "only the rotated files are removed")
+}
+
+func TestParseRotatedFileName(t *testing.T) {
+	rotatedAt, seq, ok := parseRotatedFileName("metrics.log", "metrics.log.20170101-000000.2.gz")
+	assert.True(t, ok)
+	assert.Equal(t, "20170101-000000", rotatedAt)
+	assert.Equal(t, 2, seq)
+
+	for _, invalid := range []string{"metrics.log", "metrics.log.lock", "other.log.20170101-000000", "metrics.log.20170101-000000.x"} {
+		_, _, ok := parseRotatedFileName("metrics.log", invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestFileWithoutPath(t *testing.T) {
+	f := getTestFileHandler(12, 13, 14)
+	f.Configure(map[string]interface{}{})
+
+	err := f.emit([]metric.Metric{testFileMetric("load", 1)})
+	assert.True(t, isFatal(err))
+}
@@ -0,0 +1,387 @@
+package handler
+
+import (
+	"fullerite/config"
+	"fullerite/forward"
+	"fullerite/metric"
+	"fullerite/util"
+
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+func init() {
+	RegisterHandler("Forward", newForward)
+}
+
+// The protocols of the Forward handler
+const (
+	ForwardProtocolTCP  = "tcp"
+	ForwardProtocolHTTP = "http"
+)
+
+// DefaultForwardAttempts is how many times a batch is sent by default
+const DefaultForwardAttempts = 3
+
+// Forward handler forwards the metrics to the ForwardReceiver collector of
+// another fullerite, e.g. an aggregator, which emits them as they were
+// collected: with their dimensions, the default ones of the handler
+// included, and their timestamps. Over TCP the connections are kept
+// between emissions, every batch is acknowledged.
+type Forward struct {
+	BaseHandler
+	server   string
+	port     string
+	protocol string
+	source   string
+	secret   string
+
+	useTLS             bool
+	caFile             string
+	certFile           string
+	keyFile            string
+	insecureSkipVerify bool
+	tlsConfig          *tls.Config
+	// misconfigured is set when the TLS files can't be loaded
+	misconfigured bool
+
+	conns      chan *forwardConn
+	httpClient *util.HTTPAlive
+}
+
+// forwardConn is a TCP connection the hello was sent on
+type forwardConn struct {
+	net.Conn
+	seq uint64
+}
+
+// newForward returns a new Forward handler
+func newForward(
+	channel chan metric.Metric,
+	initialInterval int,
+	initialBufferSize int,
+	initialTimeout time.Duration,
+	log *l.Entry) Handler {
+
+	inst := new(Forward)
+	inst.name = "Forward"
+
+	inst.interval = initialInterval
+	inst.maxBufferSize = initialBufferSize
+	inst.timeout = initialTimeout
+	inst.configureHTTPDefaults(DefaultForwardAttempts)
+	inst.log = log
+	inst.channel = channel
+
+	inst.port = forward.DefaultPort
+	inst.protocol = ForwardProtocolTCP
+	inst.source, _ = os.Hostname()
+	return inst
+}
+
+// Configure the Forward handler
+func (f *Forward) Configure(configMap map[string]interface{}) {
+	if server, exists := configMap["server"]; exists {
+		f.server = server.(string)
+	} else {
+		f.log.Error("There was no server specified for the Forward handler, there won't be any emissions")
+	}
+	if port, exists := configMap["port"]; exists {
+		f.port = fmt.Sprint(port)
+	}
+	if protocol, exists := configMap["protocol"]; exists {
+		switch p := fmt.Sprint(protocol); p {
+		case ForwardProtocolTCP, ForwardProtocolHTTP:
+			f.protocol = p
+		default:
+			f.log.Error("Unknown protocol ", p, ", using ", ForwardProtocolTCP)
+		}
+	}
+	if source, exists := configMap["source"]; exists && source.(string) != "" {
+		f.source = source.(string)
+	}
+	if secret, exists := configMap["secret"]; exists {
+		f.secret = secret.(string)
+	}
+
+	if useTLS, exists := configMap["tls"]; exists {
+		f.useTLS = config.GetAsBool(useTLS, false)
+	}
+	if caFile, exists := configMap["caFile"]; exists {
+		f.caFile = caFile.(string)
+	}
+	if certFile, exists := configMap["certFile"]; exists {
+		f.certFile = certFile.(string)
+	}
+	if keyFile, exists := configMap["keyFile"]; exists {
+		f.keyFile = keyFile.(string)
+	}
+	if insecureSkipVerify, exists := configMap["insecureSkipVerify"]; exists {
+		f.insecureSkipVerify = config.GetAsBool(insecureSkipVerify, false)
+	}
+	f.tlsConfig = nil
+	f.misconfigured = false
+	if f.useTLS {
+		tlsConfig, err := forward.ClientTLSConfig(f.caFile, f.certFile, f.keyFile, f.insecureSkipVerify)
+		if err != nil {
+			f.log.Error("Cannot load the TLS config of the Forward handler, there won't be any emissions: ", err)
+			f.misconfigured = true
+		}
+		f.tlsConfig = tlsConfig
+	}
+
+	f.configureCommonParams(configMap)
+
+	size := f.MaxIdleConnectionsPerHost()
+	if size <= 0 {
+		size = DefaultMaxIdleConnectionsPerHost
+	}
+	f.conns = make(chan *forwardConn, size)
+}
+
+// Server returns the name or IP of the receiver
+func (f *Forward) Server() string {
+	return f.server
+}
+
+// Port returns the port of the receiver
+func (f *Forward) Port() string {
+	return f.port
+}
+
+// Protocol returns the protocol used to forward the metrics: tcp or http
+func (f *Forward) Protocol() string {
+	return f.protocol
+}
+
+// Source returns what the handler tells the receiver it is
+func (f *Forward) Source() string {
+	return f.source
+}
+
+// Run runs the handler main loop
+func (f *Forward) Run() {
+	if f.conns == nil {
+		f.conns = make(chan *forwardConn, DefaultMaxIdleConnectionsPerHost)
+	}
+	f.httpClient = f.newHTTPClient()
+	if f.tlsConfig != nil {
+		f.httpClient.SetTLSConfig(f.tlsConfig)
+	}
+	f.releaseOnStop(f.closeConnections)
+	f.releaseOnStop(f.httpClient.Close)
+
+	f.runEmitter(f.emit)
+}
+
+// emit forwards the metrics in one batch. The metrics the receiver didn't
+// accept are dropped, a receiver refusing the secret isn't retried.
+func (f *Forward) emit(metrics []metric.Metric) error {
+	f.log.Info("Starting to emit ", len(metrics), " metrics")
+
+	if len(metrics) == 0 {
+		f.log.Warn("Skipping send because of an empty payload")
+		return fatal(errors.New("empty payload"))
+	}
+	if f.server == "" || f.misconfigured {
+		f.log.Warn("Skipping emission because we're missing the server or the TLS config")
+		return fatal(errors.New("missing server or TLS config"))
+	}
+
+	forwarded := f.convert(metrics)
+	if len(forwarded) == 0 {
+		return fatal(errors.New("no metric to forward"))
+	}
+
+	var accepted int
+	var err error
+	if f.protocol == ForwardProtocolHTTP {
+		accepted, err = f.post(forwarded)
+	} else {
+		accepted, err = f.send(forwarded)
+	}
+	if err != nil {
+		f.log.Error("Failed to forward ", len(forwarded), " metrics to ", f.address(), ": ", err)
+		return err
+	}
+	if accepted < len(forwarded) {
+		f.log.Error("The receiver accepted ", accepted, " of ", len(forwarded), " metrics")
+	} else {
+		f.log.Info("Successfully forwarded ", len(forwarded), " metrics to ", f.address())
+	}
+	return dropped(len(metrics)-accepted, nil)
+}
+
+// convert returns the metrics as they're forwarded: prefixed, with the
+// default dimensions. The values JSON can't represent are dropped.
+func (f *Forward) convert(metrics []metric.Metric) []metric.Metric {
+	forwarded := make([]metric.Metric, 0, len(metrics))
+	for _, m := range metrics {
+		if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+			f.log.Debug("Dropping ", m.Name, " with value ", m.Value)
+			continue
+		}
+		m.Name = f.Prefix() + m.Name
+		m.Dimensions = m.GetDimensions(f.DefaultDimensions())
+		forwarded = append(forwarded, m)
+	}
+	return forwarded
+}
+
+func (f *Forward) address() string {
+	return net.JoinHostPort(f.server, f.port)
+}
+
+// send forwards metrics over a pooled connection, a connection which fails
+// is closed and the next emission reconnects
+func (f *Forward) send(metrics []metric.Metric) (int, error) {
+	conn, reused, err := f.getConnection()
+	if err != nil {
+		return 0, err
+	}
+	accepted, err := f.sendBatch(conn, metrics)
+	if err != nil && reused && !isFatal(err) {
+		// the receiver may have closed the idle connection in the meantime
+		conn.Close()
+		if conn, err = f.dial(); err == nil {
+			accepted, err = f.sendBatch(conn, metrics)
+		}
+	}
+	if err != nil {
+		if conn != nil {
+			conn.Close()
+		}
+		return 0, err
+	}
+	f.putConnection(conn)
+	return accepted, nil
+}
+
+// sendBatch sends metrics and waits for the ack
+func (f *Forward) sendBatch(conn *forwardConn, metrics []metric.Metric) (int, error) {
+	conn.seq++
+	f.setDeadline(conn)
+	if err := forward.WriteMessage(conn, forward.NewBatch(conn.seq, metrics)); err != nil {
+		return 0, err
+	}
+	ack, err := forward.ReadAck(conn, conn.seq)
+	if err != nil {
+		return 0, err
+	}
+	if ack.Error != "" {
+		return 0, fatal(errors.New(ack.Error))
+	}
+	return ack.Accepted, nil
+}
+
+// getConnection returns an idle connection, or a new one if there is none
+func (f *Forward) getConnection() (conn *forwardConn, reused bool, err error) {
+	select {
+	case conn = <-f.conns:
+		return conn, true, nil
+	default:
+		conn, err = f.dial()
+		return conn, false, err
+	}
+}
+
+// dial connects to the receiver and says hello, a receiver refusing the
+// secret is a fatal error
+func (f *Forward) dial() (*forwardConn, error) {
+	dialer := &net.Dialer{Timeout: f.timeout}
+	var conn net.Conn
+	var err error
+	if f.tlsConfig != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", f.address(), f.tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", f.address())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	forwarded := &forwardConn{Conn: conn}
+	f.setDeadline(forwarded)
+	if err = forward.WriteMessage(forwarded, forward.NewHello(f.source, f.secret)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	ack, err := forward.ReadAck(forwarded, 0)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if ack.Error != "" {
+		conn.Close()
+		return nil, fatal(errors.New("the receiver refused the connection: " + ack.Error))
+	}
+	return forwarded, nil
+}
+
+func (f *Forward) setDeadline(conn *forwardConn) {
+	if f.timeout > 0 {
+		conn.SetDeadline(time.Now().Add(f.timeout))
+	}
+}
+
+// putConnection keeps conn for the next emissions, unless enough are idle
+func (f *Forward) putConnection(conn *forwardConn) {
+	select {
+	case f.conns <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (f *Forward) closeConnections() {
+	for {
+		select {
+		case conn := <-f.conns:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// post forwards metrics in an HTTP request, the requests rejected with a
+// 4xx aren't retried
+func (f *Forward) post(metrics []metric.Metric) (int, error) {
+	batch := forward.NewBatch(1, metrics)
+	batch.Source = f.source
+	batch.Secret = f.secret
+	payload, err := forward.Encode(batch)
+	if err != nil {
+		return 0, fatal(err)
+	}
+
+	scheme := "http"
+	if f.tlsConfig != nil {
+		scheme = "https"
+	}
+	uri := scheme + "://" + f.address() + forward.HTTPPath
+	header := map[string]string{"Content-Type": forward.ContentType}
+	rsp, err := f.httpClient.MakeRequest("POST", uri, bytes.NewReader(payload), header)
+	if err != nil {
+		return 0, err
+	}
+	if rsp.StatusCode == http.StatusOK {
+		ack, err := forward.Decode(rsp.Body)
+		if err != nil {
+			// the receiver got the batch, we can't tell how much of it
+			f.log.Warn("Cannot parse the ack of the receiver ", err)
+			return len(metrics), nil
+		}
+		return ack.Accepted, nil
+	}
+	return 0, f.httpStatusError(uri, rsp)
+}
@@ -0,0 +1,276 @@
+package handler
+
+import (
+	"fullerite/forward"
+	"fullerite/metric"
+	"fullerite/test_utils"
+
+	"crypto/tls"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getTestForwardHandler(interval, buffsize, timeoutsec int) *Forward {
+	testChannel := make(chan metric.Metric)
+	testLog := l.WithField("testing", "forward_handler")
+	timeout := time.Duration(timeoutsec) * time.Second
+
+	return newForward(testChannel, interval, buffsize, timeout, testLog).(*Forward)
+}
+
+// testForwardReceiver accepts connections, checks the hello against
+// secret and acks the batches, accepting all but drop of their metrics
+type testForwardReceiver struct {
+	ln       net.Listener
+	accepted chan string
+	batches  chan *forward.Message
+}
+
+func newTestForwardReceiver(t *testing.T, ln net.Listener, secret string, drop int) *testForwardReceiver {
+	r := &testForwardReceiver{ln, make(chan string, 10), make(chan *forward.Message, 10)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				hello, err := forward.ReadMessage(conn)
+				if !assert.Nil(t, err) {
+					return
+				}
+				r.accepted <- hello.Source
+				if !forward.Authenticate(secret, hello) {
+					forward.WriteMessage(conn, forward.NewAck(0, 0, assert.AnError))
+					return
+				}
+				forward.WriteMessage(conn, forward.NewAck(0, 0, nil))
+				for {
+					batch, err := forward.ReadMessage(conn)
+					if err != nil {
+						return
+					}
+					r.batches <- batch
+					forward.WriteMessage(conn, forward.NewAck(batch.Seq, len(batch.Metrics)-drop, nil))
+				}
+			}()
+		}
+	}()
+	return r
+}
+
+// getTestForwardReceiver returns a handler forwarding to a receiver
+func getTestForwardReceiver(t *testing.T, config map[string]interface{}, secret string, drop int) (*Forward, *testForwardReceiver) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	config["server"] = "127.0.0.1"
+	config["port"] = ln.Addr().(*net.TCPAddr).Port
+
+	f := getTestForwardHandler(12, 12, 12)
+	f.Configure(config)
+	return f, newTestForwardReceiver(t, ln, secret, drop)
+}
+
+func testForwardMetric(name string, value float64) metric.Metric {
+	m := metric.WithValue(name, value)
+	m.Timestamp = time.Unix(1500000000, 123456789)
+	m.AddDimension("collector", "CPUInfo")
+	return m
+}
+
+func TestForwardConfigureEmptyConfig(t *testing.T) {
+	f := getTestForwardHandler(12, 13, 14)
+	f.Configure(map[string]interface{}{})
+
+	assert.Equal(t, 12, f.Interval())
+	assert.Equal(t, 13, f.MaxBufferSize())
+	assert.Equal(t, "", f.Server())
+	assert.Equal(t, forward.DefaultPort, f.Port())
+	assert.Equal(t, ForwardProtocolTCP, f.Protocol())
+	hostname, _ := os.Hostname()
+	assert.Equal(t, hostname, f.Source())
+	assert.Nil(t, f.tlsConfig)
+	assert.Equal(t, DefaultForwardAttempts, f.maxEmissionAttempts)
+}
+
+func TestForwardConfigure(t *testing.T) {
+	f := getTestForwardHandler(12, 13, 14)
+	f.Configure(map[string]interface{}{
+		"server":             "aggregator.east",
+		"port":               3015,
+		"protocol":           "http",
+		"source":             "web1",
+		"secret":             "shared",
+		"tls":                true,
+		"insecureSkipVerify": "true",
+	})
+
+	assert.Equal(t, "aggregator.east", f.Server())
+	assert.Equal(t, "3015", f.Port())
+	assert.Equal(t, ForwardProtocolHTTP, f.Protocol())
+	assert.Equal(t, "web1", f.Source())
+	assert.Equal(t, "shared", f.secret)
+	require.NotNil(t, f.tlsConfig)
+	assert.True(t, f.tlsConfig.InsecureSkipVerify)
+}
+
+func TestForwardConfigureInvalidTLS(t *testing.T) {
+	f := getTestForwardHandler(12, 13, 14)
+	f.Configure(map[string]interface{}{
+		"server": "aggregator.east",
+		"tls":    true,
+		"caFile": "/nonexistent.pem",
+	})
+
+	err := f.emit([]metric.Metric{testForwardMetric("load", 1)})
+	assert.True(t, isFatal(err), "nothing is sent without the TLS config")
+}
+
+func TestForwardTCP(t *testing.T) {
+	f, r := getTestForwardReceiver(t, map[string]interface{}{"source": "web1", "secret": "shared"}, "shared", 0)
+	defer r.ln.Close()
+	defer f.closeConnections()
+	f.SetPrefix("fullerite.")
+	f.SetDefaultDimensions(map[string]string{"region": "east"})
+
+	sent := testForwardMetric("load", 0.5)
+	err := f.emit([]metric.Metric{sent, testForwardMetric("nan", math.NaN())})
+	assert.Equal(t, 1, droppedCount(err), "NaN can't be forwarded")
+	assert.Equal(t, "web1", <-r.accepted)
+	batch := <-r.batches
+	assert.Equal(t, uint64(1), batch.Seq)
+	metrics := batch.ToMetrics()
+	require.Len(t, metrics, 1)
+	assert.Equal(t, "fullerite.load", metrics[0].Name)
+	assert.Equal(t, map[string]string{"collector": "CPUInfo", "region": "east"}, metrics[0].Dimensions)
+	assert.True(t, sent.Timestamp.Equal(metrics[0].Timestamp))
+
+	require.Nil(t, f.emit([]metric.Metric{sent}))
+	assert.Equal(t, uint64(2), (<-r.batches).Seq, "the connection is kept")
+	assert.Empty(t, r.accepted)
+}
+
+func TestForwardTCPReconnects(t *testing.T) {
+	f, r := getTestForwardReceiver(t, map[string]interface{}{}, "", 0)
+	defer r.ln.Close()
+	defer f.closeConnections()
+
+	require.Nil(t, f.emit([]metric.Metric{testForwardMetric("load", 1)}))
+	<-r.batches
+	// the idle connection breaks
+	conn := <-f.conns
+	conn.Close()
+	f.putConnection(conn)
+
+	require.Nil(t, f.emit([]metric.Metric{testForwardMetric("load", 1)}))
+	assert.Equal(t, uint64(1), (<-r.batches).Seq, "a new connection numbers its batches from 1")
+}
+
+func TestForwardPartiallyAccepted(t *testing.T) {
+	f, r := getTestForwardReceiver(t, map[string]interface{}{}, "", 1)
+	defer r.ln.Close()
+	defer f.closeConnections()
+
+	err := f.emit([]metric.Metric{testForwardMetric("a", 1), testForwardMetric("b", 2)})
+	assert.True(t, emitted(err))
+	assert.Equal(t, 1, droppedCount(err))
+}
+
+func TestForwardWrongSecret(t *testing.T) {
+	f, r := getTestForwardReceiver(t, map[string]interface{}{"secret": "guess"}, "shared", 0)
+	defer r.ln.Close()
+
+	err := f.emit([]metric.Metric{testForwardMetric("load", 1)})
+	assert.True(t, isFatal(err), "a refused secret isn't retried")
+}
+
+func TestForwardTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fullerite-forward")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, err := test_utils.WriteSelfSignedCertificate(dir)
+	require.Nil(t, err)
+	serverConfig, err := forward.ServerTLSConfig(certFile, keyFile, certFile)
+	require.Nil(t, err)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	require.Nil(t, err)
+	r := newTestForwardReceiver(t, ln, "", 0)
+	defer ln.Close()
+
+	f := getTestForwardHandler(12, 12, 12)
+	f.Configure(map[string]interface{}{
+		"server":   "127.0.0.1",
+		"port":     ln.Addr().(*net.TCPAddr).Port,
+		"tls":      true,
+		"caFile":   certFile,
+		"certFile": certFile,
+		"keyFile":  keyFile,
+	})
+	defer f.closeConnections()
+
+	require.Nil(t, f.emit([]metric.Metric{testForwardMetric("load", 1)}))
+	assert.Len(t, (<-r.batches).Metrics, 1)
+}
+
+func TestForwardHTTP(t *testing.T) {
+	batches := make(chan *forward.Message, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, forward.HTTPPath, r.URL.Path)
+		assert.Equal(t, forward.ContentType, r.Header.Get("Content-Type"))
+		payload, err := ioutil.ReadAll(r.Body)
+		assert.Nil(t, err)
+		batch, err := forward.Decode(payload)
+		if !assert.Nil(t, err) {
+			return
+		}
+		batches <- batch
+		if batch.Secret != "shared" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		ack, _ := forward.Encode(forward.NewAck(batch.Seq, len(batch.Metrics), nil))
+		w.Write(ack)
+	}))
+	defer ts.Close()
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(ts.URL, "http://"))
+	require.Nil(t, err)
+
+	f := getTestForwardHandler(12, 12, 12)
+	f.Configure(map[string]interface{}{
+		"server":   host,
+		"port":     port,
+		"protocol": "http",
+		"source":   "web1",
+		"secret":   "shared",
+	})
+	f.httpClient = f.newHTTPClient()
+
+	require.Nil(t, f.emit([]metric.Metric{testForwardMetric("load", 1)}))
+	batch := <-batches
+	assert.Equal(t, "web1", batch.Source)
+	assert.Len(t, batch.Metrics, 1)
+
+	f.secret = "guess"
+	err = f.emit([]metric.Metric{testForwardMetric("load", 1)})
+	assert.True(t, isFatal(err), "rejected requests aren't retried")
+}
+
+func TestForwardWithoutServer(t *testing.T) {
+	f := getTestForwardHandler(12, 13, 14)
+	f.Configure(map[string]interface{}{})
+
+	err := f.emit([]metric.Metric{testForwardMetric("load", 1)})
+	assert.True(t, isFatal(err))
+}
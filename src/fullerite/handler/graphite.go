@@ -1,16 +1,51 @@
 package handler
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"fullerite/metric"
 	"fullerite/util"
 	"net"
+	"regexp"
 	"sort"
+	"strings"
 	"time"
 
 	l "github.com/Sirupsen/logrus"
 )
 
+// Protocols the Graphite handler speaks to carbon
+const (
+	GraphiteProtocolTCP    = "tcp"
+	GraphiteProtocolUDP    = "udp"
+	GraphiteProtocolPickle = "pickle"
+)
+
+// How the Graphite handler names the series
+const (
+	// name.key1.value1.key2.value2, the dimensions sorted by key
+	GraphiteFormatPath = "path"
+	// name;key1=value1;key2=value2, Graphite 1.1 tagged series
+	GraphiteFormatTagged = "tagged"
+	// pathTemplate, e.g. {host}.{collector}.{name}
+	GraphiteFormatTemplate = "template"
+)
+
+// the value of the template nodes whose dimension the metric doesn't have
+const graphiteMissingNode = "unknown"
+
+var graphiteTemplateNode = regexp.MustCompile(`\{([^{}]+)\}`)
+
+const (
+	// how long an idle connection is probed for before it's reused
+	graphiteProbeTimeout = time.Millisecond
+	// keeps the datagrams under the usual MTU
+	graphiteMaxDatagramSize = 1432
+	// datapoints per pickle message, carbon caps their size
+	graphitePickleBatchSize = 500
+)
+
 func init() {
 	RegisterHandler("Graphite", newGraphite)
 }
@@ -18,8 +53,14 @@ func init() {
 // Graphite type
 type Graphite struct {
 	BaseHandler
-	server string
-	port   string
+	server       string
+	port         string
+	protocol     string
+	format       string
+	pathTemplate string
+
+	// idle connections, reused by the next emissions
+	conns chan net.Conn
 }
 
 // allowedPunctation: taken here https://github.com/dropwizard/metrics/issues/637
@@ -41,6 +82,8 @@ func newGraphite(
 	inst.timeout = initialTimeout
 	inst.log = log
 	inst.channel = channel
+	inst.protocol = GraphiteProtocolTCP
+	inst.format = GraphiteFormatPath
 
 	return inst
 }
@@ -55,6 +98,16 @@ func (g Graphite) Port() string {
 	return g.port
 }
 
+// Protocol returns the protocol used to send the metrics: tcp, udp or pickle
+func (g Graphite) Protocol() string {
+	return g.protocol
+}
+
+// Format returns how the series are named: path, tagged or template
+func (g Graphite) Format() string {
+	return g.format
+}
+
 // Configure accepts the different configuration options for the Graphite handler
 func (g *Graphite) Configure(configMap map[string]interface{}) {
 	if server, exists := configMap["server"]; exists {
@@ -68,29 +121,110 @@ func (g *Graphite) Configure(configMap map[string]interface{}) {
 	} else {
 		g.log.Error("There was no port specified for the Graphite Handler, there won't be any emissions")
 	}
+
+	if protocol, exists := configMap["protocol"]; exists {
+		switch p := fmt.Sprint(protocol); p {
+		case GraphiteProtocolTCP, GraphiteProtocolUDP, GraphiteProtocolPickle:
+			g.protocol = p
+		default:
+			g.log.Error("Unknown protocol ", p, ", using ", GraphiteProtocolTCP)
+		}
+	}
+
+	if pathTemplate, exists := configMap["pathTemplate"]; exists {
+		g.pathTemplate = fmt.Sprint(pathTemplate)
+	}
+	if format, exists := configMap["format"]; exists {
+		switch f := fmt.Sprint(format); f {
+		case GraphiteFormatPath, GraphiteFormatTagged:
+			g.format = f
+		case GraphiteFormatTemplate:
+			if g.pathTemplate == "" {
+				g.log.Error("No pathTemplate specified, using the ", GraphiteFormatPath, " format")
+				break
+			}
+			g.format = f
+		default:
+			g.log.Error("Unknown format ", f, ", using ", GraphiteFormatPath)
+		}
+	}
 	g.configureCommonParams(configMap)
+
+	size := g.MaxIdleConnectionsPerHost()
+	if size <= 0 {
+		size = DefaultMaxIdleConnectionsPerHost
+	}
+	g.conns = make(chan net.Conn, size)
 }
 
 // Run runs the handler main loop
 func (g *Graphite) Run() {
-	g.run(g.emitMetrics)
+	if g.conns == nil {
+		g.conns = make(chan net.Conn, DefaultMaxIdleConnectionsPerHost)
+	}
+	g.releaseOnStop(g.closeConnections)
+	g.runEmitter(g.emit)
 }
 
 func (g Graphite) convertToGraphite(incomingMetric metric.Metric) (datapoint string) {
+	return fmt.Sprintf("%s %f %d\n", g.graphitePath(incomingMetric), incomingMetric.Value, incomingMetric.GetTimestamp().Unix())
+}
+
+// graphitePath names the series of the metric according to the format
+func (g Graphite) graphitePath(incomingMetric metric.Metric) (path string) {
+	dimensions := g.getSanitizedDimensions(incomingMetric)
+	name := g.Prefix() + graphiteSanitize(incomingMetric.Name)
+
+	switch g.format {
+	case GraphiteFormatTagged:
+		return graphiteTaggedPath(name, dimensions)
+	case GraphiteFormatTemplate:
+		return graphiteTemplatePath(g.pathTemplate, name, dimensions)
+	}
+
 	//orders dimensions so datapoint keeps consistent name
 	var keys []string
-	dimensions := g.getSanitizedDimensions(incomingMetric)
 	for k := range dimensions {
 		keys = append(keys, k)
 	}
 	sort.Strings(keys)
 
-	datapoint = g.Prefix() + graphiteSanitize(incomingMetric.Name)
+	path = name
+	for _, key := range keys {
+		path = fmt.Sprintf("%s.%s.%s", path, key, dimensions[key])
+	}
+	return path
+}
+
+// graphiteTaggedPath returns name;key1=value1;key2=value2 with the tags
+// sorted by key
+func graphiteTaggedPath(name string, dimensions map[string]string) string {
+	var keys []string
+	for k := range dimensions {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	path := graphiteTagSanitize(name)
 	for _, key := range keys {
-		datapoint = fmt.Sprintf("%s.%s.%s", datapoint, key, dimensions[key])
+		path += ";" + graphiteTagSanitize(key) + "=" + graphiteTagSanitize(dimensions[key])
 	}
-	datapoint = fmt.Sprintf("%s %f %d\n", datapoint, incomingMetric.Value, time.Now().Unix())
-	return datapoint
+	return path
+}
+
+// graphiteTemplatePath replaces the {name} and {dimension} nodes of
+// template, the dimensions which aren't in the template are dropped
+func graphiteTemplatePath(template string, name string, dimensions map[string]string) string {
+	return graphiteTemplateNode.ReplaceAllStringFunc(template, func(node string) string {
+		key := graphiteSanitize(node[1 : len(node)-1])
+		if key == "name" {
+			return name
+		}
+		if value, exists := dimensions[key]; exists {
+			return value
+		}
+		return graphiteMissingNode
+	})
 }
 
 func (g Graphite) getSanitizedDimensions(incomingMetric metric.Metric) map[string]string {
@@ -103,26 +237,183 @@ func (g Graphite) getSanitizedDimensions(incomingMetric metric.Metric) map[strin
 }
 
 func (g *Graphite) emitMetrics(metrics []metric.Metric) bool {
+	return g.emit(metrics) == nil
+}
+
+// emit sends metrics over a pooled connection. A connection which fails
+// is closed and the next emission reconnects. The metrics which were
+// written before a failure aren't sent again.
+func (g *Graphite) emit(metrics []metric.Metric) error {
 	g.log.Info("Starting to emit ", len(metrics), " metrics")
 
 	if len(metrics) == 0 {
 		g.log.Warn("Skipping send because of an empty payload")
-		return false
+		return fatal(errors.New("empty payload"))
 	}
 
-	addr := fmt.Sprintf("%s:%s", g.server, g.port)
-	conn, err := net.DialTimeout("tcp", addr, g.timeout)
+	conn, reused, err := g.getConnection()
+	if err != nil {
+		g.log.Error("Failed to connect ", g.address(), ": ", err)
+		return err
+	}
+	sent, err := g.write(conn, metrics)
+	if err != nil && reused {
+		// carbon may have closed the idle connection in the meantime
+		conn.Close()
+		if conn, _, err = g.dial(); err == nil {
+			var resent int
+			resent, err = g.write(conn, metrics[sent:])
+			sent += resent
+		}
+	}
 	if err != nil {
-		g.log.Error("Failed to connect ", addr)
-		return false
+		g.log.Error("Failed to send ", len(metrics)-sent, " of ", len(metrics), " metrics to ", g.address(), ": ", err)
+		if conn != nil {
+			conn.Close()
+		}
+		return partial(sent, err)
 	}
+	g.putConnection(conn)
+	return nil
+}
+
+func (g *Graphite) address() string {
+	return net.JoinHostPort(g.server, g.port)
+}
 
+// getConnection returns an idle connection, or a new one if there is none
+// or if carbon closed it
+func (g *Graphite) getConnection() (conn net.Conn, reused bool, err error) {
+	select {
+	case conn = <-g.conns:
+		if g.protocol != GraphiteProtocolUDP && !graphiteConnectionOpen(conn) {
+			conn.Close()
+			return g.dial()
+		}
+		return conn, true, nil
+	default:
+		return g.dial()
+	}
+}
+
+// graphiteConnectionOpen tells if the other end didn't close conn: carbon
+// never writes, so reading times out unless it closed it. Otherwise the
+// first write to a closed connection succeeds and its data is lost.
+func graphiteConnectionOpen(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(graphiteProbeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	_, err := conn.Read(make([]byte, 1))
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func (g *Graphite) dial() (net.Conn, bool, error) {
+	network := "tcp"
+	if g.protocol == GraphiteProtocolUDP {
+		network = "udp"
+	}
+	conn, err := net.DialTimeout(network, g.address(), g.timeout)
+	return conn, false, err
+}
+
+// putConnection keeps conn for the next emissions, unless enough are idle
+func (g *Graphite) putConnection(conn net.Conn) {
+	select {
+	case g.conns <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (g *Graphite) closeConnections() {
+	for {
+		select {
+		case conn := <-g.conns:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// write sends metrics over conn in the configured protocol, it returns
+// how many of them were written entirely
+func (g *Graphite) write(conn net.Conn, metrics []metric.Metric) (int, error) {
+	if g.timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(g.timeout))
+	}
+
+	if g.protocol == GraphiteProtocolUDP {
+		// one datagram holds as many lines as fit
+		var datagram bytes.Buffer
+		sent := 0
+		for i, m := range metrics {
+			line := g.convertToGraphite(m)
+			if datagram.Len() > 0 && datagram.Len()+len(line) > graphiteMaxDatagramSize {
+				if _, err := conn.Write(datagram.Bytes()); err != nil {
+					return sent, err
+				}
+				datagram.Reset()
+				sent = i
+			}
+			datagram.WriteString(line)
+		}
+		if _, err := conn.Write(datagram.Bytes()); err != nil {
+			return sent, err
+		}
+		return len(metrics), nil
+	}
+
+	// ends[i] is where the payload of metrics[i] ends, the end of its
+	// message for pickle
+	var payload bytes.Buffer
+	ends := make([]int, len(metrics))
+	if g.protocol == GraphiteProtocolPickle {
+		for start := 0; start < len(metrics); start += graphitePickleBatchSize {
+			end := start + graphitePickleBatchSize
+			if end > len(metrics) {
+				end = len(metrics)
+			}
+			payload.Write(g.convertToPickle(metrics[start:end]))
+			for i := start; i < end; i++ {
+				ends[i] = payload.Len()
+			}
+		}
+	} else {
+		for i, m := range metrics {
+			payload.WriteString(g.convertToGraphite(m))
+			ends[i] = payload.Len()
+		}
+	}
+
+	written, err := conn.Write(payload.Bytes())
+	if err != nil {
+		return sort.SearchInts(ends, written+1), err
+	}
+	return len(metrics), nil
+}
+
+// convertToPickle encodes metrics as a message of the carbon pickle
+// protocol: the length of the payload followed by a pickled list of
+// (path, (timestamp, value)) tuples
+func (g Graphite) convertToPickle(metrics []metric.Metric) []byte {
+	datapoints := make([]pickleDatapoint, 0, len(metrics))
 	for _, m := range metrics {
-		fmt.Fprintf(conn, g.convertToGraphite(m))
+		datapoints = append(datapoints, pickleDatapoint{
+			path:      g.graphitePath(m),
+			timestamp: m.GetTimestamp().Unix(),
+			value:     m.Value,
+		})
 	}
-	return true
+	return pickleMessage(datapoints)
 }
 
 func graphiteSanitize(value string) string {
 	return util.StrSanitize(value, false, allowedPunctuation)
 }
+
+// graphiteTagSanitize replaces the separator of the tags, which
+// graphiteSanitize allows, in names and values it already sanitized
+func graphiteTagSanitize(value string) string {
+	return strings.Replace(value, ";", "_", -1)
+}
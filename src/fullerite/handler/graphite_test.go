@@ -3,6 +3,14 @@ package handler
 import (
 	"fullerite/metric"
 
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
 	"strings"
 	"testing"
 	"time"
@@ -90,3 +98,349 @@ func TestGraphiteSanitation(t *testing.T) {
 
 	assert.Equal(t, strings.Split(datapoint1, " ")[0], datapoint2, "the two metrics should be the same")
 }
+
+func TestGraphiteUsesMetricTimestamp(t *testing.T) {
+	g := getTestGraphiteHandler(12, 12, 12)
+
+	m := metric.WithValue("test", 1.0)
+	m.Timestamp = time.Unix(1500000000, 0)
+
+	assert.Equal(t, "test 1.000000 1500000000\n", g.convertToGraphite(m))
+}
+
+// fakeCarbon accepts plaintext or pickle connections and
+// forwards the datapoints it receives as plaintext lines
+type fakeCarbon struct {
+	listener    net.Listener
+	lines       chan string
+	connections chan net.Conn
+}
+
+func newFakeCarbon(t *testing.T, pickle bool) *fakeCarbon {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	c := &fakeCarbon{listener, make(chan string, 100), make(chan net.Conn, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			c.connections <- conn
+			if pickle {
+				go c.readPickle(t, conn)
+			} else {
+				go c.readLines(conn)
+			}
+		}
+	}()
+	return c
+}
+
+func (c *fakeCarbon) readLines(conn net.Conn) {
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		c.lines <- scanner.Text()
+	}
+}
+
+func (c *fakeCarbon) readPickle(t *testing.T, conn net.Conn) {
+	for {
+		var length uint32
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return
+		}
+		datapoints, err := unpickleDatapoints(payload)
+		assert.Nil(t, err)
+		for _, d := range datapoints {
+			c.lines <- fmt.Sprintf("%s %f %d", d.path, d.value, d.timestamp)
+		}
+	}
+}
+
+func (c *fakeCarbon) port() string {
+	return fmt.Sprint(c.listener.Addr().(*net.TCPAddr).Port)
+}
+
+func (c *fakeCarbon) expectLines(t *testing.T, expected ...string) {
+	for _, line := range expected {
+		select {
+		case received := <-c.lines:
+			assert.Equal(t, line, received)
+		case <-time.After(2 * time.Second):
+			t.Fatal("carbon didn't receive ", line)
+		}
+	}
+}
+
+// unpickleDatapoints decodes the opcodes written by pickleMessage
+func unpickleDatapoints(payload []byte) (datapoints []pickleDatapoint, err error) {
+	var stack []interface{}
+	for i := 0; i < len(payload); {
+		op := payload[i]
+		i++
+		switch op {
+		case pickleProto:
+			i++
+		case pickleEmptyList, pickleMark, pickleAppends:
+		case pickleBinUnicode:
+			n := int(binary.LittleEndian.Uint32(payload[i:]))
+			stack = append(stack, string(payload[i+4:i+4+n]))
+			i += 4 + n
+		case pickleBinInt:
+			stack = append(stack, int64(int32(binary.LittleEndian.Uint32(payload[i:]))))
+			i += 4
+		case pickleLong1:
+			stack = append(stack, int64(binary.LittleEndian.Uint64(payload[i+1:])))
+			i += 1 + int(payload[i])
+		case pickleBinFloat:
+			stack = append(stack, math.Float64frombits(binary.BigEndian.Uint64(payload[i:])))
+			i += 8
+		case pickleTuple2:
+			n := len(stack)
+			stack = append(stack[:n-2], []interface{}{stack[n-2], stack[n-1]})
+			if path, ok := stack[len(stack)-1].([]interface{})[0].(string); ok {
+				point := stack[len(stack)-1].([]interface{})[1].([]interface{})
+				datapoints = append(datapoints, pickleDatapoint{path, point[0].(int64), point[1].(float64)})
+				stack = stack[:len(stack)-1]
+			}
+		case pickleStop:
+			return datapoints, nil
+		default:
+			return nil, fmt.Errorf("unexpected opcode %x", op)
+		}
+	}
+	return nil, fmt.Errorf("missing stop opcode")
+}
+
+func getTestGraphiteForCarbon(port string, protocol string) *Graphite {
+	g := getTestGraphiteHandler(12, 12, 1)
+	g.Configure(map[string]interface{}{
+		"server":   "127.0.0.1",
+		"port":     port,
+		"protocol": protocol,
+	})
+	return g
+}
+
+func testGraphiteMetric(name string, value float64) metric.Metric {
+	m := metric.WithValue(name, value)
+	m.Timestamp = time.Unix(1500000000, 0)
+	return m
+}
+
+func TestGraphiteConfigureProtocol(t *testing.T) {
+	g := getTestGraphiteHandler(12, 13, 14)
+	g.Configure(map[string]interface{}{})
+	assert.Equal(t, GraphiteProtocolTCP, g.Protocol())
+
+	g.Configure(map[string]interface{}{"protocol": "pickle"})
+	assert.Equal(t, GraphiteProtocolPickle, g.Protocol())
+
+	g.Configure(map[string]interface{}{"protocol": "carrier pigeon"})
+	assert.Equal(t, GraphiteProtocolPickle, g.Protocol())
+}
+
+func TestGraphiteReusesConnection(t *testing.T) {
+	carbon := newFakeCarbon(t, false)
+	defer carbon.listener.Close()
+	g := getTestGraphiteForCarbon(carbon.port(), GraphiteProtocolTCP)
+	defer g.closeConnections()
+
+	assert.True(t, g.emitMetrics([]metric.Metric{testGraphiteMetric("first", 1)}))
+	assert.True(t, g.emitMetrics([]metric.Metric{testGraphiteMetric("second", 2)}))
+	carbon.expectLines(t, "first 1.000000 1500000000", "second 2.000000 1500000000")
+	assert.Equal(t, 1, len(carbon.connections))
+}
+
+func TestGraphiteReconnects(t *testing.T) {
+	carbon := newFakeCarbon(t, false)
+	defer carbon.listener.Close()
+	g := getTestGraphiteForCarbon(carbon.port(), GraphiteProtocolTCP)
+	defer g.closeConnections()
+
+	assert.True(t, g.emitMetrics([]metric.Metric{testGraphiteMetric("first", 1)}))
+	carbon.expectLines(t, "first 1.000000 1500000000")
+	(<-carbon.connections).Close()
+	time.Sleep(10 * time.Millisecond)
+
+	// the first write to the closed connection would succeed
+	assert.True(t, g.emitMetrics([]metric.Metric{testGraphiteMetric("second", 2)}))
+	carbon.expectLines(t, "second 2.000000 1500000000")
+	assert.Equal(t, 1, len(carbon.connections))
+}
+
+// brokenConn accepts size bytes, then fails
+type brokenConn struct {
+	net.Conn
+	size    int
+	written bytes.Buffer
+}
+
+func (c *brokenConn) Write(b []byte) (int, error) {
+	if c.written.Len()+len(b) <= c.size {
+		return c.written.Write(b)
+	}
+	n, _ := c.written.Write(b[:c.size-c.written.Len()])
+	return n, errors.New("broken pipe")
+}
+
+func (c *brokenConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func TestGraphiteWritePartially(t *testing.T) {
+	g := getTestGraphiteForCarbon("2003", GraphiteProtocolTCP)
+	metrics := []metric.Metric{
+		testGraphiteMetric("first", 1),
+		testGraphiteMetric("second", 2),
+		testGraphiteMetric("third", 3),
+	}
+	line := len(g.convertToGraphite(metrics[0]))
+
+	conn := &brokenConn{size: line + 3}
+	sent, err := g.write(conn, metrics)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, sent, "the second line was cut")
+
+	conn = &brokenConn{size: 1 << 20}
+	sent, err = g.write(conn, metrics)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, sent)
+
+	g.protocol = GraphiteProtocolPickle
+	conn = &brokenConn{size: 10}
+	sent, err = g.write(conn, metrics)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, sent, "the pickle message was cut")
+}
+
+func TestGraphiteWriteErrors(t *testing.T) {
+	carbon := newFakeCarbon(t, false)
+	carbon.listener.Close()
+	g := getTestGraphiteForCarbon(carbon.port(), GraphiteProtocolTCP)
+
+	err := g.emit([]metric.Metric{testGraphiteMetric("test", 1)})
+	assert.NotNil(t, err)
+	assert.False(t, isFatal(err), "carbon being down is worth retrying")
+}
+
+func TestGraphiteUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer conn.Close()
+	g := getTestGraphiteForCarbon(fmt.Sprint(conn.LocalAddr().(*net.UDPAddr).Port), GraphiteProtocolUDP)
+	defer g.closeConnections()
+
+	metrics := []metric.Metric{}
+	for i := 0; i < 100; i++ {
+		metrics = append(metrics, testGraphiteMetric(fmt.Sprintf("test%d", i), float64(i)))
+	}
+	assert.True(t, g.emitMetrics(metrics))
+
+	var lines []string
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(lines) < 100 {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, n <= graphiteMaxDatagramSize)
+		lines = append(lines, strings.Split(strings.TrimSpace(string(buf[:n])), "\n")...)
+	}
+	assert.Equal(t, "test0 0.000000 1500000000", lines[0])
+	assert.Equal(t, "test99 99.000000 1500000000", lines[99])
+}
+
+func TestGraphitePickle(t *testing.T) {
+	carbon := newFakeCarbon(t, true)
+	defer carbon.listener.Close()
+	g := getTestGraphiteForCarbon(carbon.port(), GraphiteProtocolPickle)
+	defer g.closeConnections()
+
+	metrics := []metric.Metric{testGraphiteMetric("first", 1)}
+	second := testGraphiteMetric("second", 2.5)
+	second.AddDimension("host", "dev")
+	metrics = append(metrics, second)
+	assert.True(t, g.emitMetrics(metrics))
+
+	carbon.expectLines(t, "first 1.000000 1500000000", "second.host.dev 2.500000 1500000000")
+}
+
+func TestGraphitePickleMessage(t *testing.T) {
+	var metrics []metric.Metric
+	for i := 0; i < graphitePickleBatchSize+1; i++ {
+		metrics = append(metrics, testGraphiteMetric("test", float64(i)))
+	}
+	g := getTestGraphiteHandler(12, 12, 12)
+
+	message := g.convertToPickle(metrics)
+	assert.Equal(t, uint32(len(message)-4), binary.BigEndian.Uint32(message))
+	datapoints, err := unpickleDatapoints(message[4:])
+	assert.Nil(t, err)
+	assert.Equal(t, len(metrics), len(datapoints))
+	assert.Equal(t, pickleDatapoint{"test", 1500000000, 500}, datapoints[500])
+}
+
+func TestGraphiteTaggedFormat(t *testing.T) {
+	g := getTestGraphiteHandler(12, 12, 12)
+	g.SetPrefix("fullerite.")
+	g.Configure(map[string]interface{}{"format": "tagged"})
+	assert.Equal(t, GraphiteFormatTagged, g.Format())
+
+	m := testGraphiteMetric("cpu usage", 1)
+	m.AddDimension("host", "dev.box")
+	m.AddDimension("collector", "Cpu")
+	m.AddDimension("semi", "a;b")
+	m.AddDimension("empty", "")
+
+	assert.Equal(t, "fullerite.cpu_usage;collector=Cpu;empty=null;host=dev_box;semi=a_b 1.000000 1500000000\n",
+		g.convertToGraphite(m))
+}
+
+func TestGraphiteTemplateFormat(t *testing.T) {
+	g := getTestGraphiteHandler(12, 12, 12)
+	g.Configure(map[string]interface{}{
+		"format":       "template",
+		"pathTemplate": "servers.{host}.{collector}.{name}",
+	})
+	assert.Equal(t, GraphiteFormatTemplate, g.Format())
+
+	m := testGraphiteMetric("load.1m", 1)
+	m.AddDimension("host", "dev.box")
+	m.AddDimension("collector", "Load")
+	m.AddDimension("dropped", "value")
+	assert.Equal(t, "servers.dev_box.Load.load_1m 1.000000 1500000000\n", g.convertToGraphite(m))
+
+	m = testGraphiteMetric("load.1m", 1)
+	assert.Equal(t, "servers.unknown.unknown.load_1m 1.000000 1500000000\n", g.convertToGraphite(m))
+}
+
+func TestGraphiteTemplateFormatNeedsTemplate(t *testing.T) {
+	g := getTestGraphiteHandler(12, 12, 12)
+	g.Configure(map[string]interface{}{"format": "template"})
+	assert.Equal(t, GraphiteFormatPath, g.Format())
+}
+
+func TestGraphiteTaggedPickle(t *testing.T) {
+	carbon := newFakeCarbon(t, true)
+	defer carbon.listener.Close()
+	g := getTestGraphiteHandler(12, 12, 1)
+	g.Configure(map[string]interface{}{
+		"server":   "127.0.0.1",
+		"port":     carbon.port(),
+		"protocol": "pickle",
+		"format":   "tagged",
+	})
+	defer g.closeConnections()
+
+	m := testGraphiteMetric("test", 1)
+	m.AddDimension("host", "dev")
+	assert.True(t, g.emitMetrics([]metric.Metric{m}))
+	carbon.expectLines(t, "test;host=dev 1.000000 1500000000")
+}
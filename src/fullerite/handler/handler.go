@@ -7,7 +7,9 @@ import (
 	"sync/atomic"
 
 	"container/list"
+	"context"
 	"fmt"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -21,6 +23,7 @@ const (
 	DefaultTimeoutSec                = 2
 	DefaultMaxIdleConnectionsPerHost = 2
 	DefaultKeepAliveInterval         = 30
+	DefaultMaxSeriesWindow           = 600
 )
 
 var defaultLog = l.WithFields(l.Fields{"app": "fullerite", "pkg": "handler"})
@@ -68,6 +71,10 @@ type Handler interface {
 	Configure(map[string]interface{})
 	InitListeners(config.Config)
 
+	// UpdateListeners adds and removes collector endpoints
+	// of a running handler after the config was reloaded
+	UpdateListeners(config.Config)
+
 	// InternalMetrics is to publish a set of values
 	// that are relevant to the handler itself.
 	InternalMetrics() metric.InternalMetrics
@@ -114,6 +121,47 @@ type Handler interface {
 	// takes care of reporting emission metrics
 	OverrideBaseEmissionMetricsReporter()
 	UseCustomEmissionMetricsReporter() bool
+
+	// Start ties the handler to ctx, the handler is
+	// stopped once ctx is cancelled
+	Start(context.Context)
+
+	// Stop asks the handler to flush whatever it has
+	// buffered and to stop reading metrics
+	Stop()
+
+	// Done is closed once the handler is asked to stop
+	Done() <-chan struct{}
+
+	// WaitForEmissions waits for the outstanding emissions
+	// and returns how many metrics were still pending when
+	// the timeout expired
+	WaitForEmissions(time.Duration) uint64
+}
+
+// emissionTracker keeps track of the listeners of a handler and of
+// the emissions they started, so that we can flush and wait for them
+// when the handler is stopped.
+type emissionTracker struct {
+	quit     chan struct{}
+	stopOnce sync.Once
+	// closed once the emissions completed and the
+	// resources of the handler were released
+	stopped chan struct{}
+
+	listeners      sync.WaitGroup
+	emissions      sync.WaitGroup
+	pendingMetrics int64
+
+	// set once the handler runs or stops, guarded by mu
+	stopping     bool
+	emitFunc     emitter
+	endpointQuit map[string]chan struct{}
+	releases     []func()
+	queue        *emissionQueue
+
+	// created with the tracker, once the handler is configured
+	breaker *circuitBreaker
 }
 
 type emissionTiming struct {
@@ -165,6 +213,34 @@ type BaseHandler struct {
 	// List of whitelisted collectors
 	// the handler will accept metrics from
 	whiteListedCollectors map[string]bool
+
+	// Lazily created by emissionTracker()
+	tracker *emissionTracker
+
+	// Converts cumulative counters when the backend
+	// doesn't support them, nil otherwise
+	cumulativeCounters *cumulativeCounterConverter
+
+	// Caps the number of series sent to the backend, nil if unlimited
+	cardinalityLimiter *metric.CardinalityLimiter
+
+	// Keeps the batches which failed to be emitted until they
+	// can be replayed, nil if spooling is disabled
+	spool *spool
+
+	// for retrying failed emissions, zero values mean the defaults
+	maxEmissionAttempts     int
+	retryBackoff            time.Duration
+	retryMaxBackoff         time.Duration
+	circuitBreakerThreshold int
+	circuitBreakerTimeout   time.Duration
+	emissionRetries         uint64
+
+	// bounds the emissions in flight and the batches waiting
+	// for one, zero values mean the defaults
+	maxConcurrentEmissions int
+	emissionQueueSize      int
+	overflowPolicy         string
 }
 
 // SetMaxBufferSize : set the buffer size
@@ -198,15 +274,20 @@ func (base *BaseHandler) Channel() chan metric.Metric {
 
 // CollectorEndpoints : the channels to handler listens for metrics on
 func (base *BaseHandler) CollectorEndpoints() map[string]CollectorEnd {
+	mu.Lock()
+	defer mu.Unlock()
 	return base.collectorEndpoints
 }
 
 // SetCollectorEndpoints : the channels to handler listens for metrics on
 func (base *BaseHandler) SetCollectorEndpoints(c map[string]CollectorEnd) {
-	base.collectorEndpoints = make(map[string]CollectorEnd)
+	collectorEndpoints := make(map[string]CollectorEnd)
 	for name, colInfo := range c {
-		base.collectorEndpoints[name] = colInfo
+		collectorEndpoints[name] = colInfo
 	}
+	mu.Lock()
+	defer mu.Unlock()
+	base.collectorEndpoints = collectorEndpoints
 }
 
 // OverrideBaseEmissionMetricsReporter : Do not report emissionTiming metrics in the base handler
@@ -299,6 +380,42 @@ func (base *BaseHandler) MaxIdleConnectionsPerHost() int {
 
 // InitListeners - initiate listener channels for collectors
 func (base *BaseHandler) InitListeners(globalConfig config.Config) {
+	collectorEndpoints := base.collectorEndpointsFor(globalConfig)
+	fmt.Println(collectorEndpoints)
+	base.SetCollectorEndpoints(collectorEndpoints)
+}
+
+// UpdateListeners : starts listening to the collectors added to the config
+// and stops (flushing their buffer) the listeners of the removed ones.
+// Endpoints of collectors that are still configured are left untouched.
+// No metric must be written to the handler while this is running.
+func (base *BaseHandler) UpdateListeners(globalConfig config.Config) {
+	wanted := base.collectorEndpointsFor(globalConfig)
+	tracker := base.emissionTracker()
+
+	mu.Lock()
+	defer mu.Unlock()
+	current := base.collectorEndpoints
+
+	collectorEndpoints := make(map[string]CollectorEnd)
+	for name, end := range wanted {
+		if existing, exists := current[name]; exists {
+			collectorEndpoints[name] = existing
+			continue
+		}
+		collectorEndpoints[name] = end
+		base.startListener(tracker, name, end)
+	}
+	for name := range current {
+		if _, exists := wanted[name]; !exists {
+			base.stopListener(tracker, name)
+		}
+	}
+	base.collectorEndpoints = collectorEndpoints
+}
+
+// collectorEndpointsFor returns the endpoints that we want for globalConfig
+func (base *BaseHandler) collectorEndpointsFor(globalConfig config.Config) map[string]CollectorEnd {
 	collectorEndpoints := make(map[string]CollectorEnd)
 	for _, c := range append(globalConfig.Collectors, globalConfig.DiamondCollectors...) {
 
@@ -325,8 +442,7 @@ func (base *BaseHandler) InitListeners(globalConfig config.Config) {
 			getCollectorBatchSize(c, globalConfig, base.MaxBufferSize()),
 		}
 	}
-	fmt.Println(collectorEndpoints)
-	base.SetCollectorEndpoints(collectorEndpoints)
+	return collectorEndpoints
 }
 
 // GetEmissionTimesLen returns base.emissionTimes.Len thread-safe
@@ -366,9 +482,9 @@ func (base *BaseHandler) InternalMetrics() metric.InternalMetrics {
 	mu.Lock()
 	defer mu.Unlock()
 	counters := map[string]float64{
-		"totalEmissions": float64(base.totalEmissions),
-		"metricsDropped": float64(base.metricsDropped),
-		"metricsSent":    float64(base.metricsSent),
+		"totalEmissions": float64(atomic.LoadUint64(&base.totalEmissions)),
+		"metricsDropped": float64(atomic.LoadUint64(&base.metricsDropped)),
+		"metricsSent":    float64(atomic.LoadUint64(&base.metricsSent)),
 	}
 	gauges := map[string]float64{
 		"intervalLength":    float64(base.interval),
@@ -393,6 +509,28 @@ func (base *BaseHandler) InternalMetrics() metric.InternalMetrics {
 		gauges["maxEmissionTiming"] = max
 	}
 
+	if base.tracker != nil {
+		counters["emissionRetries"] = float64(atomic.LoadUint64(&base.emissionRetries))
+		base.tracker.breaker.internalMetrics(counters, gauges)
+		if base.tracker.queue != nil {
+			base.tracker.queue.internalMetrics(counters, gauges)
+		}
+	}
+
+	if base.spool != nil {
+		base.spool.internalMetrics(counters, gauges)
+	}
+
+	if base.cardinalityLimiter != nil {
+		limits := base.cardinalityLimiter.InternalMetrics()
+		for name, value := range limits.Counters {
+			counters[name] = value
+		}
+		for name, value := range limits.Gauges {
+			gauges[name] = value
+		}
+	}
+
 	return metric.InternalMetrics{
 		Counters: counters,
 		Gauges:   gauges,
@@ -440,26 +578,291 @@ func (base *BaseHandler) configureCommonParams(configMap map[string]interface{})
 		whiteList := config.GetAsSlice(asInterface)
 		base.SetCollectorWhiteList(whiteList)
 	}
+
+	if asInterface, exists := configMap["cumulativeCounterMode"]; exists {
+		expiry := DefaultCumulativeCounterExpiry
+		if asInterface, exists := configMap["cumulativeCounterExpiry"]; exists {
+			expiry = config.GetAsInt(asInterface, DefaultCumulativeCounterExpiry)
+		}
+		switch mode := fmt.Sprint(asInterface); mode {
+		case CumulativeCounterDelta, CumulativeCounterRate:
+			base.cumulativeCounters = newCumulativeCounterConverter(mode, time.Duration(expiry)*time.Second)
+		default:
+			base.log.Error("Unknown cumulativeCounterMode ", mode)
+		}
+	}
+
+	if asInterface, exists := configMap["maxSeries"]; exists {
+		window := DefaultMaxSeriesWindow
+		if asInterface, exists := configMap["maxSeriesWindow"]; exists {
+			window = config.GetAsInt(asInterface, DefaultMaxSeriesWindow)
+		}
+		overflow := false
+		if asInterface, exists := configMap["maxSeriesOverflow"]; exists {
+			overflow = config.GetAsBool(asInterface, false)
+		}
+		base.cardinalityLimiter = metric.NewCardinalityLimiter(config.GetAsInt(asInterface, 0),
+			time.Duration(window)*time.Second, overflow, []string{"collector"})
+	}
+
+	if asInterface, exists := configMap["spoolDir"]; exists {
+		maxSizeMB := DefaultSpoolMaxSizeMB
+		if asInterface, exists := configMap["spoolMaxSizeMB"]; exists {
+			maxSizeMB = config.GetAsInt(asInterface, DefaultSpoolMaxSizeMB)
+		}
+		maxAge := DefaultSpoolMaxAge
+		if asInterface, exists := configMap["spoolMaxAge"]; exists {
+			maxAge = config.GetAsInt(asInterface, DefaultSpoolMaxAge)
+		}
+		// every handler gets its own directory so that they can share spoolDir
+		dir := filepath.Join(fmt.Sprint(asInterface), base.name)
+		s, err := newSpool(dir, int64(maxSizeMB)<<20, time.Duration(maxAge)*time.Second, base.log)
+		if err != nil {
+			base.log.Error("Failed to open the spool in ", dir, ", failed emissions won't be spooled: ", err)
+		} else {
+			base.spool = s
+		}
+	}
+
+	if asInterface, exists := configMap["maxEmissionAttempts"]; exists {
+		base.maxEmissionAttempts = config.GetAsInt(asInterface, DefaultMaxEmissionAttempts)
+	}
+	if asInterface, exists := configMap["retryBackoffMs"]; exists {
+		base.retryBackoff = time.Duration(config.GetAsInt(asInterface, DefaultRetryBackoffMs)) * time.Millisecond
+	}
+	if asInterface, exists := configMap["retryMaxBackoffMs"]; exists {
+		base.retryMaxBackoff = time.Duration(config.GetAsInt(asInterface, DefaultRetryMaxBackoffMs)) * time.Millisecond
+	}
+	if asInterface, exists := configMap["circuitBreakerThreshold"]; exists {
+		// 0 or less disables the circuit breaker
+		base.circuitBreakerThreshold = config.GetAsInt(asInterface, DefaultCircuitBreakerThreshold)
+		if base.circuitBreakerThreshold <= 0 {
+			base.circuitBreakerThreshold = -1
+		}
+	}
+	if asInterface, exists := configMap["circuitBreakerTimeout"]; exists {
+		base.circuitBreakerTimeout = time.Duration(config.GetAsInt(asInterface, DefaultCircuitBreakerTimeout)) * time.Second
+	}
+
+	if asInterface, exists := configMap["maxConcurrentEmissions"]; exists {
+		base.maxConcurrentEmissions = config.GetAsInt(asInterface, DefaultMaxConcurrentEmissions)
+	}
+	if asInterface, exists := configMap["emissionQueueSize"]; exists {
+		base.emissionQueueSize = config.GetAsInt(asInterface, DefaultEmissionQueueSize)
+	}
+	if asInterface, exists := configMap["overflowPolicy"]; exists {
+		switch policy := fmt.Sprint(asInterface); policy {
+		case OverflowBlock, OverflowDropNewest, OverflowDropOldest:
+			base.overflowPolicy = policy
+		default:
+			base.log.Error("Unknown overflowPolicy ", policy, ", using ", DefaultOverflowPolicy)
+		}
+	}
+}
+
+// emissionLimits returns the configured number of emission workers,
+// size of the emission queue and overflow policy, or their defaults
+func (base *BaseHandler) emissionLimits() (workers int, queueSize int, policy string) {
+	workers, queueSize, policy = base.maxConcurrentEmissions, base.emissionQueueSize, base.overflowPolicy
+	if workers <= 0 {
+		workers = DefaultMaxConcurrentEmissions
+	}
+	if queueSize <= 0 {
+		queueSize = DefaultEmissionQueueSize
+	}
+	if policy == "" {
+		policy = DefaultOverflowPolicy
+	}
+	return
+}
+
+// prepareMetric applies the cumulativeCounterMode and the maxSeries of the
+// handler to m, returns false if m has to be dropped. The cumulative
+// counters are converted first, their series may be collapsed afterwards.
+func (base *BaseHandler) prepareMetric(m metric.Metric) (metric.Metric, bool) {
+	if base.cumulativeCounters != nil {
+		var ok bool
+		if m, ok = base.cumulativeCounters.convert(m); !ok {
+			return m, false
+		}
+	}
+	if base.cardinalityLimiter != nil {
+		return base.cardinalityLimiter.Limit(m)
+	}
+	return m, true
+}
+
+// emissionTracker returns the emission tracker of the handler
+func (base *BaseHandler) emissionTracker() *emissionTracker {
+	mu.Lock()
+	defer mu.Unlock()
+	if base.tracker == nil {
+		base.tracker = &emissionTracker{
+			quit:    make(chan struct{}),
+			stopped: make(chan struct{}),
+			breaker: base.newCircuitBreaker(),
+		}
+	}
+	return base.tracker
+}
+
+// Start : stop the handler once ctx is cancelled
+func (base *BaseHandler) Start(ctx context.Context) {
+	tracker := base.emissionTracker()
+	go func() {
+		select {
+		case <-ctx.Done():
+			base.Stop()
+		case <-tracker.quit:
+		}
+	}()
+}
+
+// Stop : flush the buffered metrics and stop reading from the collectors,
+// once everything is emitted the resources of the handler are released
+func (base *BaseHandler) Stop() {
+	tracker := base.emissionTracker()
+	tracker.stopOnce.Do(func() {
+		mu.Lock()
+		tracker.stopping = true
+		mu.Unlock()
+
+		close(tracker.quit)
+		go base.release(tracker)
+	})
+}
+
+// Done : closed once the handler is asked to stop
+func (base *BaseHandler) Done() <-chan struct{} {
+	return base.emissionTracker().quit
+}
+
+// releaseOnStop : f is called once the handler stopped and all of
+// its emissions completed, e.g. to close its connections
+func (base *BaseHandler) releaseOnStop(f func()) {
+	tracker := base.emissionTracker()
+	mu.Lock()
+	defer mu.Unlock()
+	tracker.releases = append(tracker.releases, f)
+}
+
+func (base *BaseHandler) release(tracker *emissionTracker) {
+	tracker.listeners.Wait()
+
+	mu.Lock()
+	queue := tracker.queue
+	mu.Unlock()
+	if queue != nil {
+		// the listeners flushed, the workers emit what's left and return
+		close(queue.batches)
+	}
+	tracker.emissions.Wait()
+
+	mu.Lock()
+	releases := tracker.releases
+	emissionTimingChannel := base.emissionTimingChannel
+	mu.Unlock()
+
+	for _, f := range releases {
+		f()
+	}
+	if emissionTimingChannel != nil {
+		// nothing reports emissions anymore
+		close(emissionTimingChannel)
+	}
+	close(tracker.stopped)
+}
+
+// WaitForEmissions : wait for the listeners to stop and for their emissions
+// to complete. Returns the number of metrics still pending after timeout.
+func (base *BaseHandler) WaitForEmissions(timeout time.Duration) uint64 {
+	tracker := base.emissionTracker()
+
+	select {
+	case <-tracker.stopped:
+	case <-time.After(timeout):
+		base.log.Warn("Timed out waiting for emissions to complete")
+	}
+	return uint64(atomic.LoadInt64(&tracker.pendingMetrics))
 }
 
 func (base *BaseHandler) run(emitFunc func([]metric.Metric) bool) {
+	base.runEmitter(boolEmitter(emitFunc))
+}
+
+// runEmitter is run for the handlers whose emit function tells
+// the failures worth retrying from the others
+func (base *BaseHandler) runEmitter(emitFunc emitter) {
+	tracker := base.emissionTracker()
+	mu.Lock()
+	defer mu.Unlock()
+	if tracker.stopping {
+		// stopped before it even ran
+		return
+	}
+
 	// Initiliaze channel and start listening to
 	// emissionTimings on the same
 	base.emissionTimingChannel = make(chan emissionTiming)
 	go base.recordEmissions()
 
+	workers, queueSize, policy := base.emissionLimits()
+	tracker.queue = newEmissionQueue(queueSize, policy)
+	tracker.emissions.Add(workers)
+	for i := 0; i < workers; i++ {
+		go base.emitQueued(tracker, emitFunc)
+	}
+
 	defaultCollectorEnd := CollectorEnd{base.Channel(), base.MaxBufferSize()}
+	tracker.listeners.Add(1)
+	go base.listenForMetrics(emitFunc, defaultCollectorEnd, "", nil)
+
+	if base.spool != nil {
+		tracker.listeners.Add(1)
+		go base.replaySpool(emitFunc, tracker.quit)
+	}
+
+	tracker.emitFunc = emitFunc
+	tracker.endpointQuit = make(map[string]chan struct{})
+	for k, collectorEnd := range base.collectorEndpoints {
+		base.startListener(tracker, k, collectorEnd)
+	}
+}
+
+// startListener starts listening on the endpoint of a collector, it's
+// a no-op if the handler isn't running yet. Must be called holding mu.
+func (base *BaseHandler) startListener(tracker *emissionTracker, collectorName string, collectorEnd CollectorEnd) {
+	if tracker.emitFunc == nil {
+		return
+	}
+	quit := make(chan struct{})
+	tracker.endpointQuit[collectorName] = quit
+
+	tracker.listeners.Add(1)
+	go base.listenForMetrics(tracker.emitFunc, collectorEnd, collectorName, quit)
+}
 
-	go base.listenForMetrics(emitFunc, defaultCollectorEnd, "")
-	for k := range base.CollectorEndpoints() {
-		go base.listenForMetrics(emitFunc, base.CollectorEndpoints()[k], k)
+// stopListener flushes and stops the listener of a collector.
+// Must be called holding mu.
+func (base *BaseHandler) stopListener(tracker *emissionTracker, collectorName string) {
+	if quit, exists := tracker.endpointQuit[collectorName]; exists {
+		close(quit)
+		delete(tracker.endpointQuit, collectorName)
 	}
 }
 
+// listenForMetrics buffers the metrics of one endpoint and emits them,
+// until either the handler or the endpoint (closing stop) is stopped.
 func (base *BaseHandler) listenForMetrics(
-	emitFunc func([]metric.Metric) bool,
+	emitFunc emitter,
 	collectorEnd CollectorEnd,
-	collectorName string) {
+	collectorName string,
+	stop <-chan struct{}) {
+
+	tracker := base.emissionTracker()
+	defer tracker.listeners.Done()
+
+	quit := tracker.quit
 
 	metrics := make([]metric.Metric, 0, collectorEnd.BufferSize)
 	currentBufferSize := 0
@@ -468,13 +871,38 @@ func (base *BaseHandler) listenForMetrics(
 	flusher := ticker.C
 
 	flushFunction := func() {
-		go base.emitAndTime(metrics, emitFunc)
+		// blocks if the queue is full and the policy says so
+		base.queueEmission(tracker, collectorName, metrics)
 
-		// will get copied into this call, meaning it's ok to clear it
+		// the queue holds on to the batch, meaning it's ok to clear it
 		metrics = make([]metric.Metric, 0, collectorEnd.BufferSize)
 		currentBufferSize = 0
 	}
 
+	// picks up whatever is still queued on the channel
+	// so that it goes out with the final flush
+	drainFunction := func() {
+	drain:
+		for {
+			select {
+			case incomingMetric := <-collectorEnd.Channel:
+				if incomingMetric.ZeroValue() || incomingMetric.Sentinel() {
+					continue
+				}
+				if incomingMetric, ok := base.prepareMetric(incomingMetric); ok {
+					metrics = append(metrics, incomingMetric)
+					currentBufferSize++
+				}
+			default:
+				break drain
+			}
+		}
+		base.log.Debug("Stopping: ", currentBufferSize, " col: ", collectorName)
+		if currentBufferSize > 0 {
+			flushFunction()
+		}
+	}
+
 stopReading:
 	for {
 		select {
@@ -493,6 +921,10 @@ stopReading:
 			}
 
 			base.log.Debug(base.Name(), " metric: ", incomingMetric)
+			incomingMetric, ok := base.prepareMetric(incomingMetric)
+			if !ok {
+				continue
+			}
 			metrics = append(metrics, incomingMetric)
 			currentBufferSize++
 
@@ -505,6 +937,12 @@ stopReading:
 				base.log.Debug("Time: ", currentBufferSize, " col: ", collectorName)
 				flushFunction()
 			}
+		case <-quit:
+			drainFunction()
+			break stopReading
+		case <-stop:
+			drainFunction()
+			break stopReading
 		}
 	}
 	ticker.Stop()
@@ -550,21 +988,108 @@ func (base *BaseHandler) reportEmissionMetrics(emissionResult bool, timing emiss
 			),
 		)
 		atomic.AddUint64(&base.metricsSent, uint64(timing.metricsSent))
-	} else {
+		if base.spool != nil {
+			base.spool.notifySuccess()
+		}
+	} else if base.spool == nil {
+		// otherwise the metrics were spooled, see spoolFailedEmission
 		atomic.AddUint64(&base.metricsDropped, uint64(timing.metricsSent))
 	}
 }
 
-func (base *BaseHandler) emitAndTime(metrics []metric.Metric, emitFunc func([]metric.Metric) bool) {
+// spoolFailedEmission keeps metrics which failed to be emitted in the
+// spool if there is one. Handlers reporting their own emission metrics
+// call it for the batches which failed.
+func (base *BaseHandler) spoolFailedEmission(metrics []metric.Metric) {
+	if base.spool == nil {
+		return
+	}
+	if err := base.spool.push(metrics); err != nil {
+		base.log.Error("Failed to spool ", len(metrics), " metrics: ", err)
+		atomic.AddUint64(&base.metricsDropped, uint64(len(metrics)))
+	}
+}
+
+// replaySpool emits the spooled batches, oldest first, until the
+// handler stops. After a failure it backs off exponentially, unless
+// an emission succeeds in the meantime.
+func (base *BaseHandler) replaySpool(emitFunc emitter, quit <-chan struct{}) {
+	defer base.emissionTracker().listeners.Done()
+
+	backoff := spoolMinBackoff
+	retry := time.After(0)
+	for {
+		select {
+		case <-quit:
+			return
+		case <-base.spool.nudge:
+		case <-retry:
+		}
+
+		for {
+			metrics, ok := base.spool.pop()
+			if !ok {
+				backoff = spoolMinBackoff
+				break
+			}
+			// a failed batch goes back to the spool at its place
+			if !base.timedEmit(metrics, emitFunc) {
+				backoff *= 2
+				if backoff > spoolMaxBackoff {
+					backoff = spoolMaxBackoff
+				}
+				break
+			}
+			base.spool.markReplayed(len(metrics))
+			backoff = spoolMinBackoff
+
+			select {
+			case <-quit:
+				return
+			default:
+			}
+		}
+		retry = time.After(backoff)
+	}
+}
+
+func (base *BaseHandler) emitAndTime(metrics []metric.Metric, emitFunc func([]metric.Metric) bool) bool {
+	return base.timedEmit(metrics, boolEmitter(emitFunc))
+}
+
+// timedEmit emits metrics and reports how it went. Handlers reporting
+// their own emission metrics retry and spool their batches themselves.
+func (base *BaseHandler) timedEmit(metrics []metric.Metric, emitFunc emitter) bool {
+	if base.useCustomEmissionMetricsReporter {
+		err := emitFunc(metrics)
+		atomic.AddUint64(&base.metricsDropped, uint64(droppedCount(err)))
+		return emitted(err)
+	}
+
 	start := time.Now()
-	result := emitFunc(metrics)
+	err := base.emitWithRetries(metrics, emitFunc)
 	elapsed := time.Since(start)
-	if !base.useCustomEmissionMetricsReporter {
-		timing := emissionTiming{
-			timestamp:   time.Now(),
-			duration:    elapsed,
-			metricsSent: len(metrics),
+	sent := len(metrics)
+	if count := droppedCount(err); count > 0 {
+		// the others were emitted
+		atomic.AddUint64(&base.metricsDropped, uint64(count))
+		sent -= count
+		err = nil
+	}
+	if err != nil {
+		if !isFatal(err) {
+			// the metrics sent before the emission failed aren't spooled
+			base.spoolFailedEmission(metrics[sentCount(err):])
+		} else if base.spool != nil {
+			// not worth spooling, the metrics are lost
+			atomic.AddUint64(&base.metricsDropped, uint64(len(metrics)))
 		}
-		base.reportEmissionMetrics(result, timing)
 	}
+	timing := emissionTiming{
+		timestamp:   time.Now(),
+		duration:    elapsed,
+		metricsSent: sent,
+	}
+	base.reportEmissionMetrics(err == nil, timing)
+	return err == nil
 }
@@ -1,9 +1,14 @@
 package handler
 
 import (
+	"fullerite/config"
 	"fullerite/metric"
 
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -93,6 +98,154 @@ func TestCommonKeepAliveConfig(t *testing.T) {
 	assert.Equal(t, 100, b.KeepAliveInterval())
 }
 
+func TestCumulativeCounterMode(t *testing.T) {
+	h := New("Log")
+	h.Configure(map[string]interface{}{"cumulativeCounterMode": "rate", "cumulativeCounterExpiry": 60})
+	converter := h.(*Log).cumulativeCounters
+	assert.Equal(t, CumulativeCounterRate, converter.mode)
+	assert.Equal(t, time.Minute, converter.expiry)
+
+	h = New("Log")
+	h.Configure(map[string]interface{}{"cumulativeCounterMode": "bogus"})
+	assert.Nil(t, h.(*Log).cumulativeCounters)
+}
+
+func TestMaxSeries(t *testing.T) {
+	h := New("Log")
+	h.Configure(map[string]interface{}{"maxSeries": 1})
+	base := h.(*Log)
+
+	_, ok := base.prepareMetric(metric.New("hello"))
+	assert.True(t, ok)
+	_, ok = base.prepareMetric(metric.New("world"))
+	assert.False(t, ok)
+
+	stats := h.InternalMetrics()
+	assert.Equal(t, 1.0, stats.Counters["cardinalityLimited"])
+	assert.Equal(t, 1.0, stats.Gauges["seriesLimit"])
+}
+
+func TestMaxSeriesAfterCumulativeCounterMode(t *testing.T) {
+	h := New("Log")
+	h.Configure(map[string]interface{}{
+		"maxSeries":             1,
+		"maxSeriesOverflow":     true,
+		"cumulativeCounterMode": "delta",
+	})
+	base := h.(*Log)
+	start := time.Now()
+
+	requests := func(value float64, id string, at time.Time) (metric.Metric, bool) {
+		m := metric.WithValue("requests", value)
+		m.MetricType = metric.CumulativeCounter
+		m.Timestamp = at
+		m.AddDimension("request_id", id)
+		return base.prepareMetric(m)
+	}
+	requests(100, "1", start)
+	requests(5, "2", start)
+	requests(110, "1", start.Add(10*time.Second))
+	m, ok := requests(7, "2", start.Add(10*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, metric.OverflowValue, m.Dimensions["request_id"])
+	assert.Equal(t, 2.0, m.Value, "the delta is computed before the series is collapsed")
+}
+
+func TestListenerConvertsCumulativeCounters(t *testing.T) {
+	var emittedMu sync.Mutex
+	var emitted []metric.Metric
+	emitFunc := func(metrics []metric.Metric) bool {
+		emittedMu.Lock()
+		defer emittedMu.Unlock()
+		emitted = append(emitted, metrics...)
+		return true
+	}
+
+	h := NewTest(make(chan metric.Metric), 1, 10, time.Second, l.WithField("testing", "cumcounter")).(*Test)
+	h.Configure(map[string]interface{}{"cumulativeCounterMode": "delta"})
+	endpoint := CollectorEnd{make(chan metric.Metric), 10}
+	h.SetCollectorEndpoints(map[string]CollectorEnd{"Test": endpoint})
+	go h.run(emitFunc)
+
+	start := time.Now()
+	endpoint.Channel <- cumulativeCounter(10, start, nil)
+	endpoint.Channel <- cumulativeCounter(25, start.Add(time.Second), nil)
+	endpoint.Channel <- metric.Sentinel()
+	h.Stop()
+	h.WaitForEmissions(time.Second)
+
+	emittedMu.Lock()
+	defer emittedMu.Unlock()
+	assert.Len(t, emitted, 1)
+	assert.Equal(t, 15.0, emitted[0].Value)
+	assert.Equal(t, metric.Counter, emitted[0].MetricType)
+}
+
+// waitFor polls cond until it's true or timeout expires
+func waitFor(timeout time.Duration, cond func() bool) error {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return errors.New("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestSpoolReplay(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "fullerite-spool")
+	defer os.RemoveAll(dir)
+
+	var up int32
+	emitted := make(chan metric.Metric, 10)
+	emitFunc := func(metrics []metric.Metric) bool {
+		if atomic.LoadInt32(&up) == 0 {
+			return false
+		}
+		for _, m := range metrics {
+			emitted <- m
+		}
+		return true
+	}
+
+	h := NewTest(make(chan metric.Metric), 1, 10, time.Second, l.WithField("testing", "spool")).(*Test)
+	h.Configure(map[string]interface{}{"spoolDir": dir})
+	go h.run(emitFunc)
+	defer h.Stop()
+
+	timestamp := time.Unix(time.Now().Unix()-60, 0)
+	m := metric.New("hello")
+	m.Timestamp = timestamp
+	h.Channel() <- m
+	h.Channel() <- metric.Sentinel()
+
+	assert.Nil(t, waitFor(time.Second, func() bool {
+		return h.InternalMetrics().Gauges["spoolDepth"] == 1
+	}))
+	assert.Equal(t, 0.0, h.InternalMetrics().Counters["metricsDropped"])
+
+	// the next emission succeeds, which triggers the replay
+	atomic.StoreInt32(&up, 1)
+	h.Channel() <- metric.New("world")
+	h.Channel() <- metric.Sentinel()
+
+	received := map[string]metric.Metric{}
+	for len(received) < 2 {
+		select {
+		case m := <-emitted:
+			received[m.Name] = m
+		case <-time.After(5 * time.Second):
+			t.Fatal("the spooled metric wasn't replayed")
+		}
+	}
+	assert.True(t, timestamp.Equal(received["hello"].Timestamp))
+	assert.Nil(t, waitFor(time.Second, func() bool {
+		return h.InternalMetrics().Counters["spoolReplayed"] == 1
+	}))
+	assert.Equal(t, 0.0, h.InternalMetrics().Gauges["spoolDepth"])
+}
+
 func TestEmissionAndRecord(t *testing.T) {
 	emitCalled := false
 
@@ -258,6 +411,127 @@ func TestSentinelFlushing(t *testing.T) {
 	base.CollectorEndpoints()["collector1"].Channel <- metric.Metric{}
 }
 
+func TestStopFlushesBuffer(t *testing.T) {
+	base := BaseHandler{}
+	base.log = l.WithField("testing", "basehandler_stop")
+	base.interval = 100
+	base.maxBufferSize = 100
+	base.channel = make(chan metric.Metric)
+	base.collectorEndpoints = map[string]CollectorEnd{
+		"collector1": CollectorEnd{make(chan metric.Metric), 100},
+	}
+
+	emitFunc := func(metrics []metric.Metric) bool {
+		assert.Equal(t, 2, len(metrics))
+		return true
+	}
+
+	go base.run(emitFunc)
+	base.CollectorEndpoints()["collector1"].Channel <- metric.New("testMetric")
+	base.CollectorEndpoints()["collector1"].Channel <- metric.New("testMetric1")
+	time.Sleep(100 * time.Millisecond)
+
+	base.Stop()
+	pending := base.WaitForEmissions(time.Second)
+	assert.Equal(t, uint64(0), pending)
+	assert.Equal(t, uint64(2), atomic.LoadUint64(&base.metricsSent))
+}
+
+func TestWaitForEmissionsTimeout(t *testing.T) {
+	base := BaseHandler{}
+	base.log = l.WithField("testing", "basehandler_stop")
+	base.interval = 100
+	base.maxBufferSize = 100
+	base.channel = make(chan metric.Metric)
+
+	release := make(chan struct{})
+	emitFunc := func(metrics []metric.Metric) bool {
+		<-release
+		return true
+	}
+
+	go base.run(emitFunc)
+	base.channel <- metric.New("testMetric")
+	base.channel <- metric.New("testMetric1")
+	base.channel <- metric.New("testMetric2")
+	time.Sleep(100 * time.Millisecond)
+
+	base.Stop()
+	pending := base.WaitForEmissions(100 * time.Millisecond)
+	assert.Equal(t, uint64(3), pending)
+	close(release)
+}
+
+func TestUpdateListeners(t *testing.T) {
+	base := BaseHandler{}
+	base.log = l.WithField("testing", "basehandler_update")
+	base.interval = 100
+	base.maxBufferSize = 100
+	base.channel = make(chan metric.Metric)
+	base.collectorEndpoints = map[string]CollectorEnd{
+		"collector1": CollectorEnd{make(chan metric.Metric), 100},
+		"collector2": CollectorEnd{make(chan metric.Metric), 100},
+	}
+	collector2 := base.CollectorEndpoints()["collector2"]
+
+	var emitted int64
+	emitFunc := func(metrics []metric.Metric) bool {
+		atomic.AddInt64(&emitted, int64(len(metrics)))
+		return true
+	}
+
+	go base.run(emitFunc)
+	base.CollectorEndpoints()["collector1"].Channel <- metric.New("testMetric")
+	time.Sleep(100 * time.Millisecond)
+
+	base.UpdateListeners(config.Config{Collectors: []string{"collector2", "collector3"}})
+	time.Sleep(100 * time.Millisecond)
+
+	// the listener of the removed collector flushed its buffer
+	assert.Equal(t, int64(1), atomic.LoadInt64(&emitted))
+	assert.NotContains(t, base.CollectorEndpoints(), "collector1")
+	// the untouched endpoint is the same one
+	assert.Equal(t, collector2, base.CollectorEndpoints()["collector2"])
+	assert.Contains(t, base.CollectorEndpoints(), "collector3")
+
+	base.CollectorEndpoints()["collector3"].Channel <- metric.New("testMetric")
+	base.CollectorEndpoints()["collector3"].Channel <- metric.Sentinel()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int64(2), atomic.LoadInt64(&emitted))
+
+	base.Stop()
+	base.WaitForEmissions(time.Second)
+}
+
+func TestStartReleasesOnCancel(t *testing.T) {
+	base := BaseHandler{}
+	base.log = l.WithField("testing", "basehandler_start")
+	base.interval = 100
+	base.maxBufferSize = 100
+	base.channel = make(chan metric.Metric)
+
+	released := make(chan struct{})
+	base.releaseOnStop(func() { close(released) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	base.Start(ctx)
+	go base.run(func(metrics []metric.Metric) bool { return true })
+	time.Sleep(100 * time.Millisecond)
+
+	cancel()
+	select {
+	case <-base.Done():
+	case <-time.After(time.Second):
+		t.Fatal("handler should be stopped once ctx is cancelled")
+	}
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("handler resources should be released")
+	}
+	assert.Equal(t, uint64(0), base.WaitForEmissions(time.Second))
+}
+
 func TestHandlerRun(t *testing.T) {
 	var mu sync.Mutex
 	base := BaseHandler{}
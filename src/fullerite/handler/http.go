@@ -0,0 +1,49 @@
+package handler
+
+import (
+	"fullerite/util"
+
+	"errors"
+	"strconv"
+	"time"
+)
+
+// how much of the body of a failed response is logged
+const httpMaxErrorBodySize = 512
+
+// configureHTTPDefaults sets the defaults of the handlers posting over
+// HTTP: their connections are kept alive and the endpoints failing with
+// a 5xx are tried attempts times, unless configured otherwise
+func (base *BaseHandler) configureHTTPDefaults(attempts int) {
+	base.maxIdleConnectionsPerHost = DefaultMaxIdleConnectionsPerHost
+	base.keepAliveInterval = DefaultKeepAliveInterval
+	base.maxEmissionAttempts = attempts
+}
+
+// newHTTPClient returns a client keeping the connections alive as the
+// handler is configured to
+func (base *BaseHandler) newHTTPClient() *util.HTTPAlive {
+	httpAliveClient := new(util.HTTPAlive)
+	httpAliveClient.Configure(base.timeout,
+		time.Duration(base.KeepAliveInterval())*time.Second,
+		base.MaxIdleConnectionsPerHost())
+	return httpAliveClient
+}
+
+// httpStatusError logs the failed response of endpoint, its body
+// truncated, and returns the error of the emission: fatal unless the
+// status is worth retrying
+func (base *BaseHandler) httpStatusError(endpoint string, rsp *util.HTTPAliveResponse) error {
+	body := rsp.Body
+	if len(body) > httpMaxErrorBodySize {
+		body = body[:httpMaxErrorBodySize]
+	}
+	base.log.Error("Failed to post to ", endpoint,
+		" status was ", rsp.StatusCode,
+		" rsp body was ", string(body))
+	err := errors.New(endpoint + " returned " + strconv.Itoa(rsp.StatusCode))
+	if retryableStatus(rsp.StatusCode) {
+		return err
+	}
+	return fatal(err)
+}
@@ -0,0 +1,304 @@
+package handler
+
+import (
+	"fullerite/config"
+	"fullerite/metric"
+	"fullerite/util"
+
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+func init() {
+	RegisterHandler("HTTPTemplate", newHTTPTemplate)
+}
+
+// The defaults of the HTTPTemplate handler
+const (
+	DefaultHTTPTemplateMethod      = "POST"
+	DefaultHTTPTemplateContentType = "application/json"
+	DefaultHTTPTemplateAttempts    = 3
+)
+
+// the characters sanitize replaces with an underscore
+var httpTemplateUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_.\-]`)
+
+// httpTemplateFuncs are available to the templates on top of the builtin
+// functions of text/template
+var httpTemplateFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+	"sanitize": func(value string) string {
+		return httpTemplateUnsafe.ReplaceAllString(value, "_")
+	},
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"replace": strings.Replace,
+	"join":    strings.Join,
+	"unix": func(t time.Time) int64 {
+		return t.Unix()
+	},
+	"unixMilli": func(t time.Time) int64 {
+		return t.UnixNano() / int64(time.Millisecond)
+	},
+	"unixNano": func(t time.Time) int64 {
+		return t.UnixNano()
+	},
+	// dimension returns the value of a dimension of a metric, or the
+	// fallback when the metric doesn't have it
+	"dimension": func(m httpTemplateMetric, name string, fallback ...string) string {
+		if value, exists := m.Dimensions[name]; exists {
+			return value
+		}
+		return strings.Join(fallback, "")
+	},
+}
+
+// HTTPTemplate handler sends the metrics to any HTTP service: the URL, the
+// method, the headers and the body of the request are text/templates
+// rendered for every batch, e.g. for a body
+//
+//	[{{range $i, $m := .Metrics}}{{if $i}},{{end}}
+//	  {"name": {{json $m.Name}}, "value": {{$m.Value}}, "host": {{json $m.Dimensions.host}}}
+//	{{- end}}]
+type HTTPTemplate struct {
+	BaseHandler
+	url          *template.Template
+	method       *template.Template
+	headers      map[string]*template.Template
+	body         *template.Template
+	contentType  string
+	gzip         bool
+	successCodes map[int]bool
+	// invalid is set when one of the templates can't be parsed
+	invalid    bool
+	httpClient *util.HTTPAlive
+}
+
+// httpTemplateBatch is what the templates are rendered with
+type httpTemplateBatch struct {
+	Metrics           []httpTemplateMetric
+	Count             int
+	DefaultDimensions map[string]string
+	Prefix            string
+	Now               time.Time
+}
+
+// httpTemplateMetric is a metric as the templates see it
+type httpTemplateMetric struct {
+	// Name is prefixed, RawName isn't
+	Name    string
+	RawName string
+	Value   float64
+	Type    string
+	// Dimensions include the default dimensions of the handler
+	Dimensions map[string]string
+	Timestamp  time.Time
+}
+
+// newHTTPTemplate returns a new HTTPTemplate handler
+func newHTTPTemplate(
+	channel chan metric.Metric,
+	initialInterval int,
+	initialBufferSize int,
+	initialTimeout time.Duration,
+	log *l.Entry) Handler {
+
+	inst := new(HTTPTemplate)
+	inst.name = "HTTPTemplate"
+
+	inst.interval = initialInterval
+	inst.maxBufferSize = initialBufferSize
+	inst.timeout = initialTimeout
+	inst.configureHTTPDefaults(DefaultHTTPTemplateAttempts)
+	inst.log = log
+	inst.channel = channel
+	inst.method = template.Must(newHTTPTemplateTemplate("method", DefaultHTTPTemplateMethod))
+	inst.headers = make(map[string]*template.Template)
+	inst.contentType = DefaultHTTPTemplateContentType
+	return inst
+}
+
+func newHTTPTemplateTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(httpTemplateFuncs).Option("missingkey=zero").Parse(text)
+}
+
+// Configure the HTTPTemplate handler, a template which can't be parsed
+// prevents any emission
+func (h *HTTPTemplate) Configure(configMap map[string]interface{}) {
+	if url, exists := configMap["url"]; exists {
+		h.url = h.parse("url", fmt.Sprint(url))
+	} else {
+		h.log.Error("There was no url specified for the HTTPTemplate handler, there won't be any emissions")
+	}
+	if method, exists := configMap["method"]; exists {
+		h.method = h.parse("method", fmt.Sprint(method))
+	}
+	if headers, exists := configMap["headers"]; exists {
+		for name, value := range config.GetAsMap(headers) {
+			h.headers[name] = h.parse("header "+name, value)
+		}
+	}
+	if body, exists := configMap["body"]; exists {
+		h.body = h.parse("body", fmt.Sprint(body))
+	}
+
+	if contentType, exists := configMap["contentType"]; exists {
+		h.contentType = fmt.Sprint(contentType)
+	}
+	if gzip, exists := configMap["gzip"]; exists {
+		h.gzip = config.GetAsBool(gzip, false)
+	}
+	if successCodes, exists := configMap["successCodes"]; exists {
+		// status codes are numbers, GetAsSlice only handles strings
+		codes, ok := successCodes.([]interface{})
+		if !ok {
+			h.log.Error("Invalid successCodes ", successCodes)
+		}
+		h.successCodes = make(map[int]bool)
+		for _, code := range codes {
+			if status := config.GetAsInt(code, 0); status > 0 {
+				h.successCodes[status] = true
+			} else {
+				h.log.Error("Invalid status code ", code)
+			}
+		}
+	}
+
+	h.configureCommonParams(configMap)
+}
+
+// parse returns nil and logs the error if text isn't a valid template
+func (h *HTTPTemplate) parse(name string, text string) *template.Template {
+	tmpl, err := newHTTPTemplateTemplate(name, text)
+	if err != nil {
+		h.log.Error("Invalid ", name, " template for the HTTPTemplate handler, there won't be any emissions: ", err)
+		h.invalid = true
+		return nil
+	}
+	return tmpl
+}
+
+// Run runs the handler main loop
+func (h *HTTPTemplate) Run() {
+	h.httpClient = h.newHTTPClient()
+	h.releaseOnStop(h.httpClient.Close)
+
+	h.runEmitter(h.emit)
+}
+
+// emit renders the request for the metrics and sends it, the requests
+// which can't be rendered or are rejected with a 4xx aren't retried
+func (h *HTTPTemplate) emit(metrics []metric.Metric) error {
+	h.log.Info("Starting to emit ", len(metrics), " metrics")
+
+	if len(metrics) == 0 {
+		h.log.Warn("Skipping send because of an empty payload")
+		return fatal(errors.New("empty payload"))
+	}
+	if !h.valid() {
+		h.log.Warn("Skipping emission because of the missing or invalid templates")
+		return fatal(errors.New("invalid templates"))
+	}
+
+	batch := h.batch(metrics)
+	url, err := renderHTTPTemplate(h.url, batch)
+	if err != nil {
+		h.log.Error("Cannot render the url ", err)
+		return fatal(err)
+	}
+	method, err := renderHTTPTemplate(h.method, batch)
+	if err != nil {
+		h.log.Error("Cannot render the method ", err)
+		return fatal(err)
+	}
+	header := map[string]string{"Content-Type": h.contentType}
+	for name, tmpl := range h.headers {
+		if header[name], err = renderHTTPTemplate(tmpl, batch); err != nil {
+			h.log.Error("Cannot render the header ", name, " ", err)
+			return fatal(err)
+		}
+	}
+
+	var body io.Reader
+	if h.body != nil {
+		var buf bytes.Buffer
+		if err := h.body.Execute(&buf, batch); err != nil {
+			h.log.Error("Cannot render the body ", err)
+			return fatal(err)
+		}
+		payload := buf.Bytes()
+		if h.gzip {
+			if payload, err = gzipPayload(payload); err != nil {
+				h.log.Error("Failed to compress the payload ", err)
+				return fatal(err)
+			}
+			header["Content-Encoding"] = "gzip"
+		}
+		body = bytes.NewReader(payload)
+	}
+
+	rsp, err := h.httpClient.MakeRequest(strings.TrimSpace(method), strings.TrimSpace(url), body, header)
+	if err != nil {
+		h.log.Error("Failed to make request ", err, " to endpoint ", url)
+		return err
+	}
+	if h.success(rsp.StatusCode) {
+		h.log.Info("Successfully sent ", len(metrics), " metrics to ", url)
+		return nil
+	}
+	return h.httpStatusError(url, rsp)
+}
+
+// valid tells if there's a url and the templates could all be parsed
+func (h *HTTPTemplate) valid() bool {
+	return h.url != nil && !h.invalid
+}
+
+// success tells if the status is one of successCodes, any 2xx if none
+// were configured
+func (h *HTTPTemplate) success(status int) bool {
+	if len(h.successCodes) == 0 {
+		return status/100 == 2
+	}
+	return h.successCodes[status]
+}
+
+// batch is what the templates are rendered with for the metrics
+func (h *HTTPTemplate) batch(metrics []metric.Metric) httpTemplateBatch {
+	batch := httpTemplateBatch{
+		Metrics:           make([]httpTemplateMetric, 0, len(metrics)),
+		Count:             len(metrics),
+		DefaultDimensions: h.DefaultDimensions(),
+		Prefix:            h.Prefix(),
+		Now:               time.Now(),
+	}
+	for _, m := range metrics {
+		batch.Metrics = append(batch.Metrics, httpTemplateMetric{
+			Name:       h.Prefix() + m.Name,
+			RawName:    m.Name,
+			Value:      m.Value,
+			Type:       m.MetricType,
+			Dimensions: m.GetDimensions(h.DefaultDimensions()),
+			Timestamp:  m.GetTimestamp(),
+		})
+	}
+	return batch
+}
+
+func renderHTTPTemplate(tmpl *template.Template, data interface{}) (string, error) {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, data)
+	return buf.String(), err
+}
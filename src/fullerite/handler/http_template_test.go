@@ -0,0 +1,176 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"net/http"
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getTestHTTPTemplateHandler(interval, buffsize, timeoutsec int) *HTTPTemplate {
+	testChannel := make(chan metric.Metric)
+	testLog := l.WithField("testing", "http_template_handler")
+	timeout := time.Duration(timeoutsec) * time.Second
+
+	return newHTTPTemplate(testChannel, interval, buffsize, timeout, testLog).(*HTTPTemplate)
+}
+
+// getTestHTTPTemplateClient returns a handler sending to the server at
+// url, the url template is appended to it
+func getTestHTTPTemplateClient(config map[string]interface{}, url string) *HTTPTemplate {
+	config["url"] = url + config["url"].(string)
+	h := getTestHTTPTemplateHandler(12, 12, 12)
+	h.Configure(config)
+	h.httpClient = h.newHTTPClient()
+	return h
+}
+
+func TestHTTPTemplateConfigureEmptyConfig(t *testing.T) {
+	h := getTestHTTPTemplateHandler(12, 13, 14)
+	h.Configure(map[string]interface{}{})
+
+	assert.Equal(t, 12, h.Interval())
+	assert.Equal(t, 13, h.MaxBufferSize())
+	assert.Nil(t, h.url)
+	assert.Nil(t, h.body)
+	assert.Equal(t, DefaultHTTPTemplateContentType, h.contentType)
+	assert.False(t, h.gzip)
+	assert.Empty(t, h.successCodes)
+	assert.Equal(t, DefaultHTTPTemplateAttempts, h.maxEmissionAttempts)
+	assert.False(t, h.valid())
+}
+
+func TestHTTPTemplateConfigure(t *testing.T) {
+	h := getTestHTTPTemplateHandler(12, 13, 14)
+	h.Configure(map[string]interface{}{
+		"url":          "http://alerts/{{.Count}}",
+		"method":       "PUT",
+		"headers":      map[string]interface{}{"X-Count": "{{.Count}}"},
+		"body":         "{{json .Metrics}}",
+		"contentType":  "text/plain",
+		"gzip":         "true",
+		"successCodes": []interface{}{200, "202", 302.0},
+	})
+
+	assert.True(t, h.valid())
+	assert.Contains(t, h.headers, "X-Count")
+	assert.NotNil(t, h.body)
+	assert.Equal(t, "text/plain", h.contentType)
+	assert.True(t, h.gzip)
+	assert.Equal(t, map[int]bool{200: true, 202: true, 302: true}, h.successCodes)
+}
+
+func TestHTTPTemplateConfigureInvalidTemplate(t *testing.T) {
+	h := getTestHTTPTemplateHandler(12, 13, 14)
+	h.Configure(map[string]interface{}{
+		"url":  "http://alerts",
+		"body": "{{range .Metrics}}",
+	})
+
+	assert.False(t, h.valid())
+	err := h.emit([]metric.Metric{newTestMetric("load", metric.Gauge, 1, nil)})
+	assert.True(t, isFatal(err), "nothing is sent with an invalid template")
+}
+
+func TestHTTPTemplateEmit(t *testing.T) {
+	ts, requests := newTestHTTPReceiver(t, nil, http.StatusOK)
+	defer ts.Close()
+	h := getTestHTTPTemplateClient(map[string]interface{}{
+		"url":    `/hosts/{{(index .Metrics 0).Dimensions.host | sanitize}}?count={{.Count}}`,
+		"method": `{{if gt .Count 1}}POST{{else}}PUT{{end}}`,
+		"headers": map[string]interface{}{
+			"Authorization": "Bearer secret",
+			"X-Prefix":      "{{.Prefix | upper}}",
+		},
+		"body": `[{{range $i, $m := .Metrics}}{{if $i}},{{end}}` +
+			`{"name":{{json $m.Name}},"raw":{{json $m.RawName}},"value":{{$m.Value}},` +
+			`"region":{{json (dimension $m "region")}},"core":{{json (dimension $m "core" "all")}},"ts":{{unixMilli $m.Timestamp}}}` +
+			`{{end}}]`,
+	}, ts.URL)
+	h.SetPrefix("fullerite.")
+	h.SetDefaultDimensions(map[string]string{"region": "east"})
+
+	err := h.emit([]metric.Metric{
+		newTestMetric("load", metric.Gauge, 0.5, map[string]string{"host": "web 1", "core": "0"}),
+		newTestMetric("cpu", metric.Gauge, 2, map[string]string{"host": "web 1"}),
+	})
+	require.Nil(t, err)
+
+	r := <-requests
+	assert.Equal(t, "POST", r.method)
+	assert.Equal(t, "/hosts/web_1?count=2", r.uri)
+	assert.Equal(t, DefaultHTTPTemplateContentType, r.header.Get("Content-Type"))
+	assert.Equal(t, "Bearer secret", r.header.Get("Authorization"))
+	assert.Equal(t, "FULLERITE.", r.header.Get("X-Prefix"))
+	assert.JSONEq(t, `[
+		{"name": "fullerite.load", "raw": "load", "value": 0.5, "region": "east", "core": "0", "ts": 1500000000000},
+		{"name": "fullerite.cpu", "raw": "cpu", "value": 2, "region": "east", "core": "all", "ts": 1500000000000}
+	]`, string(r.body))
+}
+
+func TestHTTPTemplateEmitGzip(t *testing.T) {
+	ts, requests := newTestHTTPReceiver(t, nil, http.StatusNoContent)
+	defer ts.Close()
+	h := getTestHTTPTemplateClient(map[string]interface{}{
+		"url":         "/events",
+		"body":        "{{range .Metrics}}{{.Name}} {{.Value}}\n{{end}}",
+		"contentType": "text/plain",
+		"gzip":        true,
+	}, ts.URL)
+
+	require.Nil(t, h.emit([]metric.Metric{newTestMetric("load", metric.Gauge, 1, nil)}))
+
+	r := <-requests
+	assert.Equal(t, "POST", r.method)
+	assert.Equal(t, "text/plain", r.header.Get("Content-Type"))
+	assert.Equal(t, "gzip", r.header.Get("Content-Encoding"))
+	assert.Equal(t, "load 1\n", string(r.body))
+}
+
+func TestHTTPTemplateSuccessCodes(t *testing.T) {
+	ts, _ := newTestHTTPReceiver(t, nil, http.StatusFound)
+	defer ts.Close()
+	h := getTestHTTPTemplateClient(map[string]interface{}{
+		"url":          "/",
+		"successCodes": []interface{}{302},
+	}, ts.URL)
+	assert.Nil(t, h.emit([]metric.Metric{newTestMetric("load", metric.Gauge, 1, nil)}))
+
+	ts, _ = newTestHTTPReceiver(t, nil, http.StatusOK)
+	defer ts.Close()
+	h = getTestHTTPTemplateClient(map[string]interface{}{
+		"url":          "/",
+		"successCodes": []interface{}{302},
+	}, ts.URL)
+	err := h.emit([]metric.Metric{newTestMetric("load", metric.Gauge, 1, nil)})
+	assert.NotNil(t, err, "only the configured codes are successes")
+}
+
+func TestHTTPTemplateErrors(t *testing.T) {
+	ts, _ := newTestHTTPReceiver(t, nil, http.StatusBadRequest)
+	defer ts.Close()
+	h := getTestHTTPTemplateClient(map[string]interface{}{"url": "/"}, ts.URL)
+	err := h.emit([]metric.Metric{newTestMetric("a", metric.Gauge, 1, nil)})
+	assert.True(t, isFatal(err), "rejected requests aren't retried")
+
+	ts, _ = newTestHTTPReceiver(t, nil, http.StatusServiceUnavailable)
+	defer ts.Close()
+	h = getTestHTTPTemplateClient(map[string]interface{}{"url": "/"}, ts.URL)
+	err = h.emit([]metric.Metric{newTestMetric("a", metric.Gauge, 1, nil)})
+	assert.NotNil(t, err)
+	assert.False(t, isFatal(err))
+
+	ts, _ = newTestHTTPReceiver(t, nil, http.StatusOK)
+	defer ts.Close()
+	h = getTestHTTPTemplateClient(map[string]interface{}{
+		"url":  "/",
+		"body": `{{index .Metrics 5}}`,
+	}, ts.URL)
+	err = h.emit([]metric.Metric{newTestMetric("a", metric.Gauge, 1, nil)})
+	assert.True(t, isFatal(err), "a batch which can't be rendered isn't retried")
+}
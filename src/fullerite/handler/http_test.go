@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"fullerite/metric"
+	"fullerite/util"
+
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+)
+
+// testHTTPRequest is what a test receiver received, its body decompressed
+type testHTTPRequest struct {
+	method string
+	uri    string
+	header http.Header
+	body   []byte
+}
+
+// newTestHTTPReceiver returns a server answering with the statuses in
+// order, then with the last one, and body. The requests it received are
+// sent on the channel.
+func newTestHTTPReceiver(t *testing.T, body []byte, statuses ...int) (*httptest.Server, chan testHTTPRequest) {
+	requests := make(chan testHTTPRequest, 10)
+	var received int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, err := ioutil.ReadAll(r.Body)
+		assert.Nil(t, err)
+		switch r.Header.Get("Content-Encoding") {
+		case "gzip":
+			reader, err := gzip.NewReader(bytes.NewReader(payload))
+			assert.Nil(t, err)
+			payload, err = ioutil.ReadAll(reader)
+			assert.Nil(t, err)
+		case "snappy":
+			payload, err = snappy.Decode(nil, payload)
+			assert.Nil(t, err)
+		}
+		requests <- testHTTPRequest{r.Method, r.URL.RequestURI(), r.Header, payload}
+
+		i := int(atomic.AddInt32(&received, 1)) - 1
+		if i >= len(statuses) {
+			i = len(statuses) - 1
+		}
+		w.WriteHeader(statuses[i])
+		w.Write(body)
+	}))
+	return ts, requests
+}
+
+// newTestMetric returns a metric of 2017-07-14 02:40:00 UTC
+func newTestMetric(name string, metricType string, value float64, dimensions map[string]string) metric.Metric {
+	m := metric.WithValue(name, value)
+	m.MetricType = metricType
+	m.Timestamp = time.Unix(1500000000, 0)
+	m.AddDimensions(dimensions)
+	return m
+}
+
+func TestHTTPStatusError(t *testing.T) {
+	h := getTestRetryHandler(map[string]interface{}{})
+
+	err := h.httpStatusError("http://localhost", &util.HTTPAliveResponse{
+		StatusCode: http.StatusServiceUnavailable,
+		Body:       []byte(strings.Repeat("x", 2*httpMaxErrorBodySize)),
+	})
+	assert.Equal(t, "http://localhost returned 503", err.Error())
+	assert.False(t, isFatal(err))
+
+	err = h.httpStatusError("http://localhost", &util.HTTPAliveResponse{StatusCode: http.StatusBadRequest})
+	assert.True(t, isFatal(err), "the rejected requests aren't retried")
+}
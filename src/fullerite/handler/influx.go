@@ -0,0 +1,306 @@
+package handler
+
+import (
+	"fullerite/config"
+	"fullerite/metric"
+	"fullerite/util"
+
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+func init() {
+	RegisterHandler("Influx", newInflux)
+}
+
+// The precisions of the timestamps InfluxDB accepts
+const (
+	InfluxPrecisionNanoseconds  = "ns"
+	InfluxPrecisionMicroseconds = "us"
+	InfluxPrecisionMilliseconds = "ms"
+	InfluxPrecisionSeconds      = "s"
+
+	DefaultInfluxPrecision = InfluxPrecisionSeconds
+	DefaultInfluxFieldKey  = "value"
+	DefaultInfluxAttempts  = 3
+)
+
+var influxPrecisions = map[string]time.Duration{
+	InfluxPrecisionNanoseconds:  time.Nanosecond,
+	InfluxPrecisionMicroseconds: time.Microsecond,
+	InfluxPrecisionMilliseconds: time.Millisecond,
+	InfluxPrecisionSeconds:      time.Second,
+}
+
+// the precision parameter of the v1 API doesn't use the same units
+var influxV1Precisions = map[string]string{
+	InfluxPrecisionNanoseconds:  "n",
+	InfluxPrecisionMicroseconds: "u",
+	InfluxPrecisionMilliseconds: "ms",
+	InfluxPrecisionSeconds:      "s",
+}
+
+// Characters escaped with a backslash in line protocol. A backslash is
+// escaped too, or a trailing one would escape the delimiter after it.
+// Line protocol can't escape line breaks, they become spaces.
+var (
+	influxMeasurementEscaper = strings.NewReplacer("\\", "\\\\", ",", "\\,", " ", "\\ ",
+		"\n", "\\ ", "\r", "\\ ")
+	influxKeyEscaper = strings.NewReplacer("\\", "\\\\", ",", "\\,", "=", "\\=", " ", "\\ ",
+		"\n", "\\ ", "\r", "\\ ")
+)
+
+// Influx handler writes line protocol to the v1 /write API or, when a
+// bucket is configured, to the v2 /api/v2/write API
+type Influx struct {
+	BaseHandler
+	endpoint   string
+	httpClient *util.HTTPAlive
+
+	// v1
+	database        string
+	retentionPolicy string
+	username        string
+	password        string
+
+	// v2
+	org    string
+	bucket string
+	token  string
+
+	precision string
+	fieldKey  string
+	gzip      bool
+}
+
+// newInflux returns a new Influx handler
+func newInflux(
+	channel chan metric.Metric,
+	initialInterval int,
+	initialBufferSize int,
+	initialTimeout time.Duration,
+	log *l.Entry) Handler {
+
+	inst := new(Influx)
+	inst.name = "Influx"
+
+	inst.interval = initialInterval
+	inst.maxBufferSize = initialBufferSize
+	inst.timeout = initialTimeout
+	inst.configureHTTPDefaults(DefaultInfluxAttempts)
+	inst.log = log
+	inst.channel = channel
+
+	inst.precision = DefaultInfluxPrecision
+	inst.fieldKey = DefaultInfluxFieldKey
+	return inst
+}
+
+// Configure the Influx handler
+func (i *Influx) Configure(configMap map[string]interface{}) {
+	if endpoint, exists := configMap["endpoint"]; exists {
+		i.endpoint = strings.TrimSuffix(endpoint.(string), "/")
+	} else {
+		i.log.Error("There was no endpoint specified for the Influx handler, there won't be any emissions")
+	}
+
+	if bucket, exists := configMap["bucket"]; exists {
+		i.bucket = bucket.(string)
+		if org, exists := configMap["org"]; exists {
+			i.org = org.(string)
+		} else {
+			i.log.Error("There was no org specified for the bucket of the Influx handler, there won't be any emissions")
+		}
+		if token, exists := configMap["token"]; exists {
+			i.token = token.(string)
+		}
+	} else if database, exists := configMap["database"]; exists {
+		i.database = database.(string)
+		if retentionPolicy, exists := configMap["retentionPolicy"]; exists {
+			i.retentionPolicy = retentionPolicy.(string)
+		}
+		if username, exists := configMap["username"]; exists {
+			i.username = username.(string)
+		}
+		if password, exists := configMap["password"]; exists {
+			i.password = password.(string)
+		}
+	} else {
+		i.log.Error("There was no database or bucket specified for the Influx handler, there won't be any emissions")
+	}
+
+	if precision, exists := configMap["precision"]; exists {
+		if _, valid := influxPrecisions[precision.(string)]; valid {
+			i.precision = precision.(string)
+		} else {
+			i.log.Error("Invalid precision ", precision, " for the Influx handler, using ", i.precision)
+		}
+	}
+	if fieldKey, exists := configMap["fieldKey"]; exists && fieldKey.(string) != "" {
+		i.fieldKey = fieldKey.(string)
+	}
+	if gzip, exists := configMap["gzip"]; exists {
+		i.gzip = config.GetAsBool(gzip, false)
+	}
+
+	i.configureCommonParams(configMap)
+}
+
+// Endpoint returns the InfluxDB endpoint
+func (i *Influx) Endpoint() string {
+	return i.endpoint
+}
+
+// Precision returns the precision of the timestamps written
+func (i *Influx) Precision() string {
+	return i.precision
+}
+
+// Run runs the handler main loop
+func (i *Influx) Run() {
+	i.httpClient = i.newHTTPClient()
+	i.releaseOnStop(i.httpClient.Close)
+
+	i.runEmitter(i.emit)
+}
+
+// emit writes the metrics to InfluxDB, the payloads it rejects aren't
+// retried. The metrics line protocol can't represent are dropped.
+func (i *Influx) emit(metrics []metric.Metric) error {
+	i.log.Info("Starting to emit ", len(metrics), " metrics")
+
+	writeURL := i.writeURL()
+	if writeURL == "" {
+		i.log.Warn("Skipping emission because we're missing the endpoint, the database or the bucket")
+		return fatal(errors.New("missing endpoint"))
+	}
+
+	var payload bytes.Buffer
+	lines := 0
+	for _, m := range metrics {
+		if i.writeLine(&payload, m) {
+			lines++
+		}
+	}
+	if lines == 0 {
+		i.log.Warn("Skipping send because of an empty payload")
+		return fatal(errors.New("empty payload"))
+	}
+
+	header := map[string]string{
+		"Content-Type": "text/plain; charset=utf-8",
+	}
+	if i.token != "" {
+		header["Authorization"] = "Token " + i.token
+	}
+	body := payload.Bytes()
+	if i.gzip {
+		compressed, err := gzipPayload(body)
+		if err != nil {
+			i.log.Error("Failed to compress the payload ", err)
+			return fatal(err)
+		}
+		body = compressed
+		header["Content-Encoding"] = "gzip"
+	}
+
+	rsp, err := i.httpClient.MakeRequest("POST", writeURL, bytes.NewReader(body), header)
+	if err != nil {
+		i.log.Error("Failed to make request ", err, " to endpoint ", i.endpoint)
+		return err
+	}
+	if rsp.StatusCode == 200 || rsp.StatusCode == 204 {
+		i.log.Info("Successfully sent ", lines, " datapoints to Influx")
+		return dropped(len(metrics)-lines, nil)
+	}
+	return i.httpStatusError(i.endpoint, rsp)
+}
+
+// writeURL returns the URL of the write API, or "" if it can't be built
+func (i *Influx) writeURL() string {
+	if i.endpoint == "" {
+		return ""
+	}
+	params := url.Values{}
+	if i.bucket != "" {
+		if i.org == "" {
+			return ""
+		}
+		params.Set("org", i.org)
+		params.Set("bucket", i.bucket)
+		params.Set("precision", i.precision)
+		return i.endpoint + "/api/v2/write?" + params.Encode()
+	}
+	if i.database == "" {
+		return ""
+	}
+	params.Set("db", i.database)
+	if i.retentionPolicy != "" {
+		params.Set("rp", i.retentionPolicy)
+	}
+	if i.username != "" {
+		params.Set("u", i.username)
+		params.Set("p", i.password)
+	}
+	params.Set("precision", influxV1Precisions[i.precision])
+	return i.endpoint + "/write?" + params.Encode()
+}
+
+// writeLine appends the line protocol of m to buf, returns false for the
+// values line protocol can't represent
+func (i *Influx) writeLine(buf *bytes.Buffer, m metric.Metric) bool {
+	if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+		i.log.Debug("Dropping metric ", m.Name, " with value ", m.Value)
+		return false
+	}
+
+	buf.WriteString(influxMeasurementEscaper.Replace(i.Prefix() + m.Name))
+
+	dimensions := m.GetDimensions(i.DefaultDimensions())
+	keys := make([]string, 0, len(dimensions))
+	for key, value := range dimensions {
+		// InfluxDB refuses empty tag keys and values
+		if key != "" && value != "" {
+			keys = append(keys, key)
+		}
+	}
+	// InfluxDB performs best when the tags are sorted
+	sort.Strings(keys)
+	for _, key := range keys {
+		buf.WriteByte(',')
+		buf.WriteString(influxKeyEscaper.Replace(key))
+		buf.WriteByte('=')
+		buf.WriteString(influxKeyEscaper.Replace(dimensions[key]))
+	}
+
+	buf.WriteByte(' ')
+	buf.WriteString(influxKeyEscaper.Replace(i.fieldKey))
+	buf.WriteByte('=')
+	buf.WriteString(strconv.FormatFloat(m.Value, 'f', -1, 64))
+
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(m.GetTimestamp().UnixNano()/int64(influxPrecisions[i.precision]), 10))
+	buf.WriteByte('\n')
+	return true
+}
+
+func gzipPayload(payload []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,257 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+type influxRequest struct {
+	path   string
+	query  url.Values
+	header http.Header
+	body   string
+}
+
+func getTestInfluxHandler(interval, buffsize, timeoutsec int) *Influx {
+	testChannel := make(chan metric.Metric)
+	testLog := l.WithField("testing", "influx_handler")
+	timeout := time.Duration(timeoutsec) * time.Second
+
+	return newInflux(testChannel, interval, buffsize, timeout, testLog).(*Influx)
+}
+
+// fakeInflux records the requests it receives and answers with status
+func fakeInflux(t *testing.T, status int) (*httptest.Server, chan influxRequest) {
+	requests := make(chan influxRequest, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.Nil(t, err)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			body = gunzip(t, body)
+		}
+		requests <- influxRequest{r.URL.Path, r.URL.Query(), r.Header, string(body)}
+		w.WriteHeader(status)
+	}))
+	return ts, requests
+}
+
+func gunzip(t *testing.T, body []byte) []byte {
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	assert.Nil(t, err)
+	uncompressed, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	return uncompressed
+}
+
+func testInfluxMetric(name string, value float64) metric.Metric {
+	m := metric.WithValue(name, value)
+	m.Timestamp = time.Unix(1500000000, 123456789)
+	return m
+}
+
+func TestInfluxConfigureEmptyConfig(t *testing.T) {
+	i := getTestInfluxHandler(12, 13, 14)
+	i.Configure(map[string]interface{}{})
+
+	assert.Equal(t, 12, i.Interval())
+	assert.Equal(t, 13, i.MaxBufferSize())
+	assert.Equal(t, DefaultInfluxPrecision, i.Precision())
+	assert.Equal(t, "", i.writeURL())
+	assert.Equal(t, DefaultInfluxAttempts, i.maxEmissionAttempts)
+}
+
+func TestInfluxConfigure(t *testing.T) {
+	i := getTestInfluxHandler(12, 13, 14)
+	i.Configure(map[string]interface{}{
+		"interval":        "10",
+		"max_buffer_size": "100",
+		"endpoint":        "http://influx:8086/",
+		"database":        "metrics",
+		"retentionPolicy": "week",
+		"precision":       "ms",
+		"gzip":            "true",
+	})
+
+	assert.Equal(t, 10, i.Interval())
+	assert.Equal(t, 100, i.MaxBufferSize())
+	assert.Equal(t, "http://influx:8086", i.Endpoint())
+	assert.Equal(t, "ms", i.Precision())
+	assert.True(t, i.gzip)
+	assert.Equal(t, "http://influx:8086/write?db=metrics&precision=ms&rp=week", i.writeURL())
+}
+
+func TestInfluxConfigureV2(t *testing.T) {
+	i := getTestInfluxHandler(12, 13, 14)
+	i.Configure(map[string]interface{}{
+		"endpoint":  "http://influx:8086",
+		"org":       "infra",
+		"bucket":    "metrics",
+		"token":     "secret",
+		"precision": "us",
+	})
+
+	assert.Equal(t, "http://influx:8086/api/v2/write?bucket=metrics&org=infra&precision=us", i.writeURL())
+}
+
+func TestInfluxConfigureInvalidPrecision(t *testing.T) {
+	i := getTestInfluxHandler(12, 13, 14)
+	i.Configure(map[string]interface{}{"precision": "minutes"})
+
+	assert.Equal(t, DefaultInfluxPrecision, i.Precision())
+}
+
+func TestInfluxLineProtocol(t *testing.T) {
+	i := getTestInfluxHandler(12, 13, 14)
+	i.SetPrefix("fullerite.")
+	i.SetDefaultDimensions(map[string]string{"host": "dev box"})
+
+	m := testInfluxMetric("cpu usage,total", 0.5)
+	m.AddDimension("core", "a=b,c")
+	m.AddDimension("empty", "")
+
+	var buf bytes.Buffer
+	assert.True(t, i.writeLine(&buf, m))
+	assert.Equal(t, "fullerite.cpu\\ usage\\,total,core=a\\=b\\,c,host=dev\\ box value=0.5 1500000000\n", buf.String())
+}
+
+func TestInfluxLineProtocolLineBreaks(t *testing.T) {
+	i := getTestInfluxHandler(12, 13, 14)
+	i.Configure(map[string]interface{}{"fieldKey": "the\nvalue"})
+
+	m := testInfluxMetric("cpu\nusage", 0.5)
+	m.AddDimension("core\r\nid", "a\nb")
+	m.AddDimension("path", "C:\\")
+
+	var buf bytes.Buffer
+	assert.True(t, i.writeLine(&buf, m))
+	assert.Equal(t, "cpu\\ usage,core\\ \\ id=a\\ b,path=C:\\\\ the\\ value=0.5 1500000000\n", buf.String())
+	assert.Equal(t, 1, strings.Count(buf.String(), "\n"), "one metric is one line")
+}
+
+func TestInfluxLineProtocolFieldKey(t *testing.T) {
+	i := getTestInfluxHandler(12, 13, 14)
+	i.Configure(map[string]interface{}{
+		"fieldKey":  "the value",
+		"precision": "ns",
+	})
+
+	var buf bytes.Buffer
+	assert.True(t, i.writeLine(&buf, testInfluxMetric("requests", 12)))
+	assert.Equal(t, "requests the\\ value=12 1500000000123456789\n", buf.String())
+}
+
+func TestInfluxLineProtocolSkipsInvalidValues(t *testing.T) {
+	i := getTestInfluxHandler(12, 13, 14)
+
+	var buf bytes.Buffer
+	assert.False(t, i.writeLine(&buf, testInfluxMetric("nan", math.NaN())))
+	assert.False(t, i.writeLine(&buf, testInfluxMetric("inf", math.Inf(1))))
+	assert.Equal(t, 0, buf.Len())
+}
+
+func TestInfluxRun(t *testing.T) {
+	ts, requests := fakeInflux(t, http.StatusNoContent)
+	defer ts.Close()
+
+	i := getTestInfluxHandler(12, 12, 12)
+	i.Configure(map[string]interface{}{
+		"interval":        "1",
+		"timeout":         "1",
+		"max_buffer_size": "1",
+		"endpoint":        ts.URL,
+		"database":        "metrics",
+		"username":        "user",
+		"password":        "pass",
+	})
+
+	go i.Run()
+	i.Channel() <- testInfluxMetric("Test", 1)
+
+	select {
+	case r := <-requests:
+		assert.Equal(t, "/write", r.path)
+		assert.Equal(t, "metrics", r.query.Get("db"))
+		assert.Equal(t, "user", r.query.Get("u"))
+		assert.Equal(t, "pass", r.query.Get("p"))
+		assert.Equal(t, "s", r.query.Get("precision"))
+		assert.Equal(t, "Test value=1 1500000000\n", r.body)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Failed to post and handle after 2 seconds")
+	}
+}
+
+func TestInfluxEmitV2Gzip(t *testing.T) {
+	ts, requests := fakeInflux(t, http.StatusNoContent)
+	defer ts.Close()
+
+	i := getTestInfluxHandler(12, 12, 12)
+	i.Configure(map[string]interface{}{
+		"endpoint":  ts.URL,
+		"org":       "infra",
+		"bucket":    "metrics",
+		"token":     "secret",
+		"precision": "ms",
+		"gzip":      true,
+	})
+	i.httpClient = i.newHTTPClient()
+
+	err := i.emit([]metric.Metric{testInfluxMetric("a", 1), testInfluxMetric("nan", math.NaN()), testInfluxMetric("b", 2)})
+	assert.True(t, emitted(err))
+	assert.Equal(t, 1, droppedCount(err), "NaN can't be written")
+
+	r := <-requests
+	assert.Equal(t, "/api/v2/write", r.path)
+	assert.Equal(t, "infra", r.query.Get("org"))
+	assert.Equal(t, "metrics", r.query.Get("bucket"))
+	assert.Equal(t, "ms", r.query.Get("precision"))
+	assert.Equal(t, "Token secret", r.header.Get("Authorization"))
+	assert.Equal(t, "gzip", r.header.Get("Content-Encoding"))
+	assert.Equal(t, "a value=1 1500000000123\nb value=2 1500000000123\n", r.body)
+}
+
+func TestInfluxEmitErrors(t *testing.T) {
+	ts, _ := fakeInflux(t, http.StatusBadRequest)
+	defer ts.Close()
+
+	i := getTestInfluxHandler(12, 12, 12)
+	i.Configure(map[string]interface{}{
+		"endpoint": ts.URL,
+		"database": "metrics",
+	})
+	i.httpClient = i.newHTTPClient()
+
+	err := i.emit([]metric.Metric{testInfluxMetric("Test", 1)})
+	assert.True(t, isFatal(err), "rejected payloads aren't retried")
+
+	err = i.emit([]metric.Metric{testInfluxMetric("Test", math.NaN())})
+	assert.True(t, isFatal(err), "empty payloads aren't retried")
+}
+
+func TestInfluxEmitServerError(t *testing.T) {
+	ts, _ := fakeInflux(t, http.StatusServiceUnavailable)
+	defer ts.Close()
+
+	i := getTestInfluxHandler(12, 12, 12)
+	i.Configure(map[string]interface{}{
+		"endpoint": ts.URL,
+		"database": "metrics",
+	})
+	i.httpClient = i.newHTTPClient()
+
+	err := i.emit([]metric.Metric{testInfluxMetric("Test", 1)})
+	assert.NotNil(t, err)
+	assert.False(t, isFatal(err))
+}
@@ -6,6 +6,7 @@ import (
 
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -87,7 +88,7 @@ func (k Kairos) Port() string {
 
 // Run runs the handler main loop
 func (k *Kairos) Run() {
-	k.run(k.emitMetrics)
+	k.runEmitter(k.emit)
 }
 
 func (k Kairos) convertToKairos(incomingMetric metric.Metric) (datapoint KairosMetric) {
@@ -95,7 +96,7 @@ func (k Kairos) convertToKairos(incomingMetric metric.Metric) (datapoint KairosM
 	km.Name = k.Prefix() + kairosSanitize(incomingMetric.Name)
 	km.Value = incomingMetric.Value
 	km.MetricType = "double"
-	km.Timestamp = time.Now().Unix() * 1000 // Kairos require timestamps to be milliseconds
+	km.Timestamp = incomingMetric.GetTimestamp().Unix() * 1000 // Kairos require timestamps to be milliseconds
 	km.Tags = make(map[string]string)
 	for key, value := range incomingMetric.GetDimensions(k.DefaultDimensions()) {
 		km.Tags[kairosSanitize(key)] = kairosSanitize(value)
@@ -104,11 +105,16 @@ func (k Kairos) convertToKairos(incomingMetric metric.Metric) (datapoint KairosM
 }
 
 func (k *Kairos) emitMetrics(metrics []metric.Metric) bool {
+	return k.emit(metrics) == nil
+}
+
+// emit posts metrics to Kairos, the payloads it rejects aren't retried
+func (k *Kairos) emit(metrics []metric.Metric) error {
 	k.log.Info("Starting to emit ", len(metrics), " metrics")
 
 	if len(metrics) == 0 {
 		k.log.Warn("Skipping send because of an empty payload")
-		return false
+		return fatal(errors.New("empty payload"))
 	}
 
 	series := make([]KairosMetric, 0, len(metrics))
@@ -120,14 +126,14 @@ func (k *Kairos) emitMetrics(metrics []metric.Metric) bool {
 	if err != nil {
 		k.log.Error("Failed marshaling datapoints to Kairos format")
 		k.log.Error("Dropping Kairos datapoints ", series)
-		return false
+		return fatal(err)
 	}
 
 	apiURL := fmt.Sprintf("http://%s:%s/api/v1/datapoints", k.server, k.port)
 	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(payload))
 	if err != nil {
 		k.log.Error("Failed to create a request to API url ", apiURL)
-		return false
+		return fatal(err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
@@ -137,16 +143,18 @@ func (k *Kairos) emitMetrics(metrics []metric.Metric) bool {
 	client := &http.Client{
 		Transport: &transport,
 	}
+	// the transport only serves this request, don't leave its connection idle
+	defer transport.CloseIdleConnections()
 	rsp, err := client.Do(req)
 	if err != nil {
 		k.log.Error("Failed to complete POST ", err)
-		return false
+		return err
 	}
 
 	defer rsp.Body.Close()
 	if rsp.StatusCode == http.StatusNoContent {
 		k.log.Info("Successfully sent ", len(series), " datapoints to Kairos")
-		return true
+		return nil
 	}
 
 	body, _ := ioutil.ReadAll(rsp.Body)
@@ -161,7 +169,10 @@ func (k *Kairos) emitMetrics(metrics []metric.Metric) bool {
 			" rsp body was ", string(body))
 	}
 
-	return false
+	if retryableStatus(rsp.StatusCode) {
+		return errors.New(rsp.Status)
+	}
+	return fatal(errors.New(rsp.Status))
 }
 
 func (k Kairos) dialTimeout(network, addr string) (net.Conn, error) {
@@ -113,6 +113,31 @@ func TestKairosRun(t *testing.T) {
 	}
 }
 
+func TestKairosRejectedPayloadIsFatal(t *testing.T) {
+	status := http.StatusBadRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+
+	url, _ := url.Parse(ts.URL)
+	urlParts := strings.Split(url.Host, ":")
+
+	k := getTestKairosHandler(12, 13, 14)
+	k.Configure(map[string]interface{}{
+		"server": urlParts[0],
+		"port":   urlParts[1],
+	})
+
+	err := k.emit([]metric.Metric{metric.New("Test")})
+	assert.True(t, isFatal(err))
+
+	status = http.StatusServiceUnavailable
+	err = k.emit([]metric.Metric{metric.New("Test")})
+	assert.NotNil(t, err)
+	assert.False(t, isFatal(err))
+}
+
 func TestKairosServerErrorParse(t *testing.T) {
 	k := getTestKairosHandler(12, 13, 14)
 
@@ -0,0 +1,404 @@
+package handler
+
+import (
+	"fullerite/config"
+	"fullerite/metric"
+	"fullerite/util"
+
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+func init() {
+	RegisterHandler("OpenTSDB", newOpenTSDB)
+}
+
+// Protocols the OpenTSDB handler speaks
+const (
+	// put lines over a persistent TCP connection
+	OpenTSDBProtocolTelnet = "telnet"
+	// JSON posted to /api/put
+	OpenTSDBProtocolHTTP = "http"
+)
+
+// What the OpenTSDB handler does with the metrics which have more
+// dimensions than OpenTSDB accepts tags
+const (
+	// keeps maxTags tags, the ones in tagPriority first
+	OpenTSDBTagOverflowTruncate = "truncate"
+	// drops the metric
+	OpenTSDBTagOverflowDrop = "drop"
+)
+
+// The defaults of the OpenTSDB handler, OpenTSDB accepts 8 tags unless
+// tsd.storage.max_tags says otherwise
+const (
+	DefaultOpenTSDBPort     = "4242"
+	DefaultOpenTSDBMaxTags  = 8
+	DefaultOpenTSDBAttempts = 3
+	// errors of the details logged per emission
+	openTSDBMaxLoggedErrors = 5
+)
+
+// OpenTSDB handler
+type OpenTSDB struct {
+	BaseHandler
+	server   string
+	port     string
+	protocol string
+
+	maxTags     int
+	tagPriority []string
+	tagOverflow string
+
+	// idle telnet connections, reused by the next emissions
+	conns      chan net.Conn
+	httpClient *util.HTTPAlive
+}
+
+type openTSDBDatapoint struct {
+	Metric    string            `json:"metric"`
+	Timestamp int64             `json:"timestamp"`
+	Value     float64           `json:"value"`
+	Tags      map[string]string `json:"tags"`
+}
+
+// openTSDBDetails is the response of /api/put?details
+type openTSDBDetails struct {
+	Success int `json:"success"`
+	Failed  int `json:"failed"`
+	Errors  []struct {
+		Datapoint openTSDBDatapoint `json:"datapoint"`
+		Error     string            `json:"error"`
+	} `json:"errors"`
+}
+
+// newOpenTSDB returns a new OpenTSDB handler
+func newOpenTSDB(
+	channel chan metric.Metric,
+	initialInterval int,
+	initialBufferSize int,
+	initialTimeout time.Duration,
+	log *l.Entry) Handler {
+
+	inst := new(OpenTSDB)
+	inst.name = "OpenTSDB"
+
+	inst.interval = initialInterval
+	inst.maxBufferSize = initialBufferSize
+	inst.timeout = initialTimeout
+	inst.configureHTTPDefaults(DefaultOpenTSDBAttempts)
+	inst.log = log
+	inst.channel = channel
+
+	inst.port = DefaultOpenTSDBPort
+	inst.protocol = OpenTSDBProtocolTelnet
+	inst.maxTags = DefaultOpenTSDBMaxTags
+	inst.tagOverflow = OpenTSDBTagOverflowTruncate
+	return inst
+}
+
+// Configure accepts the different configuration options for the OpenTSDB handler
+func (o *OpenTSDB) Configure(configMap map[string]interface{}) {
+	if server, exists := configMap["server"]; exists {
+		o.server = server.(string)
+	} else {
+		o.log.Error("There was no server specified for the OpenTSDB Handler, there won't be any emissions")
+	}
+	if port, exists := configMap["port"]; exists {
+		o.port = fmt.Sprint(port)
+	}
+
+	if protocol, exists := configMap["protocol"]; exists {
+		switch p := fmt.Sprint(protocol); p {
+		case OpenTSDBProtocolTelnet, OpenTSDBProtocolHTTP:
+			o.protocol = p
+		default:
+			o.log.Error("Unknown protocol ", p, ", using ", OpenTSDBProtocolTelnet)
+		}
+	}
+
+	if maxTags, exists := configMap["maxTags"]; exists {
+		o.maxTags = config.GetAsInt(maxTags, DefaultOpenTSDBMaxTags)
+	}
+	if tagPriority, exists := configMap["tagPriority"]; exists {
+		o.tagPriority = config.GetAsSlice(tagPriority)
+	}
+	if tagOverflow, exists := configMap["tagOverflow"]; exists {
+		switch p := fmt.Sprint(tagOverflow); p {
+		case OpenTSDBTagOverflowTruncate, OpenTSDBTagOverflowDrop:
+			o.tagOverflow = p
+		default:
+			o.log.Error("Unknown tagOverflow ", p, ", using ", OpenTSDBTagOverflowTruncate)
+		}
+	}
+	o.configureCommonParams(configMap)
+
+	size := o.MaxIdleConnectionsPerHost()
+	if size <= 0 {
+		size = DefaultMaxIdleConnectionsPerHost
+	}
+	o.conns = make(chan net.Conn, size)
+}
+
+// Server returns the OpenTSDB server's name or IP
+func (o *OpenTSDB) Server() string {
+	return o.server
+}
+
+// Port returns the OpenTSDB server's port number
+func (o *OpenTSDB) Port() string {
+	return o.port
+}
+
+// Protocol returns the protocol used to send the metrics: telnet or http
+func (o *OpenTSDB) Protocol() string {
+	return o.protocol
+}
+
+// Run runs the handler main loop
+func (o *OpenTSDB) Run() {
+	if o.conns == nil {
+		o.conns = make(chan net.Conn, DefaultMaxIdleConnectionsPerHost)
+	}
+	o.releaseOnStop(o.closeConnections)
+	if o.protocol == OpenTSDBProtocolHTTP {
+		o.httpClient = o.newHTTPClient()
+		o.releaseOnStop(o.httpClient.Close)
+	}
+
+	o.runEmitter(o.emit)
+}
+
+// emit sends the metrics in the configured protocol
+func (o *OpenTSDB) emit(metrics []metric.Metric) error {
+	o.log.Info("Starting to emit ", len(metrics), " metrics")
+
+	datapoints := make([]openTSDBDatapoint, 0, len(metrics))
+	for _, m := range metrics {
+		if datapoint, ok := o.convertToOpenTSDB(m); ok {
+			datapoints = append(datapoints, datapoint)
+		}
+	}
+	if len(datapoints) == 0 {
+		o.log.Warn("Skipping send because of an empty payload")
+		return fatal(errors.New("empty payload"))
+	}
+	invalid := len(metrics) - len(datapoints)
+
+	if o.protocol == OpenTSDBProtocolHTTP {
+		return dropped(invalid, o.emitHTTP(datapoints))
+	}
+	return dropped(invalid, o.emitTelnet(datapoints))
+}
+
+// convertToOpenTSDB returns the datapoint of m, false if OpenTSDB can't
+// store it: its value isn't a number or it has too many tags
+func (o *OpenTSDB) convertToOpenTSDB(m metric.Metric) (openTSDBDatapoint, bool) {
+	if math.IsNaN(m.Value) || math.IsInf(m.Value, 0) {
+		o.log.Debug("Dropping metric ", m.Name, " with value ", m.Value)
+		return openTSDBDatapoint{}, false
+	}
+
+	tags := make(map[string]string)
+	for key, value := range m.GetDimensions(o.DefaultDimensions()) {
+		tags[openTSDBSanitize(key)] = openTSDBSanitize(value)
+	}
+	if o.maxTags > 0 && len(tags) > o.maxTags {
+		if o.tagOverflow == OpenTSDBTagOverflowDrop {
+			o.log.Debug("Dropping metric ", m.Name, " with ", len(tags), " tags")
+			return openTSDBDatapoint{}, false
+		}
+		tags = o.truncateTags(tags)
+	}
+
+	return openTSDBDatapoint{
+		Metric:    openTSDBSanitize(o.Prefix() + m.Name),
+		Timestamp: m.GetTimestamp().Unix(),
+		Value:     m.Value,
+		Tags:      tags,
+	}, true
+}
+
+// truncateTags keeps maxTags tags: the ones in tagPriority first, in
+// order, then the others sorted by key
+func (o *OpenTSDB) truncateTags(tags map[string]string) map[string]string {
+	kept := make(map[string]string, o.maxTags)
+	for _, key := range o.tagPriority {
+		if len(kept) == o.maxTags {
+			return kept
+		}
+		key = openTSDBSanitize(key)
+		if value, exists := tags[key]; exists {
+			kept[key] = value
+		}
+	}
+
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if len(kept) == o.maxTags {
+			break
+		}
+		kept[key] = tags[key]
+	}
+	return kept
+}
+
+// openTSDBPutLine returns the put command of the telnet protocol
+func openTSDBPutLine(datapoint openTSDBDatapoint) string {
+	keys := make([]string, 0, len(datapoint.Tags))
+	for key := range datapoint.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var line bytes.Buffer
+	fmt.Fprintf(&line, "put %s %d %s", datapoint.Metric, datapoint.Timestamp,
+		strconv.FormatFloat(datapoint.Value, 'f', -1, 64))
+	for _, key := range keys {
+		line.WriteString(" " + key + "=" + datapoint.Tags[key])
+	}
+	line.WriteByte('\n')
+	return line.String()
+}
+
+// emitTelnet writes the put lines over a pooled connection. A connection
+// which fails is closed and the next emission reconnects.
+func (o *OpenTSDB) emitTelnet(datapoints []openTSDBDatapoint) error {
+	conn, reused, err := o.getConnection()
+	if err != nil {
+		o.log.Error("Failed to connect ", o.address(), ": ", err)
+		return err
+	}
+	err = o.writeTelnet(conn, datapoints)
+	if err != nil && reused {
+		// OpenTSDB may have closed the idle connection in the meantime
+		conn.Close()
+		if conn, _, err = o.dial(); err == nil {
+			err = o.writeTelnet(conn, datapoints)
+		}
+	}
+	if err != nil {
+		o.log.Error("Failed to send ", len(datapoints), " datapoints to ", o.address(), ": ", err)
+		if conn != nil {
+			conn.Close()
+		}
+		return err
+	}
+	o.putConnection(conn)
+	o.log.Info("Successfully sent ", len(datapoints), " datapoints to OpenTSDB")
+	return nil
+}
+
+func (o *OpenTSDB) writeTelnet(conn net.Conn, datapoints []openTSDBDatapoint) error {
+	if o.timeout > 0 {
+		conn.SetWriteDeadline(time.Now().Add(o.timeout))
+	}
+	w := bufio.NewWriter(conn)
+	for _, datapoint := range datapoints {
+		if _, err := w.WriteString(openTSDBPutLine(datapoint)); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// emitHTTP posts the datapoints to /api/put, asking for the details of
+// the failures. The datapoints OpenTSDB rejects are dropped, the others
+// are stored, so the emission only fails if all of them were rejected.
+func (o *OpenTSDB) emitHTTP(datapoints []openTSDBDatapoint) error {
+	payload, err := json.Marshal(datapoints)
+	if err != nil {
+		o.log.Error("Failed marshaling datapoints to OpenTSDB format")
+		return fatal(err)
+	}
+
+	apiURL := fmt.Sprintf("http://%s/api/put?details", o.address())
+	rsp, err := o.httpClient.MakeRequest("POST", apiURL, bytes.NewReader(payload),
+		map[string]string{"Content-Type": "application/json"})
+	if err != nil {
+		o.log.Error("Failed to make request ", err, " to endpoint ", apiURL)
+		return err
+	}
+
+	// OpenTSDB summarizes the datapoints it couldn't store whatever the
+	// status, 400 when some were invalid, 5xx when storing them failed
+	details := new(openTSDBDetails)
+	if json.Unmarshal(rsp.Body, details) == nil && details.Failed > 0 {
+		for i, e := range details.Errors {
+			if i == openTSDBMaxLoggedErrors {
+				break
+			}
+			o.log.Warn("OpenTSDB rejected ", e.Datapoint.Metric, " ", e.Datapoint.Tags, ": ", e.Error)
+		}
+		if details.Success > 0 {
+			o.log.Error("OpenTSDB rejected ", details.Failed, " of ", len(datapoints), " datapoints")
+			return dropped(details.Failed, nil)
+		}
+		if rsp.StatusCode/100 == 2 || !retryableStatus(rsp.StatusCode) {
+			return fatal(fmt.Errorf("OpenTSDB rejected the %d datapoints", details.Failed))
+		}
+	} else if rsp.StatusCode/100 == 2 {
+		o.log.Info("Successfully sent ", len(datapoints), " datapoints to OpenTSDB")
+		return nil
+	}
+	return o.httpStatusError(apiURL, rsp)
+}
+
+func (o *OpenTSDB) address() string {
+	return net.JoinHostPort(o.server, o.port)
+}
+
+// getConnection returns an idle connection, or a new one if there is none
+func (o *OpenTSDB) getConnection() (conn net.Conn, reused bool, err error) {
+	select {
+	case conn = <-o.conns:
+		return conn, true, nil
+	default:
+		return o.dial()
+	}
+}
+
+func (o *OpenTSDB) dial() (net.Conn, bool, error) {
+	conn, err := net.DialTimeout("tcp", o.address(), o.timeout)
+	return conn, false, err
+}
+
+// putConnection keeps conn for the next emissions, unless enough are idle
+func (o *OpenTSDB) putConnection(conn net.Conn) {
+	select {
+	case o.conns <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (o *OpenTSDB) closeConnections() {
+	for {
+		select {
+		case conn := <-o.conns:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// openTSDBSanitize keeps the characters OpenTSDB accepts, the same as Kairos
+func openTSDBSanitize(value string) string {
+	return util.StrSanitize(value, false, allowedPuncts)
+}
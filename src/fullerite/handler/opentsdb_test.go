@@ -0,0 +1,242 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestOpenTSDBHandler(interval, buffsize, timeoutsec int) *OpenTSDB {
+	testChannel := make(chan metric.Metric)
+	testLog := l.WithField("testing", "opentsdb_handler")
+	timeout := time.Duration(timeoutsec) * time.Second
+
+	return newOpenTSDB(testChannel, interval, buffsize, timeout, testLog).(*OpenTSDB)
+}
+
+func testOpenTSDBMetric(name string, value float64, dimensions map[string]string) metric.Metric {
+	m := metric.WithValue(name, value)
+	m.Timestamp = time.Unix(1500000000, 0)
+	m.AddDimensions(dimensions)
+	return m
+}
+
+// getTestOpenTSDBForHTTP returns a handler posting to a server answering
+// with status and body
+func getTestOpenTSDBForHTTP(t *testing.T, status int, body string) (*OpenTSDB, *httptest.Server, chan []openTSDBDatapoint) {
+	received := make(chan []openTSDBDatapoint, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/api/put", r.URL.Path)
+		_, details := r.URL.Query()["details"]
+		assert.True(t, details)
+
+		payload, err := ioutil.ReadAll(r.Body)
+		assert.Nil(t, err)
+		var datapoints []openTSDBDatapoint
+		assert.Nil(t, json.Unmarshal(payload, &datapoints))
+		received <- datapoints
+
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+
+	address, _ := url.Parse(ts.URL)
+	server, port, _ := net.SplitHostPort(address.Host)
+	o := getTestOpenTSDBHandler(12, 12, 12)
+	o.Configure(map[string]interface{}{
+		"server":   server,
+		"port":     port,
+		"protocol": "http",
+	})
+	o.httpClient = o.newHTTPClient()
+	return o, ts, received
+}
+
+func TestOpenTSDBConfigureEmptyConfig(t *testing.T) {
+	o := getTestOpenTSDBHandler(12, 13, 14)
+	o.Configure(map[string]interface{}{})
+
+	assert.Equal(t, 12, o.Interval())
+	assert.Equal(t, 13, o.MaxBufferSize())
+	assert.Equal(t, DefaultOpenTSDBPort, o.Port())
+	assert.Equal(t, OpenTSDBProtocolTelnet, o.Protocol())
+	assert.Equal(t, DefaultOpenTSDBMaxTags, o.maxTags)
+	assert.Equal(t, OpenTSDBTagOverflowTruncate, o.tagOverflow)
+	assert.Equal(t, DefaultOpenTSDBAttempts, o.maxEmissionAttempts)
+}
+
+func TestOpenTSDBConfigure(t *testing.T) {
+	o := getTestOpenTSDBHandler(12, 13, 14)
+	o.Configure(map[string]interface{}{
+		"server":      "opentsdb.server",
+		"port":        4343,
+		"protocol":    "http",
+		"maxTags":     "4",
+		"tagPriority": []interface{}{"host", "service"},
+		"tagOverflow": "drop",
+	})
+
+	assert.Equal(t, "opentsdb.server", o.Server())
+	assert.Equal(t, "4343", o.Port())
+	assert.Equal(t, OpenTSDBProtocolHTTP, o.Protocol())
+	assert.Equal(t, 4, o.maxTags)
+	assert.Equal(t, []string{"host", "service"}, o.tagPriority)
+	assert.Equal(t, OpenTSDBTagOverflowDrop, o.tagOverflow)
+}
+
+func TestOpenTSDBConfigureUnknownProtocol(t *testing.T) {
+	o := getTestOpenTSDBHandler(12, 13, 14)
+	o.Configure(map[string]interface{}{"protocol": "carrier-pigeon", "tagOverflow": "sample"})
+
+	assert.Equal(t, OpenTSDBProtocolTelnet, o.Protocol())
+	assert.Equal(t, OpenTSDBTagOverflowTruncate, o.tagOverflow)
+	assert.Equal(t, DefaultOpenTSDBAttempts, o.maxEmissionAttempts)
+}
+
+func TestOpenTSDBPutLine(t *testing.T) {
+	o := getTestOpenTSDBHandler(12, 13, 14)
+	o.SetPrefix("fullerite.")
+	o.SetDefaultDimensions(map[string]string{"host": "dev box"})
+
+	datapoint, ok := o.convertToOpenTSDB(testOpenTSDBMetric("cpu usage", 0.25, map[string]string{
+		"core": "a:1",
+	}))
+	assert.True(t, ok)
+	assert.Equal(t, "put fullerite.cpu_usage 1500000000 0.25 core=a-1 host=dev_box\n", openTSDBPutLine(datapoint))
+
+	o.SetPrefix("full erite.")
+	datapoint, ok = o.convertToOpenTSDB(testOpenTSDBMetric("cpu", 0.25, nil))
+	assert.True(t, ok)
+	assert.Equal(t, "full_erite.cpu", datapoint.Metric, "the prefix is sanitized too")
+}
+
+func TestOpenTSDBDropsInvalidValues(t *testing.T) {
+	o := getTestOpenTSDBHandler(12, 13, 14)
+
+	_, ok := o.convertToOpenTSDB(testOpenTSDBMetric("nan", math.NaN(), nil))
+	assert.False(t, ok)
+	_, ok = o.convertToOpenTSDB(testOpenTSDBMetric("inf", math.Inf(-1), nil))
+	assert.False(t, ok)
+}
+
+func TestOpenTSDBTruncateTags(t *testing.T) {
+	o := getTestOpenTSDBHandler(12, 13, 14)
+	o.Configure(map[string]interface{}{
+		"maxTags":     3,
+		"tagPriority": []interface{}{"service", "missing", "host"},
+	})
+
+	datapoint, ok := o.convertToOpenTSDB(testOpenTSDBMetric("requests", 1, map[string]string{
+		"a":       "1",
+		"b":       "2",
+		"host":    "dev",
+		"service": "api",
+	}))
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"service": "api", "host": "dev", "a": "1"}, datapoint.Tags)
+}
+
+func TestOpenTSDBDropTooManyTags(t *testing.T) {
+	o := getTestOpenTSDBHandler(12, 13, 14)
+	o.Configure(map[string]interface{}{
+		"maxTags":     1,
+		"tagOverflow": "drop",
+	})
+
+	_, ok := o.convertToOpenTSDB(testOpenTSDBMetric("requests", 1, map[string]string{"a": "1", "b": "2"}))
+	assert.False(t, ok)
+	_, ok = o.convertToOpenTSDB(testOpenTSDBMetric("requests", 1, map[string]string{"a": "1"}))
+	assert.True(t, ok)
+}
+
+func TestOpenTSDBTelnetReusesConnection(t *testing.T) {
+	server := newFakeCarbon(t, false)
+	defer server.listener.Close()
+
+	o := getTestOpenTSDBHandler(12, 12, 12)
+	o.Configure(map[string]interface{}{
+		"server": "127.0.0.1",
+		"port":   server.port(),
+	})
+	defer o.closeConnections()
+
+	assert.Nil(t, o.emit([]metric.Metric{testOpenTSDBMetric("first", 1, map[string]string{"host": "dev"})}))
+	assert.Nil(t, o.emit([]metric.Metric{testOpenTSDBMetric("second", 2, map[string]string{"host": "dev"})}))
+	server.expectLines(t,
+		"put first 1500000000 1 host=dev",
+		"put second 1500000000 2 host=dev")
+	assert.Len(t, server.connections, 1)
+}
+
+func TestOpenTSDBHTTP(t *testing.T) {
+	o, ts, received := getTestOpenTSDBForHTTP(t, http.StatusOK, `{"success":1,"failed":0,"errors":[]}`)
+	defer ts.Close()
+
+	err := o.emit([]metric.Metric{testOpenTSDBMetric("requests", 3, map[string]string{"host": "dev"})})
+	assert.Nil(t, err)
+	assert.Equal(t, []openTSDBDatapoint{{
+		Metric:    "requests",
+		Timestamp: 1500000000,
+		Value:     3,
+		Tags:      map[string]string{"host": "dev"},
+	}}, <-received)
+}
+
+func TestOpenTSDBHTTPPartialFailure(t *testing.T) {
+	details := `{"success":1,"failed":2,"errors":[
+		{"datapoint":{"metric":"b","timestamp":1500000000,"value":2,"tags":{}},"error":"Missing tags"},
+		{"datapoint":{"metric":"c","timestamp":1500000000,"value":3,"tags":{}},"error":"Missing tags"}]}`
+	o, ts, _ := getTestOpenTSDBForHTTP(t, http.StatusBadRequest, details)
+	defer ts.Close()
+
+	err := o.emit([]metric.Metric{
+		testOpenTSDBMetric("a", 1, map[string]string{"host": "dev"}),
+		testOpenTSDBMetric("b", 2, nil),
+		testOpenTSDBMetric("c", 3, nil),
+	})
+	assert.True(t, emitted(err), "the datapoints OpenTSDB stored aren't sent again")
+	assert.Equal(t, 2, droppedCount(err))
+
+	for _, status := range []int{http.StatusOK, http.StatusInternalServerError} {
+		o, ts, _ := getTestOpenTSDBForHTTP(t, status, details)
+		defer ts.Close()
+		err := o.emit([]metric.Metric{testOpenTSDBMetric("a", 1, nil)})
+		assert.True(t, emitted(err), "status %d", status)
+		assert.Equal(t, 2, droppedCount(err), "status %d", status)
+	}
+}
+
+func TestOpenTSDBHTTPErrors(t *testing.T) {
+	o, ts, _ := getTestOpenTSDBForHTTP(t, http.StatusBadRequest, `{"success":0,"failed":1,"errors":[]}`)
+	defer ts.Close()
+	err := o.emit([]metric.Metric{testOpenTSDBMetric("a", 1, nil)})
+	assert.True(t, isFatal(err), "rejected datapoints aren't retried")
+
+	o, ts, _ = getTestOpenTSDBForHTTP(t, http.StatusOK, `{"success":0,"failed":1,"errors":[]}`)
+	defer ts.Close()
+	err = o.emit([]metric.Metric{testOpenTSDBMetric("a", 1, nil)})
+	assert.True(t, isFatal(err), "rejected datapoints aren't retried")
+
+	o, ts, _ = getTestOpenTSDBForHTTP(t, http.StatusServiceUnavailable, "")
+	defer ts.Close()
+	err = o.emit([]metric.Metric{testOpenTSDBMetric("a", 1, nil)})
+	assert.NotNil(t, err)
+	assert.False(t, isFatal(err))
+
+	o, ts, _ = getTestOpenTSDBForHTTP(t, http.StatusServiceUnavailable, `{"success":0,"failed":1,"errors":[]}`)
+	defer ts.Close()
+	err = o.emit([]metric.Metric{testOpenTSDBMetric("a", 1, nil)})
+	assert.NotNil(t, err)
+	assert.False(t, isFatal(err), "datapoints OpenTSDB failed to store are retried")
+}
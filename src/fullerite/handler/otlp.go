@@ -0,0 +1,352 @@
+package handler
+
+import (
+	"fullerite/config"
+	"fullerite/metric"
+	"fullerite/util"
+
+	"bytes"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+)
+
+func init() {
+	RegisterHandler("OTLP", newOTLP)
+}
+
+// The defaults of the OTLP handler
+const (
+	DefaultOTLPAttempts      = 3
+	otlpContentType          = "application/x-protobuf"
+	otlpUserAgent            = "fullerite"
+	otlpScopeName            = "fullerite"
+	otlpServiceNameAttribute = "service.name"
+	otlpServiceName          = "fullerite"
+	otlpKindGauge            = "gauge"
+	otlpKindDelta            = "delta"
+	otlpKindCumulative       = "cumulative"
+)
+
+// OTLP handler posts the metrics to an OpenTelemetry collector, or any
+// other receiver of OTLP/HTTP. The default dimensions of the handler are
+// the attributes of the resource, the other dimensions the attributes of
+// the data points.
+type OTLP struct {
+	BaseHandler
+	endpoint   string
+	gzip       bool
+	headers    map[string]string
+	httpClient *util.HTTPAlive
+
+	// the sums sent so far, they give the start of the next points
+	mu        sync.Mutex
+	sums      map[string]otlpSum
+	lastFlush time.Time
+}
+
+// otlpSum is what the handler remembers of a delta or cumulative series
+type otlpSum struct {
+	start time.Time // the start of the cumulative sum
+	last  time.Time // the time of the last point sent
+	value float64
+	seen  time.Time // when the last point was sent
+}
+
+// newOTLP returns a new OTLP handler
+func newOTLP(
+	channel chan metric.Metric,
+	initialInterval int,
+	initialBufferSize int,
+	initialTimeout time.Duration,
+	log *l.Entry) Handler {
+
+	inst := new(OTLP)
+	inst.name = "OTLP"
+
+	inst.interval = initialInterval
+	inst.maxBufferSize = initialBufferSize
+	inst.timeout = initialTimeout
+	inst.configureHTTPDefaults(DefaultOTLPAttempts)
+	inst.log = log
+	inst.channel = channel
+	inst.sums = make(map[string]otlpSum)
+	inst.lastFlush = time.Now()
+	return inst
+}
+
+// Configure the OTLP handler
+func (o *OTLP) Configure(configMap map[string]interface{}) {
+	if endpoint, exists := configMap["endpoint"]; exists {
+		o.endpoint = endpoint.(string)
+	} else {
+		o.log.Error("There was no endpoint specified for the OTLP handler, there won't be any emissions")
+	}
+	if gzip, exists := configMap["gzip"]; exists {
+		o.gzip = config.GetAsBool(gzip, false)
+	}
+	if headers, exists := configMap["headers"]; exists {
+		o.headers = config.GetAsMap(headers)
+	}
+
+	o.configureCommonParams(configMap)
+}
+
+// Endpoint returns the URL the metrics are posted to
+func (o *OTLP) Endpoint() string {
+	return o.endpoint
+}
+
+// Run runs the handler main loop
+func (o *OTLP) Run() {
+	o.httpClient = o.newHTTPClient()
+	o.releaseOnStop(o.httpClient.Close)
+
+	o.runEmitter(o.emit)
+}
+
+// emit posts the metrics as an ExportMetricsServiceRequest
+func (o *OTLP) emit(metrics []metric.Metric) error {
+	o.log.Info("Starting to emit ", len(metrics), " metrics")
+
+	if len(metrics) == 0 {
+		o.log.Warn("Skipping send because of an empty payload")
+		return fatal(errors.New("empty payload"))
+	}
+	if o.endpoint == "" {
+		o.log.Warn("Skipping emission because we're missing the endpoint")
+		return fatal(errors.New("missing endpoint"))
+	}
+
+	request, sums := o.exportRequest(metrics)
+	err := o.export(request, len(metrics))
+	if emitted(err) || isFatal(err) {
+		// the emission is over, the next points start where these ended
+		o.rememberSums(sums)
+	}
+	return err
+}
+
+// export posts the request holding sent metrics, the requests rejected
+// with a 4xx aren't retried
+func (o *OTLP) export(request *ExportMetricsServiceRequest, sent int) error {
+	serialized, err := proto.Marshal(request)
+	if err != nil {
+		o.log.Error("Failed to serialize the export request ", err)
+		return fatal(err)
+	}
+
+	header := map[string]string{
+		"Content-Type": otlpContentType,
+		"User-Agent":   otlpUserAgent,
+	}
+	for name, value := range o.headers {
+		header[name] = value
+	}
+	if o.gzip {
+		if serialized, err = gzipPayload(serialized); err != nil {
+			o.log.Error("Failed to compress the payload ", err)
+			return fatal(err)
+		}
+		header["Content-Encoding"] = "gzip"
+	}
+
+	rsp, err := o.httpClient.MakeRequest("POST", o.endpoint, bytes.NewReader(serialized), header)
+	if err != nil {
+		o.log.Error("Failed to make request ", err, " to endpoint ", o.endpoint)
+		return err
+	}
+	if rsp.StatusCode/100 == 2 {
+		return dropped(o.handlePartialSuccess(rsp.Body, sent), nil)
+	}
+	return o.httpStatusError(o.endpoint, rsp)
+}
+
+// handlePartialSuccess returns how many data points the receiver rejected
+// while accepting the request, they're dropped
+func (o *OTLP) handlePartialSuccess(body []byte, sent int) int {
+	response := new(ExportMetricsServiceResponse)
+	if err := proto.Unmarshal(body, response); err != nil {
+		o.log.Warn("Cannot parse the response of the OTLP receiver ", err)
+	}
+
+	rejected := response.GetPartialSuccess().GetRejectedDataPoints()
+	if rejected <= 0 {
+		o.log.Info("Successfully sent ", sent, " metrics to ", o.endpoint)
+		return 0
+	}
+	o.log.Error("The OTLP receiver rejected ", rejected, " of ", sent, " data points: ",
+		response.GetPartialSuccess().GetErrorMessage())
+	return int(rejected)
+}
+
+// exportRequest puts the metrics in one resource, the data points of a
+// name and kind make one OTLP metric. It returns the sums of the request
+// too, to be remembered once it's sent.
+func (o *OTLP) exportRequest(metrics []metric.Metric) (*ExportMetricsServiceRequest, map[string]otlpSum) {
+	scope := &ScopeMetrics{
+		Scope: &InstrumentationScope{Name: proto.String(otlpScopeName)},
+	}
+	series := make(map[string]*OTLPMetric)
+	sums := make(map[string]otlpSum)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, m := range metrics {
+		name := o.Prefix() + m.Name
+		kind := otlpKind(m.MetricType)
+		key := name + "\x00" + kind
+		otlpMetric, exists := series[key]
+		if !exists {
+			otlpMetric = newOTLPMetric(name, kind)
+			series[key] = otlpMetric
+			scope.Metrics = append(scope.Metrics, otlpMetric)
+		}
+
+		point := &NumberDataPoint{
+			Attributes:   o.pointAttributes(m),
+			TimeUnixNano: proto.Uint64(uint64(m.GetTimestamp().UnixNano())),
+			AsDouble:     proto.Float64(m.Value),
+		}
+		if otlpMetric.Gauge != nil {
+			otlpMetric.Gauge.DataPoints = append(otlpMetric.Gauge.DataPoints, point)
+			continue
+		}
+
+		sumKey := kind + "\x00" + m.SeriesKey()
+		previous, exists := sums[sumKey]
+		if !exists {
+			previous, exists = o.sums[sumKey]
+		}
+		sum := o.nextSum(kind, m, previous, exists)
+		sums[sumKey] = sum
+		point.StartTimeUnixNano = proto.Uint64(uint64(sum.start.UnixNano()))
+		otlpMetric.Sum.DataPoints = append(otlpMetric.Sum.DataPoints, point)
+	}
+
+	request := &ExportMetricsServiceRequest{
+		ResourceMetrics: []*ResourceMetrics{{
+			Resource:     &Resource{Attributes: o.resourceAttributes()},
+			ScopeMetrics: []*ScopeMetrics{scope},
+		}},
+	}
+	return request, sums
+}
+
+// nextSum returns the sum of the point m following previous, its start
+// is the start of the point. Deltas start where the previous point of
+// their series ended, or at the previous flush. Cumulative sums start
+// when their series was first seen, or at the previous point if the
+// value went down: the counter was reset. Must be called holding mu.
+func (o *OTLP) nextSum(kind string, m metric.Metric, previous otlpSum, exists bool) otlpSum {
+	timestamp := m.GetTimestamp()
+	sum := otlpSum{start: timestamp, last: timestamp, value: m.Value}
+	switch {
+	case kind == otlpKindDelta && exists:
+		sum.start = previous.last
+	case kind == otlpKindDelta:
+		sum.start = o.lastFlush
+	case exists && m.Value >= previous.value:
+		sum.start = previous.start
+	case exists:
+		sum.start = previous.last
+	}
+	if sum.start.After(timestamp) {
+		sum.start = timestamp
+	}
+	return sum
+}
+
+// rememberSums keeps the sums which were sent, and forgets the series
+// which didn't report for a while
+func (o *OTLP) rememberSums(sums map[string]otlpSum) {
+	now := time.Now()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.lastFlush = now
+	for key, sum := range sums {
+		sum.seen = now
+		o.sums[key] = sum
+	}
+	for key, sum := range o.sums {
+		if now.Sub(sum.seen) > DefaultCumulativeCounterExpiry*time.Second {
+			delete(o.sums, key)
+		}
+	}
+}
+
+// otlpKind tells how a metric type is sent: counters are deltas over the
+// collection interval, cumulative counters totals since the series started
+func otlpKind(metricType string) string {
+	switch metricType {
+	case metric.Counter:
+		return otlpKindDelta
+	case metric.CumulativeCounter:
+		return otlpKindCumulative
+	}
+	return otlpKindGauge
+}
+
+func newOTLPMetric(name string, kind string) *OTLPMetric {
+	otlpMetric := &OTLPMetric{Name: proto.String(name)}
+	switch kind {
+	case otlpKindDelta:
+		otlpMetric.Sum = &Sum{
+			AggregationTemporality: AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA.Enum(),
+			IsMonotonic:            proto.Bool(true),
+		}
+	case otlpKindCumulative:
+		otlpMetric.Sum = &Sum{
+			AggregationTemporality: AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE.Enum(),
+			IsMonotonic:            proto.Bool(true),
+		}
+	default:
+		otlpMetric.Gauge = &Gauge{}
+	}
+	return otlpMetric
+}
+
+// resourceAttributes are the default dimensions, service.name is
+// fullerite unless they say otherwise
+func (o *OTLP) resourceAttributes() []*KeyValue {
+	attributes := map[string]string{otlpServiceNameAttribute: otlpServiceName}
+	for key, value := range o.DefaultDimensions() {
+		attributes[key] = value
+	}
+	return otlpAttributes(attributes)
+}
+
+// pointAttributes are the dimensions of m which aren't the same as the
+// resource attributes
+func (o *OTLP) pointAttributes(m metric.Metric) []*KeyValue {
+	defaults := o.DefaultDimensions()
+	attributes := make(map[string]string, len(m.Dimensions))
+	for key, value := range m.Dimensions {
+		if defaultValue, exists := defaults[key]; !exists || defaultValue != value {
+			attributes[key] = value
+		}
+	}
+	return otlpAttributes(attributes)
+}
+
+// otlpAttributes returns the attributes sorted by key
+func otlpAttributes(attributes map[string]string) []*KeyValue {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	keyValues := make([]*KeyValue, 0, len(keys))
+	for _, key := range keys {
+		keyValues = append(keyValues, &KeyValue{
+			Key:   proto.String(key),
+			Value: &AnyValue{StringValue: proto.String(attributes[key])},
+		})
+	}
+	return keyValues
+}
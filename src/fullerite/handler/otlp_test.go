@@ -0,0 +1,231 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"net/http"
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getTestOTLPHandler(interval, buffsize, timeoutsec int) *OTLP {
+	testChannel := make(chan metric.Metric)
+	testLog := l.WithField("testing", "otlp_handler")
+	timeout := time.Duration(timeoutsec) * time.Second
+
+	return newOTLP(testChannel, interval, buffsize, timeout, testLog).(*OTLP)
+}
+
+// getTestOTLPClient returns a handler posting to url
+func getTestOTLPClient(config map[string]interface{}, url string) *OTLP {
+	config["endpoint"] = url + "/v1/metrics"
+	o := getTestOTLPHandler(12, 12, 12)
+	o.Configure(config)
+	o.httpClient = o.newHTTPClient()
+	return o
+}
+
+// otlpResponse returns the serialized response of a receiver
+func otlpResponse(t *testing.T, response *ExportMetricsServiceResponse) []byte {
+	serialized, err := proto.Marshal(response)
+	require.Nil(t, err)
+	return serialized
+}
+
+// otlpExport returns the export request a receiver received
+func otlpExport(t *testing.T, r testHTTPRequest) *ExportMetricsServiceRequest {
+	export := new(ExportMetricsServiceRequest)
+	require.Nil(t, proto.Unmarshal(r.body, export))
+	return export
+}
+
+// otlpAttributeMap returns the attributes as a map
+func otlpAttributeMap(attributes []*KeyValue) map[string]string {
+	values := make(map[string]string)
+	for _, attribute := range attributes {
+		values[attribute.GetKey()] = attribute.GetValue().GetStringValue()
+	}
+	return values
+}
+
+func TestOTLPConfigureEmptyConfig(t *testing.T) {
+	o := getTestOTLPHandler(12, 13, 14)
+	o.Configure(map[string]interface{}{})
+
+	assert.Equal(t, 12, o.Interval())
+	assert.Equal(t, 13, o.MaxBufferSize())
+	assert.Equal(t, "", o.Endpoint())
+	assert.False(t, o.gzip)
+	assert.Empty(t, o.headers)
+	assert.Equal(t, DefaultOTLPAttempts, o.maxEmissionAttempts)
+}
+
+func TestOTLPConfigure(t *testing.T) {
+	o := getTestOTLPHandler(12, 13, 14)
+	o.Configure(map[string]interface{}{
+		"endpoint": "http://otel-collector:4318/v1/metrics",
+		"gzip":     "true",
+		"headers":  map[string]interface{}{"X-Team": "infra"},
+	})
+
+	assert.Equal(t, "http://otel-collector:4318/v1/metrics", o.Endpoint())
+	assert.True(t, o.gzip)
+	assert.Equal(t, map[string]string{"X-Team": "infra"}, o.headers)
+}
+
+func TestOTLPExportRequest(t *testing.T) {
+	o := getTestOTLPHandler(12, 13, 14)
+	o.SetPrefix("fullerite.")
+	o.SetDefaultDimensions(map[string]string{"host": "dev", "region": "east"})
+
+	request, _ := o.exportRequest([]metric.Metric{
+		newTestMetric("load", metric.Gauge, 0, map[string]string{"host": "dev", "core": "0"}),
+		newTestMetric("load", metric.Gauge, 1.5, map[string]string{"region": "west"}),
+		newTestMetric("requests", metric.Counter, 3, nil),
+		newTestMetric("requests", metric.CumulativeCounter, 300, nil),
+	})
+
+	require.Len(t, request.ResourceMetrics, 1)
+	resource := request.ResourceMetrics[0]
+	assert.Equal(t, map[string]string{
+		"host":         "dev",
+		"region":       "east",
+		"service.name": "fullerite",
+	}, otlpAttributeMap(resource.Resource.Attributes))
+
+	require.Len(t, resource.ScopeMetrics, 1)
+	assert.Equal(t, "fullerite", resource.ScopeMetrics[0].Scope.GetName())
+	metrics := resource.ScopeMetrics[0].Metrics
+	require.Len(t, metrics, 3)
+
+	load := metrics[0]
+	assert.Equal(t, "fullerite.load", load.GetName())
+	assert.Nil(t, load.Sum)
+	require.Len(t, load.Gauge.DataPoints, 2)
+	point := load.Gauge.DataPoints[0]
+	assert.Equal(t, map[string]string{"core": "0"}, otlpAttributeMap(point.Attributes))
+	assert.NotNil(t, point.AsDouble, "a value of 0 is sent")
+	assert.Equal(t, uint64(1500000000*time.Second), point.GetTimeUnixNano())
+	assert.Equal(t, map[string]string{"region": "west"}, otlpAttributeMap(load.Gauge.DataPoints[1].Attributes))
+
+	delta := metrics[1]
+	assert.Nil(t, delta.Gauge)
+	assert.Equal(t, AggregationTemporality_AGGREGATION_TEMPORALITY_DELTA, delta.Sum.GetAggregationTemporality())
+	assert.True(t, delta.Sum.GetIsMonotonic())
+	assert.Equal(t, 3.0, delta.Sum.DataPoints[0].GetAsDouble())
+
+	cumulative := metrics[2]
+	assert.Equal(t, AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE, cumulative.Sum.GetAggregationTemporality())
+	assert.True(t, cumulative.Sum.GetIsMonotonic())
+	assert.Equal(t, 300.0, cumulative.Sum.DataPoints[0].GetAsDouble())
+}
+
+func TestOTLPStartTimes(t *testing.T) {
+	ts, received := newTestHTTPReceiver(t, otlpResponse(t, &ExportMetricsServiceResponse{}), http.StatusOK)
+	defer ts.Close()
+	o := getTestOTLPClient(map[string]interface{}{}, ts.URL)
+	o.lastFlush = time.Unix(1499999990, 0)
+
+	emit := func(at int64, delta float64, cumulative float64) (deltaStart uint64, cumulativeStart uint64) {
+		requests := newTestMetric("requests", metric.Counter, delta, nil)
+		requests.Timestamp = time.Unix(at, 0)
+		total := newTestMetric("total", metric.CumulativeCounter, cumulative, nil)
+		total.Timestamp = time.Unix(at, 0)
+		require.Nil(t, o.emit([]metric.Metric{requests, total}))
+		metrics := otlpExport(t, <-received).ResourceMetrics[0].ScopeMetrics[0].Metrics
+		return metrics[0].Sum.DataPoints[0].GetStartTimeUnixNano(), metrics[1].Sum.DataPoints[0].GetStartTimeUnixNano()
+	}
+	seconds := func(s int64) uint64 { return uint64(time.Unix(s, 0).UnixNano()) }
+
+	deltaStart, cumulativeStart := emit(1500000000, 1, 10)
+	assert.Equal(t, seconds(1499999990), deltaStart, "a new delta starts at the previous flush")
+	assert.Equal(t, seconds(1500000000), cumulativeStart, "a new sum starts when it's first seen")
+
+	deltaStart, cumulativeStart = emit(1500000010, 1, 20)
+	assert.Equal(t, seconds(1500000000), deltaStart, "a delta starts where the previous one ended")
+	assert.Equal(t, seconds(1500000000), cumulativeStart)
+
+	_, cumulativeStart = emit(1500000020, 1, 5)
+	assert.Equal(t, seconds(1500000010), cumulativeStart, "a reset sum starts again")
+
+	unavailable, _ := newTestHTTPReceiver(t, nil, http.StatusServiceUnavailable)
+	defer unavailable.Close()
+	o.endpoint = unavailable.URL
+	assert.NotNil(t, o.emit([]metric.Metric{newTestMetric("total", metric.CumulativeCounter, 1, nil)}))
+	assert.Equal(t, time.Unix(1500000020, 0), o.sums[otlpKindCumulative+"\x00total,"].last,
+		"the sums which weren't sent aren't remembered")
+}
+
+func TestOTLPServiceNameFromDefaultDimensions(t *testing.T) {
+	o := getTestOTLPHandler(12, 13, 14)
+	o.SetDefaultDimensions(map[string]string{"service.name": "web"})
+
+	attributes := otlpAttributeMap(o.resourceAttributes())
+	assert.Equal(t, "web", attributes["service.name"])
+}
+
+func TestOTLPEmit(t *testing.T) {
+	ts, requests := newTestHTTPReceiver(t, otlpResponse(t, &ExportMetricsServiceResponse{}), http.StatusOK)
+	defer ts.Close()
+	o := getTestOTLPClient(map[string]interface{}{
+		"gzip":    true,
+		"headers": map[string]interface{}{"Authorization": "Bearer secret"},
+	}, ts.URL)
+
+	err := o.emit([]metric.Metric{newTestMetric("load", metric.Gauge, 0.5, nil)})
+	require.Nil(t, err)
+
+	r := <-requests
+	assert.Equal(t, "POST", r.method)
+	assert.Equal(t, "/v1/metrics", r.uri)
+	assert.Equal(t, "application/x-protobuf", r.header.Get("Content-Type"))
+	assert.Equal(t, "gzip", r.header.Get("Content-Encoding"))
+	assert.Equal(t, "Bearer secret", r.header.Get("Authorization"))
+
+	export := otlpExport(t, r)
+	point := export.ResourceMetrics[0].ScopeMetrics[0].Metrics[0].Gauge.DataPoints[0]
+	assert.Equal(t, 0.5, point.GetAsDouble())
+}
+
+func TestOTLPPartialSuccess(t *testing.T) {
+	ts, _ := newTestHTTPReceiver(t, otlpResponse(t, &ExportMetricsServiceResponse{
+		PartialSuccess: &ExportMetricsPartialSuccess{
+			RejectedDataPoints: proto.Int64(1),
+			ErrorMessage:       proto.String("invalid name"),
+		},
+	}), http.StatusOK)
+	defer ts.Close()
+	o := getTestOTLPClient(map[string]interface{}{}, ts.URL)
+
+	err := o.emit([]metric.Metric{
+		newTestMetric("a", metric.Gauge, 1, nil),
+		newTestMetric("b", metric.Gauge, 2, nil),
+	})
+	assert.True(t, emitted(err), "the data points the receiver accepted aren't sent again")
+	assert.Equal(t, 1, droppedCount(err))
+}
+
+func TestOTLPErrors(t *testing.T) {
+	ts, _ := newTestHTTPReceiver(t, nil, http.StatusBadRequest)
+	defer ts.Close()
+	o := getTestOTLPClient(map[string]interface{}{}, ts.URL)
+	err := o.emit([]metric.Metric{newTestMetric("a", metric.Gauge, 1, nil)})
+	assert.True(t, isFatal(err), "rejected requests aren't retried")
+
+	ts, _ = newTestHTTPReceiver(t, nil, http.StatusServiceUnavailable)
+	defer ts.Close()
+	o = getTestOTLPClient(map[string]interface{}{}, ts.URL)
+	err = o.emit([]metric.Metric{newTestMetric("a", metric.Gauge, 1, nil)})
+	assert.NotNil(t, err)
+	assert.False(t, isFatal(err))
+
+	o = getTestOTLPHandler(12, 13, 14)
+	o.Configure(map[string]interface{}{})
+	err = o.emit([]metric.Metric{newTestMetric("a", metric.Gauge, 1, nil)})
+	assert.True(t, isFatal(err), "nothing is sent without an endpoint")
+}
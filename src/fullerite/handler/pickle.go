@@ -0,0 +1,60 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+)
+
+// The pickle opcodes we need to encode the datapoints of the
+// carbon pickle protocol, see pickletools.py
+const (
+	pickleProto      = 0x80
+	pickleEmptyList  = ']'
+	pickleMark       = '('
+	pickleAppends    = 'e'
+	pickleBinUnicode = 'X'
+	pickleBinInt     = 'J'
+	pickleLong1      = 0x8a
+	pickleBinFloat   = 'G'
+	pickleTuple2     = 0x86
+	pickleStop       = '.'
+)
+
+type pickleDatapoint struct {
+	path      string
+	timestamp int64
+	value     float64
+}
+
+// pickleMessage pickles the datapoints as a list of (path, (timestamp,
+// value)) tuples, prefixed with the length of the pickle as carbon expects
+func pickleMessage(datapoints []pickleDatapoint) []byte {
+	var buf bytes.Buffer
+	// room for the length
+	buf.Write([]byte{0, 0, 0, 0})
+
+	buf.Write([]byte{pickleProto, 2, pickleEmptyList, pickleMark})
+	for _, d := range datapoints {
+		buf.WriteByte(pickleBinUnicode)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(d.path)))
+		buf.WriteString(d.path)
+
+		if d.timestamp >= math.MinInt32 && d.timestamp <= math.MaxInt32 {
+			buf.WriteByte(pickleBinInt)
+			binary.Write(&buf, binary.LittleEndian, int32(d.timestamp))
+		} else {
+			buf.Write([]byte{pickleLong1, 8})
+			binary.Write(&buf, binary.LittleEndian, d.timestamp)
+		}
+
+		buf.WriteByte(pickleBinFloat)
+		binary.Write(&buf, binary.BigEndian, d.value)
+		buf.Write([]byte{pickleTuple2, pickleTuple2})
+	}
+	buf.Write([]byte{pickleAppends, pickleStop})
+
+	message := buf.Bytes()
+	binary.BigEndian.PutUint32(message, uint32(len(message)-4))
+	return message
+}
@@ -0,0 +1,321 @@
+package handler
+
+import (
+	"fullerite/config"
+	"fullerite/metric"
+
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+func init() {
+	RegisterHandler("Prometheus", newPrometheus)
+}
+
+// The defaults of the endpoint Prometheus scrapes
+const (
+	DefaultPrometheusPort           = 9101
+	DefaultPrometheusPath           = "/metrics"
+	DefaultPrometheusStaleIntervals = 5
+)
+
+// Prometheus handler doesn't push the metrics: it keeps the latest value
+// of every series and serves them to Prometheus in its text exposition
+// format. Counters, which fullerite emits as the increase over an
+// interval, are added up to be served as the monotonic counters
+// Prometheus expects. A name has a single type: the series which don't
+// have the type of the other series of their name are dropped.
+type Prometheus struct {
+	BaseHandler
+	port           int
+	path           string
+	staleIntervals int
+
+	listener net.Listener
+
+	seriesMu sync.Mutex
+	series   map[string]*prometheusSeries
+	names    map[string]*prometheusNameType
+}
+
+// prometheusNameType is the type of the series of a name
+type prometheusNameType struct {
+	metricType string
+	series     int
+}
+
+type prometheusSeries struct {
+	name       string
+	labels     string
+	metricType string
+	value      float64
+	lastSeen   time.Time
+}
+
+// newPrometheus returns a new Prometheus handler
+func newPrometheus(
+	channel chan metric.Metric,
+	initialInterval int,
+	initialBufferSize int,
+	initialTimeout time.Duration,
+	log *l.Entry) Handler {
+
+	inst := new(Prometheus)
+	inst.name = "Prometheus"
+
+	inst.interval = initialInterval
+	inst.maxBufferSize = initialBufferSize
+	inst.timeout = initialTimeout
+	inst.log = log
+	inst.channel = channel
+
+	inst.port = DefaultPrometheusPort
+	inst.path = DefaultPrometheusPath
+	inst.staleIntervals = DefaultPrometheusStaleIntervals
+	inst.series = make(map[string]*prometheusSeries)
+	inst.names = make(map[string]*prometheusNameType)
+	return inst
+}
+
+// Configure the Prometheus handler
+func (p *Prometheus) Configure(configMap map[string]interface{}) {
+	if port, exists := configMap["port"]; exists {
+		p.port = config.GetAsInt(port, DefaultPrometheusPort)
+	}
+	if path, exists := configMap["path"]; exists {
+		p.path = path.(string)
+	}
+	if staleIntervals, exists := configMap["staleIntervals"]; exists {
+		p.staleIntervals = config.GetAsInt(staleIntervals, DefaultPrometheusStaleIntervals)
+	}
+	p.configureCommonParams(configMap)
+}
+
+// Port returns the port Prometheus scrapes
+func (p *Prometheus) Port() int {
+	return p.port
+}
+
+// Path returns the path Prometheus scrapes
+func (p *Prometheus) Path() string {
+	return p.path
+}
+
+// Run serves the metrics and runs the handler main loop
+func (p *Prometheus) Run() {
+	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", p.port))
+	if err != nil {
+		p.log.Error("Failed to listen on port ", p.port, ", Prometheus won't scrape the metrics: ", err)
+	} else {
+		mux := http.NewServeMux()
+		mux.HandleFunc(p.path, p.handleScrape)
+		server := &http.Server{Handler: mux}
+		p.seriesMu.Lock()
+		p.listener = ln
+		p.seriesMu.Unlock()
+		p.releaseOnStop(func() { server.Close() })
+		go server.Serve(ln)
+		p.log.Info("Serving the metrics to Prometheus on ", ln.Addr(), p.path)
+	}
+
+	p.runEmitter(p.emit)
+}
+
+// Addr returns the address the metrics are served on, nil until it runs
+func (p *Prometheus) Addr() net.Addr {
+	p.seriesMu.Lock()
+	defer p.seriesMu.Unlock()
+	if p.listener == nil {
+		return nil
+	}
+	return p.listener.Addr()
+}
+
+// emit keeps the latest value of the series until they're scraped, the
+// metrics whose type conflicts with the other series of their name are
+// dropped
+func (p *Prometheus) emit(metrics []metric.Metric) error {
+	now := time.Now()
+	p.seriesMu.Lock()
+	defer p.seriesMu.Unlock()
+
+	conflicts := 0
+	for _, m := range metrics {
+		name := prometheusName(p.Prefix() + m.Name)
+		labels := p.prometheusLabels(m)
+		key := name + "{" + labels + "}"
+		metricType := prometheusType(m.MetricType)
+
+		s, exists := p.series[key]
+		nameType, named := p.names[name]
+		// the only series of a name can change its type
+		if named && nameType.metricType != metricType && (!exists || nameType.series > 1) {
+			p.log.Debug("Dropping ", m.Name, ": its name is a ", nameType.metricType, ", not a ", metricType)
+			conflicts++
+			continue
+		}
+		if !named {
+			nameType = &prometheusNameType{}
+			p.names[name] = nameType
+		}
+		nameType.metricType = metricType
+		if !exists {
+			s = &prometheusSeries{name: name, labels: labels}
+			p.series[key] = s
+			nameType.series++
+		}
+
+		if m.MetricType == metric.Counter && exists && s.metricType == metricType {
+			s.value += m.Value
+		} else {
+			s.value = m.Value
+		}
+		s.metricType = metricType
+		s.lastSeen = now
+	}
+	p.expire(now)
+	if conflicts > 0 {
+		p.log.Warn("Dropped ", conflicts, " metrics whose name has series of another type")
+	}
+	return dropped(conflicts, nil)
+}
+
+// prometheusType returns the Prometheus type of a metric type
+func prometheusType(metricType string) string {
+	switch metricType {
+	case metric.Counter, metric.CumulativeCounter:
+		return "counter"
+	}
+	return "gauge"
+}
+
+// expire forgets the series which weren't seen within staleIntervals
+// intervals, seriesMu must be held
+func (p *Prometheus) expire(now time.Time) {
+	if p.staleIntervals <= 0 || p.interval <= 0 {
+		return
+	}
+	staleAfter := time.Duration(p.staleIntervals*p.interval) * time.Second
+	for key, s := range p.series {
+		if now.Sub(s.lastSeen) > staleAfter {
+			delete(p.series, key)
+			nameType := p.names[s.name]
+			nameType.series--
+			if nameType.series == 0 {
+				delete(p.names, s.name)
+			}
+		}
+	}
+}
+
+func (p *Prometheus) handleScrape(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(p.exposition(time.Now()))
+}
+
+// exposition returns the series in the text exposition format, grouped
+// by name with the # TYPE line of each name first
+func (p *Prometheus) exposition(now time.Time) []byte {
+	p.seriesMu.Lock()
+	p.expire(now)
+	series := make([]*prometheusSeries, 0, len(p.series))
+	for _, s := range p.series {
+		copied := *s
+		series = append(series, &copied)
+	}
+	p.seriesMu.Unlock()
+
+	sort.Slice(series, func(i, j int) bool {
+		if series[i].name != series[j].name {
+			return series[i].name < series[j].name
+		}
+		return series[i].labels < series[j].labels
+	})
+
+	var buf bytes.Buffer
+	for i, s := range series {
+		if i == 0 || series[i-1].name != s.name {
+			fmt.Fprintf(&buf, "# TYPE %s %s\n", s.name, s.metricType)
+		}
+		buf.WriteString(s.name)
+		if s.labels != "" {
+			buf.WriteString("{" + s.labels + "}")
+		}
+		buf.WriteByte(' ')
+		buf.WriteString(strconv.FormatFloat(s.value, 'g', -1, 64))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// prometheusLabels returns the sorted labels of m, as they're written
+// between the braces
+func (p *Prometheus) prometheusLabels(m metric.Metric) string {
+	dimensions := m.GetDimensions(p.DefaultDimensions())
+	labels := make(map[string]string, len(dimensions))
+	keys := make([]string, 0, len(dimensions))
+	for key, value := range dimensions {
+		label := prometheusLabelName(key)
+		if label == "" {
+			continue
+		}
+		if _, exists := labels[label]; !exists {
+			keys = append(keys, label)
+		}
+		labels[label] = value
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key+"=\""+prometheusLabelValueEscaper.Replace(labels[key])+"\"")
+	}
+	return strings.Join(pairs, ",")
+}
+
+var prometheusLabelValueEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n")
+
+// prometheusName makes name match [a-zA-Z_:][a-zA-Z0-9_:]*
+func prometheusName(name string) string {
+	return prometheusSanitize(name, true)
+}
+
+// prometheusLabelName makes name match [a-zA-Z_][a-zA-Z0-9_]*, the
+// names starting with __ are reserved to Prometheus
+func prometheusLabelName(name string) string {
+	name = prometheusSanitize(name, false)
+	if strings.HasPrefix(name, "__") {
+		name = strings.TrimLeft(name, "_")
+	}
+	return name
+}
+
+func prometheusSanitize(name string, allowColons bool) string {
+	if name == "" {
+		return ""
+	}
+	sanitized := []rune(name)
+	for i, c := range sanitized {
+		valid := c == '_' ||
+			(c >= 'a' && c <= 'z') ||
+			(c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9') ||
+			(c == ':' && allowColons)
+		if !valid {
+			sanitized[i] = '_'
+		}
+	}
+	if sanitized[0] >= '0' && sanitized[0] <= '9' {
+		return "_" + string(sanitized)
+	}
+	return string(sanitized)
+}
@@ -0,0 +1,233 @@
+package handler
+
+import (
+	"fullerite/metric"
+	"fullerite/util"
+
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+)
+
+func init() {
+	RegisterHandler("PrometheusRemoteWrite", newPrometheusRemoteWrite)
+}
+
+// The defaults of the PrometheusRemoteWrite handler
+const (
+	DefaultPrometheusTenantHeader        = "X-Scope-OrgID"
+	DefaultPrometheusRemoteWriteAttempts = 3
+	prometheusRemoteWriteVersion         = "0.1.0"
+	prometheusRemoteWriteNameLabel       = "__name__"
+	prometheusRemoteWriteContentEncoding = "snappy"
+	prometheusRemoteWriteContentType     = "application/x-protobuf"
+	prometheusRemoteWriteUserAgent       = "fullerite"
+	prometheusRemoteWriteVersionHeader   = "X-Prometheus-Remote-Write-Version"
+)
+
+// PrometheusRemoteWrite handler sends the metrics to the remote write
+// API of Prometheus compatible storages such as Cortex or Thanos
+type PrometheusRemoteWrite struct {
+	BaseHandler
+	endpoint   string
+	httpClient *util.HTTPAlive
+
+	bearerToken string
+	username    string
+	password    string
+
+	tenant       string
+	tenantHeader string
+}
+
+// newPrometheusRemoteWrite returns a new PrometheusRemoteWrite handler
+func newPrometheusRemoteWrite(
+	channel chan metric.Metric,
+	initialInterval int,
+	initialBufferSize int,
+	initialTimeout time.Duration,
+	log *l.Entry) Handler {
+
+	inst := new(PrometheusRemoteWrite)
+	inst.name = "PrometheusRemoteWrite"
+
+	inst.interval = initialInterval
+	inst.maxBufferSize = initialBufferSize
+	inst.timeout = initialTimeout
+	inst.log = log
+	inst.channel = channel
+
+	inst.configureHTTPDefaults(DefaultPrometheusRemoteWriteAttempts)
+	inst.tenantHeader = DefaultPrometheusTenantHeader
+	return inst
+}
+
+// Configure the PrometheusRemoteWrite handler
+func (p *PrometheusRemoteWrite) Configure(configMap map[string]interface{}) {
+	if endpoint, exists := configMap["endpoint"]; exists {
+		p.endpoint = endpoint.(string)
+	} else {
+		p.log.Error("There was no endpoint specified for the PrometheusRemoteWrite handler, there won't be any emissions")
+	}
+
+	if bearerToken, exists := configMap["bearerToken"]; exists {
+		p.bearerToken = bearerToken.(string)
+	}
+	if username, exists := configMap["username"]; exists {
+		p.username = username.(string)
+	}
+	if password, exists := configMap["password"]; exists {
+		p.password = password.(string)
+	}
+	if p.bearerToken != "" && p.username != "" {
+		p.log.Warn("Both bearerToken and username are set for the PrometheusRemoteWrite handler, using the bearer token")
+	}
+
+	if tenant, exists := configMap["tenant"]; exists {
+		p.tenant = tenant.(string)
+	}
+	if tenantHeader, exists := configMap["tenantHeader"]; exists && tenantHeader.(string) != "" {
+		p.tenantHeader = tenantHeader.(string)
+	}
+
+	p.configureCommonParams(configMap)
+}
+
+// Endpoint returns the remote write endpoint
+func (p *PrometheusRemoteWrite) Endpoint() string {
+	return p.endpoint
+}
+
+// Run runs the handler main loop
+func (p *PrometheusRemoteWrite) Run() {
+	p.httpClient = p.newHTTPClient()
+	p.releaseOnStop(p.httpClient.Close)
+
+	p.runEmitter(p.emit)
+}
+
+// emit posts the metrics as a snappy compressed WriteRequest, the
+// payloads rejected with a 4xx aren't retried
+func (p *PrometheusRemoteWrite) emit(metrics []metric.Metric) error {
+	p.log.Info("Starting to emit ", len(metrics), " metrics")
+
+	if len(metrics) == 0 {
+		p.log.Warn("Skipping send because of an empty payload")
+		return fatal(errors.New("empty payload"))
+	}
+	if p.endpoint == "" {
+		p.log.Warn("Skipping emission because we're missing the endpoint")
+		return fatal(errors.New("missing endpoint"))
+	}
+
+	request := p.writeRequest(metrics)
+	serialized, err := proto.Marshal(request)
+	if err != nil {
+		p.log.Error("Failed to serialize the write request ", err)
+		return fatal(err)
+	}
+
+	rsp, err := p.httpClient.MakeRequest(
+		"POST",
+		p.endpoint,
+		bytes.NewReader(snappy.Encode(nil, serialized)),
+		p.headers())
+	if err != nil {
+		p.log.Error("Failed to make request ", err, " to endpoint ", p.endpoint)
+		return err
+	}
+	if rsp.StatusCode/100 == 2 {
+		p.log.Info("Successfully sent ", len(request.Timeseries), " series to ", p.endpoint)
+		return nil
+	}
+
+	return p.httpStatusError(p.endpoint, rsp)
+}
+
+// headers returns the remote write headers and the ones authenticating
+// the request
+func (p *PrometheusRemoteWrite) headers() map[string]string {
+	header := map[string]string{
+		"Content-Encoding":                 prometheusRemoteWriteContentEncoding,
+		"Content-Type":                     prometheusRemoteWriteContentType,
+		"User-Agent":                       prometheusRemoteWriteUserAgent,
+		prometheusRemoteWriteVersionHeader: prometheusRemoteWriteVersion,
+	}
+	if p.bearerToken != "" {
+		header["Authorization"] = "Bearer " + p.bearerToken
+	} else if p.username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.username + ":" + p.password))
+		header["Authorization"] = "Basic " + credentials
+	}
+	if p.tenant != "" {
+		header[p.tenantHeader] = p.tenant
+	}
+	return header
+}
+
+// writeRequest groups the metrics by series, the samples of each series
+// in chronological order
+func (p *PrometheusRemoteWrite) writeRequest(metrics []metric.Metric) *WriteRequest {
+	request := new(WriteRequest)
+	series := make(map[string]*TimeSeries)
+	for _, m := range metrics {
+		labels := p.labels(m)
+		key := prometheusRemoteWriteSeriesKey(labels)
+		ts, exists := series[key]
+		if !exists {
+			ts = &TimeSeries{Labels: labels}
+			series[key] = ts
+			request.Timeseries = append(request.Timeseries, ts)
+		}
+		ts.Samples = append(ts.Samples, &Sample{
+			Value:     m.Value,
+			Timestamp: m.GetTimestamp().UnixNano() / int64(time.Millisecond),
+		})
+	}
+	for _, ts := range request.Timeseries {
+		samples := ts.Samples
+		sort.SliceStable(samples, func(i, j int) bool {
+			return samples[i].Timestamp < samples[j].Timestamp
+		})
+	}
+	return request
+}
+
+// labels returns the labels of m sorted by name, as remote write expects
+func (p *PrometheusRemoteWrite) labels(m metric.Metric) []*Label {
+	dimensions := m.GetDimensions(p.DefaultDimensions())
+	values := make(map[string]string, len(dimensions)+1)
+	for key, value := range dimensions {
+		// an empty label is the same as a missing one
+		if name := prometheusLabelName(key); name != "" && value != "" {
+			values[name] = value
+		}
+	}
+	values[prometheusRemoteWriteNameLabel] = prometheusName(p.Prefix() + m.Name)
+
+	labels := make([]*Label, 0, len(values))
+	for name, value := range values {
+		labels = append(labels, &Label{Name: name, Value: value})
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		return labels[i].Name < labels[j].Name
+	})
+	return labels
+}
+
+func prometheusRemoteWriteSeriesKey(labels []*Label) string {
+	var key bytes.Buffer
+	for _, label := range labels {
+		key.WriteString(label.Name)
+		key.WriteByte(0)
+		key.WriteString(label.Value)
+		key.WriteByte(0)
+	}
+	return key.String()
+}
@@ -0,0 +1,173 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"net/http"
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestPrometheusRemoteWriteHandler(interval, buffsize, timeoutsec int) *PrometheusRemoteWrite {
+	testChannel := make(chan metric.Metric)
+	testLog := l.WithField("testing", "prometheus_remote_write_handler")
+	timeout := time.Duration(timeoutsec) * time.Second
+
+	return newPrometheusRemoteWrite(testChannel, interval, buffsize, timeout, testLog).(*PrometheusRemoteWrite)
+}
+
+// decodeWriteRequest decodes the write request the receiver received
+func decodeWriteRequest(t *testing.T, r testHTTPRequest) *WriteRequest {
+	request := new(WriteRequest)
+	assert.Nil(t, proto.Unmarshal(r.body, request))
+	return request
+}
+
+func TestPrometheusRemoteWriteConfigureEmptyConfig(t *testing.T) {
+	p := getTestPrometheusRemoteWriteHandler(12, 13, 14)
+	p.Configure(map[string]interface{}{})
+
+	assert.Equal(t, 12, p.Interval())
+	assert.Equal(t, 13, p.MaxBufferSize())
+	assert.Equal(t, DefaultPrometheusRemoteWriteAttempts, p.retryPolicy().maxAttempts)
+	assert.Equal(t, DefaultPrometheusTenantHeader, p.tenantHeader)
+}
+
+func TestPrometheusRemoteWriteConfigure(t *testing.T) {
+	p := getTestPrometheusRemoteWriteHandler(12, 13, 14)
+	p.Configure(map[string]interface{}{
+		"endpoint":            "http://cortex/api/v1/push",
+		"tenant":              "team",
+		"tenantHeader":        "THANOS-TENANT",
+		"maxEmissionAttempts": "1",
+	})
+
+	assert.Equal(t, "http://cortex/api/v1/push", p.Endpoint())
+	assert.Equal(t, 1, p.retryPolicy().maxAttempts)
+	assert.Equal(t, "team", p.headers()["THANOS-TENANT"])
+}
+
+func TestPrometheusRemoteWriteAuthHeaders(t *testing.T) {
+	p := getTestPrometheusRemoteWriteHandler(12, 13, 14)
+	p.Configure(map[string]interface{}{
+		"username": "user",
+		"password": "pass",
+	})
+	assert.Equal(t, "Basic dXNlcjpwYXNz", p.headers()["Authorization"])
+
+	p.Configure(map[string]interface{}{"bearerToken": "secret"})
+	assert.Equal(t, "Bearer secret", p.headers()["Authorization"])
+}
+
+func TestPrometheusRemoteWriteRequest(t *testing.T) {
+	p := getTestPrometheusRemoteWriteHandler(12, 13, 14)
+	p.SetPrefix("fullerite.")
+	p.SetDefaultDimensions(map[string]string{"host": "dev"})
+
+	later := metric.WithValue("cpu.usage", 2)
+	later.Timestamp = time.Unix(1500000010, 0)
+	earlier := metric.WithValue("cpu.usage", 1)
+	earlier.Timestamp = time.Unix(1500000000, 500000000)
+	other := metric.WithValue("cpu.usage", 3)
+	other.Timestamp = time.Unix(1500000000, 0)
+	other.AddDimension("core", "1")
+	other.AddDimension("__name__", "ignored")
+
+	request := p.writeRequest([]metric.Metric{later, other, earlier})
+	assert.Len(t, request.Timeseries, 2)
+
+	first := request.Timeseries[0]
+	assert.Equal(t, []*Label{
+		{Name: "__name__", Value: "fullerite_cpu_usage"},
+		{Name: "host", Value: "dev"},
+	}, first.Labels)
+	assert.Equal(t, []*Sample{
+		{Value: 1, Timestamp: 1500000000500},
+		{Value: 2, Timestamp: 1500000010000},
+	}, first.Samples)
+
+	second := request.Timeseries[1]
+	assert.Equal(t, []*Label{
+		{Name: "__name__", Value: "fullerite_cpu_usage"},
+		{Name: "core", Value: "1"},
+		{Name: "host", Value: "dev"},
+		{Name: "name__", Value: "ignored"},
+	}, second.Labels)
+}
+
+func TestPrometheusRemoteWriteEmit(t *testing.T) {
+	ts, requests := newTestHTTPReceiver(t, nil, http.StatusNoContent)
+	defer ts.Close()
+
+	p := getTestPrometheusRemoteWriteHandler(12, 12, 12)
+	p.Configure(map[string]interface{}{
+		"interval":        "1",
+		"max_buffer_size": "1",
+		"endpoint":        ts.URL,
+		"bearerToken":     "secret",
+		"tenant":          "team",
+	})
+
+	go p.Run()
+	defer p.Stop()
+	p.Channel() <- metric.WithValue("Test", 1)
+
+	select {
+	case r := <-requests:
+		request := decodeWriteRequest(t, r)
+		assert.Equal(t, "snappy", r.header.Get("Content-Encoding"))
+		assert.Equal(t, "application/x-protobuf", r.header.Get("Content-Type"))
+		assert.Equal(t, "0.1.0", r.header.Get("X-Prometheus-Remote-Write-Version"))
+		assert.Equal(t, "Bearer secret", r.header.Get("Authorization"))
+		assert.Equal(t, "team", r.header.Get("X-Scope-OrgID"))
+		assert.Len(t, request.Timeseries, 1)
+		assert.Equal(t, "Test", request.Timeseries[0].Labels[0].Value)
+		assert.Equal(t, 1.0, request.Timeseries[0].Samples[0].Value)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Failed to post and handle after 2 seconds")
+	}
+}
+
+func TestPrometheusRemoteWriteRetriesServerErrors(t *testing.T) {
+	ts, requests := newTestHTTPReceiver(t, nil, http.StatusInternalServerError, http.StatusOK)
+	defer ts.Close()
+
+	p := getTestPrometheusRemoteWriteHandler(12, 12, 12)
+	p.Configure(map[string]interface{}{
+		"interval":        "1",
+		"max_buffer_size": "1",
+		"endpoint":        ts.URL,
+		"retryBackoffMs":  "1",
+	})
+
+	go p.Run()
+	defer p.Stop()
+	p.Channel() <- metric.WithValue("Test", 1)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		select {
+		case <-requests:
+		case <-time.After(2 * time.Second):
+			t.Fatal("The emission wasn't retried after 2 seconds")
+		}
+	}
+	assert.Nil(t, waitFor(time.Second, func() bool {
+		return p.InternalMetrics().Counters["emissionRetries"] == 1
+	}))
+}
+
+func TestPrometheusRemoteWriteRejectedPayloadIsFatal(t *testing.T) {
+	ts, _ := newTestHTTPReceiver(t, nil, http.StatusBadRequest)
+	defer ts.Close()
+
+	p := getTestPrometheusRemoteWriteHandler(12, 12, 12)
+	p.Configure(map[string]interface{}{"endpoint": ts.URL})
+	p.httpClient = p.newHTTPClient()
+
+	err := p.emit([]metric.Metric{newTestMetric("Test", metric.Gauge, 1, nil)})
+	assert.True(t, isFatal(err))
+}
@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestPrometheusHandler(interval, buffsize, timeoutsec int) *Prometheus {
+	testChannel := make(chan metric.Metric)
+	testLog := l.WithField("testing", "prometheus_handler")
+	timeout := time.Duration(timeoutsec) * time.Second
+
+	return newPrometheus(testChannel, interval, buffsize, timeout, testLog).(*Prometheus)
+}
+
+func TestPrometheusConfigureEmptyConfig(t *testing.T) {
+	p := getTestPrometheusHandler(12, 13, 14)
+	p.Configure(map[string]interface{}{})
+
+	assert.Equal(t, 12, p.Interval())
+	assert.Equal(t, 13, p.MaxBufferSize())
+	assert.Equal(t, DefaultPrometheusPort, p.Port())
+	assert.Equal(t, DefaultPrometheusPath, p.Path())
+	assert.Equal(t, DefaultPrometheusStaleIntervals, p.staleIntervals)
+}
+
+func TestPrometheusConfigure(t *testing.T) {
+	p := getTestPrometheusHandler(12, 13, 14)
+	p.Configure(map[string]interface{}{
+		"interval":           "10",
+		"port":               "9200",
+		"path":               "/prometheus",
+		"staleIntervals":     3,
+		"collectorBlackList": []interface{}{"Diamond"},
+	})
+
+	assert.Equal(t, 10, p.Interval())
+	assert.Equal(t, 9200, p.Port())
+	assert.Equal(t, "/prometheus", p.Path())
+	assert.Equal(t, 3, p.staleIntervals)
+	blackListed, _ := p.IsCollectorBlackListed("Diamond")
+	assert.True(t, blackListed)
+}
+
+func TestPrometheusSanitize(t *testing.T) {
+	assert.Equal(t, "fullerite_cpu:usage_total", prometheusName("fullerite.cpu:usage-total"))
+	assert.Equal(t, "_5xx_count", prometheusName("5xx.count"))
+	assert.Equal(t, "host_name", prometheusLabelName("host:name"))
+	assert.Equal(t, "_1st", prometheusLabelName("1st"))
+	assert.Equal(t, "reserved", prometheusLabelName("__reserved"))
+}
+
+func TestPrometheusExposition(t *testing.T) {
+	p := getTestPrometheusHandler(10, 13, 14)
+	p.SetPrefix("fullerite.")
+	p.SetDefaultDimensions(map[string]string{"host": "dev"})
+
+	gauge := metric.WithValue("cpu.usage", 0.5)
+	gauge.AddDimension("path", "C:\\ \"quoted\"\n")
+	cumulative := metric.WithValue("requests.total", 42)
+	cumulative.MetricType = metric.CumulativeCounter
+	counter := metric.WithValue("errors", 2)
+	counter.MetricType = metric.Counter
+	notANumber := metric.WithValue("nan", math.NaN())
+
+	assert.Nil(t, p.emit([]metric.Metric{gauge, cumulative, counter, notANumber}))
+	// the latest value of gauges is kept, counters add up
+	gauge.Value = 0.75
+	assert.Nil(t, p.emit([]metric.Metric{gauge, counter}))
+
+	expected := "# TYPE fullerite_cpu_usage gauge\n" +
+		"fullerite_cpu_usage{host=\"dev\",path=\"C:\\\\ \\\"quoted\\\"\\n\"} 0.75\n" +
+		"# TYPE fullerite_errors counter\n" +
+		"fullerite_errors{host=\"dev\"} 4\n" +
+		"# TYPE fullerite_nan gauge\n" +
+		"fullerite_nan{host=\"dev\"} NaN\n" +
+		"# TYPE fullerite_requests_total counter\n" +
+		"fullerite_requests_total{host=\"dev\"} 42\n"
+	assert.Equal(t, expected, string(p.exposition(time.Now())))
+}
+
+func TestPrometheusExpositionGroupsSeries(t *testing.T) {
+	p := getTestPrometheusHandler(10, 13, 14)
+
+	first := metric.WithValue("load", 1)
+	first.AddDimension("cpu", "0")
+	second := metric.WithValue("load", 2)
+	second.AddDimension("cpu", "1")
+	assert.Nil(t, p.emit([]metric.Metric{second, metric.WithValue("idle", 3), first}))
+
+	expected := "# TYPE idle gauge\n" +
+		"idle 3\n" +
+		"# TYPE load gauge\n" +
+		"load{cpu=\"0\"} 1\n" +
+		"load{cpu=\"1\"} 2\n"
+	assert.Equal(t, expected, string(p.exposition(time.Now())))
+}
+
+func TestPrometheusTypeConflicts(t *testing.T) {
+	p := getTestPrometheusHandler(10, 13, 14)
+	p.Configure(map[string]interface{}{"staleIntervals": 2})
+
+	gauge := metric.WithValue("requests", 1)
+	gauge.AddDimension("host", "a")
+	counter := metric.WithValue("requests", 2)
+	counter.MetricType = metric.Counter
+	counter.AddDimension("host", "b")
+	err := p.emit([]metric.Metric{gauge, counter})
+	assert.True(t, emitted(err))
+	assert.Equal(t, 1, droppedCount(err), "the counter conflicts with the gauge")
+	assert.Equal(t, "# TYPE requests gauge\nrequests{host=\"a\"} 1\n", string(p.exposition(time.Now())))
+
+	gauge.MetricType = metric.Counter
+	assert.Nil(t, p.emit([]metric.Metric{gauge}), "the only series of a name can change its type")
+	assert.Nil(t, p.emit([]metric.Metric{counter}))
+	assert.Equal(t, "# TYPE requests counter\nrequests{host=\"a\"} 1\nrequests{host=\"b\"} 2\n",
+		string(p.exposition(time.Now())))
+
+	assert.Equal(t, "", string(p.exposition(time.Now().Add(21*time.Second))))
+	assert.Len(t, p.names, 0, "the type of a name is forgotten with its series")
+}
+
+func TestPrometheusStaleSeriesExpire(t *testing.T) {
+	p := getTestPrometheusHandler(10, 13, 14)
+	p.Configure(map[string]interface{}{"staleIntervals": 2})
+
+	assert.Nil(t, p.emit([]metric.Metric{metric.WithValue("old", 1)}))
+	assert.Len(t, p.series, 1)
+
+	assert.Equal(t, "# TYPE old gauge\nold 1\n", string(p.exposition(time.Now().Add(19*time.Second))))
+	assert.Equal(t, "", string(p.exposition(time.Now().Add(21*time.Second))))
+	assert.Len(t, p.series, 0)
+}
+
+func TestPrometheusRun(t *testing.T) {
+	p := getTestPrometheusHandler(12, 12, 12)
+	p.Configure(map[string]interface{}{
+		"interval":        "1",
+		"max_buffer_size": "1",
+		"port":            0,
+	})
+
+	go p.Run()
+	defer p.Stop()
+	p.Channel() <- metric.WithValue("Test", 1)
+
+	assert.Nil(t, waitFor(2*time.Second, func() bool {
+		addr := p.Addr()
+		if addr == nil {
+			return false
+		}
+		rsp, err := http.Get(fmt.Sprintf("http://%s/metrics", addr))
+		if err != nil {
+			return false
+		}
+		defer rsp.Body.Close()
+		body, _ := ioutil.ReadAll(rsp.Body)
+		return string(body) == "# TYPE Test gauge\nTest 1\n"
+	}))
+}
@@ -0,0 +1,334 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Defaults of the retry policy and of the circuit breaker of the handlers
+const (
+	DefaultMaxEmissionAttempts     = 1
+	DefaultRetryBackoffMs          = 500
+	DefaultRetryMaxBackoffMs       = 10000
+	DefaultCircuitBreakerThreshold = 5
+	DefaultCircuitBreakerTimeout   = 30
+)
+
+// The states of a circuit breaker, as reported in the internal metrics
+const (
+	circuitClosed   = 0
+	circuitOpen     = 1
+	circuitHalfOpen = 2
+)
+
+var (
+	// errEmissionFailed is the error of the emit functions which only
+	// tell whether they succeeded, such failures are retried
+	errEmissionFailed = errors.New("emission failed")
+
+	// errCircuitOpen is returned while the circuit breaker short-circuits
+	errCircuitOpen = errors.New("circuit breaker open, the endpoint keeps failing")
+)
+
+// emitter emits metrics, errors wrapped with fatal() aren't retried
+type emitter func([]metric.Metric) error
+
+// boolEmitter adapts the emit functions returning whether they succeeded
+func boolEmitter(emitFunc func([]metric.Metric) bool) emitter {
+	return func(metrics []metric.Metric) error {
+		if emitFunc(metrics) {
+			return nil
+		}
+		return errEmissionFailed
+	}
+}
+
+type fatalError struct {
+	error
+}
+
+// fatal marks err as not worth retrying, e.g. the endpoint rejected the
+// payload. Fatal errors don't count as failures of the endpoint either.
+func fatal(err error) error {
+	return fatalError{err}
+}
+
+func isFatal(err error) bool {
+	_, ok := err.(fatalError)
+	return ok
+}
+
+// droppedError is returned by emitters which succeeded but dropped some
+// of the metrics: the endpoint rejected them or its format can't represent
+// them. They are neither retried nor counted as sent.
+type droppedError struct {
+	count int
+}
+
+func (e droppedError) Error() string {
+	return fmt.Sprintf("%d metrics dropped", e.count)
+}
+
+// dropped adds count metrics to the ones err dropped, it returns nil if
+// there are none. Other errors are returned as they are.
+func dropped(count int, err error) error {
+	if err != nil {
+		d, ok := err.(droppedError)
+		if !ok {
+			return err
+		}
+		count += d.count
+	}
+	if count <= 0 {
+		return nil
+	}
+	return droppedError{count}
+}
+
+// droppedCount returns how many metrics an emission which returned err
+// dropped, 0 if it failed
+func droppedCount(err error) int {
+	if d, ok := err.(droppedError); ok {
+		return d.count
+	}
+	return 0
+}
+
+// emitted tells if an emission which returned err succeeded
+func emitted(err error) bool {
+	return err == nil || droppedCount(err) > 0
+}
+
+// partialError is returned by emitters which failed after sending the
+// first sent metrics, only the others are emitted again
+type partialError struct {
+	error
+	sent int
+}
+
+// partial tells that the emission which failed with err sent its first
+// sent metrics. Errors which aren't retried are returned as they are.
+func partial(sent int, err error) error {
+	if sent <= 0 || emitted(err) || isFatal(err) {
+		return err
+	}
+	return partialError{err, sent}
+}
+
+// sentCount returns how many metrics an emission which failed with err
+// sent before failing
+func sentCount(err error) int {
+	if p, ok := err.(partialError); ok {
+		return p.sent
+	}
+	return 0
+}
+
+// emitBatches emits the batches metrics was split into concurrently and
+// waits for all of them, so that the emission is tracked as a whole. The
+// metrics of the batches which were emitted are moved to the front of
+// metrics: once it failed, only the failed batches are emitted again.
+func emitBatches(metrics []metric.Metric, batches map[string][]metric.Metric, emit func(string, []metric.Metric) bool) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var succeeded, failed []metric.Metric
+	for name, batch := range batches {
+		wg.Add(1)
+		go func(name string, batch []metric.Metric) {
+			defer wg.Done()
+			ok := emit(name, batch)
+			mu.Lock()
+			defer mu.Unlock()
+			if ok {
+				succeeded = append(succeeded, batch...)
+			} else {
+				failed = append(failed, batch...)
+			}
+		}(name, batch)
+	}
+	wg.Wait()
+	if len(failed) == 0 {
+		return nil
+	}
+	copy(metrics, succeeded)
+	copy(metrics[len(succeeded):], failed)
+	return partial(len(succeeded), errEmissionFailed)
+}
+
+// retryPolicy retries failed emissions with an exponential
+// backoff, each wait is jittered between half and all of it
+type retryPolicy struct {
+	maxAttempts int
+	backoff     time.Duration
+	maxBackoff  time.Duration
+}
+
+// wait returns how long to wait before the given attempt (starting at 2)
+func (p retryPolicy) wait(attempt int) time.Duration {
+	backoff := p.backoff
+	for i := 2; i < attempt && backoff < p.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > p.maxBackoff {
+		backoff = p.maxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+}
+
+// circuitBreaker short-circuits the emissions once threshold consecutive
+// emissions failed. After timeout a single emission is let through: the
+// breaker closes again if it succeeds and stays open otherwise.
+type circuitBreaker struct {
+	threshold int
+	timeout   time.Duration
+
+	mu                  sync.Mutex
+	state               int
+	consecutiveFailures int
+	openedAt            time.Time
+	trips               uint64
+	shortCircuits       uint64
+}
+
+// allow returns false if the emission has to be short-circuited
+func (b *circuitBreaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case circuitOpen:
+		if time.Since(b.openedAt) >= b.timeout {
+			b.state = circuitHalfOpen
+			return true
+		}
+	case circuitHalfOpen:
+		// a trial emission is in progress
+	default:
+		return true
+	}
+	b.shortCircuits++
+	return false
+}
+
+// record updates the breaker with the outcome of an emission it allowed
+func (b *circuitBreaker) record(success bool) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if success {
+		b.state = circuitClosed
+		b.consecutiveFailures = 0
+		return
+	}
+	b.consecutiveFailures++
+	if b.state == circuitHalfOpen || b.consecutiveFailures >= b.threshold {
+		if b.state != circuitOpen {
+			b.trips++
+		}
+		b.state = circuitOpen
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *circuitBreaker) internalMetrics(counters map[string]float64, gauges map[string]float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	counters["circuitBreakerTrips"] = float64(b.trips)
+	counters["circuitBreakerShortCircuits"] = float64(b.shortCircuits)
+	gauges["circuitBreakerState"] = float64(b.state)
+}
+
+// emitWithRetries emits metrics following the retry policy of the handler,
+// unless its circuit breaker is open. Retries stop once the handler is
+// asked to stop so that shutting down isn't delayed. The metrics a failed
+// attempt sent aren't emitted again, the error returned tells how many
+// were sent if it failed.
+func (base *BaseHandler) emitWithRetries(metrics []metric.Metric, emit emitter) error {
+	tracker := base.emissionTracker()
+	policy := base.retryPolicy()
+
+	var err error
+	sent := 0
+	for attempt := 1; attempt <= policy.maxAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(policy.wait(attempt)):
+			case <-tracker.quit:
+				return partial(sent, err)
+			}
+			atomic.AddUint64(&base.emissionRetries, 1)
+		}
+
+		if !tracker.breaker.allow() {
+			return partial(sent, errCircuitOpen)
+		}
+		err = emit(metrics[sent:])
+		if emitted(err) || isFatal(err) {
+			tracker.breaker.record(true)
+			if isFatal(err) {
+				base.log.Error("Not retrying the emission of ", len(metrics)-sent, " metrics: ", err)
+			}
+			return err
+		}
+		tracker.breaker.record(false)
+		sent += sentCount(err)
+	}
+	return partial(sent, err)
+}
+
+// retryPolicy returns the configured retry policy, falling back to the defaults
+func (base *BaseHandler) retryPolicy() retryPolicy {
+	p := retryPolicy{
+		maxAttempts: base.maxEmissionAttempts,
+		backoff:     base.retryBackoff,
+		maxBackoff:  base.retryMaxBackoff,
+	}
+	if p.maxAttempts <= 0 {
+		p.maxAttempts = DefaultMaxEmissionAttempts
+	}
+	if p.backoff <= 0 {
+		p.backoff = DefaultRetryBackoffMs * time.Millisecond
+	}
+	if p.maxBackoff <= 0 {
+		p.maxBackoff = DefaultRetryMaxBackoffMs * time.Millisecond
+	}
+	return p
+}
+
+// newCircuitBreaker returns the configured circuit breaker, the
+// threshold is negative if it is disabled
+func (base *BaseHandler) newCircuitBreaker() *circuitBreaker {
+	b := &circuitBreaker{
+		threshold: base.circuitBreakerThreshold,
+		timeout:   base.circuitBreakerTimeout,
+	}
+	if b.threshold == 0 {
+		b.threshold = DefaultCircuitBreakerThreshold
+	}
+	if b.timeout <= 0 {
+		b.timeout = DefaultCircuitBreakerTimeout * time.Second
+	}
+	return b
+}
+
+// retryableStatus tells whether an HTTP response status may be worth
+// retrying: the server failed, or it asked to slow down
+func retryableStatus(status int) bool {
+	return status/100 != 4 || status == http.StatusTooManyRequests
+}
@@ -0,0 +1,202 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func getTestRetryHandler(configMap map[string]interface{}) *Test {
+	h := NewTest(make(chan metric.Metric), 1, 10, time.Second, l.WithField("testing", "retry")).(*Test)
+	h.Configure(configMap)
+	return h
+}
+
+func TestRetryPolicyWait(t *testing.T) {
+	p := retryPolicy{maxAttempts: 5, backoff: 100 * time.Millisecond, maxBackoff: 300 * time.Millisecond}
+
+	for i := 0; i < 20; i++ {
+		wait := p.wait(2)
+		assert.True(t, wait >= 50*time.Millisecond && wait <= 100*time.Millisecond, wait.String())
+		wait = p.wait(3)
+		assert.True(t, wait >= 100*time.Millisecond && wait <= 200*time.Millisecond, wait.String())
+		wait = p.wait(10)
+		assert.True(t, wait >= 150*time.Millisecond && wait <= 300*time.Millisecond, wait.String())
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	b := &circuitBreaker{threshold: 2, timeout: 50 * time.Millisecond}
+
+	assert.True(t, b.allow())
+	b.record(false)
+	assert.True(t, b.allow())
+	b.record(false)
+	assert.False(t, b.allow(), "the breaker should trip after 2 failures")
+
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, b.allow(), "a trial emission should be let through")
+	assert.False(t, b.allow(), "only one trial emission at a time")
+	b.record(false)
+	assert.False(t, b.allow(), "the trial failed, the breaker should open again")
+
+	time.Sleep(60 * time.Millisecond)
+	assert.True(t, b.allow())
+	b.record(true)
+	assert.True(t, b.allow())
+
+	counters, gauges := map[string]float64{}, map[string]float64{}
+	b.internalMetrics(counters, gauges)
+	assert.Equal(t, 2.0, counters["circuitBreakerTrips"])
+	assert.Equal(t, 3.0, counters["circuitBreakerShortCircuits"])
+	assert.Equal(t, float64(circuitClosed), gauges["circuitBreakerState"])
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	h := getTestRetryHandler(map[string]interface{}{"circuitBreakerThreshold": 0})
+	b := h.newCircuitBreaker()
+	for i := 0; i < 10; i++ {
+		b.record(false)
+	}
+	assert.True(t, b.allow())
+}
+
+func TestEmitWithRetries(t *testing.T) {
+	h := getTestRetryHandler(map[string]interface{}{
+		"maxEmissionAttempts": 3,
+		"retryBackoffMs":      1,
+	})
+
+	attempts := 0
+	err := h.emitWithRetries([]metric.Metric{metric.New("test")}, func([]metric.Metric) error {
+		attempts++
+		if attempts < 3 {
+			return errEmissionFailed
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, uint64(2), h.emissionRetries)
+
+	attempts = 0
+	err = h.emitWithRetries([]metric.Metric{metric.New("test")}, func([]metric.Metric) error {
+		attempts++
+		return fatal(errors.New("bad request"))
+	})
+	assert.True(t, isFatal(err))
+	assert.Equal(t, 1, attempts, "fatal errors shouldn't be retried")
+}
+
+func TestEmitWithRetriesPartially(t *testing.T) {
+	h := getTestRetryHandler(map[string]interface{}{
+		"maxEmissionAttempts": 3,
+		"retryBackoffMs":      1,
+	})
+
+	var emitted []string
+	metrics := []metric.Metric{metric.New("a"), metric.New("b"), metric.New("c")}
+	err := h.emitWithRetries(metrics, func(metrics []metric.Metric) error {
+		emitted = append(emitted, metrics[0].Name)
+		if len(metrics) > 1 {
+			return partial(1, errEmissionFailed)
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, emitted, "the metrics which were sent aren't emitted again")
+
+	attempts := 0
+	err = h.emitWithRetries(metrics, func(metrics []metric.Metric) error {
+		attempts++
+		if attempts == 1 {
+			return partial(2, errEmissionFailed)
+		}
+		return errEmissionFailed
+	})
+	assert.Equal(t, 3, attempts)
+	assert.Equal(t, 2, sentCount(err))
+
+	assert.Equal(t, errEmissionFailed, partial(0, errEmissionFailed))
+	assert.True(t, isFatal(partial(1, fatal(errEmissionFailed))))
+}
+
+func TestEmitBatchesRetriesTheFailedBatches(t *testing.T) {
+	h := getTestRetryHandler(map[string]interface{}{
+		"maxEmissionAttempts": 2,
+		"retryBackoffMs":      1,
+	})
+
+	var mu sync.Mutex
+	emitted := map[string]int{}
+	batch := func(name string) []metric.Metric {
+		m := metric.New(name)
+		m.AddDimension("batch", name)
+		return []metric.Metric{m}
+	}
+	err := h.emitWithRetries(append(batch("a"), batch("b")...), func(metrics []metric.Metric) error {
+		batches := map[string][]metric.Metric{}
+		for _, m := range metrics {
+			batches[m.Dimensions["batch"]] = append(batches[m.Dimensions["batch"]], m)
+		}
+		return emitBatches(metrics, batches, func(name string, _ []metric.Metric) bool {
+			mu.Lock()
+			defer mu.Unlock()
+			emitted[name]++
+			return name == "a" || emitted[name] > 1
+		})
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"a": 1, "b": 2}, emitted, "the accepted batches aren't emitted again")
+}
+
+func TestEmitWithRetriesCircuitOpen(t *testing.T) {
+	h := getTestRetryHandler(map[string]interface{}{
+		"maxEmissionAttempts":     2,
+		"retryBackoffMs":          1,
+		"circuitBreakerThreshold": 2,
+		"circuitBreakerTimeout":   60,
+	})
+
+	attempts := 0
+	failing := func([]metric.Metric) error {
+		attempts++
+		return errEmissionFailed
+	}
+	metrics := []metric.Metric{metric.New("test")}
+	assert.Equal(t, errEmissionFailed, h.emitWithRetries(metrics, failing))
+	assert.Equal(t, errCircuitOpen, h.emitWithRetries(metrics, failing))
+	assert.Equal(t, 2, attempts)
+
+	im := h.InternalMetrics()
+	assert.Equal(t, 1.0, im.Counters["emissionRetries"])
+	assert.Equal(t, 1.0, im.Counters["circuitBreakerTrips"])
+	assert.Equal(t, 1.0, im.Counters["circuitBreakerShortCircuits"])
+	assert.Equal(t, float64(circuitOpen), im.Gauges["circuitBreakerState"])
+}
+
+func TestTimedEmitDropped(t *testing.T) {
+	h := getTestRetryHandler(map[string]interface{}{"retryBackoffMs": 1})
+	h.emissionTimingChannel = make(chan emissionTiming, 1)
+
+	attempts := 0
+	metrics := []metric.Metric{metric.New("a"), metric.New("b"), metric.New("c")}
+	assert.True(t, h.timedEmit(metrics, func([]metric.Metric) error {
+		attempts++
+		return dropped(1, nil)
+	}))
+	assert.Equal(t, 1, attempts, "the metrics which were dropped aren't retried")
+	counters := h.InternalMetrics().Counters
+	assert.Equal(t, 2.0, counters["metricsSent"])
+	assert.Equal(t, 1.0, counters["metricsDropped"])
+
+	assert.Equal(t, errEmissionFailed, dropped(2, errEmissionFailed))
+	assert.Equal(t, 3, droppedCount(dropped(2, dropped(1, nil))))
+	assert.Nil(t, dropped(0, nil))
+}
@@ -150,7 +150,7 @@ func (s Scribe) createScribeMetric(m metric.Metric) scribeMetric {
 		Name:       m.Name,
 		Value:      m.Value,
 		MetricType: m.MetricType,
-		Timestamp:  time.Now().Unix(),
+		Timestamp:  m.GetTimestamp().Unix(),
 		Dimensions: m.GetDimensions(s.DefaultDimensions()),
 	}
 
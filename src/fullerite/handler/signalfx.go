@@ -102,8 +102,9 @@ func (s *SignalFx) Run() {
 		time.Duration(s.KeepAliveInterval())*time.Second,
 		s.MaxIdleConnectionsPerHost())
 	s.httpClient = httpAliveClient
+	s.releaseOnStop(httpAliveClient.Close)
 
-	s.run(s.emitMetrics)
+	s.runEmitter(s.emit)
 }
 
 func signalFxValueSanitize(value string) string {
@@ -119,9 +120,9 @@ func (s SignalFx) convertToProto(incomingMetric metric.Metric) *DataPoint {
 	outname := s.Prefix() + signalFxValueSanitize(incomingMetric.Name)
 	value := incomingMetric.Value
 
-	now := time.Now().UnixNano() / int64(time.Millisecond)
+	timestamp := incomingMetric.GetTimestamp().UnixNano() / int64(time.Millisecond)
 	datapoint := new(DataPoint)
-	datapoint.Timestamp = &now
+	datapoint.Timestamp = &timestamp
 	datapoint.Metric = &outname
 	datapoint.Value = &Datum{
 		DoubleValue: &value,
@@ -247,41 +248,49 @@ func (s *SignalFx) emitBatch(batchName string, metrics []metric.Metric) bool {
 }
 
 func (s *SignalFx) emitAndTime(batchName string, metrics []metric.Metric) bool {
+	// The base handler retries and reports the emission as a whole
+	if !s.UseCustomEmissionMetricsReporter() {
+		return s.emitBatch(batchName, metrics)
+	}
+
 	start := time.Now()
-	emissionResult := s.emitBatch(batchName, metrics)
-	elapsed := time.Since(start)
-
-	// Report emission metrics if emission tracker is disabled in base handler
-	if s.UseCustomEmissionMetricsReporter() {
-		timing := emissionTiming{
-			timestamp:   time.Now(),
-			duration:    elapsed,
-			metricsSent: len(metrics),
+	emissionResult := s.emitWithRetries(metrics, func(batch []metric.Metric) error {
+		if s.emitBatch(batchName, batch) {
+			return nil
 		}
-		s.reportEmissionMetrics(emissionResult, timing)
+		return errEmissionFailed
+	}) == nil
+	timing := emissionTiming{
+		timestamp:   time.Now(),
+		duration:    time.Since(start),
+		metricsSent: len(metrics),
 	}
+	if !emissionResult {
+		s.spoolFailedEmission(metrics)
+	}
+	s.reportEmissionMetrics(emissionResult, timing)
 
 	return emissionResult
 }
 
-func (s *SignalFx) emitMetrics(metrics []metric.Metric) bool {
+func (s *SignalFx) emit(metrics []metric.Metric) error {
 
 	if len(metrics) == 0 {
 		s.log.Warn("Skipping send because of an empty payload")
-		return false
+		return errEmissionFailed
 	}
 
 	if s.batchByDimension == "" {
 		// If batchByDimension key is NOT defined,
 		// then emit all metrics in a single batch with the default token
-		return s.emitAndTime("", metrics)
+		if s.emitAndTime("", metrics) {
+			return nil
+		}
+		return errEmissionFailed
 	}
 
 	// If batchByDimension key is defined,
 	// then divide the list of metrics into batches,
 	// emit them concurrently (or parallely, if GOMAXPROCS is > 1)
-	for batchName, metricBatch := range s.makeBatches(metrics) {
-		go s.emitAndTime(batchName, metricBatch)
-	}
-	return true
+	return emitBatches(metrics, s.makeBatches(metrics), s.emitAndTime)
 }
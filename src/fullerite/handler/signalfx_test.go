@@ -2,10 +2,12 @@ package handler
 
 import (
 	"fullerite/metric"
+	"fullerite/util"
 
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -135,3 +137,40 @@ func TestSignalFxSanitation(t *testing.T) {
 		}
 	}
 }
+
+func TestSignalFxUsesMetricTimestamp(t *testing.T) {
+	s := getTestSignalfxHandler(12, 12, 12)
+
+	m := metric.New("Test")
+	m.Timestamp = time.Unix(1500000000, 500000000)
+	datapoint := s.convertToProto(m)
+
+	assert.Equal(t, int64(1500000000500), datapoint.GetTimestamp())
+}
+
+func TestSignalFxRetriesOnce(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	s := getTestSignalfxHandler(12, 12, 12)
+	s.Configure(map[string]interface{}{
+		"authToken":               "secret",
+		"endpoint":                ts.URL,
+		"maxEmissionAttempts":     3,
+		"retryBackoffMs":          1,
+		"circuitBreakerThreshold": 0,
+	})
+	httpAliveClient := new(util.HTTPAlive)
+	httpAliveClient.Configure(time.Second, time.Second, 1)
+	s.httpClient = httpAliveClient
+	defer httpAliveClient.Close()
+	s.emissionTimingChannel = make(chan emissionTiming, 1)
+
+	assert.False(t, s.timedEmit([]metric.Metric{metric.New("Test")}, s.emit))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests), "the base handler alone retries")
+	assert.Equal(t, 2.0, s.InternalMetrics().Counters["emissionRetries"])
+}
@@ -0,0 +1,258 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+// Defaults of the spool of the handlers
+const (
+	DefaultSpoolMaxSizeMB = 100
+	DefaultSpoolMaxAge    = 3600
+)
+
+// backoff between two attempts to replay the spool
+// while the endpoint is still failing
+const (
+	spoolMinBackoff = time.Second
+	spoolMaxBackoff = time.Minute
+)
+
+// spool is an on-disk queue of the batches a handler failed to emit, one
+// file per batch. Files are named after the oldest timestamp of their
+// batch so that they are replayed in order, even if a batch fails again
+// and is spooled a second time. The oldest batches are evicted once the
+// spool grows over maxBytes or once they are older than maxAge.
+type spool struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	log      *l.Entry
+
+	// signaled when an emission succeeded, the endpoint is back
+	nudge chan struct{}
+
+	mu       sync.Mutex
+	files    []spoolFile
+	bytes    int64
+	depth    int64
+	seq      uint64
+	evicted  uint64
+	replayed uint64
+
+	// for the replay rate
+	rateStart time.Time
+	rateCount uint64
+	rate      float64
+}
+
+type spoolFile struct {
+	name   string
+	oldest time.Time
+	size   int64
+	count  int
+}
+
+// newSpool opens the spool in dir, creating it if needed, and picks up
+// the batches spooled before a restart
+func newSpool(dir string, maxBytes int64, maxAge time.Duration, log *l.Entry) (*spool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &spool{
+		dir:       dir,
+		maxBytes:  maxBytes,
+		maxAge:    maxAge,
+		log:       log,
+		nudge:     make(chan struct{}, 1),
+		rateStart: time.Now(),
+	}
+	for _, entry := range entries {
+		f, seq, ok := parseSpoolFileName(entry.Name())
+		if !ok {
+			continue
+		}
+		f.size = entry.Size()
+		s.files = append(s.files, f)
+		s.bytes += f.size
+		s.depth += int64(f.count)
+		if seq >= s.seq {
+			s.seq = seq + 1
+		}
+	}
+	sort.Slice(s.files, func(i, j int) bool { return s.files[i].name < s.files[j].name })
+	return s, nil
+}
+
+// <oldest timestamp in ns>-<sequence>-<number of metrics>.json
+func spoolFileName(oldest time.Time, seq uint64, count int) string {
+	return fmt.Sprintf("%020d-%020d-%d.json", oldest.UnixNano(), seq, count)
+}
+
+func parseSpoolFileName(name string) (f spoolFile, seq uint64, ok bool) {
+	parts := strings.Split(strings.TrimSuffix(name, ".json"), "-")
+	if !strings.HasSuffix(name, ".json") || len(parts) != 3 {
+		return f, 0, false
+	}
+	nanos, err1 := strconv.ParseInt(parts[0], 10, 64)
+	seq, err2 := strconv.ParseUint(parts[1], 10, 64)
+	count, err3 := strconv.Atoi(parts[2])
+	if err1 != nil || err2 != nil || err3 != nil {
+		return f, 0, false
+	}
+	return spoolFile{name: name, oldest: time.Unix(0, nanos), count: count}, seq, true
+}
+
+// push writes a batch to the spool. The metrics are stamped with the
+// current time if they don't carry a timestamp yet, so that they land
+// at the right time once replayed.
+func (s *spool) push(metrics []metric.Metric) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	now := time.Now()
+	stamped := make([]metric.Metric, len(metrics))
+	oldest := now
+	for i, m := range metrics {
+		m.SetTimestampIfMissing(now)
+		if m.Timestamp.Before(oldest) {
+			oldest = m.Timestamp
+		}
+		stamped[i] = m
+	}
+	contents, err := json.Marshal(stamped)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := spoolFile{
+		name:   spoolFileName(oldest, s.seq, len(metrics)),
+		oldest: oldest,
+		size:   int64(len(contents)),
+		count:  len(metrics),
+	}
+	s.seq++
+
+	// written aside and renamed so that a crash doesn't leave half a batch
+	tmp := filepath.Join(s.dir, "."+f.name)
+	if err := ioutil.WriteFile(tmp, contents, 0644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(s.dir, f.name)); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	i := sort.Search(len(s.files), func(i int) bool { return s.files[i].name > f.name })
+	s.files = append(s.files, spoolFile{})
+	copy(s.files[i+1:], s.files[i:])
+	s.files[i] = f
+	s.bytes += f.size
+	s.depth += int64(f.count)
+
+	for s.bytes > s.maxBytes && len(s.files) > 0 {
+		s.evictOldest("the spool is full")
+	}
+	return nil
+}
+
+// pop removes the oldest batch from the spool and returns it, batches
+// older than maxAge are evicted. Returns false if the spool is empty.
+func (s *spool) pop() ([]metric.Metric, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.files) > 0 {
+		f := s.files[0]
+		if time.Since(f.oldest) > s.maxAge {
+			s.evictOldest("it is too old")
+			continue
+		}
+
+		path := filepath.Join(s.dir, f.name)
+		var metrics []metric.Metric
+		contents, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(contents, &metrics)
+		}
+		if err != nil {
+			s.log.Error("Failed to read spooled batch ", path, ": ", err)
+			s.evictOldest("it can't be read")
+			continue
+		}
+
+		os.Remove(path)
+		s.files = s.files[1:]
+		s.bytes -= f.size
+		s.depth -= int64(f.count)
+		return metrics, true
+	}
+	return nil, false
+}
+
+// evictOldest drops the oldest batch, must be called holding mu
+func (s *spool) evictOldest(reason string) {
+	f := s.files[0]
+	s.log.Warn("Evicting ", f.count, " spooled metrics because ", reason)
+	os.Remove(filepath.Join(s.dir, f.name))
+	s.files = s.files[1:]
+	s.bytes -= f.size
+	s.depth -= int64(f.count)
+	s.evicted += uint64(f.count)
+}
+
+// markReplayed accounts for metrics successfully replayed
+func (s *spool) markReplayed(count int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.replayed += uint64(count)
+	s.rateCount += uint64(count)
+}
+
+// notifySuccess lets the replay know the endpoint is back
+func (s *spool) notifySuccess() {
+	select {
+	case s.nudge <- struct{}{}:
+	default:
+	}
+}
+
+// internalMetrics reports the depth of the spool, the replay rate over
+// the last minute and the metrics replayed and evicted
+func (s *spool) internalMetrics(counters map[string]float64, gauges map[string]float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if elapsed := time.Since(s.rateStart); elapsed >= time.Minute {
+		s.rate = float64(s.rateCount) / elapsed.Seconds()
+		s.rateStart = time.Now()
+		s.rateCount = 0
+	}
+	counters["spoolReplayed"] = float64(s.replayed)
+	counters["spoolEvicted"] = float64(s.evicted)
+	// evicted metrics are lost for good
+	counters["metricsDropped"] += float64(s.evicted)
+	gauges["spoolDepth"] = float64(s.depth)
+	gauges["spoolBytes"] = float64(s.bytes)
+	gauges["spoolReplayRate"] = s.rate
+}
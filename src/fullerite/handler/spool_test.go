@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"fullerite/metric"
+
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSpool(t *testing.T, maxBytes int64, maxAge time.Duration) (*spool, string) {
+	dir, err := ioutil.TempDir("", "fullerite-spool")
+	assert.Nil(t, err)
+	s, err := newSpool(dir, maxBytes, maxAge, l.WithField("testing", "spool"))
+	assert.Nil(t, err)
+	return s, dir
+}
+
+func spoolMetric(name string, timestamp time.Time) metric.Metric {
+	m := metric.WithValue(name, 1)
+	m.Timestamp = timestamp
+	return m
+}
+
+func TestSpoolReplaysInOrder(t *testing.T) {
+	s, dir := newTestSpool(t, 1<<20, time.Hour)
+	defer os.RemoveAll(dir)
+
+	now := time.Unix(time.Now().Unix(), 0)
+	assert.Nil(t, s.push([]metric.Metric{spoolMetric("second", now)}))
+	assert.Nil(t, s.push([]metric.Metric{spoolMetric("first", now.Add(-time.Minute)), spoolMetric("first", now)}))
+
+	counters, gauges := map[string]float64{}, map[string]float64{}
+	s.internalMetrics(counters, gauges)
+	assert.Equal(t, 3.0, gauges["spoolDepth"])
+
+	metrics, ok := s.pop()
+	assert.True(t, ok)
+	assert.Len(t, metrics, 2)
+	assert.Equal(t, "first", metrics[0].Name)
+	assert.True(t, now.Add(-time.Minute).Equal(metrics[0].Timestamp), "timestamps are preserved")
+
+	metrics, ok = s.pop()
+	assert.True(t, ok)
+	assert.Equal(t, "second", metrics[0].Name)
+
+	_, ok = s.pop()
+	assert.False(t, ok)
+}
+
+func TestSpoolReopen(t *testing.T) {
+	s, dir := newTestSpool(t, 1<<20, time.Hour)
+	defer os.RemoveAll(dir)
+	assert.Nil(t, s.push([]metric.Metric{spoolMetric("hello", time.Now())}))
+
+	reopened, err := newSpool(dir, 1<<20, time.Hour, s.log)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), reopened.depth)
+	metrics, ok := reopened.pop()
+	assert.True(t, ok)
+	assert.Equal(t, "hello", metrics[0].Name)
+}
+
+func TestSpoolEvictions(t *testing.T) {
+	s, dir := newTestSpool(t, 1<<20, time.Minute)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(t, s.push([]metric.Metric{spoolMetric("old", time.Now().Add(-time.Hour))}))
+	assert.Nil(t, s.push([]metric.Metric{spoolMetric("new", time.Now())}))
+	metrics, ok := s.pop()
+	assert.True(t, ok)
+	assert.Equal(t, "new", metrics[0].Name, "batches older than the max age are evicted")
+
+	// each batch is about 100 bytes, only one fits
+	full, fullDir := newTestSpool(t, 120, time.Minute)
+	defer os.RemoveAll(fullDir)
+	assert.Nil(t, full.push([]metric.Metric{spoolMetric("first", time.Now())}))
+	assert.Nil(t, full.push([]metric.Metric{spoolMetric("second", time.Now())}))
+	metrics, _ = full.pop()
+	assert.Equal(t, "second", metrics[0].Name, "the oldest batches are evicted when the spool is full")
+
+	for _, s := range []*spool{s, full} {
+		counters, gauges := map[string]float64{}, map[string]float64{}
+		s.internalMetrics(counters, gauges)
+		assert.Equal(t, 1.0, counters["spoolEvicted"])
+		assert.Equal(t, 1.0, counters["metricsDropped"])
+		assert.Equal(t, 0.0, gauges["spoolDepth"])
+	}
+}
@@ -41,6 +41,7 @@ type wavefrontPayload struct {
 type wavefrontMetric struct {
 	Name      string
 	Value     float64
+	Timestamp int64
 	Source    string
 	PointTags []string
 }
@@ -191,13 +192,14 @@ func (w Wavefront) Endpoint() string {
 
 // Run runs the handler main loop
 func (w *Wavefront) Run() {
-	w.run(w.emitMetrics)
+	w.runEmitter(w.emit)
 }
 
 func (w *Wavefront) convertToWavefront(incomingMetric metric.Metric) (datapoint wavefrontMetric) {
 	wfm := new(wavefrontMetric)
 	wfm.Name = "\"" + w.Prefix() + w.wavefrontKeySanitize(incomingMetric.Name) + "\""
 	wfm.Value = incomingMetric.Value
+	wfm.Timestamp = incomingMetric.GetTimestamp().Unix()
 	wfm.Source = w.DefaultDimensions()["host"]
 	wfm.PointTags = w.getSanitizedDimensions(incomingMetric.GetDimensions(w.DefaultDimensions()))
 	wfm.PointTags = w.getSanitizedDimensions(w.defaultPointTags)
@@ -221,38 +223,49 @@ func (w *Wavefront) makeBatches(metrics []metric.Metric) map[string][]metric.Met
 	return m
 }
 
-func (w *Wavefront) emitMetrics(metrics []metric.Metric) bool {
+func (w *Wavefront) emit(metrics []metric.Metric) error {
 	if len(metrics) == 0 {
 		w.log.Warn("Skipping send because of an empty payload")
-		return false
+		return errEmissionFailed
 	}
 	if w.batchByDimension == "" {
 		// If batchByDimension key is NOT defined,
 		// then emit all metrics in a single batch
-		return w.emitAndTime(metrics)
+		if w.emitAndTime(metrics) {
+			return nil
+		}
+		return errEmissionFailed
 	}
 	// If batchByDimension key is defined,
 	// then divide the list of metrics into batches,
 	// emit them concurrently (or parallely, if GOMAXPROCS is > 1)
-	for _, metricBatch := range w.makeBatches(metrics) {
-		go w.emitAndTime(metricBatch)
-	}
-	return true
+	return emitBatches(metrics, w.makeBatches(metrics), func(_ string, batch []metric.Metric) bool {
+		return w.emitAndTime(batch)
+	})
 }
 
 func (w *Wavefront) emitAndTime(metrics []metric.Metric) bool {
+	// The base handler retries and reports the emission as a whole
+	if !w.UseCustomEmissionMetricsReporter() {
+		return w.emitBatch(metrics)
+	}
+
 	start := time.Now()
-	emissionResult := w.emitBatch(metrics)
-	elapsed := time.Since(start)
-	// Report emission metrics if emission tracker is disabled in base handler
-	if w.UseCustomEmissionMetricsReporter() {
-		timing := emissionTiming{
-			timestamp:   time.Now(),
-			duration:    elapsed,
-			metricsSent: len(metrics),
+	emissionResult := w.emitWithRetries(metrics, func(batch []metric.Metric) error {
+		if w.emitBatch(batch) {
+			return nil
 		}
-		w.reportEmissionMetrics(emissionResult, timing)
+		return errEmissionFailed
+	}) == nil
+	timing := emissionTiming{
+		timestamp:   time.Now(),
+		duration:    time.Since(start),
+		metricsSent: len(metrics),
+	}
+	if !emissionResult {
+		w.spoolFailedEmission(metrics)
 	}
+	w.reportEmissionMetrics(emissionResult, timing)
 
 	return emissionResult
 }
@@ -306,6 +319,8 @@ func (w Wavefront) emitMetricsForDirectIngestion(metrics []metric.Metric, pStr s
 	client := &http.Client{
 		Transport: &transport,
 	}
+	// the transport only serves this request, don't leave its connection idle
+	defer transport.CloseIdleConnections()
 	rsp, err := client.Do(req)
 	if err != nil {
 		w.log.Error("Failed to complete POST ", err)
@@ -355,8 +370,8 @@ func (w Wavefront) wavefrontPayloadToString(p wavefrontPayload) string {
 		for _, tagPair := range series.PointTags {
 			pointTagsBuffer.WriteString(tagPair + " ")
 		}
-		payloadBuffer.WriteString(strings.Join([]string{series.Name, " ", strconv.FormatFloat(series.Value, 'f', 2, 64), " source=", series.Source, " ", pointTagsBuffer.String(), "\n"}, ""))
-		w.log.Debug("PAYLOAD ", i, ": ", series.Name, " ", series.Value, " source=", series.Source, " ", pointTagsBuffer.String())
+		payloadBuffer.WriteString(strings.Join([]string{series.Name, " ", strconv.FormatFloat(series.Value, 'f', 2, 64), " ", strconv.FormatInt(series.Timestamp, 10), " source=", series.Source, " ", pointTagsBuffer.String(), "\n"}, ""))
+		w.log.Debug("PAYLOAD ", i, ": ", series.Name, " ", series.Value, " ", series.Timestamp, " source=", series.Source, " ", pointTagsBuffer.String())
 		pointTagsBuffer.Reset()
 	}
 	return payloadBuffer.String()
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+
 	"fullerite/config"
 	"fullerite/handler"
 	"fullerite/metric"
@@ -33,10 +35,12 @@ func createHandler(name string, globalConfig config.Config, instanceConfig map[s
 	return handlerInst
 }
 
-func startHandlers(handlers []handler.Handler) {
+// startHandlers runs the handlers until ctx is cancelled
+func startHandlers(ctx context.Context, handlers []handler.Handler) {
 	log.Info("Starting handlers...")
 	for _, handler := range handlers {
 		if handler != nil {
+			handler.Start(ctx)
 			go handler.Run()
 		}
 	}
@@ -5,6 +5,7 @@ import (
 	"fullerite/handler"
 	"fullerite/metric"
 
+	"context"
 	"fmt"
 	"testing"
 	"time"
@@ -16,7 +17,7 @@ import (
 func TestStartHandlersEmptyConfig(t *testing.T) {
 	logrus.SetLevel(logrus.PanicLevel)
 	handlers := createHandlers(config.Config{})
-	startHandlers(handlers)
+	startHandlers(context.Background(), handlers)
 
 	assert.Zero(t, len(handlers), "should not create any Handler")
 }
@@ -26,7 +27,7 @@ func TestStartHandlerUnknownHandler(t *testing.T) {
 
 	c := make(map[string]interface{})
 	h := createHandler("unknown handler", config.Config{}, c)
-	startHandlers([]handler.Handler{h})
+	startHandlers(context.Background(), []handler.Handler{h})
 
 	assert.Nil(t, h)
 }
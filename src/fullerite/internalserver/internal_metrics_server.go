@@ -21,11 +21,12 @@ const (
 
 // InternalServer will collect from each handler the status and return it over HTTP
 type InternalServer struct {
-	log               *l.Entry
-	handlerStatFunc   InternalStatFunc
-	collectorStatFunc InternalStatFunc
-	port              int
-	path              string
+	log                 *l.Entry
+	handlerStatFunc     InternalStatFunc
+	collectorStatFunc   InternalStatFunc
+	cardinalityStatFunc InternalStatFunc
+	port                int
+	path                string
 }
 
 // InternalStatFunc can be used to extract metrics
@@ -33,17 +34,20 @@ type InternalStatFunc func() (stats map[string]metric.InternalMetrics)
 
 // ResponseFormat is the structure of the response from an http request
 type ResponseFormat struct {
-	Memory     metric.InternalMetrics
-	Handlers   map[string]metric.InternalMetrics
-	Collectors map[string]metric.InternalMetrics
+	Memory      metric.InternalMetrics
+	Handlers    map[string]metric.InternalMetrics
+	Collectors  map[string]metric.InternalMetrics
+	Cardinality map[string]metric.InternalMetrics
 }
 
-// New createse a new internal server instance
-func New(cfg config.Config, h InternalStatFunc, c InternalStatFunc) *InternalServer {
+// New createse a new internal server instance, card reports the
+// cardinality limits of the collectors
+func New(cfg config.Config, h InternalStatFunc, c InternalStatFunc, card InternalStatFunc) *InternalServer {
 	srv := new(InternalServer)
 	srv.log = l.WithFields(l.Fields{"app": "fullerite", "pkg": "internalserver"})
 	srv.handlerStatFunc = h
 	srv.collectorStatFunc = c
+	srv.cardinalityStatFunc = card
 	srv.configure(cfg.InternalServerConfig)
 	return srv
 }
@@ -101,6 +105,18 @@ func (srv *InternalServer) configure(cfgMap map[string]interface{}) {
 //					"averageEmissionTiming": 1.34,
 //				}
 //			}
+//		},
+//		"cardinality": {
+//			"somecollector": {
+//				"counters": {
+//					"cardinalityLimited": 120,
+//				},
+//				"gauges": {
+//					"seriesLimit": 1000,
+//					"series": 1000,
+//					"dimension.request_id": 998,
+//				}
+//			}
 //		}
 //	}
 //
@@ -118,6 +134,9 @@ func (srv InternalServer) buildResponse() *[]byte {
 	rsp.Memory = *memoryStats
 	rsp.Handlers = srv.handlerStatFunc()
 	rsp.Collectors = srv.collectorStatFunc()
+	if srv.cardinalityStatFunc != nil {
+		rsp.Cardinality = srv.cardinalityStatFunc()
+	}
 	asString, err := json.Marshal(rsp)
 	if err != nil {
 		srv.log.Warn("Failed to marshal response ", rsp, " because of error ", err)
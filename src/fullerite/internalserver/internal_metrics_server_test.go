@@ -124,6 +124,26 @@ func TestBuildResponseMemory(t *testing.T) {
 	assert.Equal(t, 19, len(rspFormat.Memory.Gauges))
 }
 
+func TestBuildResponseCardinality(t *testing.T) {
+	srv := InternalServer{
+		log:               l.WithField("testing", "internal_server"),
+		handlerStatFunc:   handlerStatFunc([]handler.Handler{}),
+		collectorStatFunc: collectorStatFunc,
+		cardinalityStatFunc: func() map[string]metric.InternalMetrics {
+			limiter := metric.NewCardinalityLimiter(1, time.Minute, false, nil)
+			limiter.Limit(metric.New("hello"))
+			limiter.Limit(metric.New("world"))
+			return map[string]metric.InternalMetrics{"somecollector": limiter.InternalMetrics()}
+		},
+	}
+
+	rspFormat := new(ResponseFormat)
+	err := json.Unmarshal(*srv.buildResponse(), rspFormat)
+	assert.Nil(t, err)
+	assert.Equal(t, 1.0, rspFormat.Cardinality["somecollector"].Counters["cardinalityLimited"])
+	assert.Equal(t, 1.0, rspFormat.Cardinality["somecollector"].Gauges["series"])
+}
+
 func TestRespondToHttp(t *testing.T) {
 	cfg := config.Config{}
 	cfg.InternalServerConfig = map[string]interface{}{"port": 0}
@@ -139,7 +159,7 @@ func TestRespondToHttp(t *testing.T) {
 		map[string]float64{"secondgauge": 890.2},
 	)
 	testHandlers := []handler.Handler{h1, h2}
-	srv := New(cfg, handlerStatFunc(testHandlers), collectorStatFunc)
+	srv := New(cfg, handlerStatFunc(testHandlers), collectorStatFunc, collectorStatFunc)
 	go srv.Run()
 
 	time.Sleep(100 * time.Millisecond) // wait for server to bind on port
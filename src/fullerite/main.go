@@ -1,13 +1,18 @@
 package main
 
 import (
+	"fullerite/collector"
 	"fullerite/config"
 	"fullerite/handler"
 	"fullerite/internalserver"
 	"fullerite/metric"
+	"fullerite/processor"
 
+	"context"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"syscall"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -105,39 +110,66 @@ func start(ctx *cli.Context) {
 		defer profile.Start(profile.BlockProfile).Stop()
 		defer profile.Start(profile.ProfilePath("."))
 	}
-	quit := make(chan bool)
 	initLogrus(ctx)
 	log.Info("Starting fullerite...")
 
-	c, err := config.ReadConfig(ctx.String("config"))
+	configFile := ctx.String("config")
+	c, err := config.ReadConfig(configFile)
 	if err != nil {
 		return
 	}
-	handlers := createHandlers(c)
-	hook := NewLogErrorHook(handlers)
-	log.Logger.Hooks.Add(hook)
 
-	startHandlers(handlers)
-	collectors := startCollectors(c)
+	// collectors and the readers forwarding their metrics to the handlers
+	// are stopped separately so that collections in progress can finish
+	collectorCtx, stopCollectors := context.WithCancel(context.Background())
+	readerCtx, stopReaders := context.WithCancel(context.Background())
+	handlerCtx, stopHandlers := context.WithCancel(context.Background())
+	defer stopHandlers()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	collectorStatChan := make(chan metric.CollectorEmission)
+	sup := newSupervisor(configFile, c, collectorCtx, readerCtx, handlerCtx, collectorStatChan)
 
 	internalServer := internalserver.New(c,
-		handlerStatFunc(handlers),
-		readCollectorStat(collectorStatChan))
+		handlerStatFunc(sup.handlerList, sup.bus),
+		readCollectorStat(collectorStatChan),
+		processor.CardinalityStats)
 
+	sup.start()
 	go internalServer.Run()
 
-	readFromCollectors(collectors, handlers, collectorStatChan)
-
-	<-quit
+	for {
+		sig := <-signals
+		if sig == syscall.SIGHUP {
+			sup.reload()
+			continue
+		}
+		log.Info("Received ", sig, ", shutting down fullerite...")
+		shutdown(shutdownTimeout(sup.config),
+			stage{"collectors", stopCollectors, &runningCollectors},
+			stage{"collector readers", stopReaders, &runningReaders},
+			sup.handlerList())
+		return
+	}
 }
 
-func handlerStatFunc(handlers []handler.Handler) internalserver.InternalStatFunc {
+// handlerStatFunc reports the internal metrics of the handlers
+// along with the ones of their subscription to the bus
+func handlerStatFunc(handlers func() []handler.Handler, bus *handler.Bus) internalserver.InternalStatFunc {
 	return func() map[string]metric.InternalMetrics {
 		stats := map[string]metric.InternalMetrics{}
-		for _, inst := range handlers {
-			stats[inst.Name()] = inst.InternalMetrics()
+		busStats := bus.InternalMetrics()
+		for _, inst := range handlers() {
+			im := inst.InternalMetrics()
+			for name, value := range busStats[inst.Name()].Counters {
+				im.Counters[name] = value
+			}
+			for name, value := range busStats[inst.Name()].Gauges {
+				im.Gauges[name] = value
+			}
+			stats[inst.Name()] = im
 		}
 		return stats
 	}
@@ -162,6 +194,19 @@ func readCollectorStat(collectorStatChan <-chan metric.CollectorEmission) intern
 			}
 			metricStats[k] = m
 		}
+		for k, v := range collector.InternalStats() {
+			m, ok := metricStats[k]
+			if !ok {
+				metricStats[k] = v
+				continue
+			}
+			for name, value := range v.Counters {
+				m.Counters[name] = value
+			}
+			for name, value := range v.Gauges {
+				m.Gauges[name] = value
+			}
+		}
 		return metricStats
 	}
 }
@@ -187,14 +232,16 @@ func visualize(ctx *cli.Context) {
 	configMap["collectorFile"] = collectorFile
 
 	// Start collector and handlers
-	collector := startCollector("AdHoc", c, configMap)
+	collector := startCollector(context.Background(), "AdHoc", c, configMap)
 	c.Collectors = []string{"AdHoc"}
 	c.DiamondCollectors = []string{}
 	handlers := createHandlers(c)
-	startHandlers(handlers)
+	startHandlers(context.Background(), handlers)
+	bus := handler.NewBus(config.GetAsInt(c.BusBufferSize, handler.DefaultBusBufferSize))
+	bus.SetHandlers(handlers)
 
 	// Read the metrics from the AdHoc collector
-	go readFromCollector(collector, handlers)
+	go readFromCollector(context.Background(), collector, bus, newProcessorChain(c, configMap))
 
 	// Stop collecting after `die-after` duration expires
 	quitChannel := make(chan bool, 1)
@@ -0,0 +1,172 @@
+package metric
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// OverflowValue replaces the dimension values of the series collapsed
+// by a CardinalityLimiter
+const OverflowValue = "__overflow__"
+
+// how many times per window the expired series are purged, they're
+// forgotten at most a tenth of the window after they expired
+const cardinalityPurgesPerWindow = 10
+
+// CardinalityLimiter bounds the number of distinct series (a name and its
+// dimensions) seen within a rolling window. Once the limit is reached the
+// points of new series are either dropped or, with overflow set, collapsed
+// into one series per name whose dimension values are OverflowValue, except
+// for the dimensions to keep. Series expire once they haven't been seen for
+// the window.
+type CardinalityLimiter struct {
+	limit    int
+	window   time.Duration
+	overflow bool
+	keep     map[string]bool
+
+	mu            sync.Mutex
+	series        map[string]cardinalitySeries
+	lastPurge     time.Time
+	limited       uint64
+	limitedWindow uint64
+}
+
+type cardinalitySeries struct {
+	dimensions map[string]string
+	seen       time.Time
+}
+
+// DimensionCardinality is the number of distinct values of a dimension
+type DimensionCardinality struct {
+	Dimension string
+	Values    int
+}
+
+// NewCardinalityLimiter creates a limiter allowing limit series per window
+func NewCardinalityLimiter(limit int, window time.Duration, overflow bool, keep []string) *CardinalityLimiter {
+	c := &CardinalityLimiter{
+		limit:     limit,
+		window:    window,
+		overflow:  overflow,
+		keep:      make(map[string]bool),
+		series:    make(map[string]cardinalitySeries),
+		lastPurge: time.Now(),
+	}
+	for _, dimension := range keep {
+		c.keep[dimension] = true
+	}
+	return c
+}
+
+// Limit returns m, possibly collapsed, or false if it has to be dropped
+func (c *CardinalityLimiter) Limit(m Metric) (Metric, bool) {
+	now := time.Now()
+	key := m.SeriesKey()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.purge(now)
+
+	if s, exists := c.series[key]; exists || len(c.series) < c.limit {
+		s.dimensions = m.Dimensions
+		s.seen = now
+		c.series[key] = s
+		return m, true
+	}
+
+	c.limited++
+	c.limitedWindow++
+	if !c.overflow {
+		return m, false
+	}
+	dimensions := make(map[string]string, len(m.Dimensions))
+	for name, value := range m.Dimensions {
+		if c.keep[name] {
+			dimensions[name] = value
+		} else {
+			dimensions[name] = OverflowValue
+		}
+	}
+	m.Dimensions = dimensions
+	m.Collapsed = true
+	return m, true
+}
+
+// Limited returns how many points went over the limit since the last
+// call to Limited, and in total
+func (c *CardinalityLimiter) Limited() (sinceLastCall uint64, total uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sinceLastCall = c.limitedWindow
+	c.limitedWindow = 0
+	return sinceLastCall, c.limited
+}
+
+// TopDimensions returns the n dimensions with the most distinct values
+// among the series within the window, the likely culprits of hitting
+// the limit
+func (c *CardinalityLimiter) TopDimensions(n int) []DimensionCardinality {
+	c.mu.Lock()
+	values := map[string]map[string]bool{}
+	for _, s := range c.series {
+		for name, value := range s.dimensions {
+			if values[name] == nil {
+				values[name] = map[string]bool{}
+			}
+			values[name][value] = true
+		}
+	}
+	c.mu.Unlock()
+
+	top := make([]DimensionCardinality, 0, len(values))
+	for name, distinct := range values {
+		top = append(top, DimensionCardinality{name, len(distinct)})
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Values != top[j].Values {
+			return top[i].Values > top[j].Values
+		}
+		return top[i].Dimension < top[j].Dimension
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// InternalMetrics reports the limit, the series within the window, the
+// points which went over the limit and the distinct values of the top
+// dimensions, as "dimension.<name>"
+func (c *CardinalityLimiter) InternalMetrics() InternalMetrics {
+	c.mu.Lock()
+	counters := map[string]float64{"cardinalityLimited": float64(c.limited)}
+	gauges := map[string]float64{
+		"seriesLimit": float64(c.limit),
+		"series":      float64(len(c.series)),
+	}
+	c.mu.Unlock()
+
+	for _, top := range c.TopDimensions(5) {
+		gauges["dimension."+top.Dimension] = float64(top.Values)
+	}
+	return InternalMetrics{
+		Counters: counters,
+		Gauges:   gauges,
+	}
+}
+
+// purge forgets the series which weren't seen within the window,
+// it runs at most cardinalityPurgesPerWindow times per window
+func (c *CardinalityLimiter) purge(now time.Time) {
+	if now.Sub(c.lastPurge) < c.window/cardinalityPurgesPerWindow {
+		return
+	}
+	for key, s := range c.series {
+		if now.Sub(s.seen) >= c.window {
+			delete(c.series, key)
+		}
+	}
+	c.lastPurge = now
+}
@@ -0,0 +1,83 @@
+package metric
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func requestMetric(requestID string) Metric {
+	m := New("requests")
+	m.AddDimension("collector", "Test")
+	m.AddDimension("request_id", requestID)
+	return m
+}
+
+func TestCardinalityLimiterDrop(t *testing.T) {
+	c := NewCardinalityLimiter(2, time.Minute, false, nil)
+
+	for _, id := range []string{"1", "2", "1", "3", "4"} {
+		c.Limit(requestMetric(id))
+	}
+	_, ok := c.Limit(requestMetric("2"))
+	assert.True(t, ok, "series within the limit are kept")
+	_, ok = c.Limit(requestMetric("5"))
+	assert.False(t, ok)
+
+	sinceLastCall, total := c.Limited()
+	assert.Equal(t, uint64(3), sinceLastCall)
+	assert.Equal(t, uint64(3), total)
+	sinceLastCall, total = c.Limited()
+	assert.Equal(t, uint64(0), sinceLastCall)
+	assert.Equal(t, uint64(3), total)
+
+	assert.Equal(t, []DimensionCardinality{{"request_id", 2}, {"collector", 1}}, c.TopDimensions(5))
+	assert.Equal(t, []DimensionCardinality{{"request_id", 2}}, c.TopDimensions(1))
+
+	stats := c.InternalMetrics()
+	assert.Equal(t, 3.0, stats.Counters["cardinalityLimited"])
+	assert.Equal(t, 2.0, stats.Gauges["series"])
+	assert.Equal(t, 2.0, stats.Gauges["seriesLimit"])
+	assert.Equal(t, 2.0, stats.Gauges["dimension.request_id"])
+}
+
+func TestCardinalityLimiterOverflow(t *testing.T) {
+	c := NewCardinalityLimiter(1, time.Minute, true, []string{"collector"})
+
+	c.Limit(requestMetric("1"))
+	m, ok := c.Limit(requestMetric("2"))
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"collector": "Test", "request_id": OverflowValue}, m.Dimensions)
+	assert.True(t, m.Collapsed)
+}
+
+func TestCardinalityLimiterWindow(t *testing.T) {
+	c := NewCardinalityLimiter(1, time.Minute, false, nil)
+	c.Limit(requestMetric("1"))
+
+	// pretend the series and the last purge are older than the window
+	for key, s := range c.series {
+		s.seen = s.seen.Add(-2 * time.Minute)
+		c.series[key] = s
+	}
+	c.lastPurge = c.lastPurge.Add(-2 * time.Minute)
+
+	_, ok := c.Limit(requestMetric("2"))
+	assert.True(t, ok, "the expired series doesn't count anymore")
+}
+
+func TestCardinalityLimiterPurgesWithinTheWindow(t *testing.T) {
+	c := NewCardinalityLimiter(1, time.Minute, false, nil)
+	c.Limit(requestMetric("1"))
+
+	// the series just expired, the last purge was a few seconds ago
+	for key, s := range c.series {
+		s.seen = s.seen.Add(-61 * time.Second)
+		c.series[key] = s
+	}
+	c.lastPurge = c.lastPurge.Add(-7 * time.Second)
+
+	_, ok := c.Limit(requestMetric("2"))
+	assert.True(t, ok, "the expired series is forgotten before the next window")
+}
@@ -1,5 +1,13 @@
 package metric
 
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
 // The different types of metrics that are supported
 const (
 	Gauge             = "gauge"
@@ -9,11 +17,34 @@ const (
 
 // Metric type holds all the information for a single metric data
 // point. Metrics are generated in collectors and passed to handlers.
+//
+// Timestamp is the time the data point was collected. It is optional:
+// a zero Timestamp means "now" to whoever emits the metric. On the wire
+// it is encoded as (possibly fractional) seconds since the epoch, the
+// same way Diamond and AdHoc collectors report it.
+//
+// Forwarded metrics were collected by another fullerite, the dimensions
+// they were sent with win over the default dimensions of the handlers.
+//
+// Collapsed metrics stand for several series a CardinalityLimiter merged
+// into its overflow series.
 type Metric struct {
 	Name       string            `json:"name"`
 	MetricType string            `json:"type"`
 	Value      float64           `json:"value"`
 	Dimensions map[string]string `json:"dimensions"`
+	Timestamp  time.Time         `json:"-"`
+	Forwarded  bool              `json:"-"`
+	Collapsed  bool              `json:"-"`
+}
+
+// jsonMetric is the wire representation of a Metric
+type jsonMetric struct {
+	Name       string            `json:"name"`
+	MetricType string            `json:"type"`
+	Value      float64           `json:"value"`
+	Dimensions map[string]string `json:"dimensions"`
+	Timestamp  float64           `json:"timestamp,omitempty"`
 }
 
 // New returns a new metric with name. Default metric type is "gauge"
@@ -60,13 +91,17 @@ func (m *Metric) AddDimensions(dimensions map[string]string) {
 	}
 }
 
-// GetDimensions returns the dimensions of a metric merged with defaults. Defaults win.
+// GetDimensions returns the dimensions of a metric merged with defaults.
+// Defaults win, except over the dimensions of forwarded metrics.
 func (m *Metric) GetDimensions(defaults map[string]string) (dimensions map[string]string) {
 	dimensions = make(map[string]string)
 	for name, value := range m.Dimensions {
 		dimensions[name] = value
 	}
 	for name, value := range defaults {
+		if _, exists := dimensions[name]; exists && m.Forwarded {
+			continue
+		}
 		dimensions[name] = value
 	}
 	return dimensions
@@ -78,12 +113,75 @@ func (m *Metric) GetDimensionValue(dimension string) (value string, ok bool) {
 	return
 }
 
+// SeriesKey identifies the series of the metric: its name and sorted dimensions
+func (m *Metric) SeriesKey() string {
+	dimensions := make([]string, 0, len(m.Dimensions))
+	for name, value := range m.Dimensions {
+		dimensions = append(dimensions, name+"="+value)
+	}
+	sort.Strings(dimensions)
+	return m.Name + "," + strings.Join(dimensions, ",")
+}
+
 // ZeroValue is metric zero value
 func (m *Metric) ZeroValue() bool {
 	return (len(m.Name) == 0) &&
 		(len(m.MetricType) == 0) &&
 		(m.Value == 0.0) &&
-		(len(m.Dimensions) == 0)
+		(len(m.Dimensions) == 0) &&
+		m.Timestamp.IsZero()
+}
+
+// SetTimestampIfMissing stamps the metric with t unless it
+// already carries a collection timestamp.
+func (m *Metric) SetTimestampIfMissing(t time.Time) {
+	if m.Timestamp.IsZero() {
+		m.Timestamp = t
+	}
+}
+
+// GetTimestamp returns the collection timestamp of the metric,
+// falling back to the current time if the metric doesn't have one.
+func (m *Metric) GetTimestamp() time.Time {
+	if m.Timestamp.IsZero() {
+		return time.Now()
+	}
+	return m.Timestamp
+}
+
+// MarshalJSON encodes the timestamp as seconds since the epoch
+func (m Metric) MarshalJSON() ([]byte, error) {
+	jm := jsonMetric{
+		Name:       m.Name,
+		MetricType: m.MetricType,
+		Value:      m.Value,
+		Dimensions: m.Dimensions,
+	}
+	if !m.Timestamp.IsZero() {
+		jm.Timestamp = float64(m.Timestamp.Unix()) +
+			float64(m.Timestamp.Nanosecond())/float64(time.Second)
+	}
+	return json.Marshal(jm)
+}
+
+// UnmarshalJSON decodes a metric, honouring an optional
+// "timestamp" expressed in seconds since the epoch
+func (m *Metric) UnmarshalJSON(data []byte) error {
+	var jm jsonMetric
+	if err := json.Unmarshal(data, &jm); err != nil {
+		return err
+	}
+	m.Name = jm.Name
+	m.MetricType = jm.MetricType
+	m.Value = jm.Value
+	m.Dimensions = jm.Dimensions
+	m.Timestamp = time.Time{}
+	if jm.Timestamp > 0 {
+		sec, frac := math.Modf(jm.Timestamp)
+		usec := int64(math.Round(frac * float64(time.Second/time.Microsecond)))
+		m.Timestamp = time.Unix(int64(sec), usec*int64(time.Microsecond))
+	}
+	return nil
 }
 
 // Sentinel is a metric value which forces handler to flush
@@ -100,3 +198,12 @@ func AddToAll(metrics *[]Metric, dims map[string]string) {
 		}
 	}
 }
+
+// NearestRank returns the percentile of sorted values
+func NearestRank(values []float64, percentile float64) float64 {
+	rank := int(math.Ceil(percentile/100*float64(len(values)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return values[rank]
+}
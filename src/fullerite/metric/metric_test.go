@@ -5,6 +5,7 @@ import (
 	"fullerite/metric"
 
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -68,6 +69,16 @@ func TestGetDimensionsWithDimensions(t *testing.T) {
 	assert.Equal(t, numDimensions, 2, "dimensions length should be 2")
 }
 
+func TestGetDimensionsForwarded(t *testing.T) {
+	defaultDimensions := map[string]string{"host": "aggregator", "region": "east"}
+	m := metric.New("TestMetric")
+	m.AddDimension("host", "web1")
+
+	assert.Equal(t, "aggregator", m.GetDimensions(defaultDimensions)["host"], "defaults win")
+	m.Forwarded = true
+	assert.Equal(t, map[string]string{"host": "web1", "region": "east"}, m.GetDimensions(defaultDimensions))
+}
+
 func TestGetDimensionValueFound(t *testing.T) {
 	m := metric.New("TestMetric")
 	m.AddDimension("TestDimension", "test value")
@@ -101,3 +112,61 @@ func TestAddDimensions(t *testing.T) {
 
 	assert.Equal(t, m1, m2)
 }
+
+func TestMetricJSONWithoutTimestamp(t *testing.T) {
+	j := []byte(`{"name": "test", "type": "gauge", "value": 1.5, "dimensions": {"a": "b"}}`)
+	var m metric.Metric
+	err := json.Unmarshal(j, &m)
+
+	assert := assert.New(t)
+	assert.Nil(err)
+	assert.Equal("test", m.Name)
+	assert.Equal(1.5, m.Value)
+	assert.Equal("b", m.Dimensions["a"])
+	assert.True(m.Timestamp.IsZero())
+
+	out, err := json.Marshal(m)
+	assert.Nil(err)
+	assert.NotContains(string(out), "timestamp")
+}
+
+func TestMetricJSONWithTimestamp(t *testing.T) {
+	j := []byte(`[{"name": "a", "value": 1, "timestamp": 1500000000},
+		{"name": "b", "value": 2, "timestamp": 1500000000.25}]`)
+	var metrics []metric.Metric
+	err := json.Unmarshal(j, &metrics)
+
+	assert := assert.New(t)
+	assert.Nil(err)
+	assert.Equal(time.Unix(1500000000, 0), metrics[0].Timestamp)
+	assert.Equal(time.Unix(1500000000, 250000000), metrics[1].Timestamp)
+
+	out, err := json.Marshal(metrics[1])
+	assert.Nil(err)
+	assert.Contains(string(out), `"timestamp":1500000000.25`)
+}
+
+func TestGetTimestamp(t *testing.T) {
+	m := metric.New("TestMetric")
+	assert.False(t, m.GetTimestamp().IsZero(), "should fall back to now")
+
+	ts := time.Unix(1500000000, 0)
+	m.SetTimestampIfMissing(ts)
+	assert.Equal(t, ts, m.GetTimestamp())
+
+	m.SetTimestampIfMissing(time.Now())
+	assert.Equal(t, ts, m.Timestamp, "should not override an existing timestamp")
+}
+
+func TestSeriesKey(t *testing.T) {
+	m1 := metric.New("hello")
+	m1.AddDimension("a", "1")
+	m1.AddDimension("b", "2")
+	m2 := metric.New("hello")
+	m2.AddDimension("b", "2")
+	m2.AddDimension("a", "1")
+
+	assert.Equal(t, m1.SeriesKey(), m2.SeriesKey())
+	m2.AddDimension("a", "3")
+	assert.NotEqual(t, m1.SeriesKey(), m2.SeriesKey())
+}
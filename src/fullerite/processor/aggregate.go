@@ -0,0 +1,237 @@
+package processor
+
+import (
+	"fullerite/config"
+	"fullerite/metric"
+
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+var defaultAggregateStats = []string{"sum", "count", "min", "max", "avg"}
+
+// Aggregate processor groups the metrics by the "group_by" dimensions
+// (the other dimensions are dropped) and emits statistics of each group
+// every interval, e.g. the sum of a counter over all the workers of a host.
+//
+// The points of each series (a metric name with all its dimensions) are
+// first combined over the interval according to their type: gauges are
+// averaged, counters summed and the last value of cumulative counters is
+// kept. The "stats" of each group are then computed over its series:
+// "sum", "count" (the number of series), "min", "max" and "avg", plus the
+// "percentiles" listed. They are emitted as <name>.<stat>, percentiles as
+// <name>.p<percentile>. The sum keeps the type of the metric, the other
+// statistics are gauges.
+//
+// Only the metrics matching "metric_pattern" are aggregated, the raw
+// points are still forwarded unless "drop_raw" is set.
+type Aggregate struct {
+	baseProcessor
+	pattern     *regexp.Regexp
+	groupBy     []string
+	stats       []string
+	percentiles []float64
+	dropRaw     bool
+
+	now         func() time.Time
+	windowStart time.Time
+	groups      map[string]*aggregateGroup
+}
+
+type aggregateGroup struct {
+	name       string
+	metricType string
+	dimensions map[string]string
+	series     map[string]*aggregateSeries
+}
+
+type aggregateSeries struct {
+	sum   float64
+	count int
+	last  float64
+}
+
+func init() {
+	RegisterProcessor("Aggregate", newAggregate)
+}
+
+func newAggregate(log *l.Entry) Processor {
+	p := new(Aggregate)
+	p.name = "Aggregate"
+	p.log = log
+	p.stats = defaultAggregateStats
+	p.now = time.Now
+	p.groups = make(map[string]*aggregateGroup)
+	return p
+}
+
+// Configure the processor
+func (p *Aggregate) Configure(configMap map[string]interface{}) {
+	p.configureCommonParams(configMap)
+	p.pattern = compilePattern(p.log, configMap["metric_pattern"])
+	if groupBy, exists := configMap["group_by"]; exists {
+		p.groupBy = config.GetAsSlice(groupBy)
+	}
+	if stats, exists := configMap["stats"]; exists {
+		p.stats = nil
+		for _, stat := range config.GetAsSlice(stats) {
+			switch stat {
+			case "sum", "count", "min", "max", "avg":
+				p.stats = append(p.stats, stat)
+			default:
+				p.log.Error("Unknown aggregation ", stat)
+			}
+		}
+	}
+	if percentiles, exists := configMap["percentiles"]; exists {
+		// percentiles are numbers, GetAsSlice only handles strings
+		list, ok := percentiles.([]interface{})
+		if !ok {
+			p.log.Error("Invalid percentiles ", percentiles)
+		}
+		for _, percentile := range list {
+			value := config.GetAsFloat(percentile, -1)
+			if value <= 0 || value > 100 {
+				p.log.Error("Invalid percentile ", percentile)
+				continue
+			}
+			p.percentiles = append(p.percentiles, value)
+		}
+	}
+	if dropRaw, exists := configMap["drop_raw"]; exists {
+		p.dropRaw = config.GetAsBool(dropRaw, false)
+	}
+}
+
+// Process adds m to its group
+func (p *Aggregate) Process(m metric.Metric) (metric.Metric, bool) {
+	if p.pattern != nil && !p.pattern.MatchString(m.Name) {
+		return m, true
+	}
+	if p.windowStart.IsZero() {
+		p.windowStart = p.now()
+	}
+
+	dimensions := make(map[string]string, len(p.groupBy))
+	for _, name := range p.groupBy {
+		if value, exists := m.GetDimensionValue(name); exists {
+			dimensions[name] = value
+		}
+	}
+	groupKey := seriesKey(m.Name+"|"+m.MetricType, dimensions)
+	group, exists := p.groups[groupKey]
+	if !exists {
+		group = &aggregateGroup{
+			name:       m.Name,
+			metricType: m.MetricType,
+			dimensions: dimensions,
+			series:     make(map[string]*aggregateSeries),
+		}
+		p.groups[groupKey] = group
+	}
+
+	key := seriesKey(m.Name, m.Dimensions)
+	series, exists := group.series[key]
+	if !exists {
+		series = new(aggregateSeries)
+		group.series[key] = series
+	}
+	series.sum += m.Value
+	series.count++
+	series.last = m.Value
+
+	return m, !p.dropRaw
+}
+
+// Flush returns the statistics of the groups once the interval is over
+func (p *Aggregate) Flush(force bool) []metric.Metric {
+	if len(p.groups) == 0 {
+		return nil
+	}
+	now := p.now()
+	if !force && now.Sub(p.windowStart) < time.Duration(p.interval)*time.Second {
+		return nil
+	}
+
+	keys := make([]string, 0, len(p.groups))
+	for key := range p.groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var metrics []metric.Metric
+	for _, key := range keys {
+		metrics = append(metrics, p.aggregate(p.groups[key], now)...)
+	}
+	p.groups = make(map[string]*aggregateGroup)
+	p.windowStart = time.Time{}
+	return metrics
+}
+
+func (p *Aggregate) aggregate(group *aggregateGroup, now time.Time) []metric.Metric {
+	values := make([]float64, 0, len(group.series))
+	sum := 0.0
+	for _, series := range group.series {
+		var value float64
+		switch group.metricType {
+		case metric.Counter:
+			value = series.sum
+		case metric.CumulativeCounter:
+			value = series.last
+		default:
+			value = series.sum / float64(series.count)
+		}
+		values = append(values, value)
+		sum += value
+	}
+	sort.Float64s(values)
+
+	newMetric := func(stat string, value float64, metricType string) metric.Metric {
+		m := metric.WithValue(group.name+"."+stat, value)
+		m.MetricType = metricType
+		m.Timestamp = now
+		m.AddDimensions(group.dimensions)
+		return m
+	}
+
+	var metrics []metric.Metric
+	for _, stat := range p.stats {
+		switch stat {
+		case "sum":
+			metrics = append(metrics, newMetric(stat, sum, group.metricType))
+		case "count":
+			metrics = append(metrics, newMetric(stat, float64(len(values)), metric.Gauge))
+		case "min":
+			metrics = append(metrics, newMetric(stat, values[0], metric.Gauge))
+		case "max":
+			metrics = append(metrics, newMetric(stat, values[len(values)-1], metric.Gauge))
+		case "avg":
+			metrics = append(metrics, newMetric(stat, sum/float64(len(values)), metric.Gauge))
+		}
+	}
+	for _, percentile := range p.percentiles {
+		stat := "p" + strings.Replace(strconv.FormatFloat(percentile, 'f', -1, 64), ".", "_", -1)
+		metrics = append(metrics, newMetric(stat, metric.NearestRank(values, percentile), metric.Gauge))
+	}
+	return metrics
+}
+
+// seriesKey identifies a metric name and its dimensions
+func seriesKey(name string, dimensions map[string]string) string {
+	names := make([]string, 0, len(dimensions))
+	for k := range dimensions {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	key := name
+	for _, k := range names {
+		key += "," + k + "=" + dimensions[k]
+	}
+	return key
+}
@@ -0,0 +1,141 @@
+package processor
+
+import (
+	"fullerite/metric"
+
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAggregate(configMap map[string]interface{}) (*Aggregate, *time.Time) {
+	p := New("Aggregate").(*Aggregate)
+	p.SetInterval(10)
+	p.Configure(configMap)
+
+	now := time.Unix(1000, 0)
+	p.now = func() time.Time { return now }
+	return p, &now
+}
+
+func workerMetric(name string, metricType string, worker string, value float64) metric.Metric {
+	m := metric.WithValue(name, value)
+	m.MetricType = metricType
+	m.AddDimension("worker", worker)
+	m.AddDimension("service", "api")
+	return m
+}
+
+func metricsByName(metrics []metric.Metric) map[string]metric.Metric {
+	byName := map[string]metric.Metric{}
+	for _, m := range metrics {
+		byName[m.Name] = m
+	}
+	return byName
+}
+
+func TestAggregateGauges(t *testing.T) {
+	p, now := newTestAggregate(map[string]interface{}{
+		"group_by":    []interface{}{"service"},
+		"percentiles": []interface{}{50.0, 99.9},
+	})
+
+	// worker 1 averages 2 over the interval
+	for _, m := range []metric.Metric{
+		workerMetric("mem", metric.Gauge, "1", 1),
+		workerMetric("mem", metric.Gauge, "1", 3),
+		workerMetric("mem", metric.Gauge, "2", 4),
+		workerMetric("mem", metric.Gauge, "3", 6),
+	} {
+		_, keep := p.Process(m)
+		assert.True(t, keep)
+	}
+
+	assert.Empty(t, p.Flush(false), "the interval isn't over yet")
+	*now = now.Add(10 * time.Second)
+	metrics := metricsByName(p.Flush(false))
+
+	assert.Len(t, metrics, 7)
+	expected := map[string]float64{
+		"mem.sum": 12, "mem.count": 3, "mem.min": 2, "mem.max": 6,
+		"mem.avg": 4, "mem.p50": 4, "mem.p99_9": 6,
+	}
+	for name, value := range expected {
+		m := metrics[name]
+		assert.Equal(t, value, m.Value, name)
+		assert.Equal(t, metric.Gauge, m.MetricType, name)
+		assert.Equal(t, map[string]string{"service": "api"}, m.Dimensions, name)
+		assert.Equal(t, *now, m.Timestamp, name)
+	}
+
+	assert.Empty(t, p.Flush(true), "the groups are reset after a flush")
+}
+
+func TestAggregateCounters(t *testing.T) {
+	p, _ := newTestAggregate(map[string]interface{}{
+		"group_by": []interface{}{"service"},
+		"stats":    []interface{}{"sum", "max"},
+		"drop_raw": true,
+	})
+
+	for _, m := range []metric.Metric{
+		workerMetric("requests", metric.Counter, "1", 1),
+		workerMetric("requests", metric.Counter, "1", 3),
+		workerMetric("requests", metric.Counter, "2", 2),
+		workerMetric("total", metric.CumulativeCounter, "1", 100),
+		workerMetric("total", metric.CumulativeCounter, "1", 110),
+		workerMetric("total", metric.CumulativeCounter, "2", 50),
+	} {
+		_, keep := p.Process(m)
+		assert.False(t, keep)
+	}
+
+	metrics := metricsByName(p.Flush(true))
+	assert.Len(t, metrics, 4)
+
+	assert.Equal(t, 6.0, metrics["requests.sum"].Value)
+	assert.Equal(t, metric.Counter, metrics["requests.sum"].MetricType)
+	assert.Equal(t, 4.0, metrics["requests.max"].Value)
+	assert.Equal(t, metric.Gauge, metrics["requests.max"].MetricType)
+
+	assert.Equal(t, 160.0, metrics["total.sum"].Value)
+	assert.Equal(t, metric.CumulativeCounter, metrics["total.sum"].MetricType)
+	assert.Equal(t, 110.0, metrics["total.max"].Value)
+}
+
+func TestAggregateMetricPattern(t *testing.T) {
+	p, _ := newTestAggregate(map[string]interface{}{
+		"metric_pattern": "^uwsgi\\.",
+		"drop_raw":       true,
+	})
+
+	_, keep := p.Process(workerMetric("cpu", metric.Gauge, "1", 1))
+	assert.True(t, keep)
+	_, keep = p.Process(workerMetric("uwsgi.busy", metric.Gauge, "1", 1))
+	assert.False(t, keep)
+
+	metrics := metricsByName(p.Flush(true))
+	assert.Contains(t, metrics, "uwsgi.busy.avg")
+	assert.Empty(t, metrics["uwsgi.busy.avg"].Dimensions)
+	assert.NotContains(t, metrics, "cpu.avg")
+}
+
+func TestChainFlush(t *testing.T) {
+	chain := NewChain([]map[string]interface{}{
+		{"processor": "Aggregate", "stats": []interface{}{"sum"}},
+		{"processor": "AddDimensions", "dimensions": map[string]interface{}{"aggregated": "yes"}},
+	}, 10)
+	assert.True(t, chain.HasFlushers())
+	assert.False(t, chain[1:].HasFlushers())
+
+	chain.Process(metric.WithValue("hello", 1))
+	chain.Process(metric.WithValue("hello", 2))
+	assert.Empty(t, chain.Flush(false))
+
+	metrics := chain.Flush(true)
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, "hello.sum", metrics[0].Name)
+	assert.Equal(t, 1.5, metrics[0].Value)
+	assert.Equal(t, map[string]string{"aggregated": "yes"}, metrics[0].Dimensions)
+}
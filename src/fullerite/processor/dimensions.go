@@ -0,0 +1,113 @@
+package processor
+
+import (
+	"fullerite/config"
+	"fullerite/metric"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+func init() {
+	RegisterProcessor("AddDimensions", newAddDimensions)
+	RegisterProcessor("DropDimensions", newDropDimensions)
+	RegisterProcessor("RenameDimensions", newRenameDimensions)
+}
+
+// AddDimensions processor adds "dimensions" to every metric. Existing
+// dimensions are only overwritten if "overwrite" is set.
+type AddDimensions struct {
+	baseProcessor
+	dimensions map[string]string
+	overwrite  bool
+}
+
+func newAddDimensions(log *l.Entry) Processor {
+	p := new(AddDimensions)
+	p.name = "AddDimensions"
+	p.log = log
+	return p
+}
+
+// Configure the processor
+func (p *AddDimensions) Configure(configMap map[string]interface{}) {
+	p.configureCommonParams(configMap)
+	if dimensions, exists := configMap["dimensions"]; exists {
+		p.dimensions = config.GetAsMap(dimensions)
+	}
+	if overwrite, exists := configMap["overwrite"]; exists {
+		p.overwrite = config.GetAsBool(overwrite, false)
+	}
+}
+
+// Process adds the dimensions to m
+func (p *AddDimensions) Process(m metric.Metric) (metric.Metric, bool) {
+	for k, v := range p.dimensions {
+		if _, exists := m.GetDimensionValue(k); exists && !p.overwrite {
+			continue
+		}
+		m.AddDimension(k, v)
+	}
+	return m, true
+}
+
+// DropDimensions processor removes the "dimensions" listed from every metric
+type DropDimensions struct {
+	baseProcessor
+	dimensions []string
+}
+
+func newDropDimensions(log *l.Entry) Processor {
+	p := new(DropDimensions)
+	p.name = "DropDimensions"
+	p.log = log
+	return p
+}
+
+// Configure the processor
+func (p *DropDimensions) Configure(configMap map[string]interface{}) {
+	p.configureCommonParams(configMap)
+	if dimensions, exists := configMap["dimensions"]; exists {
+		p.dimensions = config.GetAsSlice(dimensions)
+	}
+}
+
+// Process removes the dimensions from m
+func (p *DropDimensions) Process(m metric.Metric) (metric.Metric, bool) {
+	for _, k := range p.dimensions {
+		m.RemoveDimension(k)
+	}
+	return m, true
+}
+
+// RenameDimensions processor renames dimensions, "dimensions"
+// maps the current names to the new ones
+type RenameDimensions struct {
+	baseProcessor
+	dimensions map[string]string
+}
+
+func newRenameDimensions(log *l.Entry) Processor {
+	p := new(RenameDimensions)
+	p.name = "RenameDimensions"
+	p.log = log
+	return p
+}
+
+// Configure the processor
+func (p *RenameDimensions) Configure(configMap map[string]interface{}) {
+	p.configureCommonParams(configMap)
+	if dimensions, exists := configMap["dimensions"]; exists {
+		p.dimensions = config.GetAsMap(dimensions)
+	}
+}
+
+// Process renames the dimensions of m
+func (p *RenameDimensions) Process(m metric.Metric) (metric.Metric, bool) {
+	for from, to := range p.dimensions {
+		if value, exists := m.GetDimensionValue(from); exists {
+			m.RemoveDimension(from)
+			m.AddDimension(to, value)
+		}
+	}
+	return m, true
+}
@@ -0,0 +1,61 @@
+package processor
+
+import (
+	"fullerite/metric"
+
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddDimensions(t *testing.T) {
+	p := New("AddDimensions")
+	p.Configure(map[string]interface{}{
+		"dimensions": map[string]interface{}{"region": "us-west", "env": "prod"},
+	})
+
+	m := metric.New("test")
+	m.AddDimension("env", "dev")
+	m, ok := p.Process(m)
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"region": "us-west", "env": "dev"}, m.Dimensions)
+}
+
+func TestAddDimensionsOverwrite(t *testing.T) {
+	p := New("AddDimensions")
+	p.Configure(map[string]interface{}{
+		"dimensions": map[string]interface{}{"env": "prod"},
+		"overwrite":  true,
+	})
+
+	m := metric.New("test")
+	m.AddDimension("env", "dev")
+	m, _ = p.Process(m)
+	assert.Equal(t, map[string]string{"env": "prod"}, m.Dimensions)
+}
+
+func TestDropDimensions(t *testing.T) {
+	p := New("DropDimensions")
+	p.Configure(map[string]interface{}{
+		"dimensions": []interface{}{"container_id", "pid"},
+	})
+
+	m := metric.New("test")
+	m.AddDimensions(map[string]string{"container_id": "abc", "pid": "1", "service": "foo"})
+	m, ok := p.Process(m)
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"service": "foo"}, m.Dimensions)
+}
+
+func TestRenameDimensions(t *testing.T) {
+	p := New("RenameDimensions")
+	p.Configure(map[string]interface{}{
+		"dimensions": map[string]interface{}{"host": "hostname", "missing": "other"},
+	})
+
+	m := metric.New("test")
+	m.AddDimensions(map[string]string{"host": "foo", "service": "bar"})
+	m, ok := p.Process(m)
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{"hostname": "foo", "service": "bar"}, m.Dimensions)
+}
@@ -0,0 +1,58 @@
+package processor
+
+import (
+	"fullerite/config"
+	"fullerite/metric"
+
+	"regexp"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+// DropMetrics processor drops the metrics whose name matches
+// "metric_pattern" or which have a dimension whose value matches
+// the pattern given for it in "dimension_patterns"
+type DropMetrics struct {
+	baseProcessor
+	metricPattern     *regexp.Regexp
+	dimensionPatterns map[string]*regexp.Regexp
+}
+
+func init() {
+	RegisterProcessor("DropMetrics", newDropMetrics)
+}
+
+func newDropMetrics(log *l.Entry) Processor {
+	p := new(DropMetrics)
+	p.name = "DropMetrics"
+	p.log = log
+	return p
+}
+
+// Configure the processor
+func (p *DropMetrics) Configure(configMap map[string]interface{}) {
+	p.configureCommonParams(configMap)
+	p.metricPattern = compilePattern(p.log, configMap["metric_pattern"])
+
+	p.dimensionPatterns = make(map[string]*regexp.Regexp)
+	if patterns, exists := configMap["dimension_patterns"]; exists {
+		for dimension, pattern := range config.GetAsMap(patterns) {
+			if re := compilePattern(p.log, pattern); re != nil {
+				p.dimensionPatterns[dimension] = re
+			}
+		}
+	}
+}
+
+// Process drops m if it matches
+func (p *DropMetrics) Process(m metric.Metric) (metric.Metric, bool) {
+	if p.metricPattern != nil && p.metricPattern.MatchString(m.Name) {
+		return m, false
+	}
+	for dimension, re := range p.dimensionPatterns {
+		if value, exists := m.GetDimensionValue(dimension); exists && re.MatchString(value) {
+			return m, false
+		}
+	}
+	return m, true
+}
@@ -0,0 +1,40 @@
+package processor
+
+import (
+	"fullerite/metric"
+
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDropMetricsByName(t *testing.T) {
+	p := New("DropMetrics")
+	p.Configure(map[string]interface{}{
+		"metric_pattern": `^debug\.`,
+	})
+
+	_, ok := p.Process(metric.New("debug.foo"))
+	assert.False(t, ok)
+	_, ok = p.Process(metric.New("foo.debug"))
+	assert.True(t, ok)
+}
+
+func TestDropMetricsByDimension(t *testing.T) {
+	p := New("DropMetrics")
+	p.Configure(map[string]interface{}{
+		"dimension_patterns": map[string]interface{}{"service": "^test_"},
+	})
+
+	m := metric.New("foo")
+	m.AddDimension("service", "test_service")
+	_, ok := p.Process(m)
+	assert.False(t, ok)
+
+	m.AddDimension("service", "service_test")
+	_, ok = p.Process(m)
+	assert.True(t, ok)
+
+	_, ok = p.Process(metric.New("foo"))
+	assert.True(t, ok, "metrics without the dimension are kept")
+}
@@ -0,0 +1,127 @@
+package processor
+
+import (
+	"fullerite/config"
+	"fullerite/metric"
+
+	"sync"
+	"time"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultMaxSeries       = 10000
+	defaultMaxSeriesWindow = 600
+)
+
+// the limiters of every collector, for the internal server
+var (
+	cardinalityMu       sync.Mutex
+	cardinalityLimiters = map[string]*metric.CardinalityLimiter{}
+)
+
+// LimitCardinality processor caps the number of distinct series each
+// collector emits within "window" seconds to "max_series". Points of new
+// series over the cap are dropped, or collapsed into an "__overflow__"
+// value of their dimensions if "overflow" is set; "keep_dimensions" lists
+// the dimensions left untouched ("collector" always is). Every interval
+// the collectors which hit the cap are reported with the
+// fullerite.cardinality_limited counter.
+type LimitCardinality struct {
+	baseProcessor
+	maxSeries      int
+	window         time.Duration
+	overflow       bool
+	keepDimensions []string
+
+	limiters  map[string]*metric.CardinalityLimiter
+	now       func() time.Time
+	lastFlush time.Time
+}
+
+func init() {
+	RegisterProcessor("LimitCardinality", newLimitCardinality)
+}
+
+func newLimitCardinality(log *l.Entry) Processor {
+	p := new(LimitCardinality)
+	p.name = "LimitCardinality"
+	p.log = log
+	p.maxSeries = defaultMaxSeries
+	p.window = defaultMaxSeriesWindow * time.Second
+	p.keepDimensions = []string{"collector"}
+	p.limiters = make(map[string]*metric.CardinalityLimiter)
+	p.now = time.Now
+	p.lastFlush = time.Now()
+	return p
+}
+
+// Configure the processor
+func (p *LimitCardinality) Configure(configMap map[string]interface{}) {
+	p.configureCommonParams(configMap)
+	if maxSeries, exists := configMap["max_series"]; exists {
+		p.maxSeries = config.GetAsInt(maxSeries, defaultMaxSeries)
+	}
+	if window, exists := configMap["window"]; exists {
+		p.window = time.Duration(config.GetAsInt(window, defaultMaxSeriesWindow)) * time.Second
+	}
+	if overflow, exists := configMap["overflow"]; exists {
+		p.overflow = config.GetAsBool(overflow, false)
+	}
+	if keep, exists := configMap["keep_dimensions"]; exists {
+		p.keepDimensions = append(config.GetAsSlice(keep), "collector")
+	}
+}
+
+// Process counts m against the cap of its collector
+func (p *LimitCardinality) Process(m metric.Metric) (metric.Metric, bool) {
+	collector, _ := m.GetDimensionValue("collector")
+	limiter, exists := p.limiters[collector]
+	if !exists {
+		limiter = metric.NewCardinalityLimiter(p.maxSeries, p.window, p.overflow, p.keepDimensions)
+		p.limiters[collector] = limiter
+
+		cardinalityMu.Lock()
+		cardinalityLimiters[collector] = limiter
+		cardinalityMu.Unlock()
+	}
+	return limiter.Limit(m)
+}
+
+// Flush reports the collectors which went over the cap during the interval
+func (p *LimitCardinality) Flush(force bool) (metrics []metric.Metric) {
+	now := p.now()
+	if !force && now.Sub(p.lastFlush) < time.Duration(p.interval)*time.Second {
+		return nil
+	}
+	p.lastFlush = now
+
+	for collector, limiter := range p.limiters {
+		limited, _ := limiter.Limited()
+		if limited == 0 {
+			continue
+		}
+		m := metric.WithValue("fullerite.cardinality_limited", float64(limited))
+		m.MetricType = metric.Counter
+		m.AddDimension("collector", collector)
+		if top := limiter.TopDimensions(1); len(top) > 0 {
+			m.AddDimension("top_dimension", top[0].Dimension)
+		}
+		p.log.Warn("Collector ", collector, " went over ", p.maxSeries, " series, limited ", limited, " metrics")
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// CardinalityStats returns the internal metrics of the
+// cardinality limiter of every collector
+func CardinalityStats() map[string]metric.InternalMetrics {
+	cardinalityMu.Lock()
+	defer cardinalityMu.Unlock()
+	stats := make(map[string]metric.InternalMetrics, len(cardinalityLimiters))
+	for collector, limiter := range cardinalityLimiters {
+		stats[collector] = limiter.InternalMetrics()
+	}
+	return stats
+}
@@ -0,0 +1,65 @@
+package processor
+
+import (
+	"fullerite/metric"
+
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func collectorMetric(collector string, requestID string) metric.Metric {
+	m := metric.New("requests")
+	m.AddDimension("collector", collector)
+	m.AddDimension("request_id", requestID)
+	return m
+}
+
+func TestLimitCardinality(t *testing.T) {
+	p := New("LimitCardinality").(*LimitCardinality)
+	p.SetInterval(10)
+	p.Configure(map[string]interface{}{"max_series": 2})
+
+	for _, id := range []string{"1", "2", "3"} {
+		p.Process(collectorMetric("App", id))
+	}
+	_, ok := p.Process(collectorMetric("App", "4"))
+	assert.False(t, ok)
+	_, ok = p.Process(collectorMetric("Other", "1"))
+	assert.True(t, ok, "every collector has its own limit")
+
+	assert.Empty(t, p.Flush(false), "the interval isn't over yet")
+	metrics := p.Flush(true)
+	assert.Len(t, metrics, 1)
+	assert.Equal(t, "fullerite.cardinality_limited", metrics[0].Name)
+	assert.Equal(t, metric.Counter, metrics[0].MetricType)
+	assert.Equal(t, 2.0, metrics[0].Value)
+	assert.Equal(t, map[string]string{"collector": "App", "top_dimension": "request_id"}, metrics[0].Dimensions)
+
+	stats := CardinalityStats()
+	assert.Equal(t, 2.0, stats["App"].Counters["cardinalityLimited"])
+	assert.Equal(t, 0.0, stats["Other"].Counters["cardinalityLimited"])
+}
+
+func TestLimitCardinalityOverflow(t *testing.T) {
+	p := New("LimitCardinality")
+	p.Configure(map[string]interface{}{
+		"max_series":      1,
+		"window":          60,
+		"overflow":        true,
+		"keep_dimensions": []interface{}{"region"},
+	})
+	assert.Equal(t, time.Minute, p.(*LimitCardinality).window)
+
+	p.Process(collectorMetric("App", "1"))
+	m := collectorMetric("App", "2")
+	m.AddDimension("region", "us-west-1")
+	m, ok := p.Process(m)
+	assert.True(t, ok)
+	assert.Equal(t, map[string]string{
+		"collector":  "App",
+		"region":     "us-west-1",
+		"request_id": metric.OverflowValue,
+	}, m.Dimensions)
+}
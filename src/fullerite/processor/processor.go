@@ -0,0 +1,165 @@
+package processor
+
+import (
+	"fullerite/config"
+	"fullerite/metric"
+
+	"fmt"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+var defaultLog = l.WithFields(l.Fields{"app": "fullerite", "pkg": "processor"})
+
+// Processor defines the interface of a generic processor. Processors sit
+// between the collectors and the handlers and can change or drop metrics.
+type Processor interface {
+	Configure(map[string]interface{})
+
+	// Process returns the metric to forward to the handlers,
+	// or false if the metric has to be dropped
+	Process(metric.Metric) (metric.Metric, bool)
+
+	// taken care of by the base
+	Name() string
+	Interval() int
+	SetInterval(int)
+}
+
+// Flusher is implemented by the processors which hold metrics back, e.g.
+// to aggregate them. Flush is called every second and returns the metrics
+// which are due, or all of them if force is set.
+type Flusher interface {
+	Flush(force bool) []metric.Metric
+}
+
+var processorConstructs map[string]func(*l.Entry) Processor
+
+// RegisterProcessor composes a map of processor names -> factor functions
+func RegisterProcessor(name string, f func(*l.Entry) Processor) {
+	if processorConstructs == nil {
+		processorConstructs = make(map[string]func(*l.Entry) Processor)
+	}
+	processorConstructs[name] = f
+}
+
+// New creates a new Processor based on the requested processor name.
+func New(name string) Processor {
+	processorLog := defaultLog.WithFields(l.Fields{"processor": name})
+
+	if f, exists := processorConstructs[name]; exists {
+		return f(processorLog)
+	}
+
+	defaultLog.Error("Cannot create processor ", name)
+	return nil
+}
+
+type baseProcessor struct {
+	name     string
+	interval int
+
+	// intentionally exported
+	log *l.Entry
+}
+
+func (p *baseProcessor) configureCommonParams(configMap map[string]interface{}) {
+	if interval, exists := configMap["interval"]; exists {
+		p.interval = config.GetAsInt(interval, p.interval)
+	}
+}
+
+// Name : the name of the processor
+func (p baseProcessor) Name() string {
+	return p.name
+}
+
+// Interval : the interval processors holding metrics back release them on
+func (p baseProcessor) Interval() int {
+	return p.interval
+}
+
+// SetInterval : set the interval
+func (p *baseProcessor) SetInterval(interval int) {
+	p.interval = interval
+}
+
+// String returns the processor name in printable format.
+func (p baseProcessor) String() string {
+	return p.Name() + "Processor"
+}
+
+// Chain is an ordered list of processors, a metric goes through
+// each of them in turn unless one of them drops it
+type Chain []Processor
+
+// NewChain creates the processors of a "processors" config, that is a
+// list of processor configs each naming its processor with the
+// "processor" key. Processors which can't be created are skipped.
+// interval is the default interval of the processors.
+func NewChain(configs interface{}, interval int) (chain Chain) {
+	var processorConfigs []map[string]interface{}
+	switch c := configs.(type) {
+	case []map[string]interface{}:
+		processorConfigs = c
+	case []interface{}:
+		for _, conf := range c {
+			if asMap, ok := conf.(map[string]interface{}); ok {
+				processorConfigs = append(processorConfigs, asMap)
+			} else {
+				defaultLog.Error("Invalid processor config ", conf)
+			}
+		}
+	case nil:
+	default:
+		defaultLog.Error("Invalid processors config ", configs)
+	}
+
+	for _, conf := range processorConfigs {
+		name := fmt.Sprint(conf["processor"])
+		if p := New(name); p != nil {
+			p.SetInterval(interval)
+			p.Configure(conf)
+			chain = append(chain, p)
+		}
+	}
+	return chain
+}
+
+// Process runs m through the chain, returns false if it was dropped
+func (chain Chain) Process(m metric.Metric) (metric.Metric, bool) {
+	for _, p := range chain {
+		var keep bool
+		if m, keep = p.Process(m); !keep {
+			return m, false
+		}
+	}
+	return m, true
+}
+
+// HasFlushers returns true if any processor of the chain has to be flushed
+func (chain Chain) HasFlushers() bool {
+	for _, p := range chain {
+		if _, ok := p.(Flusher); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Flush collects the metrics the processors held back. They go through
+// the processors following the one which released them.
+func (chain Chain) Flush(force bool) (metrics []metric.Metric) {
+	for i, p := range chain {
+		f, ok := p.(Flusher)
+		if !ok {
+			continue
+		}
+		for _, m := range f.Flush(force) {
+			if m, keep := chain[i+1:].Process(m); keep {
+				metrics = append(metrics, m)
+			}
+		}
+	}
+	return metrics
+}
@@ -0,0 +1,63 @@
+package processor
+
+import (
+	"fullerite/metric"
+
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	names := []string{"RenameMetric", "AddDimensions", "DropDimensions", "RenameDimensions", "DropMetrics", "SetMetricType"}
+	for _, name := range names {
+		p := New(name)
+		assert.NotNil(t, p, "should create a Processor for "+name)
+		assert.Equal(t, name, p.Name())
+	}
+}
+
+func TestNewInvalidProcessor(t *testing.T) {
+	assert.Nil(t, New("INVALID PROCESSOR"), "should not create a Processor")
+}
+
+func TestNewChainFromJSON(t *testing.T) {
+	var configs interface{}
+	err := json.Unmarshal([]byte(`[
+		{"processor": "RenameMetric", "pattern": "^foo", "replacement": "bar"},
+		{"processor": "INVALID PROCESSOR"},
+		{"processor": "DropMetrics", "metric_pattern": "^drop"}
+	]`), &configs)
+	assert.Nil(t, err)
+
+	chain := NewChain(configs, 10)
+	assert.Equal(t, 2, len(chain))
+	assert.Equal(t, "RenameMetric", chain[0].Name())
+	assert.Equal(t, "DropMetrics", chain[1].Name())
+}
+
+func TestNewChainEmpty(t *testing.T) {
+	assert.Empty(t, NewChain(nil, 10))
+	assert.Empty(t, NewChain("not a list", 10))
+}
+
+func TestChainProcess(t *testing.T) {
+	chain := NewChain([]map[string]interface{}{
+		{"processor": "RenameMetric", "pattern": "^foo", "replacement": "drop"},
+		{"processor": "DropMetrics", "metric_pattern": "^drop"},
+	}, 10)
+
+	m, ok := chain.Process(metric.New("bar.count"))
+	assert.True(t, ok)
+	assert.Equal(t, "bar.count", m.Name)
+
+	// renamed first, then dropped
+	_, ok = chain.Process(metric.New("foo.count"))
+	assert.False(t, ok)
+
+	var empty Chain
+	m, ok = empty.Process(metric.New("foo.count"))
+	assert.True(t, ok)
+	assert.Equal(t, "foo.count", m.Name)
+}
@@ -0,0 +1,61 @@
+package processor
+
+import (
+	"fullerite/metric"
+
+	"fmt"
+	"regexp"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+// RenameMetric processor renames the metrics whose name matches "pattern"
+// using "replacement", which can refer to the groups of the pattern
+// e.g. {"pattern": "^(.*)\\.count$", "replacement": "${1}_count"}
+type RenameMetric struct {
+	baseProcessor
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+func init() {
+	RegisterProcessor("RenameMetric", newRenameMetric)
+}
+
+func newRenameMetric(log *l.Entry) Processor {
+	p := new(RenameMetric)
+	p.name = "RenameMetric"
+	p.log = log
+	return p
+}
+
+// Configure the processor
+func (p *RenameMetric) Configure(configMap map[string]interface{}) {
+	p.configureCommonParams(configMap)
+	p.pattern = compilePattern(p.log, configMap["pattern"])
+	if replacement, exists := configMap["replacement"]; exists {
+		p.replacement = fmt.Sprint(replacement)
+	}
+}
+
+// Process renames m if its name matches
+func (p *RenameMetric) Process(m metric.Metric) (metric.Metric, bool) {
+	if p.pattern != nil {
+		m.Name = p.pattern.ReplaceAllString(m.Name, p.replacement)
+	}
+	return m, true
+}
+
+// compilePattern compiles the regex of a config, returns nil
+// if there isn't any or if it's invalid
+func compilePattern(log *l.Entry, pattern interface{}) *regexp.Regexp {
+	if pattern == nil {
+		return nil
+	}
+	re, err := regexp.Compile(fmt.Sprint(pattern))
+	if err != nil {
+		log.Error("Invalid pattern ", pattern, ": ", err)
+		return nil
+	}
+	return re
+}
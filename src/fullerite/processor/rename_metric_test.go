@@ -0,0 +1,37 @@
+package processor
+
+import (
+	"fullerite/metric"
+
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenameMetric(t *testing.T) {
+	p := New("RenameMetric")
+	p.Configure(map[string]interface{}{
+		"pattern":     `^(.*)\.count$`,
+		"replacement": "${1}_total",
+	})
+
+	m, ok := p.Process(metric.New("requests.count"))
+	assert.True(t, ok)
+	assert.Equal(t, "requests_total", m.Name)
+
+	m, ok = p.Process(metric.New("requests.rate"))
+	assert.True(t, ok)
+	assert.Equal(t, "requests.rate", m.Name)
+}
+
+func TestRenameMetricInvalidPattern(t *testing.T) {
+	p := New("RenameMetric")
+	p.Configure(map[string]interface{}{
+		"pattern":     "(",
+		"replacement": "foo",
+	})
+
+	m, ok := p.Process(metric.New("requests.count"))
+	assert.True(t, ok)
+	assert.Equal(t, "requests.count", m.Name)
+}
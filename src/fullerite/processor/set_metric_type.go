@@ -0,0 +1,54 @@
+package processor
+
+import (
+	"fullerite/metric"
+
+	"fmt"
+	"regexp"
+
+	l "github.com/Sirupsen/logrus"
+)
+
+// SetMetricType processor sets the type of the metrics to "metric_type",
+// either all of them or only those whose name matches "pattern"
+type SetMetricType struct {
+	baseProcessor
+	pattern    *regexp.Regexp
+	metricType string
+}
+
+func init() {
+	RegisterProcessor("SetMetricType", newSetMetricType)
+}
+
+func newSetMetricType(log *l.Entry) Processor {
+	p := new(SetMetricType)
+	p.name = "SetMetricType"
+	p.log = log
+	return p
+}
+
+// Configure the processor
+func (p *SetMetricType) Configure(configMap map[string]interface{}) {
+	p.configureCommonParams(configMap)
+	p.pattern = compilePattern(p.log, configMap["pattern"])
+	if metricType, exists := configMap["metric_type"]; exists {
+		switch t := fmt.Sprint(metricType); t {
+		case metric.Gauge, metric.Counter, metric.CumulativeCounter:
+			p.metricType = t
+		default:
+			p.log.Error("Unknown metric type ", t)
+		}
+	}
+}
+
+// Process sets the type of m
+func (p *SetMetricType) Process(m metric.Metric) (metric.Metric, bool) {
+	if p.metricType == "" {
+		return m, true
+	}
+	if p.pattern == nil || p.pattern.MatchString(m.Name) {
+		m.MetricType = p.metricType
+	}
+	return m, true
+}
@@ -0,0 +1,34 @@
+package processor
+
+import (
+	"fullerite/metric"
+
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetMetricType(t *testing.T) {
+	p := New("SetMetricType")
+	p.Configure(map[string]interface{}{
+		"pattern":     `\.count$`,
+		"metric_type": "cumcounter",
+	})
+
+	m, ok := p.Process(metric.New("requests.count"))
+	assert.True(t, ok)
+	assert.Equal(t, metric.CumulativeCounter, m.MetricType)
+
+	m, _ = p.Process(metric.New("requests.rate"))
+	assert.Equal(t, metric.Gauge, m.MetricType)
+}
+
+func TestSetMetricTypeUnknownType(t *testing.T) {
+	p := New("SetMetricType")
+	p.Configure(map[string]interface{}{
+		"metric_type": "histogram",
+	})
+
+	m, _ := p.Process(metric.New("requests.count"))
+	assert.Equal(t, metric.Gauge, m.MetricType)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fullerite/config"
+	"fullerite/handler"
+
+	"context"
+	"sync"
+	"time"
+)
+
+// defaultShutdownTimeout is how long (in seconds) we wait for the collectors
+// to finish and the handlers to flush before giving up
+const defaultShutdownTimeout = 10
+
+func shutdownTimeout(c config.Config) time.Duration {
+	return time.Duration(config.GetAsInt(c.ShutdownTimeout, defaultShutdownTimeout)) * time.Second
+}
+
+// stage is a group of goroutines that stop once cancel is called
+type stage struct {
+	name    string
+	cancel  context.CancelFunc
+	running *sync.WaitGroup
+}
+
+// shutdown stops fullerite in order: collectors first, then the goroutines
+// forwarding their metrics, and last the handlers which get a chance to
+// flush what they have buffered. Everything has to happen before the
+// timeout expires, metrics that couldn't be emitted by then are dropped.
+func shutdown(timeout time.Duration,
+	collectors stage,
+	readers stage,
+	handlers []handler.Handler) (flushed uint64, dropped uint64) {
+	deadline := time.Now().Add(timeout)
+
+	for _, s := range []stage{collectors, readers} {
+		s.cancel()
+		if !waitUntil(s.running, deadline) {
+			log.Warn("Timed out waiting for ", s.name, " to stop")
+		}
+	}
+
+	before := map[handler.Handler]map[string]float64{}
+	for _, h := range handlers {
+		if h != nil {
+			before[h] = h.InternalMetrics().Counters
+			h.Stop()
+		}
+	}
+
+	for _, h := range handlers {
+		if h == nil {
+			continue
+		}
+		pending := h.WaitForEmissions(remaining(deadline))
+		after := h.InternalMetrics().Counters
+
+		hFlushed := uint64(after["metricsSent"] - before[h]["metricsSent"])
+		hDropped := uint64(after["metricsDropped"]-before[h]["metricsDropped"]) + pending
+		log.Infof("Handler %s flushed %d metrics, dropped %d metrics", h.Name(), hFlushed, hDropped)
+
+		flushed += hFlushed
+		dropped += hDropped
+	}
+	log.Infof("Shutdown complete: flushed %d metrics, dropped %d metrics", flushed, dropped)
+	return flushed, dropped
+}
+
+// waitUntil waits for wg, returns false if deadline passed first
+func waitUntil(wg *sync.WaitGroup, deadline time.Time) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(remaining(deadline)):
+		return false
+	}
+}
+
+func remaining(deadline time.Time) time.Duration {
+	if left := time.Until(deadline); left > 0 {
+		return left
+	}
+	return 0
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fullerite/config"
+	"fullerite/handler"
+	"fullerite/metric"
+
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShutdownTimeout(t *testing.T) {
+	assert.Equal(t, 10*time.Second, shutdownTimeout(config.Config{}))
+	assert.Equal(t, 3*time.Second, shutdownTimeout(config.Config{ShutdownTimeout: "3"}))
+	assert.Equal(t, 5*time.Second, shutdownTimeout(config.Config{ShutdownTimeout: 5}))
+}
+
+func TestShutdownFlushesHandlers(t *testing.T) {
+	logrus.SetLevel(logrus.ErrorLevel)
+
+	channel := make(chan metric.Metric)
+	log := logrus.WithFields(logrus.Fields{"app": "fullerite", "pkg": "handler"})
+	h := handler.NewTest(channel, 100, 100, time.Second, log)
+	h.Configure(map[string]interface{}{})
+	go h.Run()
+
+	h.Channel() <- metric.New("hello")
+	h.Channel() <- metric.New("world")
+	time.Sleep(100 * time.Millisecond)
+
+	var collectors, readers sync.WaitGroup
+	collectors.Add(1)
+	readers.Add(1)
+	collectorsStopped := false
+	readersStopped := false
+	stopCollectors := func() {
+		collectorsStopped = true
+		collectors.Done()
+	}
+	stopReaders := func() {
+		assert.True(t, collectorsStopped, "collectors should be stopped before readers")
+		readersStopped = true
+		readers.Done()
+	}
+
+	flushed, dropped := shutdown(time.Second,
+		stage{"collectors", context.CancelFunc(stopCollectors), &collectors},
+		stage{"collector readers", context.CancelFunc(stopReaders), &readers},
+		[]handler.Handler{h})
+
+	assert.True(t, readersStopped)
+	assert.Equal(t, uint64(2), flushed)
+	assert.Equal(t, uint64(0), dropped)
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"fullerite/collector"
+	"fullerite/config"
+	"fullerite/handler"
+	"fullerite/metric"
+
+	"context"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// supervisor owns the running collectors and handlers so that they can be
+// reconfigured when the configuration is reloaded on SIGHUP.
+type supervisor struct {
+	configFile       string
+	config           config.Config
+	collectorConfigs map[string]map[string]interface{}
+
+	collectorCtx context.Context
+	readerCtx    context.Context
+	handlerCtx   context.Context
+
+	collectors map[string]*runningCollector
+	// the readers of the collectors, waited for before the bus is flushed
+	// on shutdown
+	readers sync.WaitGroup
+
+	handlersMu sync.RWMutex
+	handlers   map[string]handler.Handler
+
+	// broadcasts the metrics of the collectors to the handlers
+	bus *handler.Bus
+
+	hook     *LogErrorHook
+	statChan chan<- metric.CollectorEmission
+}
+
+type runningCollector struct {
+	collector.Collector
+	done <-chan struct{}
+
+	// the reader publishing the metrics of the collector on the bus, it
+	// holds the state of the processors
+	stopReader context.CancelFunc
+	readerDone <-chan struct{}
+}
+
+func newSupervisor(configFile string,
+	c config.Config,
+	collectorCtx context.Context,
+	readerCtx context.Context,
+	handlerCtx context.Context,
+	statChan chan<- metric.CollectorEmission) *supervisor {
+	return &supervisor{
+		configFile:       configFile,
+		config:           c,
+		collectorConfigs: map[string]map[string]interface{}{},
+		collectorCtx:     collectorCtx,
+		readerCtx:        readerCtx,
+		handlerCtx:       handlerCtx,
+		collectors:       map[string]*runningCollector{},
+		handlers:         map[string]handler.Handler{},
+		bus:              handler.NewBus(config.GetAsInt(c.BusBufferSize, handler.DefaultBusBufferSize)),
+		statChan:         statChan,
+	}
+}
+
+// start the handlers, the collectors and the readers in between
+func (s *supervisor) start() {
+	for name, conf := range s.config.Handlers {
+		if h := createHandler(name, s.config, conf); h != nil {
+			s.handlers[name] = h
+		}
+	}
+	handlers := s.handlerList()
+	s.hook = NewLogErrorHook(handlers)
+	log.Logger.Hooks.Add(s.hook)
+	startHandlers(s.handlerCtx, handlers)
+	s.bus.SetHandlers(handlers)
+
+	log.Info("Starting collectors...")
+	// config files that can't be read are skipped, same as before reloading existed
+	s.collectorConfigs, _ = readCollectorConfigs(s.config)
+	for _, name := range s.config.Collectors {
+		if conf, exists := s.collectorConfigs[name]; exists {
+			s.startCollector(name, conf)
+		}
+	}
+	for name := range s.collectors {
+		s.startReader(name)
+	}
+
+	// once the readers stopped what they published is delivered
+	runningReaders.Add(1)
+	go func() {
+		defer runningReaders.Done()
+		<-s.readerCtx.Done()
+		s.readers.Wait()
+		if dropped := s.bus.Flush(shutdownTimeout(s.config)); dropped > 0 {
+			log.Warn("Dropped ", dropped, " metrics the handlers didn't take in time")
+		}
+	}()
+}
+
+// handlerList returns the running handlers
+func (s *supervisor) handlerList() []handler.Handler {
+	s.handlersMu.RLock()
+	defer s.handlersMu.RUnlock()
+	handlers := make([]handler.Handler, 0, len(s.handlers))
+	for _, h := range s.handlers {
+		handlers = append(handlers, h)
+	}
+	return handlers
+}
+
+// reload reads the configuration again and applies the differences:
+// collectors and handlers which were removed are stopped, new ones are
+// started and changed ones are restarted with their new configuration.
+// The others keep running. Returns false if the configuration couldn't
+// be read, the running configuration is kept in that case.
+func (s *supervisor) reload() bool {
+	log.Info("Reloading configuration file at ", s.configFile)
+	newConfig, err := config.ReadConfig(s.configFile)
+	var collectorConfigs map[string]map[string]interface{}
+	if err == nil {
+		collectorConfigs, err = readCollectorConfigs(newConfig)
+	}
+	if err != nil {
+		s.reportReloadError(err)
+		return false
+	}
+	timeout := shutdownTimeout(newConfig)
+
+	intervalChanged := !reflect.DeepEqual(s.config.Interval, newConfig.Interval)
+	handlerGlobalsChanged := intervalChanged ||
+		s.config.Prefix != newConfig.Prefix ||
+		!reflect.DeepEqual(s.config.DefaultDimensions, newConfig.DefaultDimensions)
+
+	// collectors
+	var stoppedCollectors, startedCollectors []string
+	for name := range s.collectors {
+		newConf, exists := collectorConfigs[name]
+		if exists && !intervalChanged && reflect.DeepEqual(s.collectorConfigs[name], newConf) {
+			continue
+		}
+		stoppedCollectors = append(stoppedCollectors, name)
+		if exists {
+			startedCollectors = append(startedCollectors, name)
+		}
+	}
+	for name := range collectorConfigs {
+		if _, exists := s.collectors[name]; !exists {
+			startedCollectors = append(startedCollectors, name)
+		}
+	}
+
+	// handlers
+	var stoppedHandlers, startedHandlers []string
+	for name := range s.handlers {
+		newConf, exists := newConfig.Handlers[name]
+		if exists && !handlerGlobalsChanged && reflect.DeepEqual(s.config.Handlers[name], newConf) {
+			continue
+		}
+		stoppedHandlers = append(stoppedHandlers, name)
+		if exists {
+			startedHandlers = append(startedHandlers, name)
+		}
+	}
+	for name := range newConfig.Handlers {
+		if _, exists := s.handlers[name]; !exists {
+			startedHandlers = append(startedHandlers, name)
+		}
+	}
+
+	// The processors of the readers are built from the global ones too
+	processorsChanged := !reflect.DeepEqual(s.config.Processors, newConfig.Processors)
+	restartedReaders := stoppedCollectors
+	if processorsChanged {
+		restartedReaders = make([]string, 0, len(s.collectors))
+		for name := range s.collectors {
+			restartedReaders = append(restartedReaders, name)
+		}
+	}
+
+	// Stop the collectors while their readers still forward their metrics,
+	// then the readers, which publish what their processors hold. The
+	// other readers keep their processors, and what they aggregated.
+	for _, name := range stoppedCollectors {
+		rc := s.collectors[name]
+		rc.Stop()
+		select {
+		case <-rc.done:
+		case <-time.After(timeout):
+			log.Warn("Timed out waiting for collector ", name, " to stop")
+		}
+	}
+	for _, name := range restartedReaders {
+		rc := s.collectors[name]
+		rc.stopReader()
+		select {
+		case <-rc.readerDone:
+		case <-time.After(timeout):
+			log.Warn("Timed out waiting for the reader of collector ", name, " to stop")
+		}
+	}
+	for _, name := range stoppedCollectors {
+		delete(s.collectors, name)
+	}
+
+	// Nothing is published while the handlers are swapped and their
+	// listeners updated, so that the handlers we stop get what was
+	// published before and the ones we start what is published after, and
+	// nothing is delivered to the listeners of the removed collectors
+	s.bus.Pause()
+	if dropped := s.bus.Flush(timeout); dropped > 0 {
+		log.Warn("Dropped ", dropped, " metrics the handlers didn't take while reloading")
+	}
+	s.handlersMu.Lock()
+	for _, name := range stoppedHandlers {
+		h := s.handlers[name]
+		h.Stop()
+		if pending := h.WaitForEmissions(timeout); pending > 0 {
+			log.Warn("Handler ", name, " dropped ", pending, " metrics while reloading")
+		}
+		delete(s.handlers, name)
+	}
+	for _, h := range s.handlers {
+		h.UpdateListeners(newConfig)
+	}
+	var newHandlers []handler.Handler
+	for _, name := range startedHandlers {
+		if h := createHandler(name, newConfig, newConfig.Handlers[name]); h != nil {
+			s.handlers[name] = h
+			newHandlers = append(newHandlers, h)
+		}
+	}
+	s.handlersMu.Unlock()
+	startHandlers(s.handlerCtx, newHandlers)
+	s.hook.SetHandlers(s.handlerList())
+	s.bus.SetHandlers(s.handlerList())
+	s.bus.Resume()
+
+	s.config = newConfig
+	s.collectorConfigs = collectorConfigs
+	for _, name := range startedCollectors {
+		s.startCollector(name, collectorConfigs[name])
+	}
+	// the readers which were stopped start again unless their collector
+	// was removed, the new collectors get one
+	readers := map[string]bool{}
+	for _, names := range [][]string{restartedReaders, startedCollectors} {
+		for _, name := range names {
+			readers[name] = true
+		}
+	}
+	for name := range readers {
+		s.startReader(name)
+	}
+
+	log.Infof("Configuration reloaded: collectors stopped %v, started %v; handlers stopped %v, started %v",
+		stoppedCollectors, startedCollectors, stoppedHandlers, startedHandlers)
+	return true
+}
+
+func (s *supervisor) reportReloadError(err error) {
+	log.Error("Keeping the running configuration, failed to reload it: ", err)
+
+	m := metric.New("fullerite.config_reload_errors")
+	m.MetricType = metric.Counter
+	m.Value = 1
+	go writeToHandlers(s.handlerList(), m)
+}
+
+func (s *supervisor) startCollector(name string, conf map[string]interface{}) {
+	log.Debug("Starting collector ", name)
+	collectorInst := newCollector(name, s.config, conf)
+	if collectorInst == nil {
+		return
+	}
+	s.collectors[name] = &runningCollector{
+		Collector: collectorInst,
+		done:      goRunCollector(s.collectorCtx, collectorInst),
+	}
+}
+
+// startReader starts reading from the collector name, its processors are
+// created from the current configuration
+func (s *supervisor) startReader(name string) {
+	rc, exists := s.collectors[name]
+	if !exists {
+		return
+	}
+	ctx, cancel := context.WithCancel(s.readerCtx)
+	processors := newProcessorChain(s.config, s.collectorConfigs[name])
+	done := goReadFromCollector(ctx, rc.Collector, s.bus, processors, s.statChan)
+	rc.stopReader = cancel
+	rc.readerDone = done
+	s.readers.Add(1)
+	go func() {
+		defer s.readers.Done()
+		<-done
+	}()
+}
+
+// readCollectorConfigs reads the config of every collector. Collectors
+// without a config file are skipped, an error is returned for the first
+// config which can't be read.
+func readCollectorConfigs(c config.Config) (map[string]map[string]interface{}, error) {
+	var firstErr error
+	configs := map[string]map[string]interface{}{}
+	for _, name := range c.Collectors {
+		conf, err := c.GetCollectorConfig(name)
+		if err != nil {
+			log.Error("Collector config failed to load for: ", name)
+			if firstErr == nil && !os.IsNotExist(err) {
+				firstErr = err
+			}
+			continue
+		}
+		configs[name] = conf
+	}
+	return configs, firstErr
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fullerite/config"
+	"fullerite/handler"
+	"fullerite/metric"
+
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeSupervisorConfig(t *testing.T, dir string, c config.Config) string {
+	c.CollectorsConfigPath = dir
+	contents, err := json.Marshal(c)
+	assert.Nil(t, err)
+	configFile := filepath.Join(dir, "fullerite.conf")
+	assert.Nil(t, ioutil.WriteFile(configFile, contents, 0644))
+	return configFile
+}
+
+func writeCollectorConfig(t *testing.T, dir string, name string, contents string) {
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, name+".conf"), []byte(contents), 0644))
+}
+
+func newTestSupervisor(t *testing.T, dir string, c config.Config) (*supervisor, context.CancelFunc) {
+	configFile := writeSupervisorConfig(t, dir, c)
+	c, err := config.ReadConfig(configFile)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := newSupervisor(configFile, c, ctx, ctx, ctx, make(chan metric.CollectorEmission, 100))
+	return s, cancel
+}
+
+// stopTestSupervisor stops the collectors, readers and handlers started
+// by s and waits for them
+func stopTestSupervisor(t *testing.T, s *supervisor, cancel context.CancelFunc) {
+	noop := func() {}
+	shutdown(time.Second,
+		stage{"collectors", cancel, &runningCollectors},
+		stage{"collector readers", noop, &runningReaders},
+		s.handlerList())
+	for _, rc := range s.collectors {
+		select {
+		case <-rc.done:
+		case <-time.After(time.Second):
+			t.Fatal("the collector ", rc.Name(), " didn't stop")
+		}
+	}
+}
+
+func TestSupervisorReload(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	dir, _ := ioutil.TempDir("", "fullerite")
+	defer os.RemoveAll(dir)
+
+	writeCollectorConfig(t, dir, "Test", `{"interval": 60}`)
+	writeCollectorConfig(t, dir, "Test_2", `{"interval": 60}`)
+	c := config.Config{
+		Interval:   60,
+		Collectors: []string{"Test"},
+		Handlers: map[string]map[string]interface{}{
+			"Log": {"interval": 60},
+		},
+	}
+	s, cancel := newTestSupervisor(t, dir, c)
+	defer stopTestSupervisor(t, s, cancel)
+	s.start()
+
+	testCollector := s.collectors["Test"]
+	testReader := testCollector.readerDone
+	logHandler := s.handlers["Log"]
+
+	// add a collector and a handler
+	c.Collectors = []string{"Test", "Test 2"}
+	c.Handlers["Log 2"] = map[string]interface{}{"interval": 60}
+	writeSupervisorConfig(t, dir, c)
+	assert.True(t, s.reload())
+
+	assert.Equal(t, testCollector, s.collectors["Test"])
+	assert.Equal(t, testReader, s.collectors["Test"].readerDone, "the reader keeps its processors")
+	assert.Contains(t, s.collectors, "Test 2")
+	assert.NotNil(t, s.collectors["Test 2"].readerDone)
+	assert.Equal(t, logHandler, s.handlers["Log"])
+	assert.Contains(t, s.handlers, "Log 2")
+	assert.Contains(t, logHandler.CollectorEndpoints(), "Test 2")
+
+	// change a collector and a handler, remove the other ones
+	writeCollectorConfig(t, dir, "Test", `{"interval": 30}`)
+	c.Collectors = []string{"Test"}
+	c.Handlers = map[string]map[string]interface{}{
+		"Log": {"interval": 30},
+	}
+	writeSupervisorConfig(t, dir, c)
+	assert.True(t, s.reload())
+
+	assert.NotEqual(t, testCollector, s.collectors["Test"])
+	assert.Equal(t, 30, s.collectors["Test"].Interval())
+	assert.NotContains(t, s.collectors, "Test 2")
+	assert.NotEqual(t, logHandler, s.handlers["Log"])
+	assert.Equal(t, 30, s.handlers["Log"].Interval())
+	assert.NotContains(t, s.handlers, "Log 2")
+
+	// the processors of every collector change with the global ones
+	testReader = s.collectors["Test"].readerDone
+	c.Processors = []map[string]interface{}{{"processor": "LimitCardinality", "max_series": 10}}
+	writeSupervisorConfig(t, dir, c)
+	assert.True(t, s.reload())
+	assert.NotEqual(t, testReader, s.collectors["Test"].readerDone)
+	<-testReader
+}
+
+func TestSupervisorReloadInvalidConfig(t *testing.T) {
+	logrus.SetLevel(logrus.PanicLevel)
+	dir, _ := ioutil.TempDir("", "fullerite")
+	defer os.RemoveAll(dir)
+
+	c := config.Config{Collectors: []string{}}
+	s, cancel := newTestSupervisor(t, dir, c)
+	defer cancel()
+
+	channel := make(chan metric.Metric, 1)
+	h := handler.NewTest(channel, 10, 10, time.Second, logrus.WithField("testing", "supervisor"))
+	s.handlers["Test"] = h
+	s.hook = NewLogErrorHook(s.handlerList())
+
+	assert.Nil(t, ioutil.WriteFile(s.configFile, []byte("{not json"), 0644))
+	assert.False(t, s.reload())
+	assert.Equal(t, c.Collectors, s.config.Collectors)
+
+	select {
+	case m := <-channel:
+		assert.Equal(t, "fullerite.config_reload_errors", m.Name)
+		assert.Equal(t, metric.Counter, m.MetricType)
+		assert.Equal(t, 1.0, m.Value)
+	case <-time.After(time.Second):
+		t.Fatal("expected a reload error metric")
+	}
+}
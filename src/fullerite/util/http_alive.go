@@ -1,6 +1,7 @@
 package util
 
 import (
+	"crypto/tls"
 	"io"
 	"io/ioutil"
 	"net"
@@ -42,6 +43,19 @@ func (connection *HTTPAlive) Configure(timeout time.Duration,
 	}
 }
 
+// SetTLSConfig sets the TLS config of the https connections, once the
+// connection is configured
+func (connection *HTTPAlive) SetTLSConfig(config *tls.Config) {
+	connection.transport.TLSClientConfig = config
+}
+
+// Close releases the idle connections of the client
+func (connection *HTTPAlive) Close() {
+	if connection.transport != nil {
+		connection.transport.CloseIdleConnections()
+	}
+}
+
 // MakeRequest make a new http request
 func (connection *HTTPAlive) MakeRequest(method string,
 	uri string, body io.Reader, header map[string]string) (*HTTPAliveResponse, error) {
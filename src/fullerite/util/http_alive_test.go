@@ -34,3 +34,20 @@ func TestMakeRequest(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, string(resp.Body), "done\n")
 }
+
+func TestMakeRequestTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "done")
+	}))
+	defer ts.Close()
+
+	httpClient := new(HTTPAlive)
+	httpClient.Configure(time.Duration(10)*time.Second, time.Minute, 10)
+	_, err := httpClient.MakeRequest("GET", ts.URL, nil, nil)
+	assert.NotNil(t, err, "the certificate of the test server isn't trusted")
+
+	httpClient.SetTLSConfig(ts.Client().Transport.(*http.Transport).TLSClientConfig)
+	resp, err := httpClient.MakeRequest("GET", ts.URL, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "done\n", string(resp.Body))
+}